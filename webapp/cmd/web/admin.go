@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// userSortColumns are the columns the user list can be sorted by
+var userSortColumns = []string{
+	data.SortByID,
+	data.SortByEmail,
+	data.SortByFirstName,
+	data.SortByLastName,
+	data.SortByIsAdmin,
+	data.SortByCreatedAt,
+	data.SortByUpdatedAt,
+}
+
+// AdminAuditPage shows the audit log, filtered by the query string
+func (app *application) AdminAuditPage(w http.ResponseWriter, r *http.Request) error {
+	filter, form := parseAuditFilter(r.URL.Query())
+
+	td := make(map[string]any)
+	td["actions"] = data.AuditActions
+
+	if !form.Valid() {
+		td["events"] = []*data.AuditEvent{}
+		_ = app.render(w, r, "admin-audit.page.gohtml", &TemplateData{Data: td, Form: form, Error: "Invalid filter"})
+		return nil
+	}
+
+	events, err := app.Audit.AuditEvents(filter)
+
+	if err != nil {
+		return err
+	}
+
+	td["events"] = events
+
+	_ = app.render(w, r, "admin-audit.page.gohtml", &TemplateData{Data: td, Form: form})
+
+	return nil
+}
+
+// AdminAuditEvents returns the audit log as JSON, filtered by the query string
+func (app *application) AdminAuditEvents(w http.ResponseWriter, r *http.Request) error {
+	filter, form := parseAuditFilter(r.URL.Query())
+
+	if !form.Valid() {
+		return clientError(http.StatusBadRequest, "invalid filter", form.Errors)
+	}
+
+	events, err := app.Audit.AuditEvents(filter)
+
+	if err != nil {
+		return err
+	}
+
+	if events == nil {
+		events = []*data.AuditEvent{}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, events)
+
+	return nil
+}
+
+// parseAuditFilter reads user_id, action, from, to (dates, both inclusive), limit and offset
+func parseAuditFilter(q url.Values) (data.AuditFilter, *Form) {
+	var filter data.AuditFilter
+
+	form := NewForm(q)
+
+	filter.Action = q.Get("action")
+	filter.UserID = form.intValue("user_id")
+	filter.Limit = form.intValue("limit")
+	filter.Offset = form.intValue("offset")
+	filter.From = form.dateValue("from")
+	filter.To = form.dateValue("to")
+
+	// to is inclusive, so include the whole day
+	if !filter.To.IsZero() {
+		filter.To = filter.To.Add(24 * time.Hour)
+	}
+
+	return filter, form
+}
+
+// AdminUsersPage lists users, one page at a time, filtered and sorted by the query string
+func (app *application) AdminUsersPage(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	opts, form := parseListOptions(q)
+
+	td := make(map[string]any)
+
+	// right after a delete, the page offers to undo it
+	if id := app.Session.PopInt(r.Context(), "deleted_user"); id != 0 {
+		td["deletedUser"] = id
+	}
+
+	if !form.Valid() {
+		td["users"] = &data.UserList{}
+		td["sortLinks"] = map[string]string{}
+		_ = app.render(w, r, "admin-users.page.gohtml", &TemplateData{Data: td, Form: form, Error: "Invalid filter"})
+		return nil
+	}
+
+	list, err := app.DB.ListUsers(r.Context(), opts)
+
+	if err != nil {
+		return err
+	}
+
+	td["users"] = list
+
+	// clicking the current sort column flips the order
+	sortLinks := make(map[string]string)
+
+	for _, c := range userSortColumns {
+		order := "asc"
+		if c == opts.Sort && !opts.Desc {
+			order = "desc"
+		}
+
+		sortLinks[c] = usersPageURL(q, "sort", c, "order", order, "page", "")
+	}
+
+	td["sortLinks"] = sortLinks
+
+	if list.Page > 1 {
+		td["prevURL"] = usersPageURL(q, "page", strconv.Itoa(list.Page-1))
+	}
+
+	if list.Page*list.PerPage < list.Total {
+		td["nextURL"] = usersPageURL(q, "page", strconv.Itoa(list.Page+1))
+	}
+
+	_ = app.render(w, r, "admin-users.page.gohtml", &TemplateData{Data: td, Form: form})
+
+	return nil
+}
+
+// AdminUsers returns one page of users as JSON, filtered and sorted by the query string. Clients
+// can page with page and per_page, or pass next_cursor back as after to page by keyset.
+func (app *application) AdminUsers(w http.ResponseWriter, r *http.Request) error {
+	opts, form := parseListOptions(r.URL.Query())
+
+	if !form.Valid() {
+		return clientError(http.StatusBadRequest, "invalid filter", form.Errors)
+	}
+
+	list, err := app.DB.ListUsers(r.Context(), opts)
+
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		return clientError(http.StatusBadRequest, "invalid filter", map[string][]string{"after": {"Must be a next_cursor from a page before"}})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, list)
+
+	return nil
+}
+
+// parseListOptions reads q (search), admin (1 or 0), created_from and created_to (dates, both inclusive),
+// sort, order (asc or desc), page, per_page and after
+func parseListOptions(q url.Values) (data.ListOptions, *Form) {
+	var opts data.ListOptions
+
+	form := NewForm(q)
+
+	opts.Search = q.Get("q")
+	opts.After = q.Get("after")
+	opts.Page = form.intValue("page")
+	opts.PerPage = form.intValue("per_page")
+	opts.CreatedFrom = form.dateValue("created_from")
+	opts.CreatedTo = form.dateValue("created_to")
+
+	if !opts.CreatedTo.IsZero() {
+		opts.CreatedTo = opts.CreatedTo.Add(24 * time.Hour)
+	}
+
+	switch q.Get("admin") {
+	case "":
+	case "0", "1":
+		isAdmin := form.intValue("admin")
+		opts.IsAdmin = &isAdmin
+	default:
+		form.Errors.Add("admin", "Must be 1 or 0")
+	}
+
+	if form.Has("sort") {
+		opts.Sort = q.Get("sort")
+		form.Check(contains(userSortColumns, opts.Sort), "sort", "Can not sort by this")
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		form.Errors.Add("order", "Must be asc or desc")
+	}
+
+	return opts, form
+}
+
+// usersPageURL is the current user list with some query parameters replaced; empty values are removed
+func usersPageURL(q url.Values, pairs ...string) string {
+	next := url.Values{}
+
+	for k, v := range q {
+		next[k] = v
+	}
+
+	// a cursor is only valid for the page it came from
+	next.Del("after")
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			next.Del(pairs[i])
+		} else {
+			next.Set(pairs[i], pairs[i+1])
+		}
+	}
+
+	return "/admin/users?" + next.Encode()
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+)
+
+// recordingAuditRepo keeps audit events in memory, so tests can check what was recorded
+type recordingAuditRepo struct {
+	events []data.AuditEvent
+}
+
+func (m *recordingAuditRepo) InsertAuditEvent(e data.AuditEvent) (int, error) {
+	m.events = append(m.events, e)
+
+	return len(m.events), nil
+}
+
+func (m *recordingAuditRepo) AuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error) {
+	var events []*data.AuditEvent
+
+	for i := range m.events {
+		events = append(events, &m.events[i])
+	}
+
+	return events, nil
+}
+
+func Test_parseAuditFilter(t *testing.T) {
+	var tests = []struct {
+		name     string
+		query    string
+		valid    bool
+		expected data.AuditFilter
+	}{
+		{"empty", "", true, data.AuditFilter{}},
+		{"everything", "user_id=2&action=login&from=2022-08-19&to=2022-08-20&limit=10&offset=20", true, data.AuditFilter{
+			UserID: 2,
+			Action: "login",
+			From:   time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC),
+			To:     time.Date(2022, 8, 21, 0, 0, 0, 0, time.UTC),
+			Limit:  10,
+			Offset: 20,
+		}},
+		{"bad user id", "user_id=abc", false, data.AuditFilter{}},
+		{"negative limit", "limit=-1", false, data.AuditFilter{}},
+		{"bad date", "from=19.08.2022", false, data.AuditFilter{}},
+	}
+
+	for _, e := range tests {
+		q, _ := url.ParseQuery(e.query)
+
+		filter, form := parseAuditFilter(q)
+
+		if form.Valid() != e.valid {
+			t.Errorf("%s: expected valid to be %t, errors: %v", e.name, e.valid, form.Errors)
+		}
+
+		if e.valid && filter != e.expected {
+			t.Errorf("%s: expected filter %+v, but got %+v", e.name, e.expected, filter)
+		}
+	}
+}
+
+func TestApp_AdminAudit(t *testing.T) {
+	var tests = []struct {
+		name           string
+		handler        http.HandlerFunc
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"page", app.handle(app.AdminAuditPage), "", http.StatusOK, "<td>login</td>"},
+		{"page with bad filter", app.handle(app.AdminAuditPage), "?from=yesterday", http.StatusOK, "Must be a date"},
+		{"json", apiHandler(app.AdminAuditEvents), "?action=login", http.StatusOK, `"action":"login"`},
+		{"json with bad filter", apiHandler(app.AdminAuditEvents), "?user_id=abc", http.StatusBadRequest, `"user_id":["Must be a whole number"]`},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/admin/audit"+e.query, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: did not find %s in the response body", e.name, e.expectedBody)
+		}
+	}
+}
+
+func TestApp_LoginIsAudited(t *testing.T) {
+	audit := &recordingAuditRepo{}
+
+	oldAudit := app.Audit
+	app.Audit = audit
+	defer func() { app.Audit = oldAudit }()
+
+	var tests = []struct {
+		email          string
+		password       string
+		expectedAction string
+		expectedTarget int
+	}{
+		{"admin@example.com", "secret", data.AuditLogin, 1},
+		{"admin@example.com", "wrong", data.AuditLoginFailed, 1},
+		{"nobody@example.com", "secret", data.AuditLoginFailed, 0},
+	}
+
+	for _, e := range tests {
+		audit.events = nil
+
+		postedData := url.Values{"email": {e.email}, "password": {e.password}}
+
+		req, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		app.handle(app.Login).ServeHTTP(httptest.NewRecorder(), req)
+
+		if len(audit.events) != 1 {
+			t.Fatalf("%s/%s: expected 1 audit event, but got %d", e.email, e.password, len(audit.events))
+		}
+
+		got := audit.events[0]
+
+		if got.Action != e.expectedAction || got.TargetUserID != e.expectedTarget || got.IP != "unknown" {
+			t.Errorf("%s/%s: unexpected audit event %+v", e.email, e.password, got)
+		}
+	}
+}
+
+func Test_app_adminOnly(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct {
+		name           string
+		method         string
+		user           *data.User
+		accept         string
+		expectedStatus int
+	}{
+		{"admin", http.MethodGet, &data.User{ID: 1, IsAdmin: 1}, "", http.StatusOK},
+		{"regular user", http.MethodGet, &data.User{ID: 3}, "", http.StatusSeeOther},
+		{"regular user posting", http.MethodPost, &data.User{ID: 3}, "", http.StatusSeeOther},
+		{"regular user of the API", http.MethodGet, &data.User{ID: 3}, "application/json", http.StatusForbidden},
+		{"admin that was demoted", http.MethodGet, &data.User{ID: 2, IsAdmin: 1}, "", http.StatusSeeOther},
+		{"not logged in", http.MethodGet, nil, "", http.StatusSeeOther},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "http://testing", nil)
+		req.Header.Set("Accept", e.accept)
+		req = addContextAndSessionToRequest(req, app)
+
+		if e.user != nil {
+			app.Session.Put(req.Context(), "user", *e.user)
+		}
+
+		rr := httptest.NewRecorder()
+
+		app.adminOnly(nextHandler).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestApp_AdminAuditEvents_Empty(t *testing.T) {
+	oldAudit := app.Audit
+	app.Audit = &recordingAuditRepo{}
+	defer func() { app.Audit = oldAudit }()
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/admin/audit-events", nil)
+	req = addContextAndSessionToRequest(req, app)
+
+	rr := httptest.NewRecorder()
+
+	apiHandler(app.AdminAuditEvents).ServeHTTP(rr, req)
+
+	var events []data.AuditEvent
+
+	// an empty log is an empty array, not null
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil || events == nil {
+		t.Errorf("expected an empty json array, but got %s", rr.Body.String())
+	}
+}
+
+func Test_parseListOptions(t *testing.T) {
+	admin := 1
+	regular := 0
+
+	var tests = []struct {
+		name     string
+		query    string
+		valid    bool
+		expected data.ListOptions
+	}{
+		{"empty", "", true, data.ListOptions{}},
+		{"everything", "q=smith&admin=1&created_from=2022-08-19&created_to=2022-08-20&sort=email&order=desc&page=2&per_page=50", true, data.ListOptions{
+			Search:      "smith",
+			IsAdmin:     &admin,
+			CreatedFrom: time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC),
+			CreatedTo:   time.Date(2022, 8, 21, 0, 0, 0, 0, time.UTC),
+			Sort:        data.SortByEmail,
+			Desc:        true,
+			Page:        2,
+			PerPage:     50,
+		}},
+		{"regular users with cursor", "admin=0&after=abc", true, data.ListOptions{IsAdmin: &regular, After: "abc"}},
+		{"bad admin", "admin=yes", false, data.ListOptions{}},
+		{"bad sort", "sort=password", false, data.ListOptions{}},
+		{"bad order", "order=up", false, data.ListOptions{}},
+		{"bad page", "page=first", false, data.ListOptions{}},
+		{"bad date", "created_from=19.08.2022", false, data.ListOptions{}},
+	}
+
+	for _, e := range tests {
+		q, _ := url.ParseQuery(e.query)
+
+		opts, form := parseListOptions(q)
+
+		if form.Valid() != e.valid {
+			t.Errorf("%s: expected valid to be %t, errors: %v", e.name, e.valid, form.Errors)
+		}
+
+		if !e.valid {
+			continue
+		}
+
+		if (opts.IsAdmin == nil) != (e.expected.IsAdmin == nil) || (opts.IsAdmin != nil && *opts.IsAdmin != *e.expected.IsAdmin) {
+			t.Errorf("%s: expected admin filter %v, but got %v", e.name, e.expected.IsAdmin, opts.IsAdmin)
+		}
+
+		opts.IsAdmin, e.expected.IsAdmin = nil, nil
+
+		if opts != e.expected {
+			t.Errorf("%s: expected options %+v, but got %+v", e.name, e.expected, opts)
+		}
+	}
+}
+
+func TestApp_AdminUsers(t *testing.T) {
+	var tests = []struct {
+		name           string
+		handler        http.HandlerFunc
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"page", app.handle(app.AdminUsersPage), "", http.StatusOK, "<td>admin@example.com</td>"},
+		{"page sort links", app.handle(app.AdminUsersPage), "?sort=email", http.StatusOK, `href="/admin/users?order=desc&amp;sort=email"`},
+		{"page with bad filter", app.handle(app.AdminUsersPage), "?created_to=tomorrow", http.StatusOK, "Must be a date"},
+		{"json", apiHandler(app.AdminUsers), "?q=example", http.StatusOK, `"total":2`},
+		{"json with bad filter", apiHandler(app.AdminUsers), "?sort=password", http.StatusBadRequest, `"sort":["Can not sort by this"]`},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/admin/users"+e.query, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: did not find %s in the response body", e.name, e.expectedBody)
+		}
+	}
+}
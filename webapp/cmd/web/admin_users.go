@@ -0,0 +1,464 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+
+	"github.com/go-chi/chi"
+)
+
+// conflictMessage is shown when an admin saves a user someone else changed in the meantime
+const conflictMessage = "Someone else changed this user while you were editing. Their changes are shown below each field; check them and save again."
+
+// AdminUserPage shows the form to edit a user
+func (app *application) AdminUserPage(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.userFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	td := make(map[string]any)
+	td["user"] = user
+	td["theirs"] = map[string]string{}
+
+	_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Data: td, Form: NewForm(userFormValues(user))})
+
+	return nil
+}
+
+// AdminUserUpdate saves the edit form. Only fields that differ from the stored user are written, and
+// only if nobody changed the user since the form was loaded; otherwise the form is shown again with
+// their changes next to ours.
+func (app *application) AdminUserUpdate(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	user, err := app.userFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	form := NewForm(r.PostForm)
+	version := form.intValue("version")
+	patch := userPatchFromForm(form, user)
+
+	td := make(map[string]any)
+	td["user"] = user
+	td["theirs"] = map[string]string{}
+
+	if !form.Valid() {
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Data: td, Form: form, Error: "Please correct the errors below"})
+		return nil
+	}
+
+	updated, err := app.patchUser(r.Context(), user.ID, version, patch)
+
+	switch {
+	case errors.Is(err, repository.ErrConflict):
+		// keep what the admin typed, but let the next save go through on top of the current version
+		form.Data.Set("version", strconv.Itoa(user.Version))
+		td["theirs"] = changedFields(user, form)
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Data: td, Form: form, Error: conflictMessage})
+		return nil
+
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		form.Errors.Add("email", "Another user has this email address")
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Data: td, Form: form, Error: "Please correct the errors below"})
+		return nil
+
+	case errors.Is(err, repository.ErrNotFound):
+		return errNotFound
+
+	case err != nil:
+		return err
+	}
+
+	app.userUpdated(r, updated, patch)
+
+	app.Session.Put(r.Context(), "flash", "User saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+
+	return nil
+}
+
+// AdminUser returns one user as JSON, including the version PATCH needs
+func (app *application) AdminUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return clientError(http.StatusNotFound, "user not found", nil)
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return clientError(http.StatusNotFound, "user not found", nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, user)
+
+	return nil
+}
+
+// userPatchRequest is the body of PATCH /api/admin/users/{id}: the version the client read, and
+// the fields to change
+type userPatchRequest struct {
+	Version *int `json:"version"`
+	data.UserPatch
+}
+
+// AdminPatchUser changes the fields in the body, if the user is still at the version in the body.
+// When it isn't, the answer is 409 Conflict, and the client should get the user again.
+func (app *application) AdminPatchUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return clientError(http.StatusNotFound, "user not found", nil)
+	}
+
+	var req userPatchRequest
+
+	if err := app.readJSON(w, r, &req); err != nil {
+		return clientError(http.StatusBadRequest, err.Error(), nil)
+	}
+
+	if errs := validateUserPatch(req); len(errs) > 0 {
+		return clientError(http.StatusBadRequest, "invalid user", errs)
+	}
+
+	updated, err := app.patchUser(r.Context(), id, *req.Version, req.UserPatch)
+
+	switch {
+	case errors.Is(err, repository.ErrConflict):
+		return clientError(http.StatusConflict, "the user was changed by someone else; get it again and retry", nil)
+
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		return clientError(http.StatusBadRequest, "invalid user", map[string][]string{"email": {"Another user has this email address"}})
+
+	case errors.Is(err, repository.ErrNotFound):
+		return clientError(http.StatusNotFound, "user not found", nil)
+
+	case err != nil:
+		return err
+	}
+
+	app.userUpdated(r, updated, req.UserPatch)
+
+	_ = app.writeJSON(w, http.StatusOK, updated)
+
+	return nil
+}
+
+// errDeleteSelf is returned by deleteUser when admins try to delete themselves, which would lock
+// them out
+var errDeleteSelf = errors.New("admins can't delete themselves")
+
+// AdminUserDelete deletes a user. They can be restored until the purge removes them for good, so
+// the users page offers to undo it.
+func (app *application) AdminUserDelete(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.userFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	err = app.deleteUser(r, user.ID)
+
+	if errors.Is(err, errDeleteSelf) {
+		app.Session.Put(r.Context(), "error", "You can't delete yourself")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "deleted_user", user.ID)
+	app.Session.Put(r.Context(), "flash", "User deleted")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+
+	return nil
+}
+
+// AdminUserRestore undoes AdminUserDelete
+func (app *application) AdminUserRestore(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return errNotFound
+	}
+
+	err = app.restoreUser(r, id)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return errNotFound
+	}
+
+	// someone took the address while the user was deleted, and addresses are unique
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		app.Session.Put(r.Context(), "error", "Another user has the email address of this user now")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "flash", "User restored")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", id), http.StatusSeeOther)
+
+	return nil
+}
+
+// AdminDeleteUser deletes a user; POST /api/admin/users/{id}/restore undoes it until the purge
+func (app *application) AdminDeleteUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return clientError(http.StatusNotFound, "user not found", nil)
+	}
+
+	err = app.deleteUser(r, id)
+
+	switch {
+	case errors.Is(err, errDeleteSelf):
+		return clientError(http.StatusConflict, err.Error(), nil)
+
+	case errors.Is(err, repository.ErrNotFound):
+		return clientError(http.StatusNotFound, "user not found", nil)
+
+	case err != nil:
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// AdminRestoreUser undoes AdminDeleteUser, and returns the user as JSON
+func (app *application) AdminRestoreUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return clientError(http.StatusNotFound, "no deleted user with this id", nil)
+	}
+
+	err = app.restoreUser(r, id)
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return clientError(http.StatusNotFound, "no deleted user with this id", nil)
+
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		return clientError(http.StatusConflict, "another user has the email address of this user now", nil)
+
+	case err != nil:
+		return err
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil {
+		return err
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, user)
+
+	return nil
+}
+
+// deleteUser soft deletes a user, and audits it
+func (app *application) deleteUser(r *http.Request, id int) error {
+	if admin, ok := app.Session.Get(r.Context(), "user").(data.User); ok && admin.ID == id {
+		return errDeleteSelf
+	}
+
+	if err := app.DB.DeleteUser(id); err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditUserDeleted, id, "")
+
+	return nil
+}
+
+// restoreUser undoes deleteUser, and audits it
+func (app *application) restoreUser(r *http.Request, id int) error {
+	if err := app.DB.RestoreUser(id); err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditUserRestored, id, "")
+
+	return nil
+}
+
+// userFromURL loads the user with the id in the URL; it is a 404 if there is none
+func (app *application) userFromURL(r *http.Request) (*data.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return nil, errNotFound
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, errNotFound
+	}
+
+	return user, err
+}
+
+// userUpdated audits a change, and refreshes the session of an admin that changed themselves
+func (app *application) userUpdated(r *http.Request, user *data.User, patch data.UserPatch) {
+	var fields []string
+
+	if patch.FirstName != nil {
+		fields = append(fields, "first_name")
+	}
+
+	if patch.LastName != nil {
+		fields = append(fields, "last_name")
+	}
+
+	// the address itself only changes once the user verifies it
+	if patch.Email != nil {
+		fields = append(fields, "pending_email")
+	}
+
+	if patch.IsAdmin != nil {
+		fields = append(fields, "is_admin")
+	}
+
+	if len(fields) == 0 {
+		return
+	}
+
+	app.audit(r, data.AuditUserUpdated, user.ID, "changed "+strings.Join(fields, ", "))
+
+	if current, ok := app.Session.Get(r.Context(), "user").(data.User); ok && current.ID == user.ID {
+		app.Session.Put(r.Context(), "user", *user)
+	}
+}
+
+// userFormValues fills the edit form with a user
+func userFormValues(u *data.User) map[string][]string {
+	values := map[string][]string{
+		"first_name": {u.FirstName},
+		"last_name":  {u.LastName},
+		"email":      {u.Email},
+		"version":    {strconv.Itoa(u.Version)},
+	}
+
+	if u.IsAdmin == 1 {
+		values["is_admin"] = []string{"1"}
+	}
+
+	return values
+}
+
+// userPatchFromForm validates the edit form, and returns the fields that differ from current
+func userPatchFromForm(form *Form, current *data.User) data.UserPatch {
+	var patch data.UserPatch
+
+	form.Required("version")
+	checkUserFields(form, "first_name", "last_name", "email")
+
+	if v := strings.TrimSpace(form.Data.Get("first_name")); v != current.FirstName {
+		patch.FirstName = &v
+	}
+
+	if v := strings.TrimSpace(form.Data.Get("last_name")); v != current.LastName {
+		patch.LastName = &v
+	}
+
+	if v := strings.TrimSpace(form.Data.Get("email")); v != current.Email {
+		patch.Email = &v
+	}
+
+	isAdmin := 0
+	if form.Data.Get("is_admin") == "1" {
+		isAdmin = 1
+	}
+
+	if isAdmin != current.IsAdmin {
+		patch.IsAdmin = &isAdmin
+	}
+
+	return patch
+}
+
+// changedFields are the stored values that differ from what the admin submitted
+func changedFields(current *data.User, form *Form) map[string]string {
+	theirs := make(map[string]string)
+
+	stored := userFormValues(current)
+
+	for _, field := range []string{"first_name", "last_name", "email"} {
+		if stored[field][0] != strings.TrimSpace(form.Data.Get(field)) {
+			theirs[field] = stored[field][0]
+		}
+	}
+
+	if (current.IsAdmin == 1) != (form.Data.Get("is_admin") == "1") {
+		if current.IsAdmin == 1 {
+			theirs["is_admin"] = "Admin"
+		} else {
+			theirs["is_admin"] = "Not an admin"
+		}
+	}
+
+	return theirs
+}
+
+// validateUserPatch checks a PATCH body with the rules of the edit form; fields that are left
+// out are fine, but not blank ones
+func validateUserPatch(req userPatchRequest) map[string][]string {
+	values := url.Values{}
+	var present []string
+
+	for field, value := range map[string]*string{
+		"first_name": req.FirstName,
+		"last_name":  req.LastName,
+		"email":      req.Email,
+	} {
+		if value != nil {
+			values.Set(field, *value)
+			present = append(present, field)
+		}
+	}
+
+	if req.IsAdmin != nil {
+		values.Set("is_admin", strconv.Itoa(*req.IsAdmin))
+	}
+
+	form := NewForm(values)
+	form.Check(req.Version != nil, "version", "This field is required")
+	checkUserFields(form, present...)
+
+	return form.Errors
+}
+
+// checkUserFields validates the fields of a user in form, for both the edit form and PATCH;
+// required are the ones that can't be blank
+func checkUserFields(form *Form, required ...string) {
+	form.Required(required...)
+	form.Email("email")
+	form.OneOf("is_admin", "0", "1")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"webapp/pkg/data"
+	"webapp/pkg/repository/dbrepo"
+
+	"github.com/go-chi/chi"
+)
+
+// addIDToRequest sets the {id} url parameter, like chi does when routing
+func addIDToRequest(req *http.Request, id string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestApp_AdminUserPage(t *testing.T) {
+	var tests = []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"admin", "1", http.StatusOK, `name="version"
+                       value="1"`},
+		{"unknown user", "9", http.StatusNotFound, ""},
+		{"bad id", "one", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/admin/users/"+e.id, nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.AdminUserPage).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: did not find %s in the response body", e.name, e.expectedBody)
+		}
+	}
+}
+
+func TestApp_AdminUserUpdate(t *testing.T) {
+	var tests = []struct {
+		name           string
+		id             string
+		postedData     url.Values
+		expectedStatus int
+		expectedBody   string
+		expectedAudit  string
+	}{
+		{
+			name:           "changed name",
+			id:             "1",
+			postedData:     url.Values{"version": {"1"}, "first_name": {"Head"}, "last_name": {"User"}, "email": {"admin@example.com"}, "is_admin": {"1"}},
+			expectedStatus: http.StatusSeeOther,
+			expectedAudit:  "changed first_name",
+		},
+		{
+			name:           "changed by someone else",
+			id:             "1",
+			postedData:     url.Values{"version": {"0"}, "first_name": {"Head"}, "last_name": {"User"}, "email": {"admin@example.com"}, "is_admin": {"1"}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Now: Admin",
+		},
+		{
+			name:           "email of another user",
+			id:             "1",
+			postedData:     url.Values{"version": {"1"}, "first_name": {"Admin"}, "last_name": {"User"}, "email": {"2fa@example.com"}, "is_admin": {"1"}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Another user has this email address",
+		},
+		{
+			name:           "invalid",
+			id:             "1",
+			postedData:     url.Values{"version": {"1"}, "first_name": {""}, "last_name": {"User"}, "email": {"admin"}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Must be an email address",
+		},
+		{
+			name:           "unknown user",
+			id:             "9",
+			postedData:     url.Values{"version": {"1"}},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, e := range tests {
+		audit := &recordingAuditRepo{}
+		oldAudit := app.Audit
+		app.Audit = audit
+
+		req, _ := http.NewRequest(http.MethodPost, "/admin/users/"+e.id, strings.NewReader(e.postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.AdminUserUpdate).ServeHTTP(rr, req)
+
+		app.Audit = oldAudit
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: did not find %s in the response body", e.name, e.expectedBody)
+		}
+
+		if e.expectedAudit == "" && len(audit.events) > 0 {
+			t.Errorf("%s: expected no audit events, but got %+v", e.name, audit.events)
+		}
+
+		if e.expectedAudit != "" && (len(audit.events) != 1 || audit.events[0].Action != data.AuditUserUpdated || audit.events[0].Details != e.expectedAudit) {
+			t.Errorf("%s: expected a user_updated event with %q, but got %+v", e.name, e.expectedAudit, audit.events)
+		}
+	}
+}
+
+func TestApp_AdminPatchUser(t *testing.T) {
+	var tests = []struct {
+		name           string
+		id             string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"change one field", "2", `{"version": 1, "last_name": "Factors"}`, http.StatusOK, `"last_name":"Factors","email":"2fa@example.com"`},
+		{"nothing to change", "2", `{"version": 1}`, http.StatusOK, `"version":1`},
+		{"stale version", "2", `{"version": 0, "last_name": "Factors"}`, http.StatusConflict, "changed by someone else"},
+		{"missing version", "2", `{"last_name": "Factors"}`, http.StatusBadRequest, `"version":["This field is required"]`},
+		{"blank field", "2", `{"version": 1, "first_name": " "}`, http.StatusBadRequest, `"first_name":["This field cannot be blank"]`},
+		{"email with a name", "2", `{"version": 1, "email": "Two <two@example.com>"}`, http.StatusBadRequest, `"email":["Must be an email address"]`},
+		{"admin flag that is not one", "2", `{"version": 1, "is_admin": 2}`, http.StatusBadRequest, `"is_admin":["Must be one of 0, 1"]`},
+		{"unknown field", "2", `{"version": 1, "password": "x"}`, http.StatusBadRequest, "unknown field"},
+		{"duplicate email", "2", `{"version": 1, "email": "admin@example.com"}`, http.StatusBadRequest, "Another user has this email address"},
+		{"unknown user", "9", `{"version": 1}`, http.StatusNotFound, "user not found"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodPatch, "/api/admin/users/"+e.id, strings.NewReader(e.body))
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+
+		rr := httptest.NewRecorder()
+
+		apiHandler(app.AdminPatchUser).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: did not find %s in the response body %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+func TestApp_AdminUserDelete(t *testing.T) {
+	var tests = []struct {
+		name             string
+		id               string
+		expectedStatus   int
+		expectedLocation string
+		expectedAudit    bool
+	}{
+		{"other user", "2", http.StatusSeeOther, "/admin/users", true},
+		{"yourself", "1", http.StatusSeeOther, "/admin/users/1", false},
+		{"unknown user", "9", http.StatusNotFound, "", false},
+	}
+
+	for _, e := range tests {
+		audit := &recordingAuditRepo{}
+		oldAudit := app.Audit
+		app.Audit = audit
+
+		req, _ := http.NewRequest(http.MethodPost, "/admin/users/"+e.id+"/delete", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1, IsAdmin: 1})
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.AdminUserDelete).ServeHTTP(rr, req)
+
+		app.Audit = oldAudit
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected location %q, but got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+
+		deleted := len(audit.events) == 1 && audit.events[0].Action == data.AuditUserDeleted && strconv.Itoa(audit.events[0].TargetUserID) == e.id
+		if deleted != e.expectedAudit {
+			t.Errorf("%s: expected a user_deleted event: %t, but got %+v", e.name, e.expectedAudit, audit.events)
+		}
+
+		if !e.expectedAudit {
+			continue
+		}
+
+		// the users page the admin is sent to offers to undo it
+		rr = httptest.NewRecorder()
+
+		app.handle(app.AdminUsersPage).ServeHTTP(rr, req)
+
+		if !strings.Contains(rr.Body.String(), `action="/admin/users/`+e.id+`/restore"`) {
+			t.Errorf("%s: expected a form to undo the delete on the users page", e.name)
+		}
+	}
+}
+
+func TestApp_AdminUserRestore(t *testing.T) {
+	var tests = []struct {
+		name             string
+		id               string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"deleted user", "1", http.StatusSeeOther, "/admin/users/1"},
+		{"user that is not deleted", "9", http.StatusNotFound, ""},
+		{"user whose address was taken", strconv.Itoa(dbrepo.TestTakenEmailUserID), http.StatusSeeOther, "/admin/users"},
+	}
+
+	for _, e := range tests {
+		audit := &recordingAuditRepo{}
+		oldAudit := app.Audit
+		app.Audit = audit
+
+		req, _ := http.NewRequest(http.MethodPost, "/admin/users/"+e.id+"/restore", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.AdminUserRestore).ServeHTTP(rr, req)
+
+		app.Audit = oldAudit
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected location %q, but got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+
+		restored := len(audit.events) == 1 && audit.events[0].Action == data.AuditUserRestored
+		if restored != (e.expectedLocation == "/admin/users/"+e.id) {
+			t.Errorf("%s: expected a user_restored event only when restored, but got %+v", e.name, audit.events)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"webapp/pkg/data"
+)
+
+// audit records a security relevant event. The logged in user (if any) is the actor. Writing
+// the audit log never fails a request; errors are only logged.
+func (app *application) audit(r *http.Request, action string, targetUserID int, details string) {
+	if app.Audit == nil {
+		return
+	}
+
+	e := data.AuditEvent{
+		TargetUserID: targetUserID,
+		Action:       action,
+		IP:           app.ipFromContext(r.Context()),
+		Details:      details,
+	}
+
+	if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+		e.ActorID = user.ID
+	}
+
+	_, err := app.Audit.InsertAuditEvent(e)
+
+	if err != nil {
+		log.Println("error writing audit event:", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig is which other origins may call a group of routes from a browser, and how
+type CORSConfig struct {
+	// AllowedOrigins are like https://app.example.com. A * in the host stands for one or more
+	// labels, like https://*.example.com, and * on its own for any origin.
+	AllowedOrigins []string
+	// AllowedMethods are GET, HEAD and POST if empty
+	AllowedMethods []string
+	// AllowedHeaders are the request headers scripts may set, besides the ones browsers allow anyway
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read, besides the ones browsers show anyway
+	ExposedHeaders []string
+	// AllowCredentials lets requests send cookies, so scripts act as the logged in user
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the answer to a preflight
+	MaxAge time.Duration
+}
+
+// defaultAPICORS is how the API can be called, once origins are allowed: with the session
+// cookie, and the CSRF token for requests that need one
+func defaultAPICORS() CORSConfig {
+	return CORSConfig{
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPatch},
+		AllowedHeaders:   []string{"Content-Type", csrfHeader},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+}
+
+// allowsOrigin reports whether origin is one of the allowed origins
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		prefix, suffix, found := strings.Cut(allowed, "*")
+
+		if !found || len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+			continue
+		}
+
+		// only host names go in place of the *, not a path or a port
+		labels := origin[len(prefix) : len(origin)-len(suffix)]
+
+		if strings.Trim(labels, "abcdefghijklmnopqrstuvwxyz0123456789.-") == "" && !strings.HasPrefix(labels, ".") && !strings.HasSuffix(labels, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c CORSConfig) allowsMethod(method string) bool {
+	methods := c.AllowedMethods
+
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c CORSConfig) allowsHeader(header string) bool {
+	for _, h := range c.AllowedHeaders {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cors lets the origins of c call the routes it is used on. It answers preflights itself,
+// so it has to come before middleware like auth: browsers don't send cookies with them.
+// Requests from other origins go through without CORS headers, and browsers keep their
+// scripts from reading the answer.
+func (app *application) cors(c CORSConfig) func(http.Handler) http.Handler {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" && c.AllowCredentials {
+			// any site could act as the logged in user
+			panic("CORS can't allow credentials from any origin")
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			header.Add("Vary", "Origin")
+
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if preflight {
+				header.Add("Vary", "Access-Control-Request-Method")
+				header.Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			if origin == "" || !c.allowsOrigin(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if preflight {
+				c.preflight(w, r, origin)
+				return
+			}
+
+			c.allowOrigin(w, origin)
+
+			if len(c.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// preflight answers whether the request a browser is about to make is allowed
+func (c CORSConfig) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	method := r.Header.Get("Access-Control-Request-Method")
+
+	var headers []string
+
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+
+	// leaving the headers out tells the browser no
+	if !c.allowsMethod(method) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	for _, h := range headers {
+		if !c.allowsHeader(h) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	c.allowOrigin(w, origin)
+
+	header := w.Header()
+	header.Set("Access-Control-Allow-Methods", strings.ToUpper(method))
+
+	if len(headers) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+
+	if c.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c CORSConfig) allowOrigin(w http.ResponseWriter, origin string) {
+	header := w.Header()
+
+	// with several patterns, the answer only holds for the origin that asked
+	if len(c.AllowedOrigins) == 1 && c.AllowedOrigins[0] == "*" {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
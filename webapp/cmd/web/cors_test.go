@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CORSConfig_allowsOrigin(t *testing.T) {
+	c := CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org", "http://localhost:*"}}
+
+	var tests = []struct {
+		origin   string
+		expected bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://App.Example.com", true},
+		{"http://app.example.com", false},
+		{"https://example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://spa.example.org", true},
+		{"https://eu.spa.example.org", true},
+		{"https://example.org", false},
+		{"https://.example.org", false},
+		{"https://evil.com/.example.org", false},
+		{"https://evil.com:443.example.org", false},
+		{"http://localhost:5173", true},
+		{"null", false},
+	}
+
+	for _, e := range tests {
+		if c.allowsOrigin(e.origin) != e.expected {
+			t.Errorf("%s: expected %t, but got %t", e.origin, e.expected, !e.expected)
+		}
+	}
+
+	if !(CORSConfig{AllowedOrigins: []string{"*"}}).allowsOrigin("https://anyone.com") {
+		t.Error("expected * to allow any origin")
+	}
+}
+
+func Test_application_cors(t *testing.T) {
+	c := CORSConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPatch},
+		AllowedHeaders:   []string{"Content-Type", csrfHeader},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	var tests = []struct {
+		name            string
+		method          string
+		origin          string
+		requestMethod   string
+		requestHeaders  string
+		expectedStatus  int
+		expectedNext    bool
+		expectedHeaders map[string]string
+	}{
+		{"preflight", "OPTIONS", "https://spa.example.com", "PATCH", "content-type, x-csrf-token", http.StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin":      "https://spa.example.com",
+			"Access-Control-Allow-Methods":     "PATCH",
+			"Access-Control-Allow-Headers":     "content-type, x-csrf-token",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Max-Age":           "600",
+		}},
+		{"preflight without headers", "OPTIONS", "https://spa.example.com", "GET", "", http.StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin":  "https://spa.example.com",
+			"Access-Control-Allow-Methods": "GET",
+			"Access-Control-Allow-Headers": "",
+		}},
+		{"preflight from other origin", "OPTIONS", "https://evil.com", "PATCH", "", http.StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+			"Access-Control-Max-Age":       "",
+		}},
+		{"preflight for other method", "OPTIONS", "https://spa.example.com", "DELETE", "", http.StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+		}},
+		{"preflight for other header", "OPTIONS", "https://spa.example.com", "PATCH", "Content-Type, X-Secret", http.StatusNoContent, false, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Headers": "",
+		}},
+		{"options without preflight", "OPTIONS", "https://spa.example.com", "", "", http.StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "https://spa.example.com",
+		}},
+		{"request", "GET", "https://spa.example.com", "", "", http.StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin":      "https://spa.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Expose-Headers":    "X-Request-Id",
+			"Access-Control-Max-Age":           "",
+		}},
+		{"request from other origin", "GET", "https://evil.com", "", "", http.StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin":      "",
+			"Access-Control-Allow-Credentials": "",
+		}},
+		{"same origin", "GET", "", "", "", http.StatusOK, true, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+	}
+
+	for _, e := range tests {
+		called := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+
+		req, _ := http.NewRequest(e.method, "/api/admin/users", nil)
+
+		if e.origin != "" {
+			req.Header.Set("Origin", e.origin)
+		}
+
+		if e.requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", e.requestMethod)
+		}
+
+		if e.requestHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", e.requestHeaders)
+		}
+
+		rr := httptest.NewRecorder()
+
+		app.cors(c)(next).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if called != e.expectedNext {
+			t.Errorf("%s: expected the handler to be called: %t, but got %t", e.name, e.expectedNext, called)
+		}
+
+		for name, value := range e.expectedHeaders {
+			if rr.Header().Get(name) != value {
+				t.Errorf("%s: expected %s: %q, but got %q", e.name, name, value, rr.Header().Get(name))
+			}
+		}
+
+		// caches must not give one origin the answer for another
+		if rr.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: expected Vary: Origin first, but got %q", e.name, rr.Header().Values("Vary"))
+		}
+	}
+}
+
+func Test_application_corsAnyOrigin(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://anyone.com")
+	rr := httptest.NewRecorder()
+
+	app.cors(CORSConfig{AllowedOrigins: []string{"*"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+
+	if rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected Access-Control-Allow-Origin: *, but got %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for credentials from any origin")
+		}
+	}()
+
+	app.cors(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
+
+func Test_application_corsRoutes(t *testing.T) {
+	routes := app.routes()
+
+	// preflights come without the session cookie, and must not be sent to the login page
+	req, _ := http.NewRequest("OPTIONS", "/api/admin/users/1", nil)
+	req.Header.Set("Origin", "https://spa.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-CSRF-Token")
+	rr := httptest.NewRecorder()
+
+	routes.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status %d for a preflight, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://spa.example.com" {
+		t.Errorf("expected the SPA to be allowed, but got %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// pages are not part of the API
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://spa.example.com")
+	rr = httptest.NewRecorder()
+
+	routes.ServeHTTP(rr, req)
+
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers on pages, but got %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"mime"
+	"net/http"
+)
+
+const (
+	// csrfFieldName is the form field, and query parameter, with the token
+	csrfFieldName = "csrf_token"
+	// csrfHeader is where scripts send the token
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the token of the session, and makes one the first time
+func (app *application) csrfToken(ctx context.Context) string {
+	if token := app.Session.GetString(ctx, csrfFieldName); token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(ctx, csrfFieldName, token)
+
+	return token
+}
+
+// verifyCSRF turns away requests that other sites can make a browser send, unless they have
+// the token of the session. Those are the ones with the content types of HTML forms; other
+// ones, like JSON, need a preflight that only the CORS settings can allow.
+//
+// Forms send the token in the csrf_token field. Multipart forms send it in the query string
+// instead, as reading the body here would get around the limits of the handlers for uploads.
+func (app *application) verifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		token := r.Header.Get(csrfHeader)
+
+		switch contentType {
+		case "", "application/x-www-form-urlencoded", "text/plain":
+			if token == "" {
+				token = r.PostFormValue(csrfFieldName)
+			}
+
+		case "multipart/form-data":
+			if token == "" {
+				token = r.URL.Query().Get(csrfFieldName)
+			}
+
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfFieldName)
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			app.errorPage(w, r, http.StatusForbidden, "This form has expired; reload the page and try again", nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how much of a multipart form is kept in memory; the rest goes to temporary files
+const maxFormMemory = 32 << 20
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	fileHeaderType = reflect.TypeOf(&multipart.FileHeader{})
+)
+
+// decodeForm binds the request into dst, a pointer to a struct, and validates it. It reads url
+// encoded and multipart forms, JSON bodies, and the query string of GET requests.
+//
+// Struct fields are named by their form tag, or else by the field name, and checked with the
+// rules in their validate tag:
+//
+//	Email string `form:"email" validate:"required,email"`
+//
+// Nested structs are named with dots, like address.city, and slices of structs with an index,
+// like phones.0.number. Slices of values take every value of their field.
+//
+// The returned error is for requests we can't read at all; everything wrong with the values
+// themselves is in the errors of the form.
+func (app *application) decodeForm(w http.ResponseWriter, r *http.Request, dst any) (*Form, error) {
+	values, files, err := requestValues(w, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	v := reflect.ValueOf(dst)
+
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("decodeForm needs a pointer to a struct, not %T", dst))
+	}
+
+	form := NewForm(values)
+	form.Messages = app.tr(r).Lookup
+	bindStruct(form, files, "", v.Elem())
+
+	return form, nil
+}
+
+// requestValues returns the fields and files of the request, whatever the encoding of its body
+func requestValues(w http.ResponseWriter, r *http.Request) (url.Values, map[string][]*multipart.FileHeader, error) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r.URL.Query(), nil, nil
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch contentType {
+	case "application/json":
+		r.Body = http.MaxBytesReader(w, r.Body, maxJSONBytes)
+
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+
+		var body map[string]any
+
+		if err := dec.Decode(&body); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON body: %s", err)
+		}
+
+		if err := dec.Decode(&struct{}{}); err != io.EOF {
+			return nil, nil, fmt.Errorf("body must contain a single JSON value")
+		}
+
+		values := url.Values{}
+		flattenJSON(values, "", body)
+
+		return values, nil, nil
+
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+			return nil, nil, err
+		}
+
+		return r.MultipartForm.Value, r.MultipartForm.File, nil
+
+	default:
+		if err := r.ParseForm(); err != nil {
+			return nil, nil, err
+		}
+
+		return r.PostForm, nil, nil
+	}
+}
+
+// flattenJSON adds a decoded JSON value to values, named like the fields of a form
+func flattenJSON(values url.Values, name string, value any) {
+	switch value := value.(type) {
+	case map[string]any:
+		for k, v := range value {
+			flattenJSON(values, joinName(name, k), v)
+		}
+
+	case []any:
+		for i, v := range value {
+			if _, ok := v.(map[string]any); ok {
+				flattenJSON(values, joinName(name, strconv.Itoa(i)), v)
+			} else {
+				flattenJSON(values, name, v)
+			}
+		}
+
+	case nil:
+
+	default:
+		values.Add(name, fmt.Sprint(value))
+	}
+}
+
+func joinName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
+
+// bindStruct sets the fields of v from the form, and validates them
+func bindStruct(form *Form, files map[string][]*multipart.FileHeader, prefix string, v reflect.Value) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Tag.Get("form")
+
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		name = joinName(prefix, name)
+
+		if bindField(form, files, name, v.Field(i)) {
+			validateField(form, prefix, name, v.Field(i), field.Tag.Get("validate"))
+		}
+	}
+}
+
+// bindField sets v from the form field name, and reports whether its value could be used
+func bindField(form *Form, files map[string][]*multipart.FileHeader, name string, v reflect.Value) bool {
+	switch {
+	case v.Type() == fileHeaderType:
+		if fh := files[name]; len(fh) > 0 {
+			v.Set(reflect.ValueOf(fh[0]))
+		}
+
+		return true
+
+	case v.Type() == reflect.SliceOf(fileHeaderType):
+		v.Set(reflect.ValueOf(files[name]))
+
+		return true
+
+	case v.Type() == timeType:
+		t := form.Date(name, dateLayout)
+		v.Set(reflect.ValueOf(t))
+
+		return form.Errors.Get(name) == ""
+
+	case v.Kind() == reflect.Pointer:
+		if !hasField(form.Data, files, name) {
+			return true
+		}
+
+		elem := reflect.New(v.Type().Elem())
+
+		ok := bindField(form, files, name, elem.Elem())
+		v.Set(elem)
+
+		return ok
+
+	case v.Kind() == reflect.Struct:
+		bindStruct(form, files, name, v)
+
+		return true
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		n := sliceLength(form.Data, name)
+		s := reflect.MakeSlice(v.Type(), n, n)
+
+		for i := 0; i < n; i++ {
+			bindStruct(form, files, joinName(name, strconv.Itoa(i)), s.Index(i))
+		}
+
+		v.Set(s)
+
+		return true
+
+	case v.Kind() == reflect.Slice:
+		values := form.Data[name]
+		s := reflect.MakeSlice(v.Type(), len(values), len(values))
+
+		ok := true
+
+		for i, value := range values {
+			if key := setValue(s.Index(i), value); key != "" {
+				form.addError(name, key)
+				ok = false
+			}
+		}
+
+		v.Set(s)
+
+		return ok
+
+	default:
+		value := form.Data.Get(name)
+
+		if value == "" {
+			return true
+		}
+
+		if key := setValue(v, value); key != "" {
+			form.addError(name, key)
+			return false
+		}
+
+		return true
+	}
+}
+
+// setValue parses s into v, a string, bool or number. When it can't, it returns the key of
+// the message for the form.
+func setValue(v reflect.Value, s string) string {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		// checkboxes send "on" unless they have a value
+		b, err := strconv.ParseBool(s)
+		if s == "on" {
+			b, err = true, nil
+		}
+
+		if err != nil {
+			return msgBool
+		}
+
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return msgWholeNumber
+		}
+
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return msgWholeNumber
+		}
+
+		v.SetUint(i)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), v.Type().Bits())
+		if err != nil {
+			return msgNumber
+		}
+
+		v.SetFloat(f)
+
+	default:
+		panic(fmt.Sprintf("decodeForm can't set a %s", v.Type()))
+	}
+
+	return ""
+}
+
+// hasField reports whether the form has name, or fields nested in it
+func hasField(values url.Values, files map[string][]*multipart.FileHeader, name string) bool {
+	if values.Get(name) != "" || len(files[name]) > 0 {
+		return true
+	}
+
+	for k := range values {
+		if strings.HasPrefix(k, name+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sliceLength is one more than the highest index of name in the form, like 2 for phones.1.number
+func sliceLength(values url.Values, name string) int {
+	n := 0
+
+	for k := range values {
+		if !strings.HasPrefix(k, name+".") {
+			continue
+		}
+
+		index, _, _ := strings.Cut(strings.TrimPrefix(k, name+"."), ".")
+
+		// a limit, so a request can't make us allocate a huge slice
+		if i, err := strconv.Atoi(index); err == nil && i >= 0 && i < maxFormItems && i+1 > n {
+			n = i + 1
+		}
+	}
+
+	return n
+}
+
+// the most items we bind into a slice of structs
+const maxFormItems = 100
+
+// validateField checks the value of a field by the rules in its validate tag:
+//
+//	required     the field is filled in; slices have at least one value
+//	email        an email address
+//	url          a http or https address
+//	min=n, max=n characters of a string, the value of a number, or the values in a slice
+//	oneof=a b c  one of the values separated by spaces
+//	eqfield=name the same as the field name next to it
+//	password=n   a strong password of at least n characters
+//
+// Rules other than required, min and max check every value of a slice.
+func validateField(form *Form, prefix, name string, v reflect.Value, tag string) {
+	if tag == "" {
+		return
+	}
+
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		rule, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+
+		switch {
+		case rule == "required" && v.Kind() == reflect.Slice:
+			if v.Len() == 0 {
+				form.addError(name, msgRequired)
+			}
+
+		case rule == "required":
+			form.Required(name)
+
+		case (rule == "min" || rule == "max") && v.Kind() == reflect.Slice:
+			n := intArg(name, rule, arg)
+
+			if rule == "min" && v.Len() < n {
+				form.addError(name, msgMinItems, n)
+			}
+
+			if rule == "max" && v.Len() > n {
+				form.addError(name, msgMaxItems, n)
+			}
+
+		case (rule == "min" || rule == "max") && isNumber(v):
+			validateNumber(form, name, v, rule, arg)
+
+		case rule == "min":
+			form.MinLength(name, intArg(name, rule, arg))
+
+		case rule == "max":
+			form.MaxLength(name, intArg(name, rule, arg))
+
+		case v.Kind() == reflect.Slice:
+			// every value on its own, with the errors going to the same field
+			for _, value := range form.Data[name] {
+				one := &Form{Data: url.Values{name: {value}}, Errors: form.Errors, Messages: form.Messages}
+				validateValue(one, prefix, name, rule, arg)
+			}
+
+		default:
+			validateValue(form, prefix, name, rule, arg)
+		}
+	}
+}
+
+// validateValue checks a single value against one rule
+func validateValue(form *Form, prefix, name, rule, arg string) {
+	switch rule {
+	case "email":
+		form.Email(name)
+	case "url":
+		form.URL(name)
+	case "oneof":
+		form.OneOf(name, strings.Fields(arg)...)
+	case "eqfield":
+		form.Equal(name, joinName(prefix, arg))
+	case "password":
+		form.PasswordStrength(name, intArg(name, rule, arg))
+	default:
+		panic(fmt.Sprintf("unknown validation rule %q for %s", rule, name))
+	}
+}
+
+// validateNumber checks the min and max rules of numbers
+func validateNumber(form *Form, name string, v reflect.Value, rule, arg string) {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validation rule %s of %s needs a number", rule, name))
+	}
+
+	var f float64
+
+	switch {
+	case v.CanInt():
+		f = float64(v.Int())
+	case v.CanUint():
+		f = float64(v.Uint())
+	default:
+		f = v.Float()
+	}
+
+	// numbers that were left out are not too small
+	if !form.Has(name) {
+		return
+	}
+
+	if rule == "min" && f < limit {
+		form.addError(name, msgMin, arg)
+	}
+
+	if rule == "max" && f > limit {
+		form.addError(name, msgMax, arg)
+	}
+}
+
+func isNumber(v reflect.Value) bool {
+	return v.CanInt() || v.CanUint() || v.CanFloat()
+}
+
+func intArg(name, rule, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		panic(fmt.Sprintf("validation rule %s of %s needs a whole number", rule, name))
+	}
+
+	return n
+}
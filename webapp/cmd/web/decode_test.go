@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAddress struct {
+	Street string `form:"street" validate:"required"`
+	City   string `form:"city" validate:"required,max=10"`
+}
+
+type testSignup struct {
+	Email      string      `form:"email" validate:"required,email"`
+	Password   string      `form:"password" validate:"required,password=10"`
+	Repeat     string      `form:"repeat" validate:"eqfield=password"`
+	Age        int         `form:"age" validate:"min=18,max=130"`
+	Score      *float64    `form:"score"`
+	Newsletter bool        `form:"newsletter"`
+	Born       time.Time   `form:"born"`
+	Plan       string      `form:"plan" validate:"oneof=free pro"`
+	Tags       []string    `form:"tags" validate:"max=2,oneof=go sql web"`
+	Address    testAddress `form:"address"`
+	Phones     []testPhone `form:"phones"`
+	Ignored    string      `form:"-"`
+}
+
+type testPhone struct {
+	Number string `form:"number" validate:"required"`
+}
+
+func TestApp_decodeForm(t *testing.T) {
+	valid := url.Values{
+		"email":           {"jack@example.com"},
+		"password":        {"correct-Horse7"},
+		"repeat":          {"correct-Horse7"},
+		"age":             {"42"},
+		"score":           {"9.5"},
+		"newsletter":      {"on"},
+		"born":            {"1980-05-17"},
+		"plan":            {"pro"},
+		"tags":            {"go", "sql"},
+		"address.street":  {"Main Street 1"},
+		"address.city":    {"Berlin"},
+		"phones.1.number": {"+49 30 1234"},
+		"phones.0.number": {"+49 30 5678"},
+		"Ignored":         {"x"},
+		"-":               {"x"},
+	}
+
+	score := 9.5
+
+	expected := testSignup{
+		Email:      "jack@example.com",
+		Password:   "correct-Horse7",
+		Repeat:     "correct-Horse7",
+		Age:        42,
+		Score:      &score,
+		Newsletter: true,
+		Born:       time.Date(1980, 5, 17, 0, 0, 0, 0, time.UTC),
+		Plan:       "pro",
+		Tags:       []string{"go", "sql"},
+		Address:    testAddress{Street: "Main Street 1", City: "Berlin"},
+		Phones:     []testPhone{{Number: "+49 30 5678"}, {Number: "+49 30 1234"}},
+	}
+
+	var tests = []struct {
+		name           string
+		change         url.Values
+		expectedErrors map[string]string
+	}{
+		{"valid", nil, nil},
+		{"missing and malformed", url.Values{"email": {"jack"}, "password": {""}, "age": {"forty"}}, map[string]string{
+			"email":    "Must be an email address",
+			"password": "This field cannot be blank",
+			"repeat":   "Does not match",
+			"age":      "Must be a whole number",
+		}},
+		{"out of range", url.Values{"age": {"17"}, "score": {"high"}, "born": {"17.05.1980"}, "plan": {"gold"}}, map[string]string{
+			"age":   "Must be at least 18",
+			"score": "Must be a number",
+			"born":  "Must be a date like 2022-08-19",
+			"plan":  "Must be one of free, pro",
+		}},
+		{"slices", url.Values{"tags": {"go", "rust", "web"}, "phones.0.number": {""}}, map[string]string{
+			"tags":            "Choose at most 2",
+			"phones.0.number": "This field cannot be blank",
+		}},
+		{"nested", url.Values{"address.street": {""}, "address.city": {"Llanfairpwllgwyngyll"}}, map[string]string{
+			"address.street": "This field cannot be blank",
+			"address.city":   "Must be at most 10 characters long",
+		}},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+
+		for k, v := range valid {
+			postedData[k] = v
+		}
+
+		for k, v := range e.change {
+			postedData[k] = v
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, "/signup", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		var input testSignup
+
+		form, err := app.decodeForm(httptest.NewRecorder(), req, &input)
+
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if e.expectedErrors == nil && !reflect.DeepEqual(input, expected) {
+			t.Errorf("%s: expected\n%+v\nbut got\n%+v", e.name, expected, input)
+		}
+
+		if len(form.Errors) != len(e.expectedErrors) {
+			t.Errorf("%s: expected %d errors, but got %v", e.name, len(e.expectedErrors), form.Errors)
+		}
+
+		for field, msg := range e.expectedErrors {
+			if form.Errors.Get(field) != msg {
+				t.Errorf("%s: expected %q for %s, but got %q", e.name, msg, field, form.Errors.Get(field))
+			}
+		}
+	}
+}
+
+func TestApp_decodeFormJSON(t *testing.T) {
+	body := `{
+		"email": "jack@example.com",
+		"password": "correct-Horse7",
+		"repeat": "correct-Horse7",
+		"age": 42,
+		"score": null,
+		"newsletter": true,
+		"plan": "free",
+		"tags": ["web"],
+		"address": {"street": "Main Street 1", "city": "Berlin"},
+		"phones": [{"number": "+49 30 5678"}, {"number": ""}]
+	}`
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	var input testSignup
+
+	form, err := app.decodeForm(httptest.NewRecorder(), req, &input)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if input.Age != 42 || !input.Newsletter || input.Score != nil || input.Address.City != "Berlin" || len(input.Phones) != 2 || input.Tags[0] != "web" {
+		t.Errorf("unexpected input %+v", input)
+	}
+
+	if len(form.Errors) != 1 || form.Errors.Get("phones.1.number") != "This field cannot be blank" {
+		t.Errorf("expected an error for the second phone, but got %v", form.Errors)
+	}
+
+	// we can't read it at all
+	for _, body := range []string{`{"email": `, `["jack@example.com"]`, `{} {}`} {
+		req, _ := http.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		if _, err := app.decodeForm(httptest.NewRecorder(), req, &input); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestApp_decodeFormMultipart(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	_ = writer.WriteField("title", "Holiday")
+
+	part, _ := writer.CreateFormFile("image", "beach.png")
+	_, _ = part.Write([]byte("not really a png"))
+
+	_ = writer.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var input struct {
+		Title string                `form:"title" validate:"required"`
+		Image *multipart.FileHeader `form:"image"`
+		Other *multipart.FileHeader `form:"other"`
+	}
+
+	form, err := app.decodeForm(httptest.NewRecorder(), req, &input)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !form.Valid() || input.Title != "Holiday" || input.Image == nil || input.Image.Filename != "beach.png" || input.Other != nil {
+		t.Errorf("unexpected input %+v (%v)", input, form.Errors)
+	}
+}
+
+func TestApp_decodeFormQuery(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/search?q=jack&page=two", nil)
+
+	var input struct {
+		Query string `form:"q" validate:"required"`
+		Page  int    `form:"page"`
+	}
+
+	form, _ := app.decodeForm(httptest.NewRecorder(), req, &input)
+
+	if input.Query != "jack" || form.Errors.Get("page") != "Must be a whole number" {
+		t.Errorf("unexpected input %+v (%v)", input, form.Errors)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/jobs"
+	"webapp/pkg/mail"
+	"webapp/pkg/repository"
+	"webapp/pkg/signing"
+)
+
+const (
+	// verifyEmailPurpose is what verification tokens are signed for
+	verifyEmailPurpose = "verify-email"
+	// how long verification links work
+	verifyEmailExpiry = 48 * time.Hour
+)
+
+// sendEmail queues a message; it goes out in the background, and is tried again while the
+// mail server is down
+func (app *application) sendEmail(ctx context.Context, m mail.Message) error {
+	_, err := app.Jobs.Enqueue(ctx, sendEmailJob, m)
+
+	return err
+}
+
+// deliverEmail is the job that hands a queued message to the mailer
+func (app *application) deliverEmail(ctx context.Context, job *data.Job) error {
+	var m mail.Message
+
+	if err := jobs.Decode(job, &m); err != nil {
+		return err
+	}
+
+	err := app.Mailer.Send(ctx, m)
+
+	if errors.Is(err, mail.ErrInvalidAddress) {
+		return jobs.Permanent(err)
+	}
+
+	return err
+}
+
+// sendVerificationEmail sends a link to email that proves the user gets mail there, in the
+// language the user chose
+func (app *application) sendVerificationEmail(ctx context.Context, user *data.User, email string) error {
+	token := app.Signer.Sign(verifyEmailPurpose, fmt.Sprintf("%d:%s", user.ID, email), time.Now().Add(verifyEmailExpiry))
+	link := app.BaseURL + "/verify-email?token=" + url.QueryEscape(token)
+
+	tr := app.I18n.Translator(user.Locale)
+
+	text := tr.T(`Hello %s,
+
+please open this link to confirm your email address %s:
+
+%s
+
+The link works for 48 hours. If you did not ask for it, you can ignore this message.
+`, user.FirstName, email, link)
+
+	return app.sendEmail(ctx, mail.Message{To: email, Subject: tr.T("Confirm your email address"), Text: text})
+}
+
+// EmailPage shows the logged in user's address, whether it is verified, and a form to change it
+func (app *application) EmailPage(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	td := make(map[string]any)
+	td["user"] = user
+
+	_ = app.render(w, r, "email.page.gohtml", &TemplateData{Data: td})
+
+	return nil
+}
+
+// ChangeEmail starts changing the logged in user's address. The new address is pending until
+// the user opens the link we send to it; entering the current address again cancels the change.
+func (app *application) ChangeEmail(w http.ResponseWriter, r *http.Request) error {
+	var input struct {
+		Email string `form:"email" validate:"required,email"`
+	}
+
+	form, err := app.decodeForm(w, r, &input)
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	email := strings.TrimSpace(input.Email)
+
+	td := make(map[string]any)
+	td["user"] = user
+
+	if !form.Valid() {
+		_ = app.render(w, r, "email.page.gohtml", &TemplateData{Data: td, Form: form, Error: "Please correct the errors below"})
+		return nil
+	}
+
+	if email == user.Email {
+		email = ""
+	}
+
+	err = app.DB.SetPendingEmail(user.ID, email)
+
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		form.Errors.Add("email", "Another user has this email address")
+		_ = app.render(w, r, "email.page.gohtml", &TemplateData{Data: td, Form: form, Error: "Please correct the errors below"})
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	user.PendingEmail = email
+	app.Session.Put(r.Context(), "user", *user)
+
+	if email == "" {
+		app.Session.Put(r.Context(), "flash", "Email change cancelled")
+		http.Redirect(w, r, "/user/email", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := app.sendVerificationEmail(r.Context(), user, email); err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditEmailChangeRequested, user.ID, email)
+
+	app.Session.Put(r.Context(), "flash", app.tr(r).T("We sent a link to %s; your address changes once you open it", email))
+	http.Redirect(w, r, "/user/email", http.StatusSeeOther)
+
+	return nil
+}
+
+// ResendVerificationEmail sends the link for the pending address again, or for the current one
+// if it is not verified yet
+func (app *application) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	email := user.PendingEmail
+
+	if email == "" && !user.EmailVerified() {
+		email = user.Email
+	}
+
+	if email == "" {
+		app.Session.Put(r.Context(), "flash", "Your email address is verified already")
+		http.Redirect(w, r, "/user/email", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := app.sendVerificationEmail(r.Context(), user, email); err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "flash", app.tr(r).T("We sent a new link to %s", email))
+	http.Redirect(w, r, "/user/email", http.StatusSeeOther)
+
+	return nil
+}
+
+// VerifyEmail is where verification links point. It works without logging in, as the link
+// may well be opened in another browser.
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	current, loggedIn := app.Session.Get(r.Context(), "user").(data.User)
+
+	next := "/"
+	if loggedIn {
+		next = "/user/email"
+	}
+
+	value, err := app.Signer.Verify(verifyEmailPurpose, r.URL.Query().Get("token"), time.Now())
+
+	if errors.Is(err, signing.ErrExpired) {
+		app.Session.Put(r.Context(), "error", "This link has expired; log in and ask for a new one")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return nil
+	}
+
+	idText, email, found := strings.Cut(value, ":")
+	id, convErr := strconv.Atoi(idText)
+
+	if err != nil || !found || convErr != nil {
+		app.Session.Put(r.Context(), "error", "This link is not valid")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := app.DB.VerifyEmail(id, email)
+
+	switch {
+	// the user changed to another address since, or is gone
+	case errors.Is(err, repository.ErrNotFound):
+		app.Session.Put(r.Context(), "error", "This link is not valid anymore")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return nil
+
+	case errors.Is(err, repository.ErrDuplicateEmail):
+		app.Session.Put(r.Context(), "error", "Another user has this email address now")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return nil
+
+	case err != nil:
+		return err
+	}
+
+	app.audit(r, data.AuditEmailVerified, user.ID, email)
+
+	if loggedIn && current.ID == user.ID {
+		app.Session.Put(r.Context(), "user", *user)
+	}
+
+	app.Session.Put(r.Context(), "flash", app.tr(r).T("Your email address %s is verified", email))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+
+	return nil
+}
+
+// currentUser loads the logged in user from the database, as the copy in the session can be
+// older than the last change of their address
+func (app *application) currentUser(r *http.Request) (*data.User, error) {
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+
+	return app.DB.GetUser(sessionUser.ID)
+}
+
+// patchUser changes a user like PatchUser, except for the address: a new one is only pending,
+// and replaces the current one once the user opens the link we send to it
+func (app *application) patchUser(ctx context.Context, id, version int, patch data.UserPatch) (*data.User, error) {
+	email := patch.Email
+	patch.Email = nil
+
+	var updated *data.User
+
+	err := app.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+
+		updated, err = repo.PatchUser(id, version, patch)
+		if err != nil || email == nil {
+			return err
+		}
+
+		// going back to the current address cancels a change
+		pending := *email
+		if pending == updated.Email {
+			pending = ""
+		}
+
+		if err := repo.SetPendingEmail(id, pending); err != nil {
+			return err
+		}
+
+		updated.PendingEmail = pending
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if updated.PendingEmail != "" && email != nil {
+		if err := app.sendVerificationEmail(ctx, updated, updated.PendingEmail); err != nil {
+			log.Println("error sending verification email:", err)
+		}
+	}
+
+	return updated, nil
+}
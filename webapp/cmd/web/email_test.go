@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/mail"
+	"webapp/pkg/repository"
+	"webapp/pkg/repository/dbrepo"
+)
+
+// sentEmail runs the queued jobs, and returns the messages that went out
+func sentEmail(t *testing.T) []mail.Message {
+	if err := app.Jobs.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return app.Mailer.(*mail.Memory).Messages()
+}
+
+func TestApp_ChangeEmail(t *testing.T) {
+	var tests = []struct {
+		name           string
+		email          string
+		expectedStatus int
+		expectedBody   string
+		expectedFlash  string
+		expectedTo     string
+	}{
+		{"new address", "two@example.com", http.StatusSeeOther, "", "We sent a link to two@example.com; your address changes once you open it", "two@example.com"},
+		{"address of another user", "admin@example.com", http.StatusOK, "Another user has this email address", "", ""},
+		{"not an address", "two", http.StatusOK, "Must be an email address", "", ""},
+		{"current address", "2fa@example.com", http.StatusSeeOther, "", "Email change cancelled", ""},
+	}
+
+	for _, e := range tests {
+		useTestJobs(t)
+		app.Mailer.(*mail.Memory).Reset()
+
+		postedData := url.Values{"email": {e.email}}
+
+		req, _ := http.NewRequest(http.MethodPost, "/user/email", strings.NewReader(postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		app.Session.Put(req.Context(), "user", data.User{ID: 2})
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.ChangeEmail).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %q in the body", e.name, e.expectedBody)
+		}
+
+		if msg := app.Session.GetString(req.Context(), "flash"); msg != e.expectedFlash {
+			t.Errorf("%s: expected flash %q, but got %q", e.name, e.expectedFlash, msg)
+		}
+
+		sent := sentEmail(t)
+
+		if e.expectedTo == "" {
+			if len(sent) != 0 {
+				t.Errorf("%s: expected no email, but got %+v", e.name, sent)
+			}
+			continue
+		}
+
+		if len(sent) != 1 || sent[0].To != e.expectedTo || !strings.Contains(sent[0].Text, "http://localhost:8081/verify-email?token=") {
+			t.Errorf("%s: expected a link sent to %s, but got %+v", e.name, e.expectedTo, sent)
+		}
+
+		// the address is only pending until the link is opened
+		if user := app.Session.Get(req.Context(), "user").(data.User); user.Email != "2fa@example.com" || user.PendingEmail != e.expectedTo {
+			t.Errorf("%s: expected %s to be pending, but got %+v", e.name, e.expectedTo, user)
+		}
+	}
+}
+
+func TestApp_sendVerificationEmailTranslated(t *testing.T) {
+	var tests = []struct {
+		locale          string
+		expectedSubject string
+		expectedText    string
+	}{
+		{"", "Confirm your email address", "please open this link to confirm your email address jack@example.com:"},
+		{"de", "Bestätige deine E-Mail-Adresse", "bitte öffne diesen Link, um deine E-Mail-Adresse jack@example.com zu bestätigen:"},
+		{"sr", "Potvrdite svoju imejl adresu", "otvorite ovaj link da biste potvrdili svoju imejl adresu jack@example.com:"},
+	}
+
+	for _, e := range tests {
+		useTestJobs(t)
+		app.Mailer.(*mail.Memory).Reset()
+
+		user := &data.User{ID: 2, FirstName: "Jack", Locale: e.locale}
+
+		if err := app.sendVerificationEmail(context.Background(), user, "jack@example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := sentEmail(t)
+
+		if len(sent) != 1 || sent[0].Subject != e.expectedSubject || !strings.Contains(sent[0].Text, e.expectedText) || !strings.Contains(sent[0].Text, "/verify-email?token=") {
+			t.Errorf("%q: expected %q with %q and a link, but got %+v", e.locale, e.expectedSubject, e.expectedText, sent)
+		}
+	}
+}
+
+func TestApp_VerifyEmail(t *testing.T) {
+	valid := time.Now().Add(time.Hour)
+
+	var tests = []struct {
+		name          string
+		token         string
+		expectedFlash string
+		expectedError string
+		expectedEmail string
+	}{
+		{"pending address", app.Signer.Sign(verifyEmailPurpose, "2:"+dbrepo.TestPendingEmail, valid), "Your email address " + dbrepo.TestPendingEmail + " is verified", "", dbrepo.TestPendingEmail},
+		{"current address", app.Signer.Sign(verifyEmailPurpose, "2:2fa@example.com", valid), "Your email address 2fa@example.com is verified", "", "2fa@example.com"},
+		{"address the user gave up", app.Signer.Sign(verifyEmailPurpose, "2:old@example.com", valid), "", "This link is not valid anymore", ""},
+		{"expired", app.Signer.Sign(verifyEmailPurpose, "2:2fa@example.com", time.Now().Add(-time.Minute)), "", "This link has expired; log in and ask for a new one", ""},
+		{"signed for something else", app.Signer.Sign("reset-password", "2:2fa@example.com", valid), "", "This link is not valid", ""},
+		{"no user id", app.Signer.Sign(verifyEmailPurpose, "2fa@example.com", valid), "", "This link is not valid", ""},
+		{"garbage", "not-a-token", "", "This link is not valid", ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(e.token), nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 2, Email: "2fa@example.com"})
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.VerifyEmail).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/email" {
+			t.Errorf("%s: expected a redirect to /user/email, but got %d %s", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+
+		if msg := app.Session.GetString(req.Context(), "flash"); msg != e.expectedFlash {
+			t.Errorf("%s: expected flash %q, but got %q", e.name, e.expectedFlash, msg)
+		}
+
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q, but got %q", e.name, e.expectedError, msg)
+		}
+
+		user := app.Session.Get(req.Context(), "user").(data.User)
+
+		if e.expectedEmail != "" && (user.Email != e.expectedEmail || !user.EmailVerified()) {
+			t.Errorf("%s: expected the session user to have verified %s, but got %+v", e.name, e.expectedEmail, user)
+		}
+	}
+}
+
+func TestApp_VerifyEmailLoggedOut(t *testing.T) {
+	token := app.Signer.Sign(verifyEmailPurpose, "2:"+dbrepo.TestPendingEmail, time.Now().Add(time.Hour))
+
+	req, _ := http.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token), nil)
+	req = addContextAndSessionToRequest(req, app)
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.VerifyEmail).ServeHTTP(rr, req)
+
+	if rr.Header().Get("Location") != "/" {
+		t.Errorf("expected a redirect to /, but got %s", rr.Header().Get("Location"))
+	}
+
+	// opening the link does not log anyone in
+	if app.Session.Exists(req.Context(), "user") {
+		t.Error("the link logged the user in")
+	}
+}
+
+func TestApp_requireVerifiedEmail(t *testing.T) {
+	var tests = []struct {
+		name             string
+		method           string
+		accept           string
+		require          bool
+		user             data.User
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"verified", http.MethodGet, "", true, data.User{ID: 1}, http.StatusOK, ""},
+		{"unverified", http.MethodGet, "", true, data.User{ID: 2}, http.StatusSeeOther, "/user/email"},
+		{"unverified upload", http.MethodPost, "", true, data.User{ID: 2}, http.StatusSeeOther, "/user/email"},
+		{"unverified JSON client", http.MethodGet, "application/json", true, data.User{ID: 2}, http.StatusForbidden, ""},
+		{"not required", http.MethodGet, "", false, data.User{ID: 2}, http.StatusOK, ""},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, e := range tests {
+		app.RequireVerifiedEmail = e.require
+
+		req, _ := http.NewRequest(e.method, "/user/profile", nil)
+		req.Header.Set("Accept", e.accept)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", e.user)
+
+		rr := httptest.NewRecorder()
+
+		app.requireVerifiedEmail(next).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected location %q, but got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+	}
+
+	app.RequireVerifiedEmail = false
+}
+
+func TestApp_AdminPatchUserEmail(t *testing.T) {
+	useTestJobs(t)
+	app.Mailer.(*mail.Memory).Reset()
+
+	req, _ := http.NewRequest(http.MethodPatch, "/api/admin/users/2", strings.NewReader(`{"version": 1, "email": "two@example.com"}`))
+	req = addIDToRequest(req, "2")
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1, IsAdmin: 1})
+
+	rr := httptest.NewRecorder()
+
+	apiHandler(app.AdminPatchUser).ServeHTTP(rr, req)
+
+	// admins can't skip verification either
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"email":"2fa@example.com"`) || !strings.Contains(rr.Body.String(), `"pending_email":"two@example.com"`) {
+		t.Errorf("expected two@example.com to be pending, but got %d %s", rr.Code, rr.Body)
+	}
+
+	if sent := sentEmail(t); len(sent) != 1 || sent[0].To != "two@example.com" {
+		t.Errorf("expected a link sent to two@example.com, but got %+v", sent)
+	}
+}
+
+func TestApp_patchUserRollsBack(t *testing.T) {
+	useTestJobs(t)
+
+	repo := &dbrepo.TestDBRepo{}
+
+	defer func(db repository.DatabaseRepo) { app.DB = db }(app.DB)
+	app.DB = repo
+
+	name := "Jack"
+	taken := "admin@example.com"
+	free := "two@example.com"
+
+	var tests = []struct {
+		name           string
+		patch          data.UserPatch
+		expectedErr    error
+		expectedWrites []string
+	}{
+		// the name changes before the address turns out to be taken; both go, or neither
+		{"address of another user", data.UserPatch{FirstName: &name, Email: &taken}, repository.ErrDuplicateEmail, nil},
+		{"free address", data.UserPatch{FirstName: &name, Email: &free}, nil, []string{"PatchUser 2", "SetPendingEmail 2"}},
+	}
+
+	for _, e := range tests {
+		before := len(repo.Writes())
+
+		_, err := app.patchUser(context.Background(), 2, 1, e.patch)
+
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, but got %v", e.name, e.expectedErr, err)
+		}
+
+		if writes := repo.Writes()[before:]; fmt.Sprint(writes) != fmt.Sprint(e.expectedWrites) {
+			t.Errorf("%s: expected writes %v, but got %v", e.name, e.expectedWrites, writes)
+		}
+	}
+}
+
+func TestApp_deliverEmail(t *testing.T) {
+	repo := useTestJobs(t)
+	app.Mailer.(*mail.Memory).Reset()
+
+	_ = app.sendEmail(context.Background(), mail.Message{To: "jack@example.com", Subject: "Hi"})
+	_ = app.sendEmail(context.Background(), mail.Message{To: "jack\r\nBcc: all@example.com", Subject: "Hi"})
+
+	if sent := sentEmail(t); len(sent) != 1 || sent[0].To != "jack@example.com" {
+		t.Errorf("expected one message to jack@example.com, but got %+v", sent)
+	}
+
+	// a bad address won't get better by trying again
+	dead, _ := repo.Jobs(context.Background(), data.JobFilter{Status: data.JobDead})
+
+	if len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Errorf("expected one dead job after one attempt, but got %+v", dead)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// the page for errors; it gets the status, its title, a message and the request id
+const errorPage = "error.page.gohtml"
+
+// httpError is an error users get to see, with its status; the error that caused it is only
+// logged
+type httpError struct {
+	status  int
+	message string
+	// fields are the fields of the request that are wrong, with their messages
+	fields map[string][]string
+	err    error
+}
+
+func (e *httpError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%d %s: %s", e.status, e.message, e.err)
+	}
+
+	return fmt.Sprintf("%d %s", e.status, e.message)
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// errNotFound is returned by handlers for things that don't exist, or that the user may not
+// know exist
+var errNotFound = &httpError{status: http.StatusNotFound}
+
+// badRequest is returned by handlers for requests they can't read at all, caused by err
+func badRequest(err error) error {
+	return &httpError{status: http.StatusBadRequest, err: err}
+}
+
+// clientError is returned by handlers for requests they won't do, with a message that tells the
+// client why, and the fields that are wrong, if that's why
+func clientError(status int, message string, fields map[string][]string) error {
+	return &httpError{status: status, message: message, fields: fields}
+}
+
+// handlerFunc is a handler that returns its errors instead of answering them; see handle
+type handlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// handle turns h into an http.HandlerFunc that answers the errors it returns: an httpError
+// with its status, and anything else as a 500 that users only see the request id of
+func (app *application) handle(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			app.handleError(w, r, err)
+		}
+	}
+}
+
+func (app *application) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	var he *httpError
+
+	if !errors.As(err, &he) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if he.err != nil {
+		log.Printf("request %s: %s", middleware.GetReqID(r.Context()), he)
+	}
+
+	app.errorPage(w, r, he.status, he.message, he.fields)
+}
+
+// serverError logs err with the request id, and answers with a 500
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("request %s: %s", middleware.GetReqID(r.Context()), err)
+
+	app.errorPage(w, r, http.StatusInternalServerError, "", nil)
+}
+
+// errorMessages are what users see for a status, when the handler has nothing better
+var errorMessages = map[int]string{
+	http.StatusBadRequest:          "We could not understand this request",
+	http.StatusForbidden:           "You are not allowed to do this",
+	http.StatusNotFound:            "There is nothing here",
+	http.StatusMethodNotAllowed:    "This page does not take this kind of request",
+	http.StatusInternalServerError: "Something went wrong on our side; tell us the request ID if it keeps happening",
+}
+
+// errorPage answers with the error page, or a problem to clients that ask for JSON; only the
+// problem has the fields that are wrong
+func (app *application) errorPage(w http.ResponseWriter, r *http.Request, status int, message string, fields map[string][]string) {
+	if message == "" {
+		message = errorMessages[status]
+	}
+
+	message = app.tr(r).T(message)
+
+	if negotiate(r) == formatJSON {
+		_ = app.writeProblem(w, r, status, message, fields)
+		return
+	}
+
+	td := map[string]any{
+		"status":    status,
+		"title":     http.StatusText(status),
+		"message":   message,
+		"requestID": middleware.GetReqID(r.Context()),
+	}
+
+	_ = app.respond(w, r, status, errorPage, &TemplateData{Data: td})
+}
+
+// notFound answers requests for routes we don't have
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	app.errorPage(w, r, http.StatusNotFound, "", nil)
+}
+
+// methodNotAllowed answers requests for routes we have, but not with their method
+func (app *application) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	app.errorPage(w, r, http.StatusMethodNotAllowed, "", nil)
+}
+
+// recoverPanic answers a panic in a handler with a 500, and logs it with the request id and
+// the stack, so it can be found from what the user reports. The error page needs the session,
+// so panics before it is loaded get plain text; routes recovers again once it is.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+
+			if rec == nil {
+				return
+			}
+
+			// the server aborts the response without logging it, as it should
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			log.Printf("request %s: panic: %v\n%s", middleware.GetReqID(r.Context()), rec, debug.Stack())
+
+			w.Header().Set("Connection", "close")
+
+			if !app.sessionLoaded(r.Context()) {
+				http.Error(w, fmt.Sprintf("%s\nRequest ID: %s", http.StatusText(http.StatusInternalServerError),
+					middleware.GetReqID(r.Context())), http.StatusInternalServerError)
+				return
+			}
+
+			app.errorPage(w, r, http.StatusInternalServerError, "", nil)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func Test_application_errorRoutes(t *testing.T) {
+	var tests = []struct {
+		name                string
+		method              string
+		url                 string
+		accept              string
+		acceptLanguage      string
+		expectedStatus      int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"not found", http.MethodGet, "/fish", "", "", http.StatusNotFound, "text/html; charset=utf-8", "404 Not Found"},
+		{"not found json", http.MethodGet, "/fish", "application/json", "", http.StatusNotFound, "application/problem+json", `"title":"Not Found"`},
+		{"not found german", http.MethodGet, "/fish", "", "de", http.StatusNotFound, "text/html; charset=utf-8", "Hier gibt es nichts"},
+		{"method not allowed", http.MethodGet, "/login", "", "", http.StatusMethodNotAllowed, "text/html; charset=utf-8", "405 Method Not Allowed"},
+		{"method not allowed json", http.MethodGet, "/login", "application/json", "", http.StatusMethodNotAllowed, "application/problem+json", `"status":405`},
+	}
+
+	routes := app.routes()
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, nil)
+
+		req.Header.Set("Accept", e.accept)
+		req.Header.Set("Accept-Language", e.acceptLanguage)
+
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus || rr.Header().Get("Content-Type") != e.expectedContentType {
+			t.Errorf("%s: expected %d %s, but got %d %s", e.name, e.expectedStatus, e.expectedContentType, rr.Code, rr.Header().Get("Content-Type"))
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %q in the body, but got %s", e.name, e.expectedBody, rr.Body)
+		}
+
+		// every response can be found in the logs
+		if rr.Header().Get("Content-Type") == "application/problem+json" && !strings.Contains(rr.Body.String(), `"request_id":"`) {
+			t.Errorf("%s: expected a request id, but got %s", e.name, rr.Body)
+		}
+	}
+}
+
+func TestApp_handle(t *testing.T) {
+	var tests = []struct {
+		name           string
+		err            error
+		accept         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"no error", nil, "", http.StatusOK, ""},
+		{"not found", errNotFound, "", http.StatusNotFound, "There is nothing here"},
+		{"bad request", badRequest(errors.New("invalid JSON body")), "", http.StatusBadRequest, "We could not understand this request"},
+		{"wrapped", fmt.Errorf("loading image: %w", errNotFound), "", http.StatusNotFound, "There is nothing here"},
+		{"internal", errors.New("database unavailable"), "", http.StatusInternalServerError, "Something went wrong on our side"},
+		{"internal json", errors.New("database unavailable"), "application/json", http.StatusInternalServerError, `"title":"Internal Server Error"`},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/user/profile", nil)
+		req.Header.Set("Accept", e.accept)
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+
+		err := e.err
+		app.handle(func(w http.ResponseWriter, r *http.Request) error { return err }).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %q in the body, but got %s", e.name, e.expectedBody, rr.Body)
+		}
+
+		// what went wrong inside is only for the logs
+		if strings.Contains(rr.Body.String(), "database unavailable") {
+			t.Errorf("%s: the error got to the user", e.name)
+		}
+	}
+}
+
+// panickingRepo panics where the users page reads its users
+type panickingRepo struct {
+	repository.DatabaseRepo
+}
+
+func (panickingRepo) ListUsers(ctx context.Context, opts data.ListOptions) (*data.UserList, error) {
+	panic("something broke")
+}
+
+func TestApp_recoverPanic(t *testing.T) {
+	admin, _ := app.DB.GetUser(1)
+	cookie, _ := loggedInAs(t, admin)
+
+	defer func(db repository.DatabaseRepo) { app.DB = db }(app.DB)
+	app.DB = panickingRepo{app.DB}
+
+	req, _ := http.NewRequest(http.MethodGet, "/admin/users", nil)
+	req.AddCookie(cookie)
+
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError || rr.Header().Get("Connection") != "close" {
+		t.Errorf("expected a 500 closing the connection, but got %d %v", rr.Code, rr.Header())
+	}
+
+	if !strings.Contains(rr.Body.String(), "Request ID: ") || !strings.Contains(rr.Body.String(), "</html>") {
+		t.Errorf("expected the error page with the request id, but got %s", rr.Body)
+	}
+
+	// before the session is loaded, there is only text
+	req, _ = http.NewRequest(http.MethodGet, "/", nil)
+	rr = httptest.NewRecorder()
+
+	var requestID string
+
+	middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = middleware.GetReqID(r.Context())
+		app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("something broke")
+		})).ServeHTTP(w, r)
+	})).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "Request ID: "+requestID) {
+		t.Errorf("expected a 500 with request id %s, but got %d %s", requestID, rr.Code, rr.Body)
+	}
+
+	// the server handles aborted responses itself
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler to be panicked again, but got %v", rec)
+		}
+	}()
+
+	app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
@@ -1,14 +1,75 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/mail"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// dateLayout is how dates are entered in forms and query strings
+const dateLayout = "2006-01-02"
+
+// keys of the messages validators add to Form.Errors
+const (
+	msgRequired       = "form.required"
+	msgEmail          = "form.email"
+	msgMinLength      = "form.min_length"
+	msgMaxLength      = "form.max_length"
+	msgWholeNumber    = "form.whole_number"
+	msgNumber         = "form.number"
+	msgBool           = "form.bool"
+	msgMin            = "form.min"
+	msgMax            = "form.max"
+	msgMinItems       = "form.min_items"
+	msgMaxItems       = "form.max_items"
+	msgRange          = "form.range"
+	msgFormat         = "form.format"
+	msgEqual          = "form.equal"
+	msgOneOf          = "form.one_of"
+	msgURL            = "form.url"
+	msgDate           = "form.date"
+	msgPasswordLength = "form.password_length"
+	msgPasswordWeak   = "form.password_weak"
+)
+
+// defaultMessages are the English messages, with fmt verbs for the arguments of each validator
+var defaultMessages = map[string]string{
+	msgRequired:       "This field cannot be blank",
+	msgEmail:          "Must be an email address",
+	msgMinLength:      "Must be at least %d characters long",
+	msgMaxLength:      "Must be at most %d characters long",
+	msgWholeNumber:    "Must be a whole number",
+	msgNumber:         "Must be a number",
+	msgBool:           "Must be true or false",
+	msgMin:            "Must be at least %s",
+	msgMax:            "Must be at most %s",
+	msgMinItems:       "Choose at least %d",
+	msgMaxItems:       "Choose at most %d",
+	msgRange:          "Must be between %d and %d",
+	msgFormat:         "Has the wrong format",
+	msgEqual:          "Does not match",
+	msgOneOf:          "Must be one of %s",
+	msgURL:            "Must be a web address starting with http:// or https://",
+	msgDate:           "Must be a date like %s",
+	msgPasswordLength: "Must be at least %d characters long",
+	msgPasswordWeak:   "Must mix at least three of lower case letters, upper case letters, digits and symbols",
+}
+
+// MessageFunc returns the text of the message with key, filled in with args. It reports false
+// for keys it does not know, and the English message is used instead.
+type MessageFunc func(key string, args ...any) (string, bool)
+
 // we made it a type so we can have a function associated with it
-type errors map[string][]string
+type formErrors map[string][]string
 
-func (e errors) Get(field string) string {
+func (e formErrors) Get(field string) string {
 	errorSlice := e[field]
 
 	if len(errorSlice) == 0 {
@@ -18,13 +79,15 @@ func (e errors) Get(field string) string {
 	return errorSlice[0]
 }
 
-func (e errors) Add(field, message string) {
+func (e formErrors) Add(field, message string) {
 	e[field] = append(e[field], message)
 }
 
 type Form struct {
 	Data   url.Values
-	Errors errors
+	Errors formErrors
+	// Messages translates the errors validators add; English is used when it is nil
+	Messages MessageFunc
 }
 
 func NewForm(data url.Values) *Form {
@@ -49,7 +112,7 @@ func (f *Form) Required(fields ...string) {
 		value := f.Data.Get(field)
 
 		if strings.TrimSpace(value) == "" {
-			f.Errors.Add(field, "This field cannot be blank")
+			f.addError(field, msgRequired)
 		}
 	}
 }
@@ -63,3 +126,215 @@ func (f *Form) Check(ok bool, key, message string) {
 func (f *Form) Valid() bool {
 	return len(f.Errors) == 0
 }
+
+// Value returns what the user entered in field, to show it again
+func (f *Form) Value(field string) string {
+	return f.Data.Get(field)
+}
+
+// Invalid returns the Bootstrap class for an input with errors, and nothing for a valid one
+func (f *Form) Invalid(field string) string {
+	if f.Errors.Get(field) == "" {
+		return ""
+	}
+
+	return "is-invalid"
+}
+
+// addError adds the message with key to field, in the language of the form
+func (f *Form) addError(field, key string, args ...any) {
+	if f.Messages != nil {
+		if message, ok := f.Messages(key, args...); ok {
+			f.Errors.Add(field, message)
+			return
+		}
+	}
+
+	f.Errors.Add(field, fmt.Sprintf(defaultMessages[key], args...))
+}
+
+// The validators below only look at fields that are filled in; use Required for the ones that
+// must be.
+
+// Email checks that fields hold a bare email address, without a name or angle brackets
+func (f *Form) Email(fields ...string) {
+	for _, field := range fields {
+		if !f.Has(field) {
+			continue
+		}
+
+		value := strings.TrimSpace(f.Data.Get(field))
+		addr, err := mail.ParseAddress(value)
+
+		if err != nil || addr.Address != value {
+			f.addError(field, msgEmail)
+		}
+	}
+}
+
+// MinLength checks that field has at least n characters
+func (f *Form) MinLength(field string, n int) {
+	if f.Has(field) && utf8.RuneCountInString(strings.TrimSpace(f.Data.Get(field))) < n {
+		f.addError(field, msgMinLength, n)
+	}
+}
+
+// MaxLength checks that field has at most n characters
+func (f *Form) MaxLength(field string, n int) {
+	if f.Has(field) && utf8.RuneCountInString(strings.TrimSpace(f.Data.Get(field))) > n {
+		f.addError(field, msgMaxLength, n)
+	}
+}
+
+// Range checks that field is a whole number from min to max
+func (f *Form) Range(field string, min, max int) {
+	if !f.Has(field) {
+		return
+	}
+
+	i, err := strconv.Atoi(strings.TrimSpace(f.Data.Get(field)))
+
+	switch {
+	case err != nil:
+		f.addError(field, msgWholeNumber)
+	case i < min || i > max:
+		f.addError(field, msgRange, min, max)
+	}
+}
+
+// Matches checks that field matches pattern; anchor the pattern to match the whole value
+func (f *Form) Matches(field string, pattern *regexp.Regexp) {
+	if f.Has(field) && !pattern.MatchString(f.Data.Get(field)) {
+		f.addError(field, msgFormat)
+	}
+}
+
+// Equal checks that field has the same value as other, like a repeated password
+func (f *Form) Equal(field, other string) {
+	if f.Data.Get(field) != f.Data.Get(other) {
+		f.addError(field, msgEqual)
+	}
+}
+
+// OneOf checks that field is one of choices
+func (f *Form) OneOf(field string, choices ...string) {
+	if f.Has(field) && !contains(choices, f.Data.Get(field)) {
+		f.addError(field, msgOneOf, strings.Join(choices, ", "))
+	}
+}
+
+// URL checks that field is an absolute http or https address
+func (f *Form) URL(field string) {
+	if !f.Has(field) {
+		return
+	}
+
+	u, err := url.ParseRequestURI(strings.TrimSpace(f.Data.Get(field)))
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		f.addError(field, msgURL)
+	}
+}
+
+// Date checks that field is a date in layout, and returns it
+func (f *Form) Date(field, layout string) time.Time {
+	if !f.Has(field) {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(layout, strings.TrimSpace(f.Data.Get(field)))
+
+	if err != nil {
+		f.addError(field, msgDate, time.Date(2022, 8, 19, 14, 30, 0, 0, time.UTC).Format(layout))
+	}
+
+	return t
+}
+
+// PasswordStrength checks that field has at least minLength characters, and mixes at least three
+// kinds of them: lower case letters, upper case letters, digits and symbols
+func (f *Form) PasswordStrength(field string, minLength int) {
+	if !f.Has(field) {
+		return
+	}
+
+	password := f.Data.Get(field)
+
+	if utf8.RuneCountInString(password) < minLength {
+		f.addError(field, msgPasswordLength, minLength)
+		return
+	}
+
+	var lower, upper, digit, symbol int
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	if lower+upper+digit+symbol < 3 {
+		f.addError(field, msgPasswordWeak)
+	}
+}
+
+// intValue returns a non negative number from the form, adding an error if it isn't one
+func (f *Form) intValue(field string) int {
+	if !f.Has(field) {
+		return 0
+	}
+
+	i, err := strconv.Atoi(f.Data.Get(field))
+
+	if err != nil || i < 0 {
+		f.addError(field, msgWholeNumber)
+	}
+
+	return i
+}
+
+// dateValue returns a date (YYYY-MM-DD) from the form, adding an error if it isn't one
+func (f *Form) dateValue(field string) time.Time {
+	return f.Date(field, dateLayout)
+}
+
+// sessionForm is a form kept in the session, across the redirect after a post
+type sessionForm struct {
+	Data   url.Values
+	Errors map[string][]string
+}
+
+// keepForm puts the form into the session, for the next page to show it again. Passwords are
+// left out, they don't belong in a session and users expect to type them again.
+func (app *application) keepForm(ctx context.Context, form *Form) {
+	kept := sessionForm{Data: url.Values{}, Errors: form.Errors}
+
+	for field, values := range form.Data {
+		if !strings.Contains(field, "password") {
+			kept.Data[field] = values
+		}
+	}
+
+	app.Session.Put(ctx, "form", kept)
+}
+
+// popForm takes the form keepForm put into the session, or returns an empty one
+func (app *application) popForm(ctx context.Context) *Form {
+	kept, ok := app.Session.Pop(ctx, "form").(sessionForm)
+
+	if !ok {
+		return NewForm(url.Values{})
+	}
+
+	form := NewForm(kept.Data)
+	form.Errors = kept.Errors
+
+	return form
+}
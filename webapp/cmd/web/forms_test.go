@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"testing"
 )
 
@@ -100,3 +102,90 @@ func TestForm_ErrorGet(t *testing.T) {
 		t.Error("should not have an error, but got one")
 	}
 }
+
+func TestForm_Validators(t *testing.T) {
+	var tests = []struct {
+		name          string
+		value         string
+		validate      func(f *Form)
+		expectedError string
+	}{
+		{"email", "jack@example.com", func(f *Form) { f.Email("v") }, ""},
+		{"email without domain", "jack", func(f *Form) { f.Email("v") }, "Must be an email address"},
+		{"email with a name", "Jack <jack@example.com>", func(f *Form) { f.Email("v") }, "Must be an email address"},
+		{"empty email", "", func(f *Form) { f.Email("v") }, ""},
+		{"min length", "abc", func(f *Form) { f.MinLength("v", 3) }, ""},
+		{"too short", "ab", func(f *Form) { f.MinLength("v", 3) }, "Must be at least 3 characters long"},
+		{"characters, not bytes", "äöü", func(f *Form) { f.MaxLength("v", 3) }, ""},
+		{"too long", "abcd", func(f *Form) { f.MaxLength("v", 3) }, "Must be at most 3 characters long"},
+		{"in range", "10", func(f *Form) { f.Range("v", 1, 10) }, ""},
+		{"out of range", "11", func(f *Form) { f.Range("v", 1, 10) }, "Must be between 1 and 10"},
+		{"not a number", "ten", func(f *Form) { f.Range("v", 1, 10) }, "Must be a whole number"},
+		{"matches", "AB-12", func(f *Form) { f.Matches("v", regexp.MustCompile(`^[A-Z]{2}-\d+$`)) }, ""},
+		{"does not match", "ab-12", func(f *Form) { f.Matches("v", regexp.MustCompile(`^[A-Z]{2}-\d+$`)) }, "Has the wrong format"},
+		{"equal", "secret", func(f *Form) { f.Data.Set("w", "secret"); f.Equal("w", "v") }, ""},
+		{"not equal", "secret", func(f *Form) { f.Data.Set("w", "Secret"); f.Equal("w", "v") }, "Does not match"},
+		{"one of", "asc", func(f *Form) { f.OneOf("v", "asc", "desc") }, ""},
+		{"not one of", "up", func(f *Form) { f.OneOf("v", "asc", "desc") }, "Must be one of asc, desc"},
+		{"url", "https://example.com/a?b=c", func(f *Form) { f.URL("v") }, ""},
+		{"url without scheme", "example.com", func(f *Form) { f.URL("v") }, "Must be a web address starting with http:// or https://"},
+		{"url with another scheme", "javascript:alert(1)", func(f *Form) { f.URL("v") }, "Must be a web address starting with http:// or https://"},
+		{"date", "2022-08-19", func(f *Form) { f.Date("v", dateLayout) }, ""},
+		{"not a date", "19.08.2022", func(f *Form) { f.Date("v", dateLayout) }, "Must be a date like 2022-08-19"},
+		{"date in another layout", "2022-08-19", func(f *Form) { f.Date("v", "02.01.2006 15:04") }, "Must be a date like 19.08.2022 14:30"},
+		{"strong password", "correct-Horse7", func(f *Form) { f.PasswordStrength("v", 10) }, ""},
+		{"short password", "c-Horse7", func(f *Form) { f.PasswordStrength("v", 10) }, "Must be at least 10 characters long"},
+		{"weak password", "correcthorsebattery", func(f *Form) { f.PasswordStrength("v", 10) }, "Must mix at least three of lower case letters, upper case letters, digits and symbols"},
+	}
+
+	for _, e := range tests {
+		form := NewForm(url.Values{"v": {e.value}})
+
+		e.validate(form)
+
+		// Equal reports on the first field
+		actual := form.Errors.Get("v") + form.Errors.Get("w")
+
+		if actual != e.expectedError {
+			t.Errorf("%s: expected error %q, but got %q", e.name, e.expectedError, actual)
+		}
+	}
+}
+
+func TestForm_Messages(t *testing.T) {
+	form := NewForm(url.Values{"name": {"ab"}})
+
+	form.Messages = func(key string, args ...any) (string, bool) {
+		if key == msgMinLength {
+			return fmt.Sprintf("Mindestens %d Zeichen", args...), true
+		}
+
+		return "", false
+	}
+
+	form.MinLength("name", 3)
+	form.Required("email")
+
+	if msg := form.Errors.Get("name"); msg != "Mindestens 3 Zeichen" {
+		t.Errorf("expected the translated message, but got %q", msg)
+	}
+
+	// messages without a translation stay English
+	if msg := form.Errors.Get("email"); msg != "This field cannot be blank" {
+		t.Errorf("expected the English message, but got %q", msg)
+	}
+}
+
+func TestForm_ValueAndInvalid(t *testing.T) {
+	form := NewForm(url.Values{"email": {"jack"}, "name": {"Jack"}})
+
+	form.Email("email")
+
+	if form.Value("name") != "Jack" || form.Value("missing") != "" {
+		t.Errorf("unexpected values %q and %q", form.Value("name"), form.Value("missing"))
+	}
+
+	if form.Invalid("email") != "is-invalid" || form.Invalid("name") != "" {
+		t.Errorf("unexpected classes %q and %q", form.Invalid("email"), form.Invalid("name"))
+	}
+}
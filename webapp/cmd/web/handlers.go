@@ -1,17 +1,20 @@
 package main
 
 import (
-	"html/template"
+	"errors"
 	"log"
 	"net/http"
-	"path"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
 )
 
 // path that would be in production
 var pathToTemplates = "./templates/"
 
+// loginUnavailable is shown when we can not check a login because the database is down
+const loginUnavailable = "Logging in is not possible right now, please try again later"
+
 // W in our case web browser
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	// template data
@@ -24,6 +27,8 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 		app.Session.Put(r.Context(), "test", "Hit this page at "+time.Now().UTC().String())
 	}
 
+	td["providers"] = app.oidcProviderList()
+
 	_ = app.render(w, r, "home.page.gohtml", &TemplateData{Data: td})
 }
 
@@ -33,96 +38,146 @@ type TemplateData struct {
 	Error string
 	Flash string
 	User  data.User
+	// Form is what the user entered, with its errors; render fills in a form kept in the
+	// session by keepForm, or an empty one
+	Form *Form
+	// Locale is the language of the page, and Locales the ones users can switch to
+	Locale  string
+	Locales []string
 }
 
-func (app *application) Profile(w http.ResponseWriter, r *http.Request) {
+func (app *application) Profile(w http.ResponseWriter, r *http.Request) error {
+	user := app.Session.Get(r.Context(), "user").(data.User)
 
-	_ = app.render(w, r, "home.page.gohtml", &TemplateData{})
-}
+	images, err := app.DB.AllUserImages(user.ID)
 
-// W in our case web browser
-func (app *application) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) error {
-	// parse template from disc
-	parsedTemplate, err := template.ParseFiles(path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml"))
+	if err == nil {
+		err = app.withImageURLs(images)
+	}
 
-	// template not found, or error in template
 	if err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
 		return err
 	}
 
-	td.IP = app.ipFromContext(r.Context())
-
-	td.Error = app.Session.PopString(r.Context(), "error")
-	td.Flash = app.Session.PopString(r.Context(), "flash")
+	td := make(map[string]any)
+	td["images"] = images
 
-	// execute the template, passing the date, if any
-	err = parsedTemplate.Execute(w, td)
+	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{Data: td})
 
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
-func (app *application) Login(w http.ResponseWriter, r *http.Request) {
+// render shows a page; clients that ask for JSON get its data instead, see respond
+func (app *application) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) error {
+	return app.respond(w, r, http.StatusOK, t, td)
+}
+
+func (app *application) Login(w http.ResponseWriter, r *http.Request) error {
 
 	// A stub is a small piece of code that takes the place of another component during testing.
 	//  The benefit of using a stub is that it returns consistent results,
 	//   making the test easier to write.
 	// And you can run tests even if the other components are not working yet
-	err := r.ParseForm()
-
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+	var input struct {
+		Email    string `form:"email" validate:"required"`
+		Password string `form:"password" validate:"required"`
 	}
 
-	// validate data
-	form := NewForm(r.PostForm)
+	form, err := app.decodeForm(w, r, &input)
 
-	form.Required("email", "password")
+	if err != nil {
+		return badRequest(err)
+	}
 
 	if !form.Valid() {
-		// redirect to login page with error message
+		// redirect to login page with error message, keeping what they typed
+		app.keepForm(r.Context(), form)
 		app.Session.Put(r.Context(), "error", "Invalid login credentials")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+		return nil
 	}
 
-	email := r.Form.Get("email")
-	password := r.Form.Get("password")
+	email := input.Email
+	password := input.Password
 
 	user, err := app.DB.GetUserByEmail(email)
 
+	// not being able to look them up is no reason to tell them their login is wrong
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		log.Println("error looking up user:", err)
+		app.Session.Put(r.Context(), "error", loginUnavailable)
+		app.keepForm(r.Context(), form)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
 	if err != nil {
+		app.audit(r, data.AuditLoginFailed, 0, "unknown email "+email)
+
 		// redirect to login page with error message
 		app.Session.Put(r.Context(), "error", "Invalid login")
+		app.keepForm(r.Context(), form)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+		return nil
 	}
 
 	// if not authenticated then redirect with error
-	if !app.authenticate(r, user, password) {
+	if !app.authenticate(user, password) {
+		app.audit(r, data.AuditLoginFailed, user.ID, "wrong password")
 		app.Session.Put(r.Context(), "error", "Invalid login")
+		app.keepForm(r.Context(), form)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+		return nil
 	}
 
-	// prevent fixation attack
-	_ = app.Session.RenewToken(r.Context())
+	// we have the plain password now, so this is our chance to upgrade an outdated hash
+	if app.Hasher.NeedsRehash(user.Password) {
+		err = app.DB.ResetPassword(user.ID, password)
 
-	// redirect to some other page
-	app.Session.Put(r.Context(), "flash", "Successfully logged in")
-	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		if err != nil {
+			log.Println("error rehashing password:", err)
+		} else {
+			app.audit(r, data.AuditPasswordRehashed, user.ID, "")
+		}
+	}
+
+	// password is fine, but users with 2FA still have to give us a code
+	if user.TOTPEnabled {
+		app.Session.Put(r.Context(), "2fa_user_id", user.ID)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	app.logUserIn(w, r, user, "password")
+
+	return nil
 }
 
-func (app *application) authenticate(r *http.Request, user *data.User, password string) bool {
+func (app *application) authenticate(user *data.User, password string) bool {
 	if valid, err := user.PasswordMatches(password); err != nil || !valid {
 		return false
 	}
 
-	app.Session.Put(r.Context(), "user", user)
 	return true
 }
+
+// logUserIn puts a fully authenticated user in the session and sends them on; method
+// says how they logged in, for the audit log
+func (app *application) logUserIn(w http.ResponseWriter, r *http.Request, user *data.User, method string) {
+	// prevent fixation attack
+	_ = app.Session.RenewToken(r.Context())
+
+	app.Session.Put(r.Context(), "user", *user)
+
+	app.audit(r, data.AuditLogin, user.ID, method)
+
+	if app.mustEnrollTOTP(user) {
+		app.Session.Put(r.Context(), "flash", "Admins have to set up two-factor authentication")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	// redirect to some other page
+	app.Session.Put(r.Context(), "flash", "Successfully logged in")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
@@ -9,6 +9,9 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"webapp/pkg/data"
+	"webapp/pkg/passwords"
+	"webapp/pkg/repository/dbrepo"
 )
 
 func Test_application_handlers(t *testing.T) {
@@ -116,6 +119,17 @@ func TestApp_Login(t *testing.T) {
 			expectedStatusCode: http.StatusSeeOther,
 			expectedLoc:        "/",
 		},
+		{
+			name: "two-factor user",
+			postedData: url.Values{
+				"email": {
+					"2fa@example.com",
+				},
+				"password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/login/2fa",
+		},
 		{
 			name: "user not found",
 			postedData: url.Values{
@@ -138,7 +152,7 @@ func TestApp_Login(t *testing.T) {
 
 		rr := httptest.NewRecorder()
 
-		handler := http.HandlerFunc(app.Login)
+		handler := app.handle(app.Login)
 
 		handler.ServeHTTP(rr, req)
 
@@ -159,6 +173,56 @@ func TestApp_Login(t *testing.T) {
 	}
 }
 
+func TestApp_LoginRehashesPassword(t *testing.T) {
+	// the test admin has a bcrypt hash, so with argon2id configured login has to rehash it
+	argon2id, _ := passwords.New(passwords.Argon2id, 0, passwords.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1})
+
+	var tests = []struct {
+		name           string
+		hasher         *passwords.Hasher
+		expectedRehash bool
+	}{
+		{"outdated hash", argon2id, true},
+		{"current hash", passwords.Default, false},
+	}
+
+	oldAudit := app.Audit
+	defer func() { app.Audit = oldAudit; app.Hasher = passwords.Default }()
+
+	for _, e := range tests {
+		audit := &recordingAuditRepo{}
+		app.Audit = audit
+		app.Hasher = e.hasher
+
+		postedData := url.Values{"email": {"admin@example.com"}, "password": {"secret"}}
+
+		req, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.Login).ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != "/user/profile" {
+			t.Errorf("%s: expected login to succeed, but got redirected to %s", e.name, loc)
+		}
+
+		// the event is only recorded once the new hash is stored
+		rehashed := false
+
+		for _, event := range audit.events {
+			if event.Action == data.AuditPasswordRehashed && event.TargetUserID == 1 {
+				rehashed = true
+			}
+		}
+
+		if rehashed != e.expectedRehash {
+			t.Errorf("%s: expected rehash %t, but got %t", e.name, e.expectedRehash, rehashed)
+		}
+	}
+}
+
 // func TestAppHomeOld(t *testing.T) {
 // 	// create a request
 // 	req, _ := http.NewRequest("GET", "/", nil)
@@ -260,3 +324,85 @@ func addContextAndSessionToRequest(req *http.Request, app application) *http.Req
 
 	return req.WithContext(ctx)
 }
+
+func TestApp_LoginDatabaseDown(t *testing.T) {
+	audit := &recordingAuditRepo{}
+
+	oldAudit := app.Audit
+	app.Audit = audit
+	defer func() { app.Audit = oldAudit }()
+
+	postedData := url.Values{"email": {dbrepo.TestUnavailableEmail}, "password": {"secret"}}
+
+	req, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(postedData.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.Login).ServeHTTP(rr, req)
+
+	if msg := app.Session.GetString(req.Context(), "error"); msg != loginUnavailable {
+		t.Errorf("expected error %q, but got %q", loginUnavailable, msg)
+	}
+
+	// it's not a failed login when we could not even check it
+	if len(audit.events) != 0 {
+		t.Errorf("expected no audit events, but got %+v", audit.events)
+	}
+}
+
+func TestApp_LoginKeepsForm(t *testing.T) {
+	var tests = []struct {
+		name         string
+		postedData   url.Values
+		expectedHTML []string
+	}{
+		{
+			name:         "missing password",
+			postedData:   url.Values{"email": {"admin@example.com"}},
+			expectedHTML: []string{`value="admin@example.com"`, `form-control is-invalid`, "This field cannot be blank"},
+		},
+		{
+			name:         "wrong password",
+			postedData:   url.Values{"email": {"admin@example.com"}, "password": {"wrong"}},
+			expectedHTML: []string{`value="admin@example.com"`, "Invalid login"},
+		},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(e.postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.Login).ServeHTTP(rr, req)
+
+		kept, ok := app.Session.Get(req.Context(), "form").(sessionForm)
+
+		if !ok {
+			t.Fatalf("%s: no form in the session", e.name)
+		}
+
+		if kept.Data.Has("password") {
+			t.Errorf("%s: the password was kept in the session", e.name)
+		}
+
+		// the page we are redirected to shows the form again, once
+		for i := 0; i < 2; i++ {
+			home, _ := http.NewRequest(http.MethodGet, "/", nil)
+			home = home.WithContext(req.Context())
+
+			rr = httptest.NewRecorder()
+
+			http.HandlerFunc(app.Home).ServeHTTP(rr, home)
+
+			for _, html := range e.expectedHTML {
+				if found := strings.Contains(rr.Body.String(), html); found != (i == 0) {
+					t.Errorf("%s: expected %s on the page %t, but got %t", e.name, html, i == 0, found)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"webapp/pkg/storage"
+)
+
+const contextNonceKey contextKey = "csp_nonce"
+
+// CSP is a Content-Security-Policy, with the sources of each directive; directives without
+// sources, like sandbox, have none. script-src and style-src get the nonce of the request.
+type CSP map[string][]string
+
+// String returns the policy as a header value, with the directives sorted and nonce filled in
+func (c CSP) String(nonce string) string {
+	directives := make([]string, 0, len(c))
+
+	for d := range c {
+		directives = append(directives, d)
+	}
+
+	sort.Strings(directives)
+
+	parts := make([]string, len(directives))
+
+	for i, d := range directives {
+		sources := c[d]
+
+		if nonce != "" && (d == "script-src" || d == "style-src") {
+			sources = append(sources[:len(sources):len(sources)], "'nonce-"+nonce+"'")
+		}
+
+		parts[i] = strings.Join(append([]string{d}, sources...), " ")
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// SecurityHeaders are the headers secureHeaders sets on every response
+type SecurityHeaders struct {
+	// HSTSMaxAge is how long browsers only use HTTPS for us; 0 leaves the header out
+	HSTSMaxAge        time.Duration
+	ReferrerPolicy    string
+	PermissionsPolicy string
+	CSP               CSP
+}
+
+// defaultSecurityHeaders are the headers of pages. Bootstrap comes from its CDN; the QR code
+// of the two-factor setup is a data URL.
+func defaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{
+		HSTSMaxAge:        2 * 365 * 24 * time.Hour,
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		CSP: CSP{
+			"default-src":     {"'self'"},
+			"script-src":      {"'self'"},
+			"style-src":       {"'self'", "https://cdn.jsdelivr.net"},
+			"img-src":         {"'self'", "data:"},
+			"object-src":      {"'none'"},
+			"base-uri":        {"'self'"},
+			"form-action":     {"'self'"},
+			"frame-ancestors": {"'none'"},
+		},
+	}
+}
+
+// With returns a copy of h with the directives of csp replaced, for routes that need another
+// policy
+func (h SecurityHeaders) With(csp CSP) SecurityHeaders {
+	merged := make(CSP, len(h.CSP)+len(csp))
+
+	for d, sources := range h.CSP {
+		merged[d] = sources
+	}
+
+	for d, sources := range csp {
+		merged[d] = sources
+	}
+
+	h.CSP = merged
+
+	return h
+}
+
+// secureHeaders sets the headers of h on responses, with a new CSP nonce for each request.
+// Routes can use it again with other headers; the nonce stays the same, so templates that
+// already have it keep working.
+func (app *application) secureHeaders(h SecurityHeaders) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nonce, ok := r.Context().Value(contextNonceKey).(string)
+
+			if !ok {
+				nonce = newNonce()
+				r = r.WithContext(context.WithValue(r.Context(), contextNonceKey, nonce))
+			}
+
+			header := w.Header()
+
+			if h.HSTSMaxAge > 0 {
+				header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int(h.HSTSMaxAge.Seconds())))
+			}
+
+			header.Set("X-Content-Type-Options", "nosniff")
+			header.Set("Referrer-Policy", h.ReferrerPolicy)
+			header.Set("Permissions-Policy", h.PermissionsPolicy)
+			header.Set("Content-Security-Policy", h.CSP.String(nonce))
+
+			// for browsers that don't know frame-ancestors
+			switch strings.Join(h.CSP["frame-ancestors"], " ") {
+			case "'none'":
+				header.Set("X-Frame-Options", "DENY")
+			case "'self'":
+				header.Set("X-Frame-Options", "SAMEORIGIN")
+			default:
+				header.Del("X-Frame-Options")
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// cspNonce returns the nonce of the request, for script and style elements of templates
+func (app *application) cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(contextNonceKey).(string)
+
+	return nonce
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	// templates escape + and / in attributes; CSP takes the URL alphabet as well
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// storageOrigin returns the origin of links to stored images, or "" when this server serves
+// them, so pages can be allowed to show them
+func storageOrigin(s storage.Storage) string {
+	link, err := s.URL("origin", time.Minute)
+	if err != nil {
+		return ""
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/storage"
+)
+
+func Test_application_secureHeaders(t *testing.T) {
+	routes := app.routes()
+
+	nonces := make(map[string]bool)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		var expected = map[string]string{
+			"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+			"X-Content-Type-Options":    "nosniff",
+			"Referrer-Policy":           "strict-origin-when-cross-origin",
+			"Permissions-Policy":        "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+			"X-Frame-Options":           "DENY",
+		}
+
+		for name, value := range expected {
+			if rr.Header().Get(name) != value {
+				t.Errorf("expected %s: %s, but got %q", name, value, rr.Header().Get(name))
+			}
+		}
+
+		csp := rr.Header().Get("Content-Security-Policy")
+		m := regexp.MustCompile(`script-src 'self' 'nonce-([^']+)'`).FindStringSubmatch(csp)
+
+		if m == nil || !strings.Contains(csp, "frame-ancestors 'none'") {
+			t.Fatalf("expected a policy with a nonce, but got %q", csp)
+		}
+
+		// templates get the same nonce
+		if !strings.Contains(rr.Body.String(), `nonce="`+m[1]+`"`) {
+			t.Errorf("expected nonce %s in the page", m[1])
+		}
+
+		nonces[m[1]] = true
+	}
+
+	if len(nonces) != 2 {
+		t.Error("expected a new nonce for every request")
+	}
+}
+
+func Test_application_secureHeadersPerRoute(t *testing.T) {
+	signed, _ := app.Storage.URL("admin-new.jpg", time.Minute)
+
+	req, _ := http.NewRequest(http.MethodGet, signed, nil)
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	// uploads can't run scripts, even when opened on their own
+	if csp := rr.Header().Get("Content-Security-Policy"); csp != "default-src 'none'; sandbox" {
+		t.Errorf("expected the policy of uploads, but got %q", csp)
+	}
+
+	if rr.Header().Get("X-Frame-Options") != "" || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+}
+
+func Test_SecurityHeaders(t *testing.T) {
+	h := defaultSecurityHeaders()
+	h.HSTSMaxAge = 0
+
+	docs := h.With(CSP{"script-src": {"'self'", "https://cdn.example.com"}, "frame-ancestors": {"'self'"}})
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+
+	app.secureHeaders(h)(app.secureHeaders(docs)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).ServeHTTP(rr, req)
+
+	csp := rr.Header().Get("Content-Security-Policy")
+
+	if !strings.Contains(csp, "script-src 'self' https://cdn.example.com 'nonce-") || rr.Header().Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Errorf("expected the policy of the route, but got %q and %q", csp, rr.Header().Get("X-Frame-Options"))
+	}
+
+	if rr.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("expected no HSTS header")
+	}
+
+	// the route got a copy
+	if len(h.CSP["script-src"]) != 1 || len(h.CSP["frame-ancestors"]) != 1 || h.CSP["frame-ancestors"][0] != "'none'" {
+		t.Errorf("the defaults changed: %v", h.CSP)
+	}
+
+	if actual := (CSP{"style-src": {"'self'"}, "default-src": {"'none'"}}).String("abc"); actual != "default-src 'none'; style-src 'self' 'nonce-abc'" {
+		t.Errorf("unexpected policy %q", actual)
+	}
+}
+
+// remoteStorage has links to another host, like S3
+type remoteStorage struct {
+	storage.Storage
+}
+
+func (remoteStorage) URL(key string, expires time.Duration) (string, error) {
+	return "https://bucket.s3.example.com/" + key + "?X-Amz-Signature=abc", nil
+}
+
+func Test_storageOrigin(t *testing.T) {
+	if origin := storageOrigin(app.Storage); origin != "" {
+		t.Errorf("expected no origin for local storage, but got %s", origin)
+	}
+
+	if origin := storageOrigin(remoteStorage{}); origin != "https://bucket.s3.example.com" {
+		t.Errorf("expected the origin of the bucket, but got %s", origin)
+	}
+}
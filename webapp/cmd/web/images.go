@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/imaging"
+	"webapp/pkg/random"
+	"webapp/pkg/repository"
+	"webapp/pkg/storage"
+
+	"github.com/go-chi/chi"
+)
+
+// the largest image we accept
+const maxImageBytes = 10 << 20
+
+// how long links to images work; pages showing them are reloaded well within that
+const imageURLExpiry = time.Hour
+
+// UploadImage queues an image for the logged in user's gallery; once processed, it is their avatar
+func (app *application) UploadImage(w http.ResponseWriter, r *http.Request) error {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageBytes+1024)
+
+	err := r.ParseMultipartForm(maxImageBytes)
+
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Choose an image of at most 10 MB")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return nil
+	}
+
+	file, _, err := r.FormFile("image")
+
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Choose an image to upload")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return nil
+	}
+	defer file.Close()
+
+	content, err := readAll(file, maxImageBytes)
+
+	// a quick look at the header, so we can tell about obvious problems right away
+	if err == nil {
+		err = imaging.Check(content)
+	}
+
+	if errors.Is(err, imaging.ErrUnsupported) {
+		app.Session.Put(r.Context(), "error", "Only JPEG, PNG, GIF and WebP images can be uploaded")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return nil
+	}
+
+	if errors.Is(err, imaging.ErrTooLarge) {
+		app.Session.Put(r.Context(), "error", "Images can have at most 50 megapixels")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// processing takes a while, so it happens in the background; the original is kept
+	// under a random name until then
+	token, err := random.String()
+
+	if err != nil {
+		return err
+	}
+
+	key := "original-" + token
+
+	err = app.Storage.Put(r.Context(), key, bytes.NewReader(content), http.DetectContentType(content))
+
+	if err == nil {
+		_, err = app.Jobs.Enqueue(r.Context(), processImageJob, processImagePayload{UserID: user.ID, Key: key})
+
+		if err != nil {
+			_ = app.Storage.Delete(r.Context(), key)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "flash", "Image uploaded, it shows up in a moment")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+
+	return nil
+}
+
+// SetPrimaryImage makes one of the logged in user's images their avatar
+func (app *application) SetPrimaryImage(w http.ResponseWriter, r *http.Request) error {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return errNotFound
+	}
+
+	err = app.DB.SetPrimaryUserImage(user.ID, id)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return errNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "flash", "Avatar changed")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+
+	return nil
+}
+
+// DeleteImage removes one of the logged in user's images, and the files no other image uses
+func (app *application) DeleteImage(w http.ResponseWriter, r *http.Request) error {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err != nil {
+		return errNotFound
+	}
+
+	image, err := app.DB.GetUserImage(id)
+
+	// other users' images don't exist, as far as this user is concerned
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && image.UserID != user.ID) {
+		return errNotFound
+	}
+
+	if err == nil {
+		err = app.DB.DeleteUserImage(id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// only once the row is gone, so we never point at a missing file
+	for _, f := range image.FileNames() {
+		app.removeUpload(r.Context(), f)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Image deleted")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+
+	return nil
+}
+
+// processUpload makes the variants of an uploaded image and puts them into storage. The image
+// it returns points at the largest variant; the original is not kept, as it can have EXIF data
+// like where a photo was taken. Files are named after their content, so the same variant is
+// only stored once.
+func (app *application) processUpload(ctx context.Context, file io.Reader) (*data.UserImage, error) {
+	content, err := readAll(file, maxImageBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := imaging.Process(content, imaging.DefaultVariants, app.ImageFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	image := &data.UserImage{}
+
+	for _, o := range outputs {
+		key := storage.ContentKey(o.Data, app.ImageFormat.Ext())
+
+		if err := app.Storage.Put(ctx, key, bytes.NewReader(o.Data), app.ImageFormat.ContentType()); err != nil {
+			return nil, err
+		}
+
+		image.Variants = append(image.Variants, &data.UserImageVariant{
+			Name:        o.Variant,
+			FileName:    key,
+			ContentType: app.ImageFormat.ContentType(),
+			Width:       o.Width,
+			Height:      o.Height,
+		})
+	}
+
+	image.FileName = image.Variants[0].FileName
+
+	return image, nil
+}
+
+// readAll reads at most limit bytes of r, and fails with imaging.ErrTooLarge when there is more
+func readAll(r io.Reader, limit int64) ([]byte, error) {
+	content, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(content)) > limit {
+		return nil, imaging.ErrTooLarge
+	}
+
+	return content, nil
+}
+
+// removeUpload deletes a file of an image, unless another image still uses it
+func (app *application) removeUpload(ctx context.Context, fileName string) {
+	if fileName == "" {
+		return
+	}
+
+	inUse, err := app.DB.UserImageFileInUse(fileName)
+
+	// when in doubt, keep the file
+	if err != nil || inUse {
+		if err != nil {
+			log.Println("error checking image file:", err)
+		}
+
+		return
+	}
+
+	if err := app.Storage.Delete(ctx, fileName); err != nil {
+		log.Println("error removing image:", err)
+	}
+}
+
+// withImageURLs fills in signed links for images and their variants
+func (app *application) withImageURLs(images []*data.UserImage) error {
+	var err error
+
+	for _, i := range images {
+		if i.FileName != "" {
+			if i.URL, err = app.Storage.URL(i.FileName, imageURLExpiry); err != nil {
+				return err
+			}
+		}
+
+		for _, v := range i.Variants {
+			if v.URL, err = app.Storage.URL(v.FileName, imageURLExpiry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
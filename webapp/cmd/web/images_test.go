@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/storage"
+)
+
+// useTestStorage points the application at an empty local storage until the test ends
+func useTestStorage(t *testing.T) *storage.Local {
+	local, err := storage.NewLocal(t.TempDir(), "/images", []byte("test-signing-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := app.Storage
+	app.Storage = local
+	t.Cleanup(func() { app.Storage = old })
+
+	return local
+}
+
+// multipartImage returns a multipart body with content as the image field, and its content type
+func multipartImage(t *testing.T, content []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("image", "upload.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = part.Write(content)
+	_ = writer.Close()
+
+	return body, writer.FormDataContentType()
+}
+
+func TestApp_UploadImage(t *testing.T) {
+	uploads := useTestStorage(t)
+
+	var pngImage bytes.Buffer
+	_ = png.Encode(&pngImage, image.NewRGBA(image.Rect(0, 0, 800, 600)))
+
+	// a PNG that claims to be 100000 x 100000 pixels
+	var huge bytes.Buffer
+	_ = png.Encode(&huge, image.NewGray(image.Rect(0, 0, 1, 1)))
+
+	hugeImage := huge.Bytes()
+	binary.BigEndian.PutUint32(hugeImage[16:], 100000)
+	binary.BigEndian.PutUint32(hugeImage[20:], 100000)
+	binary.BigEndian.PutUint32(hugeImage[29:], crc32.ChecksumIEEE(hugeImage[12:29]))
+
+	// every upload is processed in the background, and stored as a large, medium and thumbnail JPEG
+	var tests = []struct {
+		name          string
+		content       []byte
+		expectedFlash string
+		expectedError string
+		expectedFiles int
+	}{
+		{"png", pngImage.Bytes(), "Image uploaded, it shows up in a moment", "", 3},
+		{"same png again", pngImage.Bytes(), "Image uploaded, it shows up in a moment", "", 3},
+		{"text", []byte("hello, world"), "", "Only JPEG, PNG, GIF and WebP images can be uploaded", 3},
+		{"too many pixels", hugeImage, "", "Images can have at most 50 megapixels", 3},
+	}
+
+	for _, e := range tests {
+		body, contentType := multipartImage(t, e.content)
+
+		req, _ := http.NewRequest(http.MethodPost, "/user/images", body)
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", contentType)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.UploadImage).ServeHTTP(rr, req)
+
+		if err := app.Jobs.Drain(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		if msg := app.Session.GetString(req.Context(), "flash"); msg != e.expectedFlash {
+			t.Errorf("%s: expected flash %q, but got %q", e.name, e.expectedFlash, msg)
+		}
+
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q, but got %q", e.name, e.expectedError, msg)
+		}
+
+		files, _ := os.ReadDir(uploads.Dir)
+
+		if len(files) != e.expectedFiles {
+			t.Errorf("%s: expected %d uploaded files, but got %d", e.name, e.expectedFiles, len(files))
+		}
+
+		// files are named after their content, and the original is not kept
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), ".jpg") || f.Name() == storage.ContentKey(pngImage.Bytes(), ".png") {
+				t.Errorf("%s: unexpected file %s", e.name, f.Name())
+			}
+		}
+	}
+}
+
+func TestApp_DeleteImage(t *testing.T) {
+	uploads := useTestStorage(t)
+
+	// the test repository has images 1 and 2 for the admin, and 3 and 4 for the 2fa user;
+	// 2 and 4 share admin-new.jpg, and 2 has two more variants
+	for _, f := range []string{"admin-old.jpg", "admin-new.jpg", "admin-new-medium.jpg", "admin-new-thumbnail.jpg", "2fa.jpg"} {
+		_ = os.WriteFile(path.Join(uploads.Dir, f), []byte("not really a jpg"), 0644)
+	}
+
+	var tests = []struct {
+		name           string
+		id             string
+		expectedStatus int
+		removedFiles   []string
+		keptFile       string
+	}{
+		{"own image", "1", http.StatusSeeOther, []string{"admin-old.jpg"}, ""},
+		{"own image with a shared file", "2", http.StatusSeeOther, []string{"admin-new-medium.jpg", "admin-new-thumbnail.jpg"}, "admin-new.jpg"},
+		{"image of another user", "3", http.StatusNotFound, nil, "2fa.jpg"},
+		{"unknown image", "9", http.StatusNotFound, nil, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/user/images/"+e.id+"/delete", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.DeleteImage).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		for _, f := range e.removedFiles {
+			if _, err := os.Stat(path.Join(uploads.Dir, f)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s was not removed", e.name, f)
+			}
+		}
+
+		if e.keptFile != "" {
+			if _, err := os.Stat(path.Join(uploads.Dir, e.keptFile)); err != nil {
+				t.Errorf("%s: %s was removed", e.name, e.keptFile)
+			}
+		}
+	}
+}
+
+func TestApp_SetPrimaryImage(t *testing.T) {
+	var tests = []struct {
+		name           string
+		id             string
+		expectedStatus int
+	}{
+		{"own image", "1", http.StatusSeeOther},
+		{"image of another user", "3", http.StatusNotFound},
+		{"bad id", "one", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/user/images/"+e.id+"/primary", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, e.id)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.SetPrimaryImage).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestApp_ProfileGallery(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.Profile).ServeHTTP(rr, req)
+
+	// the gallery shows the medium variant, when there is one
+	for _, expected := range []string{`src="/images/admin-new-medium.jpg?expires=`, `src="/images/admin-old.jpg?expires=`, "Use as avatar"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("did not find %s in the profile page", expected)
+		}
+	}
+}
+
+func TestApp_ServeImage(t *testing.T) {
+	uploads := useTestStorage(t)
+
+	_ = os.WriteFile(path.Join(uploads.Dir, "admin-new.jpg"), []byte("not really a jpg"), 0644)
+
+	signed, _ := uploads.URL("admin-new.jpg", time.Hour)
+
+	var tests = []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		{"signed link", signed, http.StatusOK},
+		{"unsigned link", "/images/admin-new.jpg", http.StatusForbidden},
+	}
+
+	routes := app.routes()
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, e.url, nil)
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
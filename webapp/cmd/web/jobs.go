@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/imaging"
+	"webapp/pkg/jobs"
+	"webapp/pkg/repository"
+	"webapp/pkg/storage"
+
+	"github.com/go-chi/chi"
+)
+
+// kinds of background jobs
+const (
+	purgeUsersJob   = "users.purge"
+	processImageJob = "images.process"
+	sendEmailJob    = "email.send"
+)
+
+// processImagePayload is an uploaded image waiting to be processed, stored under Key
+type processImagePayload struct {
+	UserID int    `json:"user_id"`
+	Key    string `json:"key"`
+}
+
+// registerJobs tells the job runner what to do with each kind of job, and which run on a schedule
+func (app *application) registerJobs(purgeInterval, purgeAfter time.Duration) {
+	// remove deleted users once they can't be restored anymore
+	app.Jobs.Handle(purgeUsersJob, func(ctx context.Context, job *data.Job) error {
+		return app.purgeDeletedUsers(purgeAfter)
+	})
+	app.Jobs.Every(purgeUsersJob, purgeInterval)
+
+	app.Jobs.Handle(processImageJob, app.processImage)
+	app.Jobs.Handle(sendEmailJob, app.deliverEmail)
+}
+
+// processImage makes the variants of an uploaded image, adds it to the user's gallery, and
+// removes the original
+func (app *application) processImage(ctx context.Context, job *data.Job) error {
+	var payload processImagePayload
+
+	if err := jobs.Decode(job, &payload); err != nil {
+		return err
+	}
+
+	original, err := app.Storage.Get(ctx, payload.Key)
+
+	if errors.Is(err, storage.ErrNotFound) {
+		return jobs.Permanent(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	image, err := app.processUpload(ctx, original)
+	original.Close()
+
+	if errors.Is(err, imaging.ErrUnsupported) || errors.Is(err, imaging.ErrTooLarge) {
+		return jobs.Permanent(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	image.UserID = payload.UserID
+	image.IsPrimary = true
+
+	_, err = app.DB.InsertUserImage(*image)
+
+	if err != nil {
+		for _, f := range image.FileNames() {
+			app.removeUpload(ctx, f)
+		}
+
+		return err
+	}
+
+	if err := app.Storage.Delete(ctx, payload.Key); err != nil {
+		log.Println("error removing original image:", err)
+	}
+
+	return nil
+}
+
+// AdminJobs returns background jobs as JSON, newest first, filtered by status and kind
+func (app *application) AdminJobs(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	form := NewForm(q)
+
+	filter := data.JobFilter{
+		Kind:   q.Get("kind"),
+		Status: q.Get("status"),
+		Limit:  form.intValue("limit"),
+	}
+
+	switch filter.Status {
+	case "", data.JobPending, data.JobRunning, data.JobDone, data.JobDead:
+	default:
+		form.Errors.Add("status", "Unknown status")
+	}
+
+	if !form.Valid() {
+		return clientError(http.StatusBadRequest, "invalid filter", form.Errors)
+	}
+
+	list, err := app.Jobs.Repo.Jobs(r.Context(), filter)
+
+	if err != nil {
+		return err
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, list)
+
+	return nil
+}
+
+// AdminRetryJob queues a dead job again, with a new set of attempts
+func (app *application) AdminRetryJob(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+	if err != nil {
+		return clientError(http.StatusNotFound, "no dead job with this id", nil)
+	}
+
+	err = app.Jobs.Repo.RequeueJob(r.Context(), id)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return clientError(http.StatusNotFound, "no dead job with this id", nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditJobRetried, 0, fmt.Sprintf("job %d", id))
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/jobs"
+	"webapp/pkg/repository/dbrepo"
+)
+
+// useTestJobs gives the application an empty job queue until the test ends
+func useTestJobs(t *testing.T) *dbrepo.MemoryJobRepo {
+	repo := dbrepo.NewMemoryJobRepo()
+
+	old := app.Jobs
+	app.Jobs = jobs.New(repo)
+	app.Jobs.Backoff = func(int) time.Duration { return 0 }
+	app.registerJobs(time.Hour, 30*24*time.Hour)
+	t.Cleanup(func() { app.Jobs = old })
+
+	return repo
+}
+
+func TestApp_processImage(t *testing.T) {
+	uploads := useTestStorage(t)
+
+	_ = os.WriteFile(path.Join(uploads.Dir, "original-text"), []byte("hello, world"), 0644)
+
+	var tests = []struct {
+		name           string
+		payload        string
+		expectedStatus string
+		expectedError  string
+	}{
+		{"missing original", `{"user_id": 1, "key": "original-gone"}`, data.JobDead, "not found"},
+		{"not an image", `{"user_id": 1, "key": "original-text"}`, data.JobDead, "unsupported image"},
+		{"bad payload", `{"user_id": "one"}`, data.JobDead, "bad payload"},
+	}
+
+	for _, e := range tests {
+		repo := useTestJobs(t)
+
+		_, _ = repo.EnqueueJob(context.Background(), data.Job{Kind: processImageJob, Payload: []byte(e.payload)})
+
+		if err := app.Jobs.Drain(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		list, _ := repo.Jobs(context.Background(), data.JobFilter{Kind: processImageJob})
+
+		if len(list) != 1 || list[0].Status != e.expectedStatus || !strings.Contains(list[0].LastError, e.expectedError) {
+			t.Errorf("%s: expected a %s job with error %q, but got %+v", e.name, e.expectedStatus, e.expectedError, list)
+		}
+
+		// we don't try again when it can't work
+		if len(list) == 1 && list[0].Attempts != 1 {
+			t.Errorf("%s: expected 1 attempt, but got %d", e.name, list[0].Attempts)
+		}
+	}
+}
+
+func TestApp_AdminJobs(t *testing.T) {
+	repo := useTestJobs(t)
+
+	_, _ = repo.EnqueueJob(context.Background(), data.Job{Kind: processImageJob})
+	_, _ = repo.EnqueueJob(context.Background(), data.Job{Kind: purgeUsersJob})
+
+	var tests = []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedJobs   int
+	}{
+		{"all", "", http.StatusOK, 2},
+		{"by kind", "?kind=" + purgeUsersJob, http.StatusOK, 1},
+		{"dead", "?status=dead", http.StatusOK, 0},
+		{"unknown status", "?status=stuck", http.StatusBadRequest, 0},
+		{"bad limit", "?limit=many", http.StatusBadRequest, 0},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/api/admin/jobs"+e.query, nil)
+		rr := httptest.NewRecorder()
+
+		apiHandler(app.AdminJobs).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var list []*data.Job
+		_ = json.Unmarshal(rr.Body.Bytes(), &list)
+
+		if len(list) != e.expectedJobs {
+			t.Errorf("%s: expected %d jobs, but got %d", e.name, e.expectedJobs, len(list))
+		}
+	}
+}
+
+func TestApp_AdminRetryJob(t *testing.T) {
+	repo := useTestJobs(t)
+
+	dead, _ := repo.EnqueueJob(context.Background(), data.Job{Kind: processImageJob, Payload: []byte(`{"user_id": "one"}`)})
+	_ = app.Jobs.Drain(context.Background())
+
+	pending, _ := repo.EnqueueJob(context.Background(), data.Job{Kind: purgeUsersJob, RunAt: time.Now().Add(time.Hour)})
+
+	audit := &recordingAuditRepo{}
+
+	oldAudit := app.Audit
+	app.Audit = audit
+	defer func() { app.Audit = oldAudit }()
+
+	var tests = []struct {
+		name           string
+		id             int64
+		expectedStatus int
+	}{
+		{"dead job", dead, http.StatusNoContent},
+		{"job that is not dead", pending, http.StatusNotFound},
+		{"unknown job", 99, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		id := strconv.FormatInt(e.id, 10)
+
+		req, _ := http.NewRequest(http.MethodPost, "/api/admin/jobs/"+id+"/retry", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addIDToRequest(req, id)
+
+		rr := httptest.NewRecorder()
+
+		apiHandler(app.AdminRetryJob).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	list, _ := repo.Jobs(context.Background(), data.JobFilter{Status: data.JobPending, Kind: processImageJob})
+
+	if len(list) != 1 || list[0].Attempts != 0 {
+		t.Errorf("expected the dead job to be pending with no attempts, but got %+v", list)
+	}
+
+	if len(audit.events) != 1 || audit.events[0].Action != data.AuditJobRetried {
+		t.Errorf("expected one %s audit event, but got %+v", data.AuditJobRetried, audit.events)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// the largest JSON body we read
+const maxJSONBytes = 1 << 20
+
+// Problem describes an error in the format of RFC 7807, for clients that asked for JSON
+type Problem struct {
+	Type     string              `json:"type"`
+	Title    string              `json:"title"`
+	Status   int                 `json:"status"`
+	Detail   string              `json:"detail,omitempty"`
+	Instance string              `json:"instance,omitempty"`
+	Errors   map[string][]string `json:"errors,omitempty"`
+	// RequestID finds the request in the logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeProblem sends an error as application/problem+json; errors are the fields that are
+// wrong, with their messages
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string, errors map[string][]string) error {
+	out, err := json.Marshal(Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Errors:    errors,
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(out)
+
+	return err
+}
+
+// writeJSON sends data as JSON with the given status code
+func (app *application) writeJSON(w http.ResponseWriter, status int, data any) error {
+	out, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(out)
+
+	return err
+}
+
+// readJSON decodes a request body with exactly one JSON value into data, rejecting unknown fields
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(data); err != nil {
+		return fmt.Errorf("invalid JSON body: %s", err)
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return fmt.Errorf("body must contain a single JSON value")
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"webapp/pkg/data"
+	"webapp/pkg/i18n"
+)
+
+// localeNames are the names of the languages we support, in their own language
+var localeNames = map[string]string{
+	"en": "English",
+	"de": "Deutsch",
+	"sr": "Srpski",
+}
+
+// localeName returns the name of a locale for the language switch
+func localeName(locale string) string {
+	if name, ok := localeNames[locale]; ok {
+		return name
+	}
+
+	return locale
+}
+
+// tr returns the translator localize picked for the request, or the default one outside of it
+func (app *application) tr(r *http.Request) *i18n.Translator {
+	if tr, ok := r.Context().Value(contextTranslatorKey).(*i18n.Translator); ok {
+		return tr
+	}
+
+	return app.I18n.Translator(app.I18n.Default)
+}
+
+// SetLocale switches the language of the interface. It is kept in the session, and with the
+// user when logged in, so it follows them to other browsers.
+func (app *application) SetLocale(w http.ResponseWriter, r *http.Request) error {
+	var input struct {
+		Locale string `form:"locale" validate:"required"`
+	}
+
+	form, err := app.decodeForm(w, r, &input)
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	form.OneOf("locale", app.I18n.Locales()...)
+
+	if !form.Valid() {
+		return badRequest(nil)
+	}
+
+	app.Session.Put(r.Context(), "locale", input.Locale)
+
+	if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+		if err := app.DB.SetUserLocale(user.ID, input.Locale); err != nil {
+			return err
+		}
+
+		user.Locale = input.Locale
+		app.Session.Put(r.Context(), "user", user)
+	}
+
+	http.Redirect(w, r, localReferer(r), http.StatusSeeOther)
+
+	return nil
+}
+
+// localReferer returns the path of the page the request came from, or / when it has none;
+// only the path is used, so a forged Referer can't send users to another site
+func localReferer(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+
+	// //host and /\host are other sites to browsers
+	if err != nil || len(u.Path) == 0 || u.Path[0] != '/' || (len(u.Path) > 1 && (u.Path[1] == '/' || u.Path[1] == '\\')) {
+		return "/"
+	}
+
+	return (&url.URL{Path: u.Path, RawQuery: u.RawQuery}).String()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"webapp/pkg/data"
+)
+
+func TestApp_localize(t *testing.T) {
+	var tests = []struct {
+		name           string
+		acceptLanguage string
+		sessionLocale  string
+		user           *data.User
+		expected       string
+	}{
+		{"nothing", "", "", nil, "en"},
+		{"browser", "fr, de-DE;q=0.8", "", nil, "de"},
+		{"session", "de", "sr", nil, "sr"},
+		{"user", "de", "en", &data.User{ID: 1, Locale: "sr"}, "sr"},
+		{"user without a choice", "de", "", &data.User{ID: 1}, "de"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", e.acceptLanguage)
+		req = addContextAndSessionToRequest(req, app)
+
+		if e.sessionLocale != "" {
+			app.Session.Put(req.Context(), "locale", e.sessionLocale)
+		}
+
+		if e.user != nil {
+			app.Session.Put(req.Context(), "user", *e.user)
+		}
+
+		var actual string
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actual = app.tr(r).Locale
+		})
+
+		rr := httptest.NewRecorder()
+
+		app.localize(next).ServeHTTP(rr, req)
+
+		if actual != e.expected || rr.Header().Get("Content-Language") != e.expected {
+			t.Errorf("%s: expected %s, but got %s (Content-Language %s)", e.name, e.expected, actual, rr.Header().Get("Content-Language"))
+		}
+
+		if rr.Header().Get("Vary") != "Accept-Language" {
+			t.Errorf("%s: expected Vary: Accept-Language, but got %q", e.name, rr.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestApp_SetLocale(t *testing.T) {
+	var tests = []struct {
+		name             string
+		locale           string
+		referer          string
+		user             *data.User
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"logged out", "de", "http://localhost:8080/user/profile?tab=images", nil, http.StatusSeeOther, "/user/profile?tab=images"},
+		{"logged in", "sr", "", &data.User{ID: 1}, http.StatusSeeOther, "/"},
+		{"other site", "de", "http://localhost:8080//evil.example.com/", nil, http.StatusSeeOther, "/"},
+		{"backslash", "de", `http://localhost:8080/\evil.example.com/`, nil, http.StatusSeeOther, "/"},
+		{"unsupported", "fr", "", nil, http.StatusBadRequest, ""},
+		{"missing", "", "", nil, http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{"locale": {e.locale}}
+
+		req, _ := http.NewRequest(http.MethodPost, "/locale", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Referer", e.referer)
+		req = addContextAndSessionToRequest(req, app)
+
+		if e.user != nil {
+			app.Session.Put(req.Context(), "user", *e.user)
+		}
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.SetLocale).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected location %q, but got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+
+		if e.expectedStatus != http.StatusSeeOther {
+			continue
+		}
+
+		if locale := app.Session.GetString(req.Context(), "locale"); locale != e.locale {
+			t.Errorf("%s: expected %s in the session, but got %q", e.name, e.locale, locale)
+		}
+
+		// the choice goes with the user to other browsers
+		if user, ok := app.Session.Get(req.Context(), "user").(data.User); e.user != nil && (!ok || user.Locale != e.locale) {
+			t.Errorf("%s: expected the user to have %s, but got %+v", e.name, e.locale, user)
+		}
+	}
+}
+
+func TestApp_renderTranslated(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	req = addContextAndSessionToRequest(req, app)
+
+	app.Session.Put(req.Context(), "error", "Log in first")
+
+	rr := httptest.NewRecorder()
+
+	app.localize(http.HandlerFunc(app.Home)).ServeHTTP(rr, req)
+
+	for _, expected := range []string{`<html lang="de">`, "Startseite", "Bitte melde dich zuerst an", "Deutsch", "Srpski"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected %q in the page", expected)
+		}
+	}
+}
+
+func TestApp_renderAdminTranslated(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/admin/users?admin=x", nil)
+	req.Header.Set("Accept-Language", "sr")
+	req = addContextAndSessionToRequest(req, app)
+
+	app.Session.Put(req.Context(), "deleted_user", 2)
+
+	rr := httptest.NewRecorder()
+
+	app.localize(app.handle(app.AdminUsersPage)).ServeHTTP(rr, req)
+
+	for _, expected := range []string{"Korisnici", "Neispravan filter", "Mora biti 1 ili 0", "Poništi brisanje korisnika 2", "0 korisnika", "Ime"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected %q in the page", expected)
+		}
+	}
+}
+
+func TestApp_decodeFormTranslated(t *testing.T) {
+	postedData := url.Values{"email": {"jack"}, "password": {"abc"}}
+
+	req, _ := http.NewRequest(http.MethodPost, "/signup", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "sr")
+	req = addContextAndSessionToRequest(req, app)
+
+	var input struct {
+		Email    string `form:"email" validate:"email"`
+		Password string `form:"password" validate:"min=3"`
+		Name     string `form:"name" validate:"required,max=2"`
+	}
+
+	var form *Form
+
+	app.localize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		form, _ = app.decodeForm(w, r, &input)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	var tests = []struct {
+		field    string
+		expected string
+	}{
+		{"email", "Mora biti imejl adresa"},
+		{"name", "Ovo polje ne sme biti prazno"},
+	}
+
+	for _, e := range tests {
+		if actual := form.Errors.Get(e.field); actual != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.field, e.expected, actual)
+		}
+	}
+
+	// plurals follow the number in the message
+	form = &Form{Data: url.Values{"name": {"Jack"}}, Errors: formErrors{}, Messages: app.I18n.Translator("sr").Lookup}
+	form.MaxLength("name", 2)
+
+	if actual := form.Errors.Get("name"); actual != "Sme imati najviše 2 znaka" {
+		t.Errorf("expected the few form, but got %q", actual)
+	}
+}
@@ -1,34 +1,210 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/encryption"
+	"webapp/pkg/i18n"
+	"webapp/pkg/imaging"
+	"webapp/pkg/jobs"
+	"webapp/pkg/mail"
+	"webapp/pkg/oidc"
+	"webapp/pkg/passwords"
 	"webapp/pkg/repository"
 	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/signing"
+	"webapp/pkg/storage"
 
 	"github.com/alexedwards/scs/v2"
 )
 
 type application struct {
-	DSN     string
-	DB      repository.DatabaseRepo
-	Session *scs.SessionManager
+	DSN        string
+	DB         repository.DatabaseRepo
+	Audit      repository.AuditRepo
+	Session    *scs.SessionManager
+	Encryption *encryption.Encryption
+	// RequireAdmin2FA forces admins to set up two-factor authentication before using /user pages
+	RequireAdmin2FA bool
+	// OIDCProviders are the external identity providers users can log in with, by name
+	OIDCProviders map[string]*oidc.Provider
+	// Hasher hashes passwords, and tells us when a stored hash should be upgraded
+	Hasher *passwords.Hasher
+	// Storage keeps uploaded images
+	Storage storage.Storage
+	// ImageFormat is what uploaded images are converted to
+	ImageFormat imaging.Format
+	// Jobs runs slow work, like processing images, in the background
+	Jobs *jobs.Runner
+	// Mailer sends email, like the links that verify addresses
+	Mailer mail.Mailer
+	// Signer signs the links we send by email
+	Signer *signing.Signer
+	// BaseURL is where users reach the application, for links in email
+	BaseURL string
+	// RequireVerifiedEmail keeps users with an unverified address out of /user pages
+	RequireVerifiedEmail bool
+	// I18n has the translations of the interface
+	I18n *i18n.Catalog
+	// Headers are the security headers of responses
+	Headers SecurityHeaders
+	// APICORS are the other origins that may call /api routes, like a SPA on another subdomain
+	APICORS CORSConfig
 }
 
 func main() {
 	// register type with application
 	gob.Register(data.User{})
+	gob.Register(sessionForm{})
 
 	// set up an app config
-	app := application{}
+	app := application{Headers: defaultSecurityHeaders(), APICORS: defaultAPICORS()}
 
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5434 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection")
 
+	var encryptionKey, oidcConfig, passwordAlgorithm string
+	var bcryptCost int
+	var argon2Memory, argon2Iterations, argon2Parallelism uint
+	var purgeAfter, purgeInterval time.Duration
+	var jobWorkers int
+	var storageBackend, uploadDir, urlSigningKey, imageFormat string
+	var s3Config storage.S3Config
+	var linkSigningKey, mailer, mailDir, localesDir string
+	var smtpMailer mail.SMTP
+	var corsOrigins string
+
+	flag.StringVar(&encryptionKey, "encryption-key", "", "Key used to encrypt two-factor secrets; required, at least 32 random characters")
+	flag.BoolVar(&app.RequireAdmin2FA, "require-admin-2fa", false, "Force admin users to enable two-factor authentication")
+	flag.StringVar(&oidcConfig, "oidc-config", "", "Path to a JSON file with OpenID Connect providers")
+	flag.StringVar(&passwordAlgorithm, "password-algorithm", passwords.Bcrypt, "Password hashing algorithm: bcrypt or argon2id")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", passwords.Default.BcryptCost, "bcrypt cost for new password hashes")
+	flag.UintVar(&argon2Memory, "argon2-memory", uint(passwords.DefaultArgon2Params.Memory), "argon2id memory in KiB")
+	flag.UintVar(&argon2Iterations, "argon2-iterations", uint(passwords.DefaultArgon2Params.Iterations), "argon2id iterations")
+	flag.UintVar(&argon2Parallelism, "argon2-parallelism", uint(passwords.DefaultArgon2Params.Parallelism), "argon2id parallelism")
+	flag.DurationVar(&purgeAfter, "purge-after", 30*24*time.Hour, "How long deleted users can be restored before they are removed for good")
+	flag.DurationVar(&purgeInterval, "purge-interval", time.Hour, "How often to remove deleted users")
+	flag.IntVar(&jobWorkers, "job-workers", 2, "How many background jobs run at the same time")
+
+	flag.StringVar(&storageBackend, "storage", "local", "Where uploaded images are stored: local or s3")
+	flag.StringVar(&uploadDir, "upload-dir", "./uploads", "Directory for uploaded images, with local storage")
+	flag.StringVar(&urlSigningKey, "url-signing-key", "", "Key used to sign links to uploaded images; required with local storage, at least 32 random characters")
+	flag.StringVar(&imageFormat, "image-format", string(imaging.JPEG), "Format uploaded images are converted to: jpeg or webp")
+	flag.StringVar(&s3Config.Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 compatible endpoint, with s3 storage")
+	flag.StringVar(&s3Config.Region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&s3Config.Bucket, "s3-bucket", "", "S3 bucket for uploaded images")
+	flag.StringVar(&s3Config.AccessKey, "s3-access-key", "", "S3 access key")
+	flag.StringVar(&s3Config.SecretKey, "s3-secret-key", "", "S3 secret key")
+	flag.BoolVar(&s3Config.PathStyle, "s3-path-style", false, "Put the bucket in the path instead of the host name, as MinIO needs")
+
+	flag.StringVar(&app.BaseURL, "base-url", "http://localhost:8081", "Where users reach the application, for links in email")
+	flag.StringVar(&linkSigningKey, "link-signing-key", "", "Key used to sign links sent by email; required, at least 32 random characters")
+	flag.BoolVar(&app.RequireVerifiedEmail, "require-verified-email", false, "Keep users out of /user pages until they verify their email address")
+	flag.StringVar(&mailer, "mailer", "file", "How email is sent: smtp, or file to write it to a directory")
+	flag.StringVar(&mailDir, "mail-dir", "./mail", "Directory for email, with the file mailer")
+	flag.StringVar(&smtpMailer.Addr, "smtp-addr", "localhost:25", "SMTP server host:port")
+	flag.StringVar(&smtpMailer.Username, "smtp-user", "", "SMTP user name, if the server needs a login")
+	flag.StringVar(&smtpMailer.Password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&smtpMailer.From, "mail-from", "webapp@localhost", "Sender address of email")
+	flag.DurationVar(&app.Headers.HSTSMaxAge, "hsts-max-age", app.Headers.HSTSMaxAge, "How long browsers only use HTTPS for us; 0 turns HSTS off")
+	flag.StringVar(&localesDir, "locales-dir", "./locales", "Directory with a JSON file of translations per language")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "Comma separated origins that may call the API from browsers, like https://*.example.com")
+	flag.BoolVar(&app.APICORS.AllowCredentials, "cors-credentials", app.APICORS.AllowCredentials, "Let API calls from other origins send the session cookie")
+	flag.DurationVar(&app.APICORS.MaxAge, "cors-max-age", app.APICORS.MaxAge, "How long browsers may cache the answer to a CORS preflight")
+
 	flag.Parse()
 
+	for _, origin := range strings.Split(corsOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			app.APICORS.AllowedOrigins = append(app.APICORS.AllowedOrigins, origin)
+		}
+	}
+
+	requireKey("encryption-key", encryptionKey)
+	app.Encryption = encryption.New(encryptionKey)
+
+	// before they are converted to their smaller types, where too large values wrap around
+	if argon2Memory > passwords.MaxArgon2Memory || argon2Iterations > passwords.MaxArgon2Iterations || argon2Parallelism > passwords.MaxArgon2Parallelism {
+		log.Fatalf("-argon2-memory can be at most %d, -argon2-iterations %d, and -argon2-parallelism %d",
+			passwords.MaxArgon2Memory, passwords.MaxArgon2Iterations, passwords.MaxArgon2Parallelism)
+	}
+
+	hasher, err := passwords.New(passwordAlgorithm, bcryptCost, passwords.Argon2Params{
+		Memory:      uint32(argon2Memory),
+		Iterations:  uint32(argon2Iterations),
+		Parallelism: uint8(argon2Parallelism),
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Hasher = hasher
+
+	switch storageBackend {
+	case "local":
+		requireKey("url-signing-key", urlSigningKey)
+		app.Storage, err = storage.NewLocal(uploadDir, "/images", []byte(urlSigningKey))
+	case "s3":
+		app.Storage, err = storage.NewS3(s3Config)
+	default:
+		err = fmt.Errorf("unknown storage %q", storageBackend)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// pages show images from wherever they are stored
+	if origin := storageOrigin(app.Storage); origin != "" {
+		app.Headers.CSP["img-src"] = append(app.Headers.CSP["img-src"], origin)
+	}
+
+	switch mailer {
+	case "smtp":
+		app.Mailer = &smtpMailer
+	case "file":
+		app.Mailer = &mail.File{Dir: mailDir, From: smtpMailer.From}
+	default:
+		log.Fatalf("unknown mailer %q", mailer)
+	}
+
+	requireKey("link-signing-key", linkSigningKey)
+	app.Signer = signing.New(linkSigningKey)
+	app.BaseURL = strings.TrimSuffix(app.BaseURL, "/")
+
+	app.I18n, err = i18n.Load(os.DirFS(localesDir), "en")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.ImageFormat, err = imaging.ParseFormat(imageFormat)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.OIDCProviders = make(map[string]*oidc.Provider)
+
+	if oidcConfig != "" {
+		configs, err := oidc.LoadConfig(oidcConfig)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, c := range configs {
+			app.OIDCProviders[c.Name] = oidc.NewProvider(c)
+		}
+	}
+
 	conn, err := app.connectToDb()
 
 	if err != nil {
@@ -38,10 +214,21 @@ func main() {
 	defer conn.Close()
 
 	// now we can use all db methods
-	app.DB = &dbrepo.PostgresDBRepo{
-		DB: conn,
+	repo := &dbrepo.PostgresDBRepo{
+		DB:     conn,
+		Hasher: app.Hasher,
 	}
 
+	app.DB = repo
+	app.Audit = repo
+
+	// background jobs are queued in the database, and shared by every instance
+	app.Jobs = jobs.New(repo)
+	app.Jobs.Workers = jobWorkers
+	app.registerJobs(purgeInterval, purgeAfter)
+
+	go app.Jobs.Run(context.Background())
+
 	// get a session manager
 	app.Session = getSession()
 
@@ -58,3 +245,14 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// minKeyLength is how long keys from flags are, at least
+const minKeyLength = 32
+
+// requireKey stops the application when the key of a flag is missing or too short. Keys
+// have no default, because anyone who knows a default can forge what the key protects.
+func requireKey(name, key string) {
+	if len(key) < minKeyLength {
+		log.Fatalf("-%s needs a secret of at least %d random characters", name, minKeyLength)
+	}
+}
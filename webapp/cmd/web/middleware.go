@@ -2,15 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
 )
 
 type contextKey string
 
 const contextUserKey contextKey = "user_ip"
 
+const contextTranslatorKey contextKey = "translator"
+
+const contextFormatKey contextKey = "format"
+
+// contextFreshUserKey holds the logged in user as auth read them from the database
+const contextFreshUserKey contextKey = "fresh_user"
+
 func (app *application) ipFromContext(ctx context.Context) string {
 	return ctx.Value(contextUserKey).(string)
 }
@@ -64,14 +74,157 @@ func getIP(r *http.Request) (string, error) {
 	return ip, nil
 }
 
+// freshUser reads the logged in user from the database, as the copy in the session may be
+// from before an admin changed or deleted them. It returns repository.ErrNotFound when the user
+// is not logged in, or deleted.
+func (app *application) freshUser(r *http.Request) (*data.User, error) {
+	if user, ok := r.Context().Value(contextFreshUserKey).(*data.User); ok {
+		return user, nil
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+
+	return app.DB.GetUser(user.ID)
+}
+
+// auth sends visitors that are not logged in to the login form; clients that ask for JSON
+// can't log in there, so they get a 401 instead. Users deleted since they logged in are logged
+// out.
 func (app *application) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !app.Session.Exists(r.Context(), "user") {
+		user, err := app.freshUser(r)
+
+		if errors.Is(err, repository.ErrNotFound) && app.Session.Exists(r.Context(), "user") {
+			_ = app.Session.Destroy(r.Context())
+		}
+
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if user == nil {
+			if negotiate(r) == formatJSON {
+				app.errorPage(w, r, http.StatusUnauthorized, "Log in first", nil)
+				return
+			}
+
 			app.Session.Put(r.Context(), "error", "Log in first")
 			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 			return
 		}
 
+		// later middleware and handlers don't have to read the user again
+		ctx := context.WithValue(r.Context(), contextFreshUserKey, user)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireTOTP sends admins that are forced into 2FA, but have not enrolled yet, to the setup page.
+// It answers with 303, so a blocked POST becomes a GET of the page instead of a POST to it;
+// clients that ask for JSON get a 403.
+func (app *application) requireTOTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+
+		if ok && app.mustEnrollTOTP(&user) {
+			if negotiate(r) == formatJSON {
+				app.errorPage(w, r, http.StatusForbidden, "Set up two-factor authentication first", nil)
+				return
+			}
+
+			app.Session.Put(r.Context(), "error", "Set up two-factor authentication first")
+			http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireVerifiedEmail sends users with an unverified address to the email page, when the
+// application requires verified addresses. The session may still have the user from before
+// they opened the link in another browser, so it is refreshed before turning them away. Like
+// requireTOTP, it answers with 303, so a blocked upload isn't sent on to the email form, and
+// with a 403 to clients that ask for JSON.
+func (app *application) requireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+
+		if ok && app.RequireVerifiedEmail && !user.EmailVerified() {
+			fresh, err := app.DB.GetUser(user.ID)
+
+			if err != nil || !fresh.EmailVerified() {
+				if negotiate(r) == formatJSON {
+					app.errorPage(w, r, http.StatusForbidden, "Verify your email address first", nil)
+					return
+				}
+
+				app.Session.Put(r.Context(), "error", "Verify your email address first")
+				http.Redirect(w, r, "/user/email", http.StatusSeeOther)
+				return
+			}
+
+			app.Session.Put(r.Context(), "user", *fresh)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localize picks the language of the request: the one the user chose, when logged in or
+// for this session, or else the best match of what the browser asks for
+func (app *application) localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := app.Session.Get(r.Context(), "user").(data.User)
+
+		locale := app.I18n.Match(user.Locale, app.Session.GetString(r.Context(), "locale"), r.Header.Get("Accept-Language"))
+
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+
+		ctx := context.WithValue(r.Context(), contextTranslatorKey, app.I18n.Translator(locale))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// jsonOnly makes the answers of an API JSON, errors included, whatever the client accepts
+func jsonOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextFormatKey, formatJSON)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// adminOnly lets only admin users through; others are sent to their profile with a 303, so a
+// blocked POST becomes a GET of it, or get a 403 when they ask for JSON. Whether they are an admin comes from the database, so admins lose
+// their rights as soon as someone takes them away.
+func (app *application) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.freshUser(r)
+
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if user == nil || user.IsAdmin != 1 {
+			if negotiate(r) == formatJSON {
+				app.errorPage(w, r, http.StatusForbidden, "You are not allowed to see that page", nil)
+				return
+			}
+
+			app.Session.Put(r.Context(), "error", "You are not allowed to see that page")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
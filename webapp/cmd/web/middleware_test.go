@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -94,32 +95,85 @@ func Test_app_auth(t *testing.T) {
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
 	var tests = []struct {
-		name   string
-		isAuth bool
+		name           string
+		userID         int
+		accept         string
+		expectedStatus int
 	}{
-		{"logged in", true},
-		{"not logged in", false},
+		{"logged in", 1, "", http.StatusOK},
+		{"not logged in", 0, "", http.StatusTemporaryRedirect},
+		{"JSON client not logged in", 0, "application/json", http.StatusUnauthorized},
+		{"deleted since logging in", 9, "", http.StatusTemporaryRedirect},
 	}
 
 	for _, e := range tests {
 		handlerToTest := app.auth(nextHandler)
 		req, _ := http.NewRequest(http.MethodGet, "http://testing", nil)
+		req.Header.Set("Accept", e.accept)
 		req = addContextAndSessionToRequest(req, app)
 
-		if e.isAuth {
-			app.Session.Put(req.Context(), "user", data.User{ID: 1})
+		if e.userID != 0 {
+			app.Session.Put(req.Context(), "user", data.User{ID: e.userID})
 		}
 
 		rr := httptest.NewRecorder()
 
 		handlerToTest.ServeHTTP(rr, req)
 
-		if e.isAuth && rr.Code != http.StatusOK {
-			t.Errorf("%s: expected status code of 200, but got %d", e.name, rr.Code)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
 		}
 
-		if !e.isAuth && rr.Code != http.StatusTemporaryRedirect {
-			t.Errorf("%s: expected status %d, but got %d", e.name, http.StatusTemporaryRedirect, rr.Code)
+		if e.expectedStatus != http.StatusOK && app.Session.Exists(req.Context(), "user") {
+			t.Errorf("%s: expected the user to be logged out", e.name)
+		}
+	}
+}
+
+func Test_app_verifyCSRF(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var tests = []struct {
+		name           string
+		method         string
+		contentType    string
+		body           string
+		query          string
+		header         bool
+		expectedStatus int
+	}{
+		{"get", http.MethodGet, "", "", "", false, http.StatusOK},
+		{"form with token", http.MethodPost, "application/x-www-form-urlencoded", "csrf_token=TOKEN", "", false, http.StatusOK},
+		{"form without token", http.MethodPost, "application/x-www-form-urlencoded", "email=jack", "", false, http.StatusForbidden},
+		{"form with wrong token", http.MethodPost, "application/x-www-form-urlencoded", "csrf_token=other", "", false, http.StatusForbidden},
+		{"no body", http.MethodPost, "", "", "", false, http.StatusForbidden},
+		{"text", http.MethodPost, "text/plain", "csrf_token=TOKEN", "", false, http.StatusForbidden},
+		{"header", http.MethodPost, "text/plain", "", "", true, http.StatusOK},
+		{"multipart with query", http.MethodPost, "multipart/form-data; boundary=x", "", "?csrf_token=TOKEN", false, http.StatusOK},
+		{"multipart without", http.MethodPost, "multipart/form-data; boundary=x", "", "", false, http.StatusForbidden},
+		{"json", http.MethodPatch, "application/json", "{}", "", false, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/user/email"+e.query, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		token := app.csrfToken(req.Context())
+
+		req.Body = io.NopCloser(strings.NewReader(strings.ReplaceAll(e.body, "TOKEN", token)))
+		req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, "TOKEN", token)
+		req.Header.Set("Content-Type", e.contentType)
+
+		if e.header {
+			req.Header.Set("X-CSRF-Token", token)
+		}
+
+		rr := httptest.NewRecorder()
+
+		app.verifyCSRF(nextHandler).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
 		}
 	}
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"webapp/pkg/data"
+	"webapp/pkg/openapi"
+)
+
+// apiDocument describes the JSON API; routes validate requests against it, and tests responses
+var apiDocument = newAPIDocument()
+
+// newAPIDocument describes the JSON API. Schemas come from the types handlers send and read;
+// what the types can't tell, like the values a field takes, is added here, and has to follow
+// the validation of the handlers.
+func newAPIDocument() *openapi.Document {
+	doc := openapi.New("webapp", "1.0.0",
+		"The admin API, for admins that have set up two-factor authentication when it is required, "+
+			"and the data of the profile page.")
+
+	doc.Components.SecuritySchemes["session"] = &openapi.SecurityScheme{
+		Type:        "apiKey",
+		In:          "cookie",
+		Name:        "session",
+		Description: "The session of a logged in user; log in with the form at /",
+	}
+
+	one := 1
+	binary := []any{0, 1}
+
+	user := doc.Define("User", data.User{})
+	userSchema := doc.Components.Schemas["User"]
+	userSchema.Properties["email"].Format = "email"
+	userSchema.Properties["is_admin"].Enum = binary
+
+	userList := doc.Define("UserList", data.UserList{})
+	hit := doc.Define("UserSearchHit", userSearchHit{})
+	auditEvent := doc.Define("AuditEvent", data.AuditEvent{})
+	job := doc.Define("Job", data.Job{})
+	doc.Components.Schemas["Job"].Properties["status"].Enum = []any{data.JobPending, data.JobRunning, data.JobDone, data.JobDead}
+
+	doc.Define("UserImageVariant", data.UserImageVariant{})
+	image := doc.Define("UserImage", data.UserImage{})
+
+	patch := doc.Define("UserPatch", userPatchRequest{})
+	patchSchema := doc.Components.Schemas["UserPatch"]
+	// the handler needs the version, but a nil pointer is how it finds out it's missing
+	patchSchema.Properties["version"].Nullable = false
+	patchSchema.Properties["first_name"].MinLength = &one
+	patchSchema.Properties["last_name"].MinLength = &one
+	patchSchema.Properties["email"].Format = "email"
+	patchSchema.Properties["is_admin"].Enum = binary
+	// readJSON doesn't take unknown fields
+	patchSchema.AdditionalProperties = false
+
+	problem := doc.Define("Problem", Problem{})
+
+	pageSchema := doc.SchemaOf(pageJSON{})
+	pageSchema.Properties["data"] = &openapi.Schema{
+		Type:       "object",
+		Properties: map[string]*openapi.Schema{"images": openapi.ArrayOf(image)},
+		Required:   []string{"images"},
+	}
+	doc.Components.Schemas["ProfilePage"] = pageSchema
+	profile := openapi.Ref("ProfilePage")
+
+	session := []map[string][]string{{"session": {}}}
+
+	respond := func(description string, schema *openapi.Schema) *openapi.Response {
+		return &openapi.Response{Description: description, Content: openapi.JSON(schema)}
+	}
+
+	// errors are problems, see writeProblem
+	fail := func(description string) *openapi.Response {
+		return &openapi.Response{
+			Description: description,
+			Content:     map[string]*openapi.MediaType{"application/problem+json": {Schema: problem}},
+		}
+	}
+
+	// what the middleware of /api/admin does with requests it doesn't let through
+	unauthorized := fail("Not logged in")
+	forbidden := fail("Not an admin, or without two-factor authentication when it is required")
+	invalid := fail("The request does not match this document, or is invalid otherwise; errors are by field")
+	failed := fail("Something went wrong on our side")
+
+	doc.Add(http.MethodGet, "/api/admin/audit-events", &openapi.Operation{
+		OperationID: "listAuditEvents",
+		Summary:     "The audit log, newest first",
+		Tags:        []string{"audit"},
+		Security:    session,
+		Parameters: []*openapi.Parameter{
+			openapi.QueryParam("user_id", "Events of this user, as actor or target", openapi.Integer(0)),
+			openapi.QueryParam("action", "Events with this action", openapi.String("")),
+			openapi.QueryParam("from", "Events on or after this day", openapi.String("date")),
+			openapi.QueryParam("to", "Events on or before this day", openapi.String("date")),
+			openapi.QueryParam("limit", "At most this many events", openapi.Integer(0)),
+			openapi.QueryParam("offset", "Skip this many events", openapi.Integer(0)),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The events", openapi.ArrayOf(auditEvent)),
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodGet, "/api/admin/users", &openapi.Operation{
+		OperationID: "listUsers",
+		Summary:     "One page of users",
+		Description: "Page with page and per_page, or pass next_cursor back as after to page by keyset.",
+		Tags:        []string{"users"},
+		Security:    session,
+		Parameters: []*openapi.Parameter{
+			openapi.QueryParam("q", "Part of the first name, last name or email", openapi.String("")),
+			openapi.QueryParam("admin", "Only admins (1) or only other users (0)", &openapi.Schema{Type: "integer", Enum: binary}),
+			openapi.QueryParam("created_from", "Users created on or after this day", openapi.String("date")),
+			openapi.QueryParam("created_to", "Users created on or before this day", openapi.String("date")),
+			openapi.QueryParam("sort", "Sort by this column; last_name when left out", openapi.String("", userSortColumns...)),
+			openapi.QueryParam("order", "Sort order", openapi.String("", "asc", "desc")),
+			openapi.QueryParam("page", "Page to return, from 1", openapi.Integer(0)),
+			openapi.QueryParam("per_page", "Users per page, at most 100", openapi.Integer(0)),
+			openapi.QueryParam("after", "The next_cursor of the page before", openapi.String("")),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The page", userList),
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodGet, "/api/admin/users/search", &openapi.Operation{
+		OperationID: "searchUsers",
+		Summary:     "Users matching a search, best matches first",
+		Tags:        []string{"users"},
+		Security:    session,
+		Parameters: []*openapi.Parameter{
+			openapi.QueryParam("q", "Parts of names and email; without it, nobody matches", openapi.String("")),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The matches, with the matching parts marked in HTML", openapi.ArrayOf(hit)),
+			"401": unauthorized,
+			"403": forbidden,
+			"500": failed,
+		},
+	})
+
+	userID := openapi.PathParam("id", openapi.Integer(1))
+
+	doc.Add(http.MethodGet, "/api/admin/users/{id}", &openapi.Operation{
+		OperationID: "getUser",
+		Summary:     "One user, with the version updates need",
+		Tags:        []string{"users"},
+		Security:    session,
+		Parameters:  []*openapi.Parameter{userID},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The user", user),
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"404": fail("There is no such user"),
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodPatch, "/api/admin/users/{id}", &openapi.Operation{
+		OperationID: "patchUser",
+		Summary:     "Change fields of a user",
+		Description: "Only the fields in the body change, and only if the user is still at the version in the body. " +
+			"A new email address replaces the old one once the user verifies it.",
+		Tags:        []string{"users"},
+		Security:    session,
+		Parameters:  []*openapi.Parameter{userID},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(patch)},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The changed user", user),
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"404": fail("There is no such user"),
+			"409": fail("Someone else changed the user since the version in the body; get it again"),
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodDelete, "/api/admin/users/{id}", &openapi.Operation{
+		OperationID: "deleteUser",
+		Summary:     "Delete a user",
+		Description: "Deleted users can be restored until the purge removes them for good.",
+		Tags:        []string{"users"},
+		Security:    session,
+		Parameters:  []*openapi.Parameter{userID},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The user is deleted"},
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"404": fail("There is no such user"),
+			"409": fail("Admins can't delete themselves"),
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodPost, "/api/admin/users/{id}/restore", &openapi.Operation{
+		OperationID: "restoreUser",
+		Summary:     "Undo the delete of a user",
+		Tags:        []string{"users"},
+		Security:    session,
+		Parameters:  []*openapi.Parameter{userID},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The restored user", user),
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"404": fail("There is no deleted user with this id"),
+			"409": fail("Another user has taken the email address of the user since it was deleted"),
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodGet, "/api/admin/jobs", &openapi.Operation{
+		OperationID: "listJobs",
+		Summary:     "Background jobs, newest first",
+		Tags:        []string{"jobs"},
+		Security:    session,
+		Parameters: []*openapi.Parameter{
+			openapi.QueryParam("kind", "Jobs of this kind, like email.send", openapi.String("")),
+			openapi.QueryParam("status", "Jobs in this state", openapi.String("", data.JobPending, data.JobRunning, data.JobDone, data.JobDead)),
+			openapi.QueryParam("limit", "At most this many jobs", openapi.Integer(0)),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": respond("The jobs", openapi.ArrayOf(job)),
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodPost, "/api/admin/jobs/{id}/retry", &openapi.Operation{
+		OperationID: "retryJob",
+		Summary:     "Queue a dead job again, with a new set of attempts",
+		Tags:        []string{"jobs"},
+		Security:    session,
+		Parameters:  []*openapi.Parameter{openapi.PathParam("id", &openapi.Schema{Type: "integer", Format: "int64"})},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The job is queued"},
+			"400": invalid,
+			"401": unauthorized,
+			"403": forbidden,
+			"404": fail("There is no dead job with this id"),
+			"500": failed,
+		},
+	})
+
+	doc.Add(http.MethodGet, "/user/profile", &openapi.Operation{
+		OperationID: "getProfile",
+		Summary:     "The images of the logged in user",
+		Description: "This is a page; send Accept: application/json to get its data.",
+		Tags:        []string{"profile"},
+		Security:    session,
+		Responses: map[string]*openapi.Response{
+			"200": respond("The data of the page", profile),
+			"401": unauthorized,
+			"403": fail("Without a verified email address when it is required, or two-factor authentication"),
+			"500": failed,
+		},
+	})
+
+	return doc
+}
+
+// OpenAPI sends the description of the JSON API, for clients to generate code from
+func (app *application) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	_ = app.writeJSON(w, http.StatusOK, apiDocument)
+}
+
+// APIDocsPage shows the description of the JSON API to people
+func (app *application) APIDocsPage(w http.ResponseWriter, r *http.Request) error {
+	td := make(map[string]any)
+	td["doc"] = apiDocument
+	td["endpoints"] = apiDocument.Endpoints()
+
+	_ = app.render(w, r, "api-docs.page.gohtml", &TemplateData{Data: td})
+
+	return nil
+}
+
+// validateRequests answers requests that don't match doc with a 400, and the fields that
+// are wrong. Requests without an operation in doc go through, for the router to answer.
+func (app *application) validateRequests(doc *openapi.Document) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxJSONBytes)
+
+			err := doc.ValidateRequest(r)
+
+			var verr *openapi.ValidationError
+
+			switch {
+			case err == nil, errors.Is(err, openapi.ErrNoOperation):
+				next.ServeHTTP(w, r)
+			case errors.As(err, &verr):
+				app.handleError(w, r, clientError(http.StatusBadRequest, "invalid request", verr.Errors))
+			default:
+				app.handleError(w, r, badRequest(err))
+			}
+		})
+	}
+}
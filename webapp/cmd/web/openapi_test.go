@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"webapp/pkg/data"
+
+	"github.com/go-chi/chi"
+)
+
+// loggedInAs returns the session cookie of user, and the CSRF token of the session
+func loggedInAs(t *testing.T, user *data.User) (*http.Cookie, string) {
+	ctx, err := app.Session.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.Session.Put(ctx, "user", *user)
+	csrf := app.csrfToken(ctx)
+
+	token, _, err := app.Session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Cookie{Name: app.Session.Cookie.Name, Value: token}, csrf
+}
+
+// apiHandler wraps a handler of the API like its routes do, so its errors are problems
+func apiHandler(h handlerFunc) http.HandlerFunc {
+	return jsonOnly(app.handle(h)).ServeHTTP
+}
+
+func Test_apiDocument_routes(t *testing.T) {
+	routes := app.routes().(chi.Routes)
+
+	// every operation has a route
+	for _, e := range apiDocument.Endpoints() {
+		if !routeExists(e.Path, e.Method, routes) {
+			t.Errorf("%s %s is in the document, but not a route", e.Method, e.Path)
+		}
+	}
+
+	// and every route of the API is in the document
+	_ = chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if strings.HasPrefix(route, "/api/admin/") {
+			if op, _ := apiDocument.Find(method, route); op == nil {
+				t.Errorf("%s %s is not in the document", method, route)
+			}
+		}
+
+		return nil
+	})
+}
+
+func TestApp_OpenAPI(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/api/openapi.json", nil)
+	req.Header.Set("Origin", "https://spa.example.com")
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("expected the document as JSON, but got %s", err)
+	}
+
+	if doc.OpenAPI != "3.0.3" || doc.Paths["/api/admin/users/{id}"]["patch"] == nil {
+		t.Errorf("expected an OpenAPI 3 document with patchUser, but got %s", rr.Body)
+	}
+
+	// SDKs of the SPA get it, too
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://spa.example.com" {
+		t.Errorf("expected CORS headers, but got %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/docs", nil)
+	rr = httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	for _, expected := range []string{`id="patchUser"`, `<code>/api/admin/users/{id}</code>`, `id="schema-UserPatch"`, "array of UserSearchHit"} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected %s in the docs page", expected)
+		}
+	}
+}
+
+// TestApp_API sends requests through the routes, and checks that each answer is one the
+// document describes
+func TestApp_API(t *testing.T) {
+	repo := useTestJobs(t)
+
+	dead, _ := repo.EnqueueJob(context.Background(), data.Job{Kind: processImageJob, Payload: []byte(`{"user_id": "one"}`)})
+	_ = app.Jobs.Drain(context.Background())
+
+	admin, _ := app.DB.GetUser(1)
+	cookie, csrf := loggedInAs(t, admin)
+
+	var tests = []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		loggedIn       bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"audit events", "GET", "/api/admin/audit-events?action=login", "", true, http.StatusOK, `"action":"login"`},
+		{"audit events with bad filter", "GET", "/api/admin/audit-events?from=yesterday", "", true, http.StatusBadRequest, `"from":["Must be a date like 2022-08-19"]`},
+		{"users", "GET", "/api/admin/users?q=example&sort=email&order=desc", "", true, http.StatusOK, `"total":2`},
+		{"users with bad filter", "GET", "/api/admin/users?sort=password&page=-1", "", true, http.StatusBadRequest, `"page":["Must be at least 0"]`},
+		{"not logged in", "GET", "/api/admin/users", "", false, http.StatusUnauthorized, "Log in first"},
+		{"search", "GET", "/api/admin/users/search?q=adm", "", true, http.StatusOK, `"first_name":"\u003cmark\u003eAdm\u003c/mark\u003ein"`},
+		{"user", "GET", "/api/admin/users/2", "", true, http.StatusOK, `"totp_enabled":true`},
+		{"unknown user", "GET", "/api/admin/users/9", "", true, http.StatusNotFound, "user not found"},
+		{"user id that is not a number", "GET", "/api/admin/users/two", "", true, http.StatusBadRequest, `"id":["Must be a whole number"]`},
+		{"patch user", "PATCH", "/api/admin/users/2", `{"version":1,"first_name":"Jack"}`, true, http.StatusOK, `"first_name":"Jack"`},
+		{"patch without version", "PATCH", "/api/admin/users/2", `{"first_name":"Jack"}`, true, http.StatusBadRequest, `"version":["This field is required"]`},
+		{"patch with null version", "PATCH", "/api/admin/users/2", `{"version":null}`, true, http.StatusBadRequest, `"version":["Must not be null"]`},
+		{"patch with unknown field", "PATCH", "/api/admin/users/2", `{"version":1,"password":"x"}`, true, http.StatusBadRequest, `"password":["Unknown field"]`},
+		{"patch with bad fields", "PATCH", "/api/admin/users/2", `{"version":1,"last_name":"","is_admin":2}`, true, http.StatusBadRequest, `"is_admin":["Must be one of 0, 1"]`},
+		{"patch that conflicts", "PATCH", "/api/admin/users/2", `{"version":3,"first_name":"Jack"}`, true, http.StatusConflict, "changed by someone else"},
+		{"patch unknown user", "PATCH", "/api/admin/users/9", `{"version":1}`, true, http.StatusNotFound, "user not found"},
+		{"delete user", "DELETE", "/api/admin/users/2", "", true, http.StatusNoContent, ""},
+		{"delete yourself", "DELETE", "/api/admin/users/1", "", true, http.StatusConflict, "can't delete themselves"},
+		{"delete unknown user", "DELETE", "/api/admin/users/9", "", true, http.StatusNotFound, "user not found"},
+		{"restore user", "POST", "/api/admin/users/1/restore", "", true, http.StatusOK, `"id":1`},
+		{"restore user that is not deleted", "POST", "/api/admin/users/9/restore", "", true, http.StatusNotFound, "no deleted user"},
+		{"restore user whose address was taken", "POST", "/api/admin/users/3/restore", "", true, http.StatusConflict, "another user has the email address"},
+		{"jobs", "GET", "/api/admin/jobs?status=dead", "", true, http.StatusOK, `"status":"dead"`},
+		{"jobs with bad filter", "GET", "/api/admin/jobs?status=lost", "", true, http.StatusBadRequest, `"status":["Must be one of pending, running, done, dead"]`},
+		{"retry job", "POST", "/api/admin/jobs/" + strconv.FormatInt(dead, 10) + "/retry", "", true, http.StatusNoContent, ""},
+		{"retry unknown job", "POST", "/api/admin/jobs/99/retry", "", true, http.StatusNotFound, "no dead job"},
+		{"profile", "GET", "/user/profile", "", true, http.StatusOK, `"images":[`},
+	}
+
+	covered := make(map[string]bool)
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set(csrfHeader, csrf)
+
+		if e.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		if e.loggedIn {
+			req.AddCookie(cookie)
+		}
+
+		rr := httptest.NewRecorder()
+
+		app.routes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d: %s", e.name, e.expectedStatus, rr.Code, rr.Body)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: expected %s in the body, but got %s", e.name, e.expectedBody, rr.Body)
+		}
+
+		if err := apiDocument.ValidateResponse(req.Method, req.URL.Path, rr.Code, rr.Header(), rr.Body.Bytes()); err != nil {
+			t.Errorf("%s: the answer does not match the document: %s", e.name, err)
+		}
+
+		op, _ := apiDocument.Find(req.Method, req.URL.Path)
+		if op != nil {
+			covered[op.OperationID] = true
+		}
+	}
+
+	for _, e := range apiDocument.Endpoints() {
+		if !covered[e.OperationID] {
+			t.Errorf("expected a test of %s", e.OperationID)
+		}
+	}
+}
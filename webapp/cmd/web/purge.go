@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+	"webapp/pkg/data"
+)
+
+// purgeDeletedUsers permanently removes users that were soft deleted more than retention ago,
+// and the files of their images
+func (app *application) purgeDeletedUsers(retention time.Duration) error {
+	before := time.Now().Add(-retention)
+
+	count, files, err := app.DB.PurgeDeletedUsers(before)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		app.removeUpload(context.Background(), f)
+	}
+
+	if count > 0 && app.Audit != nil {
+		_, err = app.Audit.InsertAuditEvent(data.AuditEvent{
+			Action:  data.AuditUserPurged,
+			IP:      "purge job",
+			Details: fmt.Sprintf("%d users deleted before %s", count, before.Format(time.RFC3339)),
+		})
+
+		if err != nil {
+			log.Println("error writing audit event:", err)
+		}
+	}
+
+	return nil
+}
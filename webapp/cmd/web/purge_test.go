@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+)
+
+func TestApp_purgeDeletedUsers(t *testing.T) {
+	// the test repository reports one purged user, with an image called purged.jpg
+	uploads := useTestStorage(t)
+
+	image := path.Join(uploads.Dir, "purged.jpg")
+	_ = os.WriteFile(image, []byte("not really a jpg"), 0644)
+
+	audit := &recordingAuditRepo{}
+
+	oldAudit := app.Audit
+	app.Audit = audit
+	defer func() { app.Audit = oldAudit }()
+
+	err := app.purgeDeletedUsers(30 * 24 * time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Error("image of purged user still exists")
+	}
+
+	if len(audit.events) != 1 || audit.events[0].Action != data.AuditUserPurged {
+		t.Errorf("expected one %s audit event, but got %+v", data.AuditUserPurged, audit.events)
+	}
+}
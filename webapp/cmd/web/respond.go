@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"webapp/pkg/data"
+)
+
+// the formats respond can answer in
+const (
+	formatHTML = "html"
+	formatJSON = "json"
+)
+
+// negotiate picks the format the client prefers by its Accept header. Browsers, and clients
+// that take anything, get HTML; JSON has to be asked for over it.
+func negotiate(r *http.Request) string {
+	// routes that only speak one format, see jsonOnly
+	if format, ok := r.Context().Value(contextFormatKey).(string); ok {
+		return format
+	}
+
+	accept := r.Header.Get("Accept")
+
+	if accept == "" {
+		return formatHTML
+	}
+
+	html := acceptQuality(accept, "text/html")
+	json := acceptQuality(accept, "application/json")
+
+	// clients asking for errors in the JSON format want the rest in JSON as well
+	if q := acceptQuality(accept, "application/problem+json"); q > json {
+		json = q
+	}
+
+	if json > html {
+		return formatJSON
+	}
+
+	return formatHTML
+}
+
+// acceptQuality returns the q value that the most specific range in an Accept header gives
+// mediaType, or 0 if none matches
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+
+	best, quality := -1, 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		specificity := -1
+
+		switch mediaRange {
+		case mediaType:
+			specificity = 2
+		case typ + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		}
+
+		if specificity <= best {
+			continue
+		}
+
+		q := 1.0
+
+		if s, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				q = f
+			}
+		}
+
+		best, quality = specificity, q
+	}
+
+	return quality
+}
+
+// respond answers with the page t, or with its data as JSON to clients that prefer JSON.
+// JSON clients get a problem (see writeProblem) instead, when status is an error or the form
+// has errors; as a page shows those errors with a 200, that becomes a 422 for them.
+func (app *application) respond(w http.ResponseWriter, r *http.Request, status int, t string, td *TemplateData) error {
+	w.Header().Add("Vary", "Accept")
+
+	if negotiate(r) == formatJSON {
+		app.fillTemplateData(r, td)
+
+		return app.respondJSON(w, r, status, td)
+	}
+
+	// parse template from disc, with the partials and the functions templates can use
+	parsedTemplate, err := app.parseTemplate(r, t, td)
+
+	// execute the template, passing the date, if any; into a buffer, so an error halfway
+	// doesn't leave half a page
+	var buf bytes.Buffer
+
+	if err == nil {
+		app.fillTemplateData(r, td)
+		err = parsedTemplate.Execute(&buf, td)
+	}
+
+	// template not found, or error in template
+	if err != nil {
+		if t == errorPage {
+			log.Println(err)
+			http.Error(w, http.StatusText(status), status)
+			return err
+		}
+
+		app.serverError(w, r, err)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	_, err = buf.WriteTo(w)
+
+	return err
+}
+
+// fillTemplateData adds what every page shows to td: the messages and form kept in the
+// session, the user and the language
+func (app *application) fillTemplateData(r *http.Request, td *TemplateData) {
+	tr := app.tr(r)
+
+	td.IP = app.ipFromContext(r.Context())
+
+	// messages from the session win over the ones handlers pass in
+	if msg := app.Session.PopString(r.Context(), "error"); msg != "" {
+		td.Error = msg
+	}
+
+	if msg := app.Session.PopString(r.Context(), "flash"); msg != "" {
+		td.Flash = msg
+	}
+
+	// messages are keyed by their English text
+	if td.Error != "" {
+		td.Error = tr.T(td.Error)
+	}
+
+	if td.Flash != "" {
+		td.Flash = tr.T(td.Flash)
+	}
+
+	td.Locale = tr.Locale
+	td.Locales = app.I18n.Locales()
+
+	if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+		td.User = user
+	}
+
+	// a form from before a redirect is only shown once, even if the handler has its own
+	if form := app.popForm(r.Context()); td.Form == nil {
+		td.Form = form
+	}
+}
+
+// pageJSON is what JSON clients get instead of a page
+type pageJSON struct {
+	Data   map[string]any `json:"data,omitempty"`
+	User   *data.User     `json:"user,omitempty"`
+	Flash  string         `json:"flash,omitempty"`
+	Locale string         `json:"locale"`
+}
+
+// respondJSON sends the data of a page, or a problem when it shows an error
+func (app *application) respondJSON(w http.ResponseWriter, r *http.Request, status int, td *TemplateData) error {
+	var errors map[string][]string
+
+	if td.Form != nil && !td.Form.Valid() {
+		errors = td.Form.Errors
+
+		if status < http.StatusBadRequest {
+			status = http.StatusUnprocessableEntity
+		}
+	}
+
+	if status >= http.StatusBadRequest {
+		return app.writeProblem(w, r, status, td.Error, errors)
+	}
+
+	page := pageJSON{Data: td.Data, Flash: td.Flash, Locale: td.Locale}
+
+	if td.User.ID != 0 {
+		page.User = &td.User
+	}
+
+	return app.writeJSON(w, status, page)
+}
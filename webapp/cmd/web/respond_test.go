@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"webapp/pkg/data"
+)
+
+func Test_negotiate(t *testing.T) {
+	var tests = []struct {
+		accept   string
+		expected string
+	}{
+		{"", formatHTML},
+		{"*/*", formatHTML},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatHTML},
+		{"application/json", formatJSON},
+		{"application/problem+json", formatJSON},
+		{"application/json, */*;q=0.1", formatJSON},
+		{"application/json;q=0.5, text/html", formatHTML},
+		{"text/*;q=0.2, application/*", formatJSON},
+		{"application/json;q=0", formatHTML},
+		{"image/png", formatHTML},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", e.accept)
+
+		if actual := negotiate(req); actual != e.expected {
+			t.Errorf("%q: expected %s, but got %s", e.accept, e.expected, actual)
+		}
+	}
+}
+
+func TestApp_ProfileJSON(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/user/profile", nil)
+	req.Header.Set("Accept", "application/json")
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1, Email: "admin@example.com"})
+	app.Session.Put(req.Context(), "flash", "Image deleted")
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.Profile).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" || rr.Header().Get("Vary") != "Accept" {
+		t.Fatalf("expected JSON, but got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	var page struct {
+		Data struct {
+			Images []data.UserImage `json:"images"`
+		} `json:"data"`
+		User   data.User `json:"user"`
+		Flash  string    `json:"flash"`
+		Locale string    `json:"locale"`
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+
+	if page.User.Email != "admin@example.com" || page.Flash != "Image deleted" || page.Locale != "en" || len(page.Data.Images) == 0 {
+		t.Errorf("unexpected page %s", rr.Body)
+	}
+}
+
+func TestApp_ChangeEmailProblem(t *testing.T) {
+	postedData := url.Values{"email": {"two"}}
+
+	req, _ := http.NewRequest(http.MethodPost, "/user/email", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/problem+json, application/json")
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 2})
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.ChangeEmail).ServeHTTP(rr, req)
+
+	// a page with form errors is a failed request to an API client
+	if rr.Code != http.StatusUnprocessableEntity || rr.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("expected a 422 problem, but got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	var problem Problem
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Problem{
+		Type:     "about:blank",
+		Title:    "Unprocessable Entity",
+		Status:   http.StatusUnprocessableEntity,
+		Detail:   "Please correct the errors below",
+		Instance: "/user/email",
+		Errors:   map[string][]string{"email": {"Must be an email address"}},
+	}
+
+	if !reflect.DeepEqual(problem, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, problem)
+	}
+}
+
+func TestApp_respondStatus(t *testing.T) {
+	var tests = []struct {
+		name                string
+		accept              string
+		expectedContentType string
+	}{
+		{"browser", "text/html", "text/html; charset=utf-8"},
+		{"api client", "application/json", "application/problem+json"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", e.accept)
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+
+		_ = app.respond(rr, req, http.StatusNotFound, "home.page.gohtml", &TemplateData{Data: map[string]any{}, Error: "Log in first"})
+
+		if rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != e.expectedContentType {
+			t.Errorf("%s: expected 404 %s, but got %d %s", e.name, e.expectedContentType, rr.Code, rr.Header().Get("Content-Type"))
+		}
+
+		if !strings.Contains(rr.Body.String(), "Log in first") {
+			t.Errorf("%s: expected the error in the body, but got %s", e.name, rr.Body)
+		}
+	}
+}
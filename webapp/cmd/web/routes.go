@@ -2,28 +2,138 @@ package main
 
 import (
 	"net/http"
+	"webapp/pkg/storage"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// routeNames are the routes templates link to with url, so links follow when a path changes
+var routeNames = map[string]string{
+	"home":                    "/",
+	"login":                   "/login",
+	"login.2fa":               "/login/2fa",
+	"login.oidc":              "/login/oidc/{provider}",
+	"locale":                  "/locale",
+	"user.email":              "/user/email",
+	"user.email.verify":       "/user/email/verify",
+	"user.profile":            "/user/profile",
+	"user.images":             "/user/images",
+	"user.images.primary":     "/user/images/{id}/primary",
+	"user.images.delete":      "/user/images/{id}/delete",
+	"user.2fa.setup":          "/user/2fa/setup",
+	"user.2fa.recovery-codes": "/user/2fa/recovery-codes",
+	"user.2fa.disable":        "/user/2fa/disable",
+	"admin.audit":             "/admin/audit",
+	"admin.users":             "/admin/users",
+	"admin.users.search":      "/admin/users/search",
+	"admin.user":              "/admin/users/{id}",
+	"admin.user.delete":       "/admin/users/{id}/delete",
+	"admin.user.restore":      "/admin/users/{id}/restore",
+	"api.docs":                "/api/docs",
+	"api.openapi":             "/api/openapi.json",
+}
+
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	// register middleware (must be before routes)
-	mux.Use(middleware.Recoverer)
+	mux.Use(middleware.RequestID)
+	mux.Use(app.secureHeaders(app.Headers))
+	mux.Use(app.recoverPanic)
 	mux.Use(app.addIPToContext)
 	mux.Use(app.Session.LoadAndSave)
+	mux.Use(app.localize)
+	// again, so panics of handlers get the error page, which needs the session and the language
+	mux.Use(app.recoverPanic)
+	mux.Use(app.verifyCSRF)
+
+	// subrouters take these over, so they have to be set before them
+	mux.NotFound(app.notFound)
+	mux.MethodNotAllowed(app.methodNotAllowed)
 
 	// register routes
 	mux.Get("/", app.Home)
-	mux.Post("/login", app.Login)
+	mux.Post("/login", app.handle(app.Login))
+	mux.Get("/login/2fa", app.TwoFactorPage)
+	mux.Post("/login/2fa", app.handle(app.TwoFactorLogin))
+	mux.Get("/login/oidc/{provider}", app.handle(app.OIDCLogin))
+	mux.Get("/login/oidc/{provider}/callback", app.handle(app.OIDCCallback))
+	mux.Get("/verify-email", app.handle(app.VerifyEmail))
+	mux.Post("/locale", app.handle(app.SetLocale))
 
 	mux.Route("/user", func(mux chi.Router) {
 		mux.Use(app.auth)
-		mux.Get("/profile", app.Profile)
+
+		mux.Get("/2fa/setup", app.handle(app.TwoFactorSetupPage))
+		mux.Post("/2fa/setup", app.handle(app.TwoFactorSetup))
+		mux.Post("/2fa/recovery-codes", app.handle(app.TwoFactorRecoveryCodes))
+		mux.Post("/2fa/disable", app.handle(app.TwoFactorDisable))
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireTOTP)
+			mux.Get("/email", app.handle(app.EmailPage))
+			mux.Post("/email", app.handle(app.ChangeEmail))
+			mux.Post("/email/verify", app.handle(app.ResendVerificationEmail))
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireVerifiedEmail)
+				mux.Get("/profile", app.handle(app.Profile))
+				mux.Post("/images", app.handle(app.UploadImage))
+				mux.Post("/images/{id}/primary", app.handle(app.SetPrimaryImage))
+				mux.Post("/images/{id}/delete", app.handle(app.DeleteImage))
+			})
+		})
 	})
 
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.auth)
+		mux.Use(app.requireTOTP)
+		mux.Use(app.adminOnly)
+
+		mux.Get("/audit", app.handle(app.AdminAuditPage))
+		mux.Get("/users", app.handle(app.AdminUsersPage))
+		mux.Get("/users/search", app.handle(app.AdminUserSearchPage))
+		mux.Get("/users/{id}", app.handle(app.AdminUserPage))
+		mux.Post("/users/{id}", app.handle(app.AdminUserUpdate))
+		mux.Post("/users/{id}/delete", app.handle(app.AdminUserDelete))
+		mux.Post("/users/{id}/restore", app.handle(app.AdminUserRestore))
+	})
+
+	// the description of the API, for people and for code generators
+	mux.With(app.cors(app.APICORS)).Get("/api/openapi.json", app.OpenAPI)
+	mux.Get("/api/docs", app.handle(app.APIDocsPage))
+
+	mux.Route("/api/admin", func(mux chi.Router) {
+		// preflights come without the session cookie, so before auth
+		mux.Use(app.cors(app.APICORS))
+		mux.Use(jsonOnly)
+		mux.Use(app.auth)
+		mux.Use(app.requireTOTP)
+		mux.Use(app.adminOnly)
+		mux.Use(app.validateRequests(apiDocument))
+
+		mux.Get("/audit-events", app.handle(app.AdminAuditEvents))
+		mux.Get("/users", app.handle(app.AdminUsers))
+		mux.Get("/users/search", app.handle(app.AdminUserSearch))
+		mux.Get("/users/{id}", app.handle(app.AdminUser))
+		mux.Patch("/users/{id}", app.handle(app.AdminPatchUser))
+		mux.Delete("/users/{id}", app.handle(app.AdminDeleteUser))
+		mux.Post("/users/{id}/restore", app.handle(app.AdminRestoreUser))
+		mux.Get("/jobs", app.handle(app.AdminJobs))
+		mux.Post("/jobs/{id}/retry", app.handle(app.AdminRetryJob))
+	})
+
+	// uploaded images, behind signed links, when they are stored on this server
+	if local, ok := app.Storage.(*storage.Local); ok {
+		// they are what users uploaded, so they can't run anything, even if a browser takes
+		// one for a page
+		files := app.Headers
+		files.CSP = CSP{"default-src": {"'none'"}, "sandbox": nil}
+
+		mux.With(app.secureHeaders(files)).Handle("/images/*", http.StripPrefix("/images", local))
+	}
+
 	// static assets
 	fileServer := http.FileServer(http.Dir("./static"))
 
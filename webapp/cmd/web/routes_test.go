@@ -15,7 +15,42 @@ func Test_application_routes(t *testing.T) {
 	}{
 		{route: "/", method: "GET"},
 		{route: "/login", method: "POST"},
+		{route: "/login/2fa", method: "GET"},
+		{route: "/login/2fa", method: "POST"},
+		{route: "/login/oidc/{provider}", method: "GET"},
+		{route: "/login/oidc/{provider}/callback", method: "GET"},
+		{route: "/verify-email", method: "GET"},
+		{route: "/locale", method: "POST"},
+		{route: "/user/email", method: "GET"},
+		{route: "/user/email", method: "POST"},
+		{route: "/user/email/verify", method: "POST"},
 		{route: "/user/profile", method: "GET"},
+		{route: "/user/images", method: "POST"},
+		{route: "/user/images/{id}/primary", method: "POST"},
+		{route: "/user/images/{id}/delete", method: "POST"},
+		{route: "/user/2fa/setup", method: "GET"},
+		{route: "/user/2fa/setup", method: "POST"},
+		{route: "/user/2fa/recovery-codes", method: "POST"},
+		{route: "/user/2fa/disable", method: "POST"},
+		{route: "/admin/audit", method: "GET"},
+		{route: "/admin/users", method: "GET"},
+		{route: "/admin/users/search", method: "GET"},
+		{route: "/admin/users/{id}", method: "GET"},
+		{route: "/admin/users/{id}", method: "POST"},
+		{route: "/admin/users/{id}/delete", method: "POST"},
+		{route: "/admin/users/{id}/restore", method: "POST"},
+		{route: "/api/openapi.json", method: "GET"},
+		{route: "/api/docs", method: "GET"},
+		{route: "/api/admin/audit-events", method: "GET"},
+		{route: "/api/admin/users", method: "GET"},
+		{route: "/api/admin/users/search", method: "GET"},
+		{route: "/api/admin/users/{id}", method: "GET"},
+		{route: "/api/admin/users/{id}", method: "PATCH"},
+		{route: "/api/admin/users/{id}", method: "DELETE"},
+		{route: "/api/admin/users/{id}/restore", method: "POST"},
+		{route: "/api/admin/jobs", method: "GET"},
+		{route: "/api/admin/jobs/{id}/retry", method: "POST"},
+		{route: "/images/*", method: "GET"},
 		{route: "/static/*", method: "GET"},
 	}
 
@@ -49,3 +84,14 @@ func routeExists(testRoute, testMethod string, chiRoutes chi.Routes) bool {
 func Test_app_Auth(t *testing.T) {
 
 }
+
+func Test_application_routeNames(t *testing.T) {
+	chiRoutes := app.routes().(chi.Routes)
+
+	// templates link to these, so each has to be a route with some method
+	for name, pattern := range routeNames {
+		if !routeExists(pattern, "GET", chiRoutes) && !routeExists(pattern, "POST", chiRoutes) {
+			t.Errorf("route %s of %s is not registered", pattern, name)
+		}
+	}
+}
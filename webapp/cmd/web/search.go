@@ -0,0 +1,129 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"unicode"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// userSearchLimit is how many search results we show
+const userSearchLimit = 50
+
+// userSearchHit is a search result with the matching parts of the user's name and email marked
+type userSearchHit struct {
+	*data.UserSearchResult
+	Highlight map[string]template.HTML `json:"highlight"`
+}
+
+// AdminUserSearchPage searches users by (parts of) their names and email
+func (app *application) AdminUserSearchPage(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query().Get("q")
+
+	hits, err := app.searchUsers(r, query)
+
+	if err != nil {
+		return err
+	}
+
+	td := make(map[string]any)
+	td["q"] = query
+	td["hits"] = hits
+
+	_ = app.render(w, r, "admin-user-search.page.gohtml", &TemplateData{Data: td})
+
+	return nil
+}
+
+// AdminUserSearch returns the users matching q as JSON, best matches first
+func (app *application) AdminUserSearch(w http.ResponseWriter, r *http.Request) error {
+	hits, err := app.searchUsers(r, r.URL.Query().Get("q"))
+
+	if err != nil {
+		return err
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, hits)
+
+	return nil
+}
+
+func (app *application) searchUsers(r *http.Request, query string) ([]userSearchHit, error) {
+	hits := []userSearchHit{}
+
+	if strings.TrimSpace(query) == "" {
+		return hits, nil
+	}
+
+	results, err := app.DB.SearchUsers(r.Context(), query, userSearchLimit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	terms := repository.SearchTerms(query)
+
+	for _, res := range results {
+		hits = append(hits, userSearchHit{
+			UserSearchResult: res,
+			Highlight: map[string]template.HTML{
+				"first_name": highlight(res.User.FirstName, terms),
+				"last_name":  highlight(res.User.LastName, terms),
+				"email":      highlight(res.User.Email, terms),
+			},
+		})
+	}
+
+	return hits, nil
+}
+
+// highlight escapes text, and wraps every case insensitive occurrence of the terms in <mark>
+func highlight(text string, terms []string) template.HTML {
+	runes := []rune(text)
+
+	// lower case rune by rune, so positions in lower are positions in runes
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	marked := make([]bool, len(runes))
+
+	for _, term := range terms {
+		t := []rune(term)
+
+		if len(t) == 0 {
+			continue
+		}
+
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) == term {
+				for j := i; j < i+len(t); j++ {
+					marked[j] = true
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && marked[j] == marked[i] {
+			j++
+		}
+
+		part := template.HTMLEscapeString(string(runes[i:j]))
+
+		if marked[i] {
+			part = "<mark>" + part + "</mark>"
+		}
+
+		b.WriteString(part)
+		i = j
+	}
+
+	return template.HTML(b.String())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_highlight(t *testing.T) {
+	var tests = []struct {
+		name     string
+		text     string
+		terms    []string
+		expected template.HTML
+	}{
+		{"no terms", "James", nil, "James"},
+		{"prefix", "James", []string{"ja"}, "<mark>Ja</mark>mes"},
+		{"several terms", "James Bond", []string{"bond", "ja"}, "<mark>Ja</mark>mes <mark>Bond</mark>"},
+		{"overlapping terms", "Bond", []string{"bo", "ond"}, "<mark>Bond</mark>"},
+		{"escapes html", "<b>Bond</b>", []string{"bond"}, "&lt;b&gt;<mark>Bond</mark>&lt;/b&gt;"},
+		{"unicode", "Đorđe Petrović", []string{"đor", "vić"}, "<mark>Đor</mark>đe Petro<mark>vić</mark>"},
+	}
+
+	for _, e := range tests {
+		if got := highlight(e.text, e.terms); got != e.expected {
+			t.Errorf("%s: expected %s, but got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestApp_AdminUserSearch(t *testing.T) {
+	var tests = []struct {
+		name         string
+		handler      http.HandlerFunc
+		query        string
+		expectedBody string
+	}{
+		{"page", app.handle(app.AdminUserSearchPage), "?q=fac", "<td><mark>Fac</mark>tor</td>"},
+		{"page without query", app.handle(app.AdminUserSearchPage), "", "Part of a name or email"},
+		{"page without results", app.handle(app.AdminUserSearchPage), "?q=nobody", "No users found"},
+		{"json", apiHandler(app.AdminUserSearch), "?q=admin", `"email":"\u003cmark\u003eadmin\u003c/mark\u003e@example.com"`},
+		{"json without query", apiHandler(app.AdminUserSearch), "", "[]"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/admin/users/search"+e.query, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, but got %d", e.name, http.StatusOK, rr.Code)
+		}
+
+		if !strings.Contains(rr.Body.String(), e.expectedBody) {
+			t.Errorf("%s: did not find %s in the response body %s", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -19,3 +20,15 @@ func getSession() *scs.SessionManager {
 
 	return session
 }
+
+// sessionLoaded tells whether LoadAndSave has put the session into ctx; scs panics instead of
+// saying so
+func (app *application) sessionLoaded(ctx context.Context) (loaded bool) {
+	defer func() {
+		loaded = recover() == nil
+	}()
+
+	app.Session.Status(ctx)
+
+	return true
+}
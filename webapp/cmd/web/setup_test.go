@@ -1,9 +1,20 @@
 package main
 
 import (
+	"encoding/gob"
 	"os"
 	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/encryption"
+	"webapp/pkg/i18n"
+	"webapp/pkg/imaging"
+	"webapp/pkg/jobs"
+	"webapp/pkg/mail"
+	"webapp/pkg/passwords"
 	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/signing"
+	"webapp/pkg/storage"
 )
 
 // we declared variable usable by test files, test files are ignored when we build application
@@ -15,11 +26,53 @@ var app application
 func TestMain(m *testing.M) {
 	pathToTemplates = "./../../templates/"
 
+	// like main does, for tests that store sessions
+	gob.Register(data.User{})
+	gob.Register(sessionForm{})
+
 	app.Session = getSession()
 
+	// the test repository stores two-factor secrets encrypted with this key
+	app.Encryption = encryption.New("test-encryption-key")
+
+	app.Hasher = passwords.Default
+
 	// now we can use all db methods
 	app.DB = &dbrepo.TestDBRepo{}
+	app.Audit = &dbrepo.TestDBRepo{}
+
+	// uploads go to a temporary directory; tests that look at files use their own with useTestStorage
+	uploads, err := os.MkdirTemp("", "uploads")
+	if err != nil {
+		panic(err)
+	}
+
+	app.Storage, _ = storage.NewLocal(uploads, "/images", []byte("test-signing-key"))
+	app.ImageFormat = imaging.JPEG
+
+	// jobs are queued in memory, and tests run them with Drain; failed jobs are retried right away
+	app.Jobs = jobs.New(dbrepo.NewMemoryJobRepo())
+	app.Jobs.Backoff = func(int) time.Duration { return 0 }
+	app.registerJobs(time.Hour, 30*24*time.Hour)
+
+	// email is kept in memory, for tests to look at
+	app.Mailer = &mail.Memory{}
+	app.Signer = signing.New("test-link-key")
+	app.BaseURL = "http://localhost:8081"
+
+	app.Headers = defaultSecurityHeaders()
+	app.APICORS = defaultAPICORS()
+	app.APICORS.AllowedOrigins = []string{"https://*.example.com"}
+
+	app.I18n, err = i18n.Load(os.DirFS("./../../locales"), "en")
+	if err != nil {
+		panic(err)
+	}
 
 	// this runs all tests
-	os.Exit(m.Run())
+	code := m.Run()
+
+	_ = os.RemoveAll(uploads)
+
+	os.Exit(code)
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/oidc"
+	"webapp/pkg/random"
+	"webapp/pkg/repository"
+
+	"github.com/go-chi/chi"
+)
+
+// OIDCLogin sends the browser to an external identity provider to log in
+func (app *application) OIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := app.OIDCProviders[chi.URLParam(r, "provider")]
+
+	if !ok {
+		return errNotFound
+	}
+
+	state, err := random.String()
+	if err != nil {
+		return err
+	}
+
+	nonce, err := random.String()
+	if err != nil {
+		return err
+	}
+
+	verifier, err := random.String()
+	if err != nil {
+		return err
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+
+	if err != nil {
+		log.Println("error contacting identity provider:", err)
+		app.Session.Put(r.Context(), "error", app.tr(r).T("Could not reach %s", provider.DisplayName))
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	// we need all of these again in the callback
+	app.Session.Put(r.Context(), "oidc_provider", provider.Name)
+	app.Session.Put(r.Context(), "oidc_state", state)
+	app.Session.Put(r.Context(), "oidc_nonce", nonce)
+	app.Session.Put(r.Context(), "oidc_verifier", verifier)
+
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+
+	return nil
+}
+
+// OIDCCallback is where the identity provider sends the browser back to, with an authorization code
+func (app *application) OIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := app.OIDCProviders[chi.URLParam(r, "provider")]
+
+	if !ok {
+		return errNotFound
+	}
+
+	// pop everything, so a callback can only be used once
+	expectedProvider := app.Session.PopString(r.Context(), "oidc_provider")
+	state := app.Session.PopString(r.Context(), "oidc_state")
+	nonce := app.Session.PopString(r.Context(), "oidc_nonce")
+	verifier := app.Session.PopString(r.Context(), "oidc_verifier")
+
+	q := r.URL.Query()
+
+	if q.Get("error") != "" {
+		log.Println("identity provider returned an error:", q.Get("error"), q.Get("error_description"))
+		app.Session.Put(r.Context(), "error", "Invalid login")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	if state == "" || expectedProvider != provider.Name || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+		app.Session.Put(r.Context(), "error", "Invalid login")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	claims, err := provider.Exchange(r.Context(), q.Get("code"), verifier, nonce)
+
+	if err != nil {
+		app.audit(r, data.AuditLoginFailed, 0, provider.Name+": "+err.Error())
+		log.Println("error exchanging authorization code:", err)
+		app.Session.Put(r.Context(), "error", "Invalid login")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := app.userForIdentity(r, provider, claims)
+
+	if errors.Is(err, repository.ErrUnavailable) {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", loginUnavailable)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	if err != nil {
+		app.audit(r, data.AuditLoginFailed, 0, err.Error())
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "There is no account for this login")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	// users that turned on 2FA with us still have to give us a code
+	if user.TOTPEnabled {
+		app.Session.Put(r.Context(), "2fa_user_id", user.ID)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	app.logUserIn(w, r, user, provider.Name)
+
+	return nil
+}
+
+// userForIdentity finds the local user for an external identity. Identities we have not seen before
+// are linked to the user with the same (verified) email, or to a new user if the provider allows signup.
+func (app *application) userForIdentity(r *http.Request, provider *oidc.Provider, claims *oidc.Claims) (*data.User, error) {
+	user, err := app.DB.GetUserByIdentity(provider.Name, claims.Subject)
+
+	if err == nil || !errors.Is(err, repository.ErrNotFound) {
+		return user, err
+	}
+
+	// never link on an email address the provider has not verified
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, fmt.Errorf("%s identity %s has no verified email", provider.Name, claims.Subject)
+	}
+
+	created := false
+
+	// a new user without their identity would never be able to log in, so create and link them together
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		created = false
+
+		user, err = repo.GetUserByEmail(claims.Email)
+
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return err
+		}
+
+		if err != nil {
+			if !provider.AllowSignup {
+				return fmt.Errorf("no local account for %s identity %s", provider.Name, claims.Subject)
+			}
+
+			user, err = createUserForIdentity(repo, claims)
+
+			if err != nil {
+				return err
+			}
+
+			created = true
+		}
+
+		// the provider vouches for the address, so the user does not have to verify it with us
+		if !user.EmailVerified() {
+			user, err = repo.VerifyEmail(user.ID, claims.Email)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = repo.InsertUserIdentity(data.UserIdentity{
+			UserID:   user.ID,
+			Provider: provider.Name,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		})
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		app.audit(r, data.AuditUserCreated, user.ID, "first login with "+provider.Name)
+	}
+
+	app.audit(r, data.AuditIdentityLinked, user.ID, provider.Name+" "+claims.Subject)
+
+	return user, nil
+}
+
+// createUserForIdentity adds a local user for someone logging in with an identity provider for the first time
+func createUserForIdentity(repo repository.DatabaseRepo, claims *oidc.Claims) (*data.User, error) {
+	// they log in through the provider, so nobody ever needs to know this password
+	password, err := random.String()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the provider verified the address
+	verified := time.Now()
+
+	user := data.User{
+		FirstName:       claims.GivenName,
+		LastName:        claims.FamilyName,
+		Email:           claims.Email,
+		Password:        password,
+		IsAdmin:         0,
+		EmailVerifiedAt: &verified,
+	}
+
+	id, err := repo.InsertUser(user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	user.ID = id
+	user.Password = ""
+
+	return &user, nil
+}
+
+// oidcProviderList returns the configured providers, sorted by name, for login buttons
+func (app *application) oidcProviderList() []*oidc.Provider {
+	providers := make([]*oidc.Provider, 0, len(app.OIDCProviders))
+
+	for _, p := range app.OIDCProviders {
+		providers = append(providers, p)
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+
+	return providers
+}
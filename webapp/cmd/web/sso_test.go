@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"webapp/pkg/data"
+	"webapp/pkg/oidc"
+	"webapp/pkg/oidc/oidctest"
+
+	"github.com/go-chi/chi"
+)
+
+// addProviderToRequest sets the {provider} url parameter, like chi does when routing
+func addProviderToRequest(req *http.Request, provider string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("provider", provider)
+
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestApp_OIDCLogin(t *testing.T) {
+	srv := oidctest.NewServer("webapp")
+	defer srv.Close()
+
+	app.OIDCProviders = map[string]*oidc.Provider{
+		"test": oidc.NewProvider(oidc.Config{
+			Name:        "test",
+			Issuer:      srv.URL,
+			ClientID:    "webapp",
+			RedirectURL: "http://localhost/login/oidc/test/callback",
+		}),
+	}
+	defer func() { app.OIDCProviders = nil }()
+
+	var tests = []struct {
+		name          string
+		subject       string
+		email         string
+		emailVerified bool
+		allowSignup   bool
+		badState      bool
+		expectedLoc   string
+		expectedUser  int
+	}{
+		{"linked by email", "subject-1", "admin@example.com", true, false, false, "/user/profile", 1},
+		{"already linked identity with 2fa", "linked-subject", "2fa@example.com", true, false, false, "/login/2fa", 0},
+		{"unverified email", "subject-2", "admin@example.com", false, false, false, "/", 0},
+		{"unknown email without signup", "subject-3", "new@example.com", true, false, false, "/", 0},
+		{"unknown email with signup", "subject-3", "new@example.com", true, true, false, "/user/profile", 2},
+		{"wrong state", "subject-1", "admin@example.com", true, false, true, "/", 0},
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, e := range tests {
+		srv.User = oidctest.User{Subject: e.subject, Email: e.email, EmailVerified: e.emailVerified, GivenName: "Some", FamilyName: "One"}
+		app.OIDCProviders["test"].AllowSignup = e.allowSignup
+
+		// start the login
+		req, _ := http.NewRequest(http.MethodGet, "/login/oidc/test", nil)
+		req = addContextAndSessionToRequest(req, app)
+		req = addProviderToRequest(req, "test")
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.OIDCLogin).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("%s: expected redirect to provider, but got status %d", e.name, rr.Code)
+		}
+
+		// the stub provider logs the user in right away and sends them back
+		res, err := client.Get(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		callback, err := res.Location()
+		if err != nil {
+			t.Fatalf("%s: provider did not redirect back: %s", e.name, err)
+		}
+
+		if e.badState {
+			q := callback.Query()
+			q.Set("state", "something-else")
+			callback.RawQuery = q.Encode()
+		}
+
+		// same session as the first request
+		req2, _ := http.NewRequestWithContext(req.Context(), http.MethodGet, callback.String(), nil)
+		req2 = addProviderToRequest(req2, "test")
+
+		rr = httptest.NewRecorder()
+
+		app.handle(app.OIDCCallback).ServeHTTP(rr, req2)
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLoc {
+			t.Errorf("%s: expected location %s, but got %s", e.name, e.expectedLoc, loc)
+		}
+
+		user, ok := app.Session.Get(req2.Context(), "user").(data.User)
+
+		if e.expectedUser == 0 && ok {
+			t.Errorf("%s: expected nobody to be logged in, but user %d is", e.name, user.ID)
+		}
+
+		if e.expectedUser != 0 && user.ID != e.expectedUser {
+			t.Errorf("%s: expected user %d to be logged in, but got %d", e.name, e.expectedUser, user.ID)
+		}
+	}
+}
+
+func TestApp_OIDCLogin_UnknownProvider(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/login/oidc/nope", nil)
+	req = addContextAndSessionToRequest(req, app)
+	req = addProviderToRequest(req, "nope")
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.OIDCLogin).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+}
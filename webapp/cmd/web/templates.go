@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// path to static assets, for the versions in asset links
+var pathToStatic = "./static/"
+
+// partials are in this directory under the templates; every page can use them
+const partialsDir = "partials"
+
+// templateFuncs are the functions every template can use:
+//
+//	T "%d images" 3          translated text, see package i18n
+//	localeName "de"          name of a language, in that language
+//	url "user.images.delete" 7
+//	                         path of a named route, with its parameters filled in
+//	asset "css/app.css"      link to a static file, with its version for caching
+//	csrfField, csrfToken     the token forms have to send, see verifyCSRF
+//	nonce                    the CSP nonce inline scripts and styles need, see secureHeaders
+//	date, datetime           a time.Time or *time.Time, like 2022-08-19 or 2022-08-19 14:30
+//	humanizeTime             a time in the past, like 5 minutes ago
+//	humanizeBytes            a size, like 1.5 MB
+//	pluralize 3 "user" "users"
+//	                         the word for the count; use T for text that is translated
+//	loggedIn, isAdmin        about the user who asks for the page
+//	isCurrentUser 7          whether that user has the id
+func (app *application) templateFuncs(r *http.Request, td *TemplateData) template.FuncMap {
+	tr := app.tr(r)
+
+	return template.FuncMap{
+		"T":          tr.T,
+		"localeName": localeName,
+		"url":        routeURL,
+		"asset":      assetURL,
+		"csrfToken": func() string {
+			return app.csrfToken(r.Context())
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				csrfFieldName, template.HTMLEscapeString(app.csrfToken(r.Context()))))
+		},
+		"nonce": func() string {
+			return app.cspNonce(r)
+		},
+		"date": func(t any) string {
+			return formatTime(t, dateLayout)
+		},
+		"datetime": func(t any) string {
+			return formatTime(t, dateTimeLayout)
+		},
+		"humanizeTime": func(t any) string {
+			return humanizeTime(tr.T, t, time.Now())
+		},
+		"humanizeBytes": humanizeBytes,
+		"pluralize":     pluralize,
+		"loggedIn": func() bool {
+			return td.User.ID != 0
+		},
+		"isAdmin": func() bool {
+			return td.User.IsAdmin == 1
+		},
+		"isCurrentUser": func(id int) bool {
+			return td.User.ID != 0 && td.User.ID == id
+		},
+	}
+}
+
+// parseTemplate parses a page with the base layout and every partial
+func (app *application) parseTemplate(r *http.Request, t string, td *TemplateData) (*template.Template, error) {
+	files := []string{path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml")}
+
+	partials, err := filepath.Glob(path.Join(pathToTemplates, partialsDir, "*.gohtml"))
+	if err != nil {
+		return nil, err
+	}
+
+	files = append(files, partials...)
+
+	return template.New(t).Funcs(app.templateFuncs(r, td)).ParseFiles(files...)
+}
+
+// routeURL returns the path of the route called name in routeNames, with its {parameters}
+// filled in by params, in order
+func routeURL(name string, params ...any) (string, error) {
+	pattern, ok := routeNames[name]
+	if !ok {
+		return "", fmt.Errorf("no route called %q", name)
+	}
+
+	parts := strings.Split(pattern, "/")
+	n := 0
+
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") {
+			continue
+		}
+
+		if n == len(params) {
+			return "", fmt.Errorf("route %q needs more than %d parameters", name, len(params))
+		}
+
+		parts[i] = url.PathEscape(fmt.Sprint(params[n]))
+		n++
+	}
+
+	if n != len(params) {
+		return "", fmt.Errorf("route %q has %d parameters, not %d", name, n, len(params))
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// assetVersions caches the versions of static files by name; they don't change while we run
+var assetVersions sync.Map
+
+// assetURL returns the link to a static file, with a version from its content, so browsers can
+// cache it for good and still get the new one after a deploy
+func assetURL(file string) string {
+	file = strings.TrimPrefix(path.Clean("/"+file), "/")
+	link := "/static/" + file
+
+	if version, ok := assetVersions.Load(file); ok {
+		return link + "?v=" + version.(string)
+	}
+
+	content, err := os.ReadFile(filepath.Join(pathToStatic, filepath.FromSlash(file)))
+
+	// the file server answers with a 404 then
+	if err != nil {
+		return link
+	}
+
+	sum := sha256.Sum256(content)
+	version := hex.EncodeToString(sum[:4])
+
+	assetVersions.Store(file, version)
+
+	return link + "?v=" + version
+}
+
+// the layout of the datetime template function
+const dateTimeLayout = "2006-01-02 15:04"
+
+// formatTime formats a time.Time or *time.Time; zero and nil times are empty
+func formatTime(t any, layout string) string {
+	tm, ok := toTime(t)
+	if !ok {
+		return ""
+	}
+
+	return tm.Format(layout)
+}
+
+func toTime(t any) (time.Time, bool) {
+	switch t := t.(type) {
+	case time.Time:
+		return t, !t.IsZero()
+	case *time.Time:
+		if t == nil {
+			return time.Time{}, false
+		}
+
+		return *t, !t.IsZero()
+	default:
+		return time.Time{}, false
+	}
+}
+
+// humanizeTime tells how long ago t was, in the words of translate; times in the future are
+// shown as they are
+func humanizeTime(translate func(string, ...any) string, t any, now time.Time) string {
+	tm, ok := toTime(t)
+	if !ok {
+		return ""
+	}
+
+	d := now.Sub(tm)
+
+	switch {
+	case d < 0:
+		return tm.Format(dateTimeLayout)
+	case d < time.Minute:
+		return translate("just now")
+	case d < time.Hour:
+		return translate("%d minutes ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return translate("%d hours ago", int(d/time.Hour))
+	case d < 30*24*time.Hour:
+		return translate("%d days ago", int(d/(24*time.Hour)))
+	default:
+		return tm.Format(dateLayout)
+	}
+}
+
+// humanizeBytes returns a size in the largest unit it has at least one of
+func humanizeBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/float64(div)), ".0") + " " + string("KMGTPE"[exp]) + "B"
+}
+
+// pluralize returns singular for a count of one, and plural for any other
+func pluralize(n int, singular, plural string) string {
+	if n == 1 || n == -1 {
+		return singular
+	}
+
+	return plural
+}
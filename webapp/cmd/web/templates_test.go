@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+)
+
+func Test_routeURL(t *testing.T) {
+	var tests = []struct {
+		name        string
+		route       string
+		params      []any
+		expected    string
+		expectError bool
+	}{
+		{"plain", "user.profile", nil, "/user/profile", false},
+		{"with id", "user.images.delete", []any{7}, "/user/images/7/delete", false},
+		{"escaped", "login.oidc", []any{"a b/c"}, "/login/oidc/a%20b%2Fc", false},
+		{"unknown", "user.nothing", nil, "", true},
+		{"missing parameter", "admin.user", nil, "", true},
+		{"too many parameters", "admin.users", []any{1}, "", true},
+	}
+
+	for _, e := range tests {
+		actual, err := routeURL(e.route, e.params...)
+
+		if (err != nil) != e.expectError {
+			t.Errorf("%s: expected error %v, but got %v", e.name, e.expectError, err)
+		}
+
+		if actual != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, actual)
+		}
+	}
+}
+
+func Test_assetURL(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "css"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "css", "app.css"), []byte("body {}"), 0644)
+
+	saved := pathToStatic
+	pathToStatic = dir
+	defer func() { pathToStatic = saved }()
+
+	if actual := assetURL("css/app.css"); !strings.HasPrefix(actual, "/static/css/app.css?v=") || len(actual) != len("/static/css/app.css?v=")+8 {
+		t.Errorf("expected a versioned link, but got %s", actual)
+	}
+
+	// a path can't get out of the static files
+	if actual := assetURL("../../main.go"); actual != "/static/main.go" {
+		t.Errorf("expected /static/main.go, but got %s", actual)
+	}
+}
+
+func Test_humanize(t *testing.T) {
+	now := time.Date(2022, 8, 19, 14, 30, 0, 0, time.UTC)
+	de := app.I18n.Translator("de").T
+	en := app.I18n.Translator("en").T
+
+	var zero *time.Time
+
+	var tests = []struct {
+		name      string
+		translate func(string, ...any) string
+		t         any
+		expected  string
+	}{
+		{"just now", en, now.Add(-10 * time.Second), "just now"},
+		{"one minute", en, now.Add(-time.Minute), "1 minute ago"},
+		{"hours", en, now.Add(-5 * time.Hour), "5 hours ago"},
+		{"pointer", en, func() *time.Time { t := now.Add(-48 * time.Hour); return &t }(), "2 days ago"},
+		{"german", de, now.Add(-3 * time.Minute), "vor 3 Minuten"},
+		{"long ago", en, now.Add(-90 * 24 * time.Hour), "2022-05-21"},
+		{"future", en, now.Add(time.Hour), "2022-08-19 15:30"},
+		{"zero", en, time.Time{}, ""},
+		{"nil", en, zero, ""},
+	}
+
+	for _, e := range tests {
+		if actual := humanizeTime(e.translate, e.t, now); actual != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, actual)
+		}
+	}
+
+	for n, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1024: "1 KB", 1536: "1.5 KB", 10 << 20: "10 MB", 3 << 30: "3 GB"} {
+		if actual := humanizeBytes(n); actual != expected {
+			t.Errorf("%d bytes: expected %q, but got %q", n, expected, actual)
+		}
+	}
+
+	for n, expected := range map[int]string{0: "users", 1: "user", 2: "users"} {
+		if actual := pluralize(n, "user", "users"); actual != expected {
+			t.Errorf("%d: expected %q, but got %q", n, expected, actual)
+		}
+	}
+}
+
+func TestApp_renderPartials(t *testing.T) {
+	var tests = []struct {
+		name       string
+		user       data.User
+		expected   []string
+		unexpected []string
+	}{
+		{"logged out", data.User{}, []string{`<nav class="navbar`, `name="csrf_token"`}, []string{`href="/user/profile"`, `href="/admin/users"`}},
+		{"user", data.User{ID: 2}, []string{`href="/user/profile"`}, []string{`href="/admin/users"`}},
+		{"admin", data.User{ID: 1, IsAdmin: 1}, []string{`href="/user/profile"`, `href="/admin/users"`, `href="/admin/audit"`}, nil},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		if e.user.ID != 0 {
+			app.Session.Put(req.Context(), "user", e.user)
+		}
+
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(app.Home).ServeHTTP(rr, req)
+
+		for _, s := range e.expected {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("%s: expected %s in the page", e.name, s)
+			}
+		}
+
+		for _, s := range e.unexpected {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("%s: did not expect %s in the page", e.name, s)
+			}
+		}
+
+		// the field has the token of the session
+		field := fmt.Sprintf(`name="csrf_token" value="%s"`, app.csrfToken(req.Context()))
+
+		if !strings.Contains(rr.Body.String(), field) {
+			t.Errorf("%s: expected %s in the page", e.name, field)
+		}
+	}
+}
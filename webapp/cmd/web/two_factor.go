@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/totp"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// issuer is the name authenticator apps show next to our codes
+const issuer = "Webapp"
+
+// how many wrong codes we accept during login before starting over
+const maxTwoFactorAttempts = 5
+
+// number of recovery codes handed out on enrollment
+const recoveryCodeCount = 10
+
+// mustEnrollTOTP reports whether the user is an admin that is forced into 2FA but has not set it up yet
+func (app *application) mustEnrollTOTP(user *data.User) bool {
+	return app.RequireAdmin2FA && user.IsAdmin == 1 && !user.TOTPEnabled
+}
+
+// TwoFactorPage displays the second login step, where users type the code from their app
+func (app *application) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	if !app.Session.Exists(r.Context(), "2fa_user_id") {
+		app.Session.Put(r.Context(), "error", "Log in first")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.render(w, r, "totp-login.page.gohtml", &TemplateData{})
+}
+
+// TwoFactorLogin checks the code (or a recovery code) of a user that already gave us a valid password
+func (app *application) TwoFactorLogin(w http.ResponseWriter, r *http.Request) error {
+	var input struct {
+		Code string `form:"code" validate:"required"`
+	}
+
+	form, err := app.decodeForm(w, r, &input)
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	id := app.Session.GetInt(r.Context(), "2fa_user_id")
+
+	if id == 0 {
+		app.Session.Put(r.Context(), "error", "Log in first")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Enter the code from your authenticator app")
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		log.Println("error looking up user:", err)
+		app.Session.Put(r.Context(), "error", loginUnavailable)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	if err != nil {
+		app.Session.Remove(r.Context(), "2fa_user_id")
+		app.Session.Put(r.Context(), "error", "Invalid login")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	if !app.checkSecondFactor(user, input.Code) {
+		app.audit(r, data.AuditLoginFailed, user.ID, "wrong two-factor code")
+
+		attempts := app.Session.GetInt(r.Context(), "2fa_attempts") + 1
+
+		// too many guesses, make them start over with the password
+		if attempts >= maxTwoFactorAttempts {
+			app.Session.Remove(r.Context(), "2fa_user_id")
+			app.Session.Remove(r.Context(), "2fa_attempts")
+			app.Session.Put(r.Context(), "error", "Too many invalid codes, log in again")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil
+		}
+
+		app.Session.Put(r.Context(), "2fa_attempts", attempts)
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	app.Session.Remove(r.Context(), "2fa_user_id")
+	app.Session.Remove(r.Context(), "2fa_attempts")
+
+	app.logUserIn(w, r, user, "password and two-factor code")
+
+	return nil
+}
+
+// checkSecondFactor accepts either the current TOTP code or one of the user's unused recovery codes.
+// A TOTP code stays valid for a while, so it is only accepted once; so are codes from before it.
+func (app *application) checkSecondFactor(user *data.User, code string) bool {
+	if !user.TOTPEnabled {
+		return false
+	}
+
+	secret, err := app.Encryption.Decrypt(user.TOTPSecret)
+
+	if err != nil {
+		log.Println("error decrypting totp secret:", err)
+		return false
+	}
+
+	if counter, ok := totp.Match(secret, code, time.Now()); ok {
+		fresh, err := app.DB.UseTOTPCounter(user.ID, counter)
+
+		if err != nil {
+			log.Println("error using totp code:", err)
+			return false
+		}
+
+		return fresh
+	}
+
+	used, err := app.DB.UseRecoveryCode(user.ID, totp.HashRecoveryCode(code))
+
+	if err != nil {
+		log.Println("error using recovery code:", err)
+		return false
+	}
+
+	return used
+}
+
+// TwoFactorSetupPage shows a new secret (as QR code and otpauth URI) to a logged in user, or
+// the current 2FA status if they already enrolled
+func (app *application) TwoFactorSetupPage(w http.ResponseWriter, r *http.Request) error {
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	td := make(map[string]any)
+
+	td["enabled"] = user.TOTPEnabled
+	td["required"] = app.RequireAdmin2FA && user.IsAdmin == 1
+
+	if !user.TOTPEnabled {
+		secret, err := totp.GenerateSecret()
+
+		if err != nil {
+			return err
+		}
+
+		// keep the secret on the server until the user proves they have it in their app
+		app.Session.Put(r.Context(), "2fa_pending_secret", secret)
+
+		uri := totp.URI(issuer, user.Email, secret)
+
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+
+		if err != nil {
+			return err
+		}
+
+		td["secret"] = secret
+		td["uri"] = template.URL(uri)
+		td["qr"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	_ = app.render(w, r, "totp-setup.page.gohtml", &TemplateData{Data: td})
+
+	return nil
+}
+
+// TwoFactorSetup confirms enrollment with a code generated from the pending secret
+func (app *application) TwoFactorSetup(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+	secret := app.Session.GetString(r.Context(), "2fa_pending_secret")
+
+	counter, ok := totp.Match(secret, r.Form.Get("code"), time.Now())
+
+	if secret == "" || !ok {
+		app.Session.Put(r.Context(), "error", "Invalid code, scan the new QR code and try again")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return nil
+	}
+
+	encrypted, err := app.Encryption.Encrypt(secret)
+
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.EnableTOTP(user.ID, encrypted)
+
+	if err != nil {
+		return err
+	}
+
+	// the code that proved the setup can't log in, too
+	if _, err := app.DB.UseTOTPCounter(user.ID, counter); err != nil {
+		return err
+	}
+
+	app.Session.Remove(r.Context(), "2fa_pending_secret")
+
+	app.audit(r, data.AuditTOTPEnabled, user.ID, "")
+
+	user.TOTPSecret = encrypted
+	user.TOTPEnabled = true
+	app.Session.Put(r.Context(), "user", user)
+
+	app.showNewRecoveryCodes(w, r, user)
+
+	return nil
+}
+
+// TwoFactorRecoveryCodes replaces a user's recovery codes with a fresh set
+func (app *application) TwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	if !app.checkSecondFactor(&user, r.Form.Get("code")) {
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return nil
+	}
+
+	app.showNewRecoveryCodes(w, r, user)
+
+	return nil
+}
+
+// TwoFactorDisable turns 2FA off, unless the user is an admin and we force 2FA for admins
+func (app *application) TwoFactorDisable(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+
+	if err != nil {
+		return badRequest(err)
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	if app.RequireAdmin2FA && user.IsAdmin == 1 {
+		app.Session.Put(r.Context(), "error", "Admins can not turn off two-factor authentication")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return nil
+	}
+
+	if !app.checkSecondFactor(&user, r.Form.Get("code")) {
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return nil
+	}
+
+	err = app.DB.DisableTOTP(user.ID)
+
+	if err != nil {
+		return err
+	}
+
+	app.audit(r, data.AuditTOTPDisabled, user.ID, "")
+
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	app.Session.Put(r.Context(), "user", user)
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication turned off")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+
+	return nil
+}
+
+// showNewRecoveryCodes generates and stores recovery codes, and renders them; this is the only time we show them
+func (app *application) showNewRecoveryCodes(w http.ResponseWriter, r *http.Request, user data.User) {
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	hashes := make([]string, 0, len(codes))
+
+	for _, c := range codes {
+		hashes = append(hashes, totp.HashRecoveryCode(c))
+	}
+
+	err = app.DB.ReplaceRecoveryCodes(user.ID, hashes)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, data.AuditRecoveryCodes, user.ID, "")
+
+	td := make(map[string]any)
+	td["codes"] = codes
+
+	_ = app.render(w, r, "recovery-codes.page.gohtml", &TemplateData{Data: td})
+}
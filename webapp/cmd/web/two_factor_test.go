@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/totp"
+)
+
+func TestApp_TwoFactorLogin(t *testing.T) {
+	validCode, _ := totp.Code(dbrepo.TestTOTPSecret, time.Now())
+
+	// a repository of its own, that hasn't seen the code yet
+	defer func(db repository.DatabaseRepo) { app.DB = db }(app.DB)
+	app.DB = &dbrepo.TestDBRepo{}
+
+	var tests = []struct {
+		name        string
+		pendingUser int
+		code        string
+		expectedLoc string
+	}{
+		{"no pending login", 0, validCode, "/"},
+		{"valid code", 2, validCode, "/user/profile"},
+		{"replayed code", 2, validCode, "/login/2fa"},
+		{"recovery code", 2, dbrepo.TestRecoveryCode, "/user/profile"},
+		{"wrong code", 2, "000000", "/login/2fa"},
+		{"missing code", 2, "", "/login/2fa"},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{"code": {e.code}}
+
+		req, _ := http.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		if e.pendingUser > 0 {
+			app.Session.Put(req.Context(), "2fa_user_id", e.pendingUser)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler := app.handle(app.TwoFactorLogin)
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLoc {
+			t.Errorf("%s: expected location %s, but got %s", e.name, e.expectedLoc, loc)
+		}
+
+		loggedIn := app.Session.Exists(req.Context(), "user")
+
+		if loggedIn != (e.expectedLoc == "/user/profile") {
+			t.Errorf("%s: unexpected logged in state %t", e.name, loggedIn)
+		}
+	}
+}
+
+func TestApp_TwoFactorLogin_TooManyAttempts(t *testing.T) {
+	postedData := url.Values{"code": {"000000"}}
+
+	req, _ := http.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(postedData.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.Session.Put(req.Context(), "2fa_user_id", 2)
+	app.Session.Put(req.Context(), "2fa_attempts", maxTwoFactorAttempts-1)
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.TwoFactorLogin).ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/" {
+		t.Errorf("expected to be sent back to /, but got %s", loc)
+	}
+
+	if app.Session.Exists(req.Context(), "2fa_user_id") {
+		t.Error("pending login should have been removed from the session")
+	}
+}
+
+func TestApp_LoginForcesAdminEnrollment(t *testing.T) {
+	app.RequireAdmin2FA = true
+	defer func() { app.RequireAdmin2FA = false }()
+
+	postedData := url.Values{"email": {"admin@example.com"}, "password": {"secret"}}
+
+	req, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(postedData.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.handle(app.Login).ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/user/2fa/setup" {
+		t.Errorf("expected admin to be sent to /user/2fa/setup, but got %s", loc)
+	}
+}
+
+func TestApp_TwoFactorSetup(t *testing.T) {
+	secret, _ := totp.GenerateSecret()
+	validCode, _ := totp.Code(secret, time.Now())
+
+	var tests = []struct {
+		name           string
+		code           string
+		expectedStatus int
+	}{
+		{"valid code", validCode, http.StatusOK},
+		{"wrong code", "000000", http.StatusSeeOther},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{"code": {e.code}}
+
+		req, _ := http.NewRequest(http.MethodPost, "/user/2fa/setup", strings.NewReader(postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		app.Session.Put(req.Context(), "user", data.User{ID: 1, Email: "admin@example.com"})
+		app.Session.Put(req.Context(), "2fa_pending_secret", secret)
+
+		rr := httptest.NewRecorder()
+
+		app.handle(app.TwoFactorSetup).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if e.expectedStatus == http.StatusOK {
+			if !strings.Contains(rr.Body.String(), "Recovery codes") {
+				t.Errorf("%s: recovery codes were not shown", e.name)
+			}
+
+			user := app.Session.Get(req.Context(), "user").(data.User)
+
+			if !user.TOTPEnabled {
+				t.Errorf("%s: session user should have 2FA enabled", e.name)
+			}
+		}
+	}
+}
+
+func Test_app_requireTOTP(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	app.RequireAdmin2FA = true
+	defer func() { app.RequireAdmin2FA = false }()
+
+	var tests = []struct {
+		name           string
+		method         string
+		accept         string
+		user           data.User
+		expectedStatus int
+	}{
+		{"admin without 2fa", http.MethodGet, "", data.User{ID: 1, IsAdmin: 1}, http.StatusSeeOther},
+		{"admin without 2fa posting", http.MethodPost, "", data.User{ID: 1, IsAdmin: 1}, http.StatusSeeOther},
+		{"admin without 2fa using the API", http.MethodGet, "application/json", data.User{ID: 1, IsAdmin: 1}, http.StatusForbidden},
+		{"admin with 2fa", http.MethodGet, "", data.User{ID: 1, IsAdmin: 1, TOTPEnabled: true}, http.StatusOK},
+		{"regular user", http.MethodGet, "", data.User{ID: 3}, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "http://testing", nil)
+		req.Header.Set("Accept", e.accept)
+		req = addContextAndSessionToRequest(req, app)
+
+		app.Session.Put(req.Context(), "user", e.user)
+
+		rr := httptest.NewRecorder()
+
+		app.requireTOTP(nextHandler).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
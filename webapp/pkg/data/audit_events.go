@@ -0,0 +1,65 @@
+package data
+
+import "time"
+
+// actions recorded in the audit log
+const (
+	AuditLogin                = "login"
+	AuditLoginFailed          = "login_failed"
+	AuditPasswordReset        = "password_reset"
+	AuditPasswordRehashed     = "password_rehashed"
+	AuditUserCreated          = "user_created"
+	AuditUserUpdated          = "user_updated"
+	AuditUserDeleted          = "user_deleted"
+	AuditUserRestored         = "user_restored"
+	AuditUserPurged           = "user_purged"
+	AuditTOTPEnabled          = "totp_enabled"
+	AuditTOTPDisabled         = "totp_disabled"
+	AuditRecoveryCodes        = "recovery_codes_generated"
+	AuditIdentityLinked       = "identity_linked"
+	AuditJobRetried           = "job_retried"
+	AuditEmailChangeRequested = "email_change_requested"
+	AuditEmailVerified        = "email_verified"
+)
+
+// AuditActions are all the actions above, for filters to offer; add new actions here, too
+var AuditActions = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditPasswordReset,
+	AuditPasswordRehashed,
+	AuditUserCreated,
+	AuditUserUpdated,
+	AuditUserDeleted,
+	AuditUserRestored,
+	AuditUserPurged,
+	AuditTOTPEnabled,
+	AuditTOTPDisabled,
+	AuditRecoveryCodes,
+	AuditIdentityLinked,
+	AuditJobRetried,
+	AuditEmailChangeRequested,
+	AuditEmailVerified,
+}
+
+// AuditEvent is one security relevant thing that happened. ActorID is the logged in user
+// that did it, and TargetUserID the user it happened to; either is 0 when there is none.
+type AuditEvent struct {
+	ID           int       `json:"id"`
+	ActorID      int       `json:"actor_id,omitempty"`
+	TargetUserID int       `json:"target_user_id,omitempty"`
+	Action       string    `json:"action"`
+	IP           string    `json:"ip"`
+	Details      string    `json:"details,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuditFilter selects audit events; zero values are ignored.
+type AuditFilter struct {
+	UserID int
+	Action string
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
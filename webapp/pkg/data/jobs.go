@@ -0,0 +1,45 @@
+package data
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// states of a job
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	// JobDead jobs failed too often, or for good; they stay until someone retries them
+	JobDead = "dead"
+)
+
+// DefaultMaxAttempts is how often a job is tried when it does not say
+const DefaultMaxAttempts = 5
+
+// Job is a piece of work done in the background, outside of requests
+type Job struct {
+	ID      int64           `json:"id"`
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+	Status  string          `json:"status"`
+	// Attempts counts how often the job was started, including the one running now
+	Attempts    int `json:"attempts"`
+	MaxAttempts int `json:"max_attempts"`
+	// RunAt is when the job is due; retries move it into the future
+	RunAt     time.Time  `json:"run_at"`
+	LockedAt  *time.Time `json:"locked_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	// UniqueKey keeps a job from being queued twice; empty for most jobs
+	UniqueKey  string     `json:"unique_key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobFilter selects jobs; zero values are ignored.
+type JobFilter struct {
+	Kind   string
+	Status string
+	Limit  int
+}
@@ -4,9 +4,75 @@ import "time"
 
 // UserImage is the type for user profile images.
 type UserImage struct {
-	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`
-	FileName  string    `json:"file_name"`
+	ID       int    `json:"id"`
+	UserID   int    `json:"user_id"`
+	FileName string `json:"file_name"`
+	// IsPrimary marks the image we show as the user's avatar; a user has at most one
+	IsPrimary bool `json:"is_primary"`
+	// URL is a signed link to the file, filled in when images are shown; it is not stored
+	URL string `json:"url,omitempty"`
+	// Variants are the sizes we made of the upload; images from before we made them have none
+	Variants  []*UserImageVariant `json:"variants,omitempty"`
+	CreatedAt time.Time           `json:"-"`
+	UpdatedAt time.Time           `json:"-"`
+}
+
+// UserImageVariant is one size of a user image, like its thumbnail
+type UserImageVariant struct {
+	ID          int    `json:"id"`
+	UserImageID int    `json:"user_image_id"`
+	Name        string `json:"name"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	// URL is a signed link to the file, like UserImage.URL
+	URL       string    `json:"url,omitempty"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
+
+// Variant returns the variant called name, or nil
+func (i *UserImage) Variant(name string) *UserImageVariant {
+	for _, v := range i.Variants {
+		if v.Name == name {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// VariantURL links to the variant called name, or to the image itself when there is no such variant
+func (i *UserImage) VariantURL(name string) string {
+	if v := i.Variant(name); v != nil && v.URL != "" {
+		return v.URL
+	}
+
+	return i.URL
+}
+
+// FileNames are the files of the image and its variants, each once
+func (i *UserImage) FileNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, f := range append([]string{i.FileName}, variantFileNames(i.Variants)...) {
+		if f != "" && !seen[f] {
+			seen[f] = true
+			names = append(names, f)
+		}
+	}
+
+	return names
+}
+
+func variantFileNames(variants []*UserImageVariant) []string {
+	names := make([]string, 0, len(variants))
+
+	for _, v := range variants {
+		names = append(names, v.FileName)
+	}
+
+	return names
+}
@@ -1,9 +1,8 @@
 package data
 
 import (
-	"errors"
-	"golang.org/x/crypto/bcrypt"
 	"time"
+	"webapp/pkg/passwords"
 )
 
 // User describes the data for the User type.
@@ -16,22 +15,105 @@ type User struct {
 	IsAdmin   int       `json:"is_admin"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
+	// TOTPSecret is the encrypted two-factor secret; only meaningful when TOTPEnabled is true
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// Version goes up with every change of the name, email or admin flag; updates have to
+	// send the version they started from, so they can't overwrite changes they haven't seen
+	Version int `json:"version"`
+	// EmailVerifiedAt is when the user showed they get mail at Email; nil until then
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	// PendingEmail is the address the user is changing to; it replaces Email once it is verified
+	PendingEmail string `json:"pending_email,omitempty"`
+	// Locale is the language the user chose for the application, like "de"; empty means the
+	// one their browser asks for
+	Locale string `json:"locale,omitempty"`
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
+// EmailVerified reports whether the user showed they get mail at their address
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// UserPatch is a partial update of a user; nil fields are left as they are
+type UserPatch struct {
+	FirstName *string `json:"first_name,omitempty"`
+	LastName  *string `json:"last_name,omitempty"`
+	Email     *string `json:"email,omitempty"`
+	IsAdmin   *int    `json:"is_admin,omitempty"`
+}
+
+// Empty reports whether the patch changes nothing
+func (p UserPatch) Empty() bool {
+	return p.FirstName == nil && p.LastName == nil && p.Email == nil && p.IsAdmin == nil
+}
+
+// Apply changes u as the patch would
+func (p UserPatch) Apply(u *User) {
+	if p.FirstName != nil {
+		u.FirstName = *p.FirstName
+	}
+
+	if p.LastName != nil {
+		u.LastName = *p.LastName
+	}
+
+	if p.Email != nil {
+		u.Email = *p.Email
+	}
+
+	if p.IsAdmin != nil {
+		u.IsAdmin = *p.IsAdmin
+	}
+}
+
+// PasswordMatches compares a user supplied password with the hash we have stored
+// for a given user in the database. The hash can be bcrypt or argon2id. If the password
 // and hash match, we return true; otherwise, we return false.
 func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:  
-			return false, err
-		}
-	}
+	return passwords.Verify(plainText, u.Password)
+}
+
+// columns users can be sorted by
+const (
+	SortByID        = "id"
+	SortByEmail     = "email"
+	SortByFirstName = "first_name"
+	SortByLastName  = "last_name"
+	SortByIsAdmin   = "is_admin"
+	SortByCreatedAt = "created_at"
+	SortByUpdatedAt = "updated_at"
+)
+
+// ListOptions selects, sorts and paginates users. Zero values are ignored.
+type ListOptions struct {
+	// Page is 1 based; it's ignored when After is set
+	Page    int
+	PerPage int
+	// After is the NextCursor of a previous page, for keyset pagination
+	After string
+	// Sort is one of the SortBy columns; last_name when empty
+	Sort string
+	Desc bool
+	// IsAdmin only returns admins (1) or non admins (0) when set
+	IsAdmin     *int
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// Search matches part of the first name, last name or email
+	Search string
+}
+
+// UserList is one page of users, and how many users there are in total
+type UserList struct {
+	Users      []*User `json:"users"`
+	Total      int     `json:"total"`
+	Page       int     `json:"page,omitempty"`
+	PerPage    int     `json:"per_page"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
 
-	return true, nil
+// UserSearchResult is a user found by a search, and how well they match; higher ranks match better
+type UserSearchResult struct {
+	User *User   `json:"user"`
+	Rank float64 `json:"rank"`
 }
@@ -0,0 +1,74 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// Encryption encrypts small values (like TOTP secrets) before they are stored in the database
+type Encryption struct {
+	Key []byte
+}
+
+// New returns an Encryption using a 32 byte key derived from the given passphrase
+func New(passphrase string) *Encryption {
+	key := sha256.Sum256([]byte(passphrase))
+
+	return &Encryption{Key: key[:]}
+}
+
+// Encrypt seals plainText with AES-GCM and returns it base64 encoded, nonce first
+func (e *Encryption) Encrypt(plainText string) (string, error) {
+	gcm, err := e.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plainText), nil)
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt
+func (e *Encryption) Decrypt(cipherText string) (string, error) {
+	gcm, err := e.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("cipher text too short")
+	}
+
+	nonce, data := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+func (e *Encryption) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
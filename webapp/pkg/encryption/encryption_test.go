@@ -0,0 +1,34 @@
+package encryption
+
+import "testing"
+
+func TestEncryption_EncryptDecrypt(t *testing.T) {
+	e := New("some passphrase")
+
+	encrypted, err := e.Encrypt("hello, world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encrypted == "hello, world" {
+		t.Error("value was not encrypted")
+	}
+
+	decrypted, err := e.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted != "hello, world" {
+		t.Errorf("expected hello, world but got %s", decrypted)
+	}
+
+	// a different key must not be able to open the value
+	if _, err := New("other passphrase").Decrypt(encrypted); err == nil {
+		t.Error("expected error decrypting with the wrong key, but got none")
+	}
+
+	if _, err := e.Decrypt("bm9wZQ=="); err == nil {
+		t.Error("expected error decrypting garbage, but got none")
+	}
+}
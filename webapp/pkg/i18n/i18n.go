@@ -0,0 +1,256 @@
+// Package i18n translates the messages of the application. A Catalog holds the translations of
+// every locale, read from one JSON file per locale, like de.json. Messages are keyed by their
+// English text, so a message without a translation is shown in English:
+//
+//	{
+//	    "Log in first": "Bitte melde dich zuerst an",
+//	    "%d images": {"one": "%d Bild", "other": "%d Bilder"}
+//	}
+//
+// Messages with plural forms pick one by the first argument, which has to be an int. The
+// forms are the CLDR plural categories of the locale: one, few and other.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// message is a translation, with one text per plural form; messages without plurals only
+// have other
+type message map[string]string
+
+func (m *message) UnmarshalJSON(b []byte) error {
+	var text string
+
+	if err := json.Unmarshal(b, &text); err == nil {
+		*m = message{"other": text}
+		return nil
+	}
+
+	var forms map[string]string
+
+	if err := json.Unmarshal(b, &forms); err != nil {
+		return fmt.Errorf("a message is a string, or an object of plural forms: %w", err)
+	}
+
+	if forms["other"] == "" {
+		return fmt.Errorf("plural forms %v have no other", forms)
+	}
+
+	*m = forms
+
+	return nil
+}
+
+// Catalog is the translations of every locale we support
+type Catalog struct {
+	// Default is the locale of users that ask for none we support
+	Default  string
+	messages map[string]map[string]message
+}
+
+// New returns an empty catalog; it only has the default locale, which needs no translations
+func New(defaultLocale string) *Catalog {
+	return &Catalog{
+		Default:  defaultLocale,
+		messages: map[string]map[string]message{defaultLocale: {}},
+	}
+}
+
+// Load returns a catalog with every .json file in fsys, named by its locale
+func Load(fsys fs.FS, defaultLocale string) (*Catalog, error) {
+	c := New(defaultLocale)
+
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		var messages map[string]message
+
+		if err := json.Unmarshal(content, &messages); err != nil {
+			return nil, fmt.Errorf("i18n: %s: %w", file, err)
+		}
+
+		c.messages[strings.TrimSuffix(path.Base(file), ".json")] = messages
+	}
+
+	return c, nil
+}
+
+// Locales returns the supported locales, sorted
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.messages))
+
+	for l := range c.messages {
+		locales = append(locales, l)
+	}
+
+	sort.Strings(locales)
+
+	return locales
+}
+
+// Match returns the supported locale that fits the preferences best. Each preference is a
+// locale, or a list of them like in an Accept-Language header; earlier preferences win over
+// later ones, whatever their weights.
+func (c *Catalog) Match(preferences ...string) string {
+	for _, p := range preferences {
+		for _, tag := range parseAcceptLanguage(p) {
+			if _, ok := c.messages[tag]; ok {
+				return tag
+			}
+
+			// de-AT is fine with de
+			base, _, _ := strings.Cut(tag, "-")
+
+			if _, ok := c.messages[base]; ok {
+				return base
+			}
+		}
+	}
+
+	return c.Default
+}
+
+// parseAcceptLanguage returns the lower case language tags of a header, best first
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if f, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = f
+			}
+		}
+
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+
+	return result
+}
+
+// Translator translates into one locale
+func (c *Catalog) Translator(locale string) *Translator {
+	messages, ok := c.messages[locale]
+
+	if !ok {
+		locale = c.Default
+		messages = c.messages[locale]
+	}
+
+	return &Translator{Locale: locale, messages: messages}
+}
+
+// Translator translates messages into one locale
+type Translator struct {
+	Locale   string
+	messages map[string]message
+}
+
+// T returns the translation of key, filled in with args like fmt.Sprintf. Without a
+// translation, the key itself is filled in.
+func (t *Translator) T(key string, args ...any) string {
+	if s, ok := t.Lookup(key, args...); ok {
+		return s
+	}
+
+	if len(args) == 0 {
+		return key
+	}
+
+	return fmt.Sprintf(key, args...)
+}
+
+// Lookup is T, but reports when there is no translation instead of using the key
+func (t *Translator) Lookup(key string, args ...any) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	m, ok := t.messages[key]
+	if !ok {
+		return "", false
+	}
+
+	text := m["other"]
+
+	if len(args) > 0 {
+		if n, ok := args[0].(int); ok {
+			if form, ok := m[PluralForm(t.Locale, n)]; ok {
+				text = form
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return text, true
+	}
+
+	return fmt.Sprintf(text, args...), true
+}
+
+// PluralForm returns the CLDR plural category of n in locale: one, few or other
+func PluralForm(locale string, n int) string {
+	if n < 0 {
+		n = -n
+	}
+
+	base, _, _ := strings.Cut(locale, "-")
+
+	switch base {
+	// Serbian, Croatian and Bosnian have a form for 2 to 4, except 12 to 14
+	case "sr", "hr", "bs":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return "one"
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return "few"
+		default:
+			return "other"
+		}
+
+	default:
+		if n == 1 {
+			return "one"
+		}
+
+		return "other"
+	}
+}
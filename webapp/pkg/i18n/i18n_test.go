@@ -0,0 +1,136 @@
+package i18n
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+var testFiles = fstest.MapFS{
+	"de.json": {Data: []byte(`{
+		"Log in first": "Bitte melde dich zuerst an",
+		"Hello %s": "Hallo %s",
+		"%d images": {"one": "%d Bild", "other": "%d Bilder"}
+	}`)},
+	"sr.json": {Data: []byte(`{
+		"%d images": {"one": "%d slika", "few": "%d slike", "other": "%d slika"}
+	}`)},
+	"README.md": {Data: []byte("not a catalog")},
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(testFiles, "en")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.Locales(), []string{"de", "en", "sr"}) {
+		t.Errorf("expected de, en and sr, but got %v", c.Locales())
+	}
+
+	var tests = []fstest.MapFS{
+		{"de.json": {Data: []byte(`{"Log in first": `)}},
+		{"de.json": {Data: []byte(`{"%d images": {"one": "%d Bild"}}`)}},
+		{"de.json": {Data: []byte(`{"Log in first": 1}`)}},
+	}
+
+	for _, files := range tests {
+		if _, err := Load(files, "en"); err == nil {
+			t.Errorf("expected an error for %s", files["de.json"].Data)
+		}
+	}
+}
+
+func TestCatalog_Match(t *testing.T) {
+	c, _ := Load(testFiles, "en")
+
+	var tests = []struct {
+		name        string
+		preferences []string
+		expected    string
+	}{
+		{"nothing", nil, "en"},
+		{"empty", []string{"", ""}, "en"},
+		{"exact", []string{"sr"}, "sr"},
+		{"region", []string{"de-AT"}, "de"},
+		{"underscore and case", []string{"DE_ch"}, "de"},
+		{"weights", []string{"fr;q=0.9, sr;q=0.5, de;q=0.8"}, "de"},
+		{"refused", []string{"de;q=0, sr;q=0.1"}, "sr"},
+		{"unsupported", []string{"fr, it;q=0.8, *"}, "en"},
+		{"earlier preference wins", []string{"", "sr", "de"}, "sr"},
+		{"header after choice", []string{"fr", "de, sr"}, "de"},
+	}
+
+	for _, e := range tests {
+		if actual := c.Match(e.preferences...); actual != e.expected {
+			t.Errorf("%s: expected %s, but got %s", e.name, e.expected, actual)
+		}
+	}
+}
+
+func TestTranslator(t *testing.T) {
+	c, _ := Load(testFiles, "en")
+
+	var tests = []struct {
+		name     string
+		locale   string
+		key      string
+		args     []any
+		expected string
+	}{
+		{"translated", "de", "Log in first", nil, "Bitte melde dich zuerst an"},
+		{"with args", "de", "Hello %s", []any{"Jack"}, "Hallo Jack"},
+		{"german one", "de", "%d images", []any{1}, "1 Bild"},
+		{"german other", "de", "%d images", []any{0}, "0 Bilder"},
+		{"serbian one", "sr", "%d images", []any{21}, "21 slika"},
+		{"serbian few", "sr", "%d images", []any{3}, "3 slike"},
+		{"serbian teen", "sr", "%d images", []any{12}, "12 slika"},
+		{"missing", "sr", "Log in first", nil, "Log in first"},
+		{"missing with args", "en", "Hello %s", []any{"Jack"}, "Hello Jack"},
+		{"unsupported locale", "fr", "Hello %s", []any{"Jack"}, "Hello Jack"},
+	}
+
+	for _, e := range tests {
+		if actual := c.Translator(e.locale).T(e.key, e.args...); actual != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, actual)
+		}
+	}
+
+	if _, ok := c.Translator("sr").Lookup("Log in first"); ok {
+		t.Error("expected no translation for Log in first in sr")
+	}
+
+	var nilTranslator *Translator
+
+	if _, ok := nilTranslator.Lookup("Log in first"); ok {
+		t.Error("expected no translation from a nil translator")
+	}
+}
+
+func TestPluralForm(t *testing.T) {
+	var tests = []struct {
+		locale   string
+		n        int
+		expected string
+	}{
+		{"en", 1, "one"},
+		{"en", 0, "other"},
+		{"en", 2, "other"},
+		{"de-AT", 1, "one"},
+		{"sr", 1, "one"},
+		{"sr", 11, "other"},
+		{"sr", 101, "one"},
+		{"sr", 2, "few"},
+		{"sr", 14, "other"},
+		{"sr", 24, "few"},
+		{"sr", 5, "other"},
+		{"sr", -2, "few"},
+	}
+
+	for _, e := range tests {
+		if actual := PluralForm(e.locale, e.n); actual != e.expected {
+			t.Errorf("%s %d: expected %s, but got %s", e.locale, e.n, e.expected, actual)
+		}
+	}
+}
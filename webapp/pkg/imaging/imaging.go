@@ -0,0 +1,212 @@
+// Package imaging turns uploaded pictures into the variants we show: decoded on the server,
+// turned upright, scaled down and encoded again. Encoding again drops all metadata, like the
+// EXIF location phones put into their photos.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+
+	// formats we accept for uploads; webp decodes WebP, too
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/chai2010/webp"
+	"golang.org/x/image/draw"
+)
+
+// the most pixels we decode; a small file can claim to be a huge image
+const maxPixels = 50_000_000
+
+// the JPEG quality of variants
+const jpegQuality = 85
+
+// ErrUnsupported is returned for content that is not an image we can decode
+var ErrUnsupported = errors.New("imaging: unsupported image")
+
+// ErrTooLarge is returned for images with more than maxPixels pixels
+var ErrTooLarge = errors.New("imaging: image too large")
+
+// Format is what variants are encoded as
+type Format string
+
+const (
+	JPEG Format = "jpeg"
+	WebP Format = "webp"
+)
+
+// ContentType is the media type of the format
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Ext is the file extension of the format
+func (f Format) Ext() string {
+	if f == JPEG {
+		return ".jpg"
+	}
+
+	return "." + string(f)
+}
+
+// ParseFormat checks a format name, like the ones from command line flags
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case JPEG, WebP:
+		return Format(s), nil
+	}
+
+	return "", fmt.Errorf("imaging: unknown format %q", s)
+}
+
+// Variant is one size we keep of every image
+type Variant struct {
+	Name string
+	// Size is the longest side, in pixels; smaller images are not scaled up
+	Size int
+	// Square crops the middle of the image before scaling
+	Square bool
+}
+
+// the names of the variants
+const (
+	Thumbnail = "thumbnail"
+	Medium    = "medium"
+	Large     = "large"
+)
+
+// DefaultVariants are the sizes profile pictures come in, largest first
+var DefaultVariants = []Variant{
+	{Name: Large, Size: 1600},
+	{Name: Medium, Size: 640},
+	{Name: Thumbnail, Size: 160, Square: true},
+}
+
+// Output is one encoded variant
+type Output struct {
+	Variant string
+	Width   int
+	Height  int
+	Data    []byte
+}
+
+// Process decodes content, turns it upright, and encodes every variant in format
+func Process(content []byte, variants []Variant, format Format) ([]Output, error) {
+	img, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make([]Output, 0, len(variants))
+
+	for _, v := range variants {
+		scaled := Resize(img, v)
+
+		var buf bytes.Buffer
+
+		if err := Encode(&buf, scaled, format); err != nil {
+			return nil, err
+		}
+
+		b := scaled.Bounds()
+
+		outputs = append(outputs, Output{Variant: v.Name, Width: b.Dx(), Height: b.Dy(), Data: buf.Bytes()})
+	}
+
+	return outputs, nil
+}
+
+// Check reads just the header of an image, to tell quickly if Decode will take it
+func Check(content []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return ErrUnsupported
+	}
+
+	if config.Width*config.Height > maxPixels {
+		return ErrTooLarge
+	}
+
+	return nil
+}
+
+// Decode decodes a JPEG, PNG, GIF or WebP image, and applies the EXIF orientation of JPEGs
+func Decode(content []byte) (image.Image, error) {
+	if err := Check(content); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	return orient(img, orientation(content)), nil
+}
+
+// Resize scales img down so its longest side is v.Size, cropping it square first if v.Square
+func Resize(img image.Image, v Variant) image.Image {
+	src := img.Bounds()
+
+	if v.Square {
+		side := src.Dx()
+		if src.Dy() < side {
+			side = src.Dy()
+		}
+
+		x := src.Min.X + (src.Dx()-side)/2
+		y := src.Min.Y + (src.Dy()-side)/2
+		src = image.Rect(x, y, x+side, y+side)
+	}
+
+	w, h := src.Dx(), src.Dy()
+
+	if w > v.Size || h > v.Size {
+		if w >= h {
+			w, h = v.Size, h*v.Size/w
+		} else {
+			w, h = w*v.Size/h, v.Size
+		}
+	}
+
+	if w < 1 {
+		w = 1
+	}
+
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	if w == src.Dx() && h == src.Dy() {
+		draw.Copy(dst, image.Point{}, img, src, draw.Src, nil)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	}
+
+	return dst
+}
+
+// Encode writes img in format. JPEGs have no transparency, so it becomes white; WebPs keep it.
+// WebPs are lossy, at the quality of JPEGs, and encoded by libwebp.
+func Encode(w io.Writer, img image.Image, format Format) error {
+	switch format {
+	case JPEG:
+		b := img.Bounds()
+		flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: jpegQuality})
+	case WebP:
+		return webp.Encode(w, img, &webp.Options{Quality: jpegQuality})
+	}
+
+	return fmt.Errorf("imaging: unknown format %q", format)
+}
@@ -0,0 +1,237 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// halves is a w x h image, red on the left and blue on the right
+func halves(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+// withOrientation returns a JPEG of img with an EXIF segment that has orientation o, and a bit of GPS data
+func withOrientation(t *testing.T, img image.Image, o uint16) []byte {
+	var buf bytes.Buffer
+
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a little endian TIFF header, and one directory with one entry
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, o)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	tiff = append(tiff, "GPS 45.2671 19.8335"...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	app1 := []byte{0xff, 0xe1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	b := buf.Bytes()
+
+	return append(append(append([]byte{}, b[:2]...), app1...), b[2:]...)
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xc000 && g < 0x4000 && b < 0x4000
+}
+
+func isBlue(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return b > 0xc000 && r < 0x4000 && g < 0x4000
+}
+
+func Test_orientation(t *testing.T) {
+	for o := uint16(1); o <= 8; o++ {
+		if got := orientation(withOrientation(t, halves(8, 4), o)); got != int(o) {
+			t.Errorf("expected orientation %d, but got %d", o, got)
+		}
+	}
+
+	var plain bytes.Buffer
+	_ = jpeg.Encode(&plain, halves(8, 4), nil)
+
+	var tests = []struct {
+		name    string
+		content []byte
+	}{
+		{"no exif", plain.Bytes()},
+		{"png", []byte("\x89PNG\r\n\x1a\n")},
+		{"truncated", withOrientation(t, halves(8, 4), 6)[:30]},
+		{"empty", nil},
+	}
+
+	for _, e := range tests {
+		if got := orientation(e.content); got != 1 {
+			t.Errorf("%s: expected orientation 1, but got %d", e.name, got)
+		}
+	}
+}
+
+func TestDecode_Orientation(t *testing.T) {
+	// red is on the left of the stored image; where it ends up when turned upright
+	var tests = []struct {
+		o             uint16
+		width, height int
+		redAt, blueAt image.Point
+	}{
+		{1, 32, 16, image.Pt(4, 8), image.Pt(28, 8)},
+		{2, 32, 16, image.Pt(28, 8), image.Pt(4, 8)},
+		{3, 32, 16, image.Pt(28, 8), image.Pt(4, 8)},
+		{4, 32, 16, image.Pt(4, 8), image.Pt(28, 8)},
+		{5, 16, 32, image.Pt(8, 4), image.Pt(8, 28)},
+		{6, 16, 32, image.Pt(8, 4), image.Pt(8, 28)},
+		{7, 16, 32, image.Pt(8, 28), image.Pt(8, 4)},
+		{8, 16, 32, image.Pt(8, 28), image.Pt(8, 4)},
+	}
+
+	for _, e := range tests {
+		img, err := Decode(withOrientation(t, halves(32, 16), e.o))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := img.Bounds()
+
+		if b.Dx() != e.width || b.Dy() != e.height {
+			t.Errorf("orientation %d: expected %dx%d, but got %dx%d", e.o, e.width, e.height, b.Dx(), b.Dy())
+			continue
+		}
+
+		if !isRed(img.At(e.redAt.X, e.redAt.Y)) || !isBlue(img.At(e.blueAt.X, e.blueAt.Y)) {
+			t.Errorf("orientation %d: image is not upright", e.o)
+		}
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	if _, err := Decode([]byte("hello, world")); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected unsupported, but got %v", err)
+	}
+
+	// a PNG header claiming 100000 x 100000 pixels
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+
+	huge := buf.Bytes()
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	if _, err := Decode(huge); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected too large, but got %v", err)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	var tests = []struct {
+		name     string
+		width    int
+		height   int
+		format   Format
+		expected map[string]image.Point
+	}{
+		{"landscape jpeg", 2000, 1000, JPEG, map[string]image.Point{Large: {1600, 800}, Medium: {640, 320}, Thumbnail: {160, 160}}},
+		{"portrait webp", 300, 600, WebP, map[string]image.Point{Large: {300, 600}, Medium: {300, 600}, Thumbnail: {160, 160}}},
+		{"small", 100, 40, JPEG, map[string]image.Point{Large: {100, 40}, Medium: {100, 40}, Thumbnail: {40, 40}}},
+	}
+
+	for _, e := range tests {
+		content := withOrientation(t, halves(e.width, e.height), 1)
+
+		outputs, err := Process(content, DefaultVariants, e.format)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if len(outputs) != len(DefaultVariants) {
+			t.Fatalf("%s: expected %d variants, but got %d", e.name, len(DefaultVariants), len(outputs))
+		}
+
+		for _, o := range outputs {
+			size := e.expected[o.Variant]
+
+			if o.Width != size.X || o.Height != size.Y {
+				t.Errorf("%s %s: expected %dx%d, but got %dx%d", e.name, o.Variant, size.X, size.Y, o.Width, o.Height)
+			}
+
+			config, format, err := image.DecodeConfig(bytes.NewReader(o.Data))
+
+			if err != nil || Format(format) != e.format || config.Width != o.Width || config.Height != o.Height {
+				t.Errorf("%s %s: output is not a %dx%d %s (%v)", e.name, o.Variant, o.Width, o.Height, e.format, err)
+			}
+
+			// re-encoding drops the EXIF segment, and the location in it
+			if bytes.Contains(o.Data, []byte("Exif")) || bytes.Contains(o.Data, []byte("GPS")) {
+				t.Errorf("%s %s: output still has EXIF data", e.name, o.Variant)
+			}
+		}
+	}
+}
+
+func TestEncode_Transparency(t *testing.T) {
+	// transparent on the left, opaque blue on the right
+	img := halves(64, 32)
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.NRGBA{})
+		}
+	}
+
+	var tests = []struct {
+		format        Format
+		expectedAlpha uint32
+	}{
+		{JPEG, 0xffff},
+		{WebP, 0},
+	}
+
+	for _, e := range tests {
+		var buf bytes.Buffer
+
+		if err := Encode(&buf, img, e.format); err != nil {
+			t.Fatalf("%s: %s", e.format, err)
+		}
+
+		decoded, format, err := image.Decode(&buf)
+		if err != nil || Format(format) != e.format {
+			t.Fatalf("%s: could not decode the output as %s: %v", e.format, e.format, err)
+		}
+
+		if _, _, _, a := decoded.At(8, 16).RGBA(); a != e.expectedAlpha {
+			t.Errorf("%s: expected alpha %#x on the left, but got %#x", e.format, e.expectedAlpha, a)
+		}
+
+		if r, _, b, _ := decoded.At(56, 16).RGBA(); b < 0xc000 || r > 0x4000 {
+			t.Errorf("%s: expected blue on the right, but got %v", e.format, decoded.At(56, 16))
+		}
+	}
+}
@@ -0,0 +1,401 @@
+// Package jobs runs work in the background, outside of requests. Jobs are queued in a
+// repository.JobRepo, so they survive restarts and are shared by every instance of the
+// application; each job is run by one worker at a time. Failed jobs are tried again later,
+// waiting longer after every attempt, and end up as dead letters when they keep failing.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// PruneKind is the job that removes old finished jobs; every Runner has it
+const PruneKind = "jobs.prune"
+
+// how long finished jobs are kept, so we can look at what happened
+const keepDone = 7 * 24 * time.Hour
+
+// Handler does the work of a job. Returning an error tries the job again later, unless the
+// error is Permanent. Handlers can run more than once for a job, when a worker stops halfway.
+type Handler func(ctx context.Context, job *data.Job) error
+
+// Runner claims jobs and hands them to the handlers of their kind
+type Runner struct {
+	Repo repository.JobRepo
+	// Workers is how many jobs run at the same time
+	Workers int
+	// PollInterval is how long idle workers wait before they look for jobs again
+	PollInterval time.Duration
+	// LockTimeout is how long a job can run; after that, its lock is stale and another worker takes over
+	LockTimeout time.Duration
+	// Backoff is how long to wait before the next attempt, after a job failed attempt times
+	Backoff func(attempt int) time.Duration
+	// Now is the clock
+	Now func() time.Time
+
+	mu        sync.Mutex
+	handlers  map[string]Handler
+	schedules []schedule
+}
+
+// schedule is a job that is queued every interval
+type schedule struct {
+	kind     string
+	interval time.Duration
+	// queued is the start of the last interval the job was queued for by this runner
+	queued time.Time
+}
+
+// New returns a Runner with sensible defaults, that prunes finished jobs every hour
+func New(repo repository.JobRepo) *Runner {
+	r := &Runner{
+		Repo:         repo,
+		Workers:      2,
+		PollInterval: time.Second,
+		LockTimeout:  5 * time.Minute,
+		Backoff:      DefaultBackoff,
+		Now:          time.Now,
+		handlers:     map[string]Handler{},
+	}
+
+	r.Handle(PruneKind, r.prune)
+	r.Every(PruneKind, time.Hour)
+
+	return r
+}
+
+// DefaultBackoff waits 10 seconds after the first attempt, and twice as long after every
+// other one, up to an hour
+func DefaultBackoff(attempt int) time.Duration {
+	wait := 10 * time.Second
+
+	for i := 1; i < attempt && wait < time.Hour; i++ {
+		wait *= 2
+	}
+
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+
+	return wait
+}
+
+// Handle sets the handler for a kind of job
+func (r *Runner) Handle(kind string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers[kind] = h
+}
+
+// Every queues a job of kind once every interval, counted from midnight UTC. However many
+// instances of the application run, the job runs once per interval.
+func (r *Runner) Every(kind string, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.schedules = append(r.schedules, schedule{kind: kind, interval: interval})
+}
+
+// Option changes a job before it is queued
+type Option func(job *data.Job)
+
+// At runs the job at t, instead of right away
+func At(t time.Time) Option {
+	return func(job *data.Job) {
+		job.RunAt = t
+	}
+}
+
+// After runs the job once d has passed
+func After(d time.Duration) Option {
+	return func(job *data.Job) {
+		job.RunAt = time.Now().Add(d)
+	}
+}
+
+// MaxAttempts is how often the job is tried before it is dead
+func MaxAttempts(n int) Option {
+	return func(job *data.Job) {
+		job.MaxAttempts = n
+	}
+}
+
+// Unique keeps the job from being queued when a job with the same key is
+func Unique(key string) Option {
+	return func(job *data.Job) {
+		job.UniqueKey = key
+	}
+}
+
+// Enqueue queues a job of kind, with payload encoded as JSON. It returns the id of the job,
+// or 0 when a Unique job with the same key is queued already.
+func (r *Runner) Enqueue(ctx context.Context, kind string, payload any, opts ...Option) (int64, error) {
+	job := data.Job{Kind: kind}
+
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+
+		job.Payload = b
+	}
+
+	for _, opt := range opts {
+		opt(&job)
+	}
+
+	return r.Repo.EnqueueJob(ctx, job)
+}
+
+// Decode reads the payload of a job into v. A payload we can not read will not get
+// better with time, so the error is Permanent.
+func Decode(job *data.Job, v any) error {
+	if err := json.Unmarshal(job.Payload, v); err != nil {
+		return Permanent(fmt.Errorf("jobs: bad payload for %s: %w", job.Kind, err))
+	}
+
+	return nil
+}
+
+// permanentError is a failure trying again won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as a failure trying again won't fix; the job is dead right away
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// IsPermanent tells if err, or an error it wraps, was marked with Permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+
+	return errors.As(err, &p)
+}
+
+// Run starts the workers and the scheduler, and blocks until ctx is done and the jobs
+// that are running have returned
+func (r *Runner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		r.schedule(ctx)
+	}()
+
+	wg.Wait()
+}
+
+// work runs jobs until ctx is done, waiting a bit when there are none
+func (r *Runner) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := r.RunOnce(ctx)
+
+		if err != nil && ctx.Err() == nil {
+			log.Println("error claiming job:", err)
+		}
+
+		if ran {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.PollInterval):
+		}
+	}
+}
+
+// schedule queues the jobs of the current interval of every schedule, until ctx is done
+func (r *Runner) schedule(ctx context.Context) {
+	for {
+		r.EnqueueScheduled(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.PollInterval):
+		}
+	}
+}
+
+// EnqueueScheduled queues the jobs of the current interval of every schedule that are not
+// queued yet. The runner only goes to the database once per interval and schedule; the
+// unique key takes care of the other instances.
+func (r *Runner) EnqueueScheduled(ctx context.Context) {
+	r.mu.Lock()
+	schedules := append([]schedule{}, r.schedules...)
+	r.mu.Unlock()
+
+	now := r.Now()
+
+	for i, s := range schedules {
+		slot := now.UTC().Truncate(s.interval)
+		if slot.Equal(s.queued) {
+			continue
+		}
+
+		key := s.kind + "@" + slot.Format(time.RFC3339)
+
+		if _, err := r.Enqueue(ctx, s.kind, nil, At(slot), Unique(key)); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("error scheduling %s: %s", s.kind, err)
+			}
+
+			continue
+		}
+
+		r.mu.Lock()
+		r.schedules[i].queued = slot
+		r.mu.Unlock()
+	}
+}
+
+// RunOnce claims one due job and runs it. It returns false when no job was due.
+func (r *Runner) RunOnce(ctx context.Context) (bool, error) {
+	job, err := r.Repo.ClaimJob(ctx, r.kinds(), r.LockTimeout)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	r.run(ctx, job)
+
+	return true, nil
+}
+
+// Drain runs jobs until none are due; tests use it to run what a request queued
+func (r *Runner) Drain(ctx context.Context) error {
+	for {
+		ran, err := r.RunOnce(ctx)
+
+		if err != nil || !ran {
+			return err
+		}
+	}
+}
+
+// run runs a claimed job, and records how it went
+func (r *Runner) run(ctx context.Context, job *data.Job) {
+	var err error
+
+	// a worker stopped while running the job for the last time
+	if job.Attempts > job.MaxAttempts {
+		err = Permanent(errors.New("jobs: the job did not finish in time"))
+	} else {
+		err = r.call(ctx, job)
+	}
+
+	switch {
+	case err == nil:
+		err = r.Repo.CompleteJob(ctx, job)
+	case IsPermanent(err) || job.Attempts >= job.MaxAttempts:
+		log.Printf("job %d (%s) failed for good: %s", job.ID, job.Kind, err)
+		err = r.Repo.BuryJob(ctx, job, err.Error())
+	default:
+		log.Printf("job %d (%s) failed, attempt %d of %d: %s", job.ID, job.Kind, job.Attempts, job.MaxAttempts, err)
+		err = r.Repo.RetryJob(ctx, job, r.Now().Add(r.Backoff(job.Attempts)), err.Error())
+	}
+
+	// another worker took over the job, because we took too long
+	if errors.Is(err, repository.ErrNotFound) {
+		log.Printf("job %d (%s) was taken over by another worker", job.ID, job.Kind)
+		return
+	}
+
+	if err != nil {
+		log.Printf("error updating job %d (%s): %s", job.ID, job.Kind, err)
+	}
+}
+
+// call runs the handler of a job, with a deadline of the lock timeout; a panic is an error
+func (r *Runner) call(ctx context.Context, job *data.Job) (err error) {
+	r.mu.Lock()
+	h := r.handlers[job.Kind]
+	r.mu.Unlock()
+
+	if h == nil {
+		return Permanent(fmt.Errorf("jobs: no handler for %s", job.Kind))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.LockTimeout)
+	defer cancel()
+
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("job %d (%s) panicked: %v\n%s", job.ID, job.Kind, p, debug.Stack())
+			err = fmt.Errorf("jobs: panic: %v", p)
+		}
+	}()
+
+	return h(ctx, job)
+}
+
+// kinds are the kinds of jobs this runner has handlers for
+func (r *Runner) kinds() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kinds := make([]string, 0, len(r.handlers))
+	for k := range r.handlers {
+		kinds = append(kinds, k)
+	}
+
+	return kinds
+}
+
+// prune removes finished jobs once they are old enough, but keeps the ones of the current
+// interval of every schedule, so they are not queued again
+func (r *Runner) prune(ctx context.Context, job *data.Job) error {
+	keep := keepDone
+
+	r.mu.Lock()
+	for _, s := range r.schedules {
+		if s.interval > keep {
+			keep = s.interval
+		}
+	}
+	r.mu.Unlock()
+
+	_, err := r.Repo.PruneJobs(ctx, r.Now().Add(-keep))
+
+	return err
+}
@@ -0,0 +1,303 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/repository/dbrepo"
+)
+
+// newTestRunner returns a runner on an in-memory queue that retries right away
+func newTestRunner() (*Runner, *dbrepo.MemoryJobRepo) {
+	repo := dbrepo.NewMemoryJobRepo()
+
+	r := New(repo)
+	r.Backoff = func(int) time.Duration { return 0 }
+
+	return r, repo
+}
+
+func TestRunner_Drain(t *testing.T) {
+	var tests = []struct {
+		name             string
+		handler          func(calls int) error
+		expectedCalls    int
+		expectedStatus   string
+		expectedAttempts int
+	}{
+		{"success", func(int) error { return nil }, 1, data.JobDone, 1},
+		{"fails once", func(calls int) error {
+			if calls == 1 {
+				return errors.New("try again")
+			}
+			return nil
+		}, 2, data.JobDone, 2},
+		{"always fails", func(int) error { return errors.New("broken") }, 3, data.JobDead, 3},
+		{"permanent", func(int) error { return Permanent(errors.New("never works")) }, 1, data.JobDead, 1},
+		{"panics", func(int) error { panic("oops") }, 3, data.JobDead, 3},
+	}
+
+	for _, e := range tests {
+		r, repo := newTestRunner()
+
+		calls := 0
+		r.Handle("test", func(ctx context.Context, job *data.Job) error {
+			calls++
+			return e.handler(calls)
+		})
+
+		id, err := r.Enqueue(context.Background(), "test", map[string]int{"n": 1}, MaxAttempts(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Drain(context.Background()); err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if calls != e.expectedCalls {
+			t.Errorf("%s: expected %d calls, but got %d", e.name, e.expectedCalls, calls)
+		}
+
+		jobs, _ := repo.Jobs(context.Background(), data.JobFilter{Kind: "test"})
+
+		if len(jobs) != 1 || jobs[0].ID != id {
+			t.Fatalf("%s: expected job %d, but got %+v", e.name, id, jobs)
+		}
+
+		if jobs[0].Status != e.expectedStatus || jobs[0].Attempts != e.expectedAttempts {
+			t.Errorf("%s: expected %s after %d attempts, but got %s after %d", e.name, e.expectedStatus, e.expectedAttempts, jobs[0].Status, jobs[0].Attempts)
+		}
+
+		if e.expectedStatus == data.JobDead && jobs[0].LastError == "" {
+			t.Errorf("%s: dead job has no error", e.name)
+		}
+	}
+}
+
+func TestRunner_Backoff(t *testing.T) {
+	r, repo := newTestRunner()
+	r.Backoff = DefaultBackoff
+
+	now := time.Date(2022, 8, 19, 12, 0, 0, 0, time.UTC)
+	repo.Now = func() time.Time { return now }
+	r.Now = repo.Now
+
+	calls := 0
+	r.Handle("test", func(ctx context.Context, job *data.Job) error {
+		calls++
+		return errors.New("broken")
+	})
+
+	_, _ = r.Enqueue(context.Background(), "test", nil, At(now))
+	_ = r.Drain(context.Background())
+
+	if calls != 1 {
+		t.Fatalf("expected 1 call before the retry is due, but got %d", calls)
+	}
+
+	jobs, _ := repo.Jobs(context.Background(), data.JobFilter{})
+
+	if expected := now.Add(10 * time.Second); !jobs[0].RunAt.Equal(expected) || jobs[0].Status != data.JobPending {
+		t.Errorf("expected a pending retry at %s, but got %s at %s", expected, jobs[0].Status, jobs[0].RunAt)
+	}
+
+	now = now.Add(10 * time.Second)
+	_ = r.Drain(context.Background())
+
+	if calls != 2 {
+		t.Errorf("expected 2 calls once the retry is due, but got %d", calls)
+	}
+}
+
+func TestRunner_StaleLock(t *testing.T) {
+	r, repo := newTestRunner()
+
+	now := time.Now()
+	repo.Now = func() time.Time { return now }
+
+	calls := 0
+	r.Handle("test", func(ctx context.Context, job *data.Job) error {
+		calls++
+		return nil
+	})
+
+	_, _ = r.Enqueue(context.Background(), "test", nil)
+
+	// a worker claims the job, and stops before it finishes
+	_, _ = repo.ClaimJob(context.Background(), []string{"test"}, r.LockTimeout)
+
+	if ran, _ := r.RunOnce(context.Background()); ran {
+		t.Error("ran a job another worker holds")
+	}
+
+	now = now.Add(r.LockTimeout + time.Second)
+
+	if ran, _ := r.RunOnce(context.Background()); !ran || calls != 1 {
+		t.Errorf("expected the stale job to run again, but it ran %d times", calls)
+	}
+}
+
+func TestRunner_EnqueueScheduled(t *testing.T) {
+	r, repo := newTestRunner()
+
+	now := time.Date(2022, 8, 19, 12, 10, 0, 0, time.UTC)
+	r.Now = func() time.Time { return now }
+
+	r.Handle("report", func(ctx context.Context, job *data.Job) error { return nil })
+	r.Every("report", time.Hour)
+
+	// two instances scheduling in the same hour queue one job
+	r.EnqueueScheduled(context.Background())
+	r.EnqueueScheduled(context.Background())
+
+	jobs, _ := repo.Jobs(context.Background(), data.JobFilter{Kind: "report"})
+
+	if len(jobs) != 1 || !jobs[0].RunAt.Equal(time.Date(2022, 8, 19, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected one job at 12:00, but got %+v", jobs)
+	}
+
+	now = now.Add(time.Hour)
+	r.EnqueueScheduled(context.Background())
+
+	jobs, _ = repo.Jobs(context.Background(), data.JobFilter{Kind: "report"})
+
+	if len(jobs) != 2 {
+		t.Errorf("expected a second job in the next hour, but got %d jobs", len(jobs))
+	}
+
+	// every runner prunes old jobs
+	if jobs, _ := repo.Jobs(context.Background(), data.JobFilter{Kind: PruneKind}); len(jobs) != 2 {
+		t.Errorf("expected 2 prune jobs, but got %d", len(jobs))
+	}
+}
+
+// countingJobRepo counts the jobs that are queued, and fails while err is set
+type countingJobRepo struct {
+	repository.JobRepo
+	enqueued int
+	err      error
+}
+
+func (m *countingJobRepo) EnqueueJob(ctx context.Context, job data.Job) (int64, error) {
+	m.enqueued++
+
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	return m.JobRepo.EnqueueJob(ctx, job)
+}
+
+func TestRunner_EnqueueScheduled_OncePerInterval(t *testing.T) {
+	repo := &countingJobRepo{JobRepo: dbrepo.NewMemoryJobRepo()}
+
+	// the only schedule is pruning, every hour
+	r := New(repo)
+
+	now := time.Date(2022, 8, 19, 12, 10, 0, 0, time.UTC)
+	r.Now = func() time.Time { return now }
+
+	var tests = []struct {
+		name     string
+		err      error
+		advance  time.Duration
+		expected int
+	}{
+		{"database is down", errors.New("database is down"), 0, 1},
+		{"tried again after an error", nil, time.Second, 2},
+		{"same hour", nil, time.Minute, 2},
+		{"later in the same hour", nil, 40 * time.Minute, 2},
+		{"next hour", nil, 10 * time.Minute, 3},
+	}
+
+	for _, e := range tests {
+		repo.err = e.err
+		now = now.Add(e.advance)
+
+		r.EnqueueScheduled(context.Background())
+
+		if repo.enqueued != e.expected {
+			t.Errorf("%s: expected %d jobs to be queued, but got %d", e.name, e.expected, repo.enqueued)
+		}
+	}
+}
+
+func TestRunner_Unique(t *testing.T) {
+	r, _ := newTestRunner()
+
+	first, _ := r.Enqueue(context.Background(), "test", nil, Unique("user-1"))
+	second, _ := r.Enqueue(context.Background(), "test", nil, Unique("user-1"))
+
+	if first == 0 || second != 0 {
+		t.Errorf("expected only the first job to be queued, but got ids %d and %d", first, second)
+	}
+}
+
+func TestRunner_Requeue(t *testing.T) {
+	r, repo := newTestRunner()
+
+	fail := true
+	r.Handle("test", func(ctx context.Context, job *data.Job) error {
+		if fail {
+			return Permanent(errors.New("not yet"))
+		}
+		return nil
+	})
+
+	id, _ := r.Enqueue(context.Background(), "test", nil)
+	_ = r.Drain(context.Background())
+
+	fail = false
+
+	if err := repo.RequeueJob(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = r.Drain(context.Background())
+
+	if jobs, _ := repo.Jobs(context.Background(), data.JobFilter{Status: data.JobDone}); len(jobs) != 1 {
+		t.Errorf("expected the requeued job to be done, but got %+v", jobs)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var payload struct {
+		UserID int `json:"user_id"`
+	}
+
+	err := Decode(&data.Job{Kind: "test", Payload: []byte(`{"user_id": 3}`)}, &payload)
+
+	if err != nil || payload.UserID != 3 {
+		t.Errorf("expected user 3, but got %d (%v)", payload.UserID, err)
+	}
+
+	err = Decode(&data.Job{Kind: "test", Payload: []byte(`{"user_id": "three"}`)}, &payload)
+
+	if !IsPermanent(err) {
+		t.Errorf("expected a permanent error, but got %v", err)
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	var tests = []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{50, time.Hour},
+	}
+
+	for _, e := range tests {
+		if got := DefaultBackoff(e.attempt); got != e.expected {
+			t.Errorf("attempt %d: expected %s, but got %s", e.attempt, e.expected, got)
+		}
+	}
+}
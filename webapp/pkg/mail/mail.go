@@ -0,0 +1,148 @@
+// Package mail sends email. The application talks to a Mailer: SMTP hands messages to a mail
+// server, File writes them to a directory and Memory keeps them, for local use and tests.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidAddress is returned for messages with an address we can't put into a header
+var ErrInvalidAddress = errors.New("mail: invalid address")
+
+// Message is a plain text email to one recipient
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// now is the clock; tests replace it
+var now = time.Now
+
+// Bytes formats the message as it goes over the wire, with from as the sender
+func (m Message) Bytes(from string) ([]byte, error) {
+	for _, addr := range []string{from, m.To} {
+		if addr == "" || strings.ContainsAny(addr, "\r\n") || !strings.Contains(addr, "@") {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, addr)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	// encoding the subject also keeps line breaks in it from starting new headers
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Text, "\r\n", "\n"), "\n", "\r\n"))
+
+	return buf.Bytes(), nil
+}
+
+// SMTP sends messages through a mail server
+type SMTP struct {
+	// Addr is the host:port of the server
+	Addr string
+	// Username and Password log in, when Username is set; the server has to support TLS then
+	Username string
+	Password string
+	From     string
+}
+
+// Send hands the message to the server
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	msg, err := m.Bytes(s.From)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, msg)
+}
+
+// File writes every message to a .eml file in Dir, to be opened with a mail program
+type File struct {
+	Dir  string
+	From string
+}
+
+// Send writes the message to a new file
+func (f *File) Send(ctx context.Context, m Message) error {
+	msg, err := m.Bytes(f.From)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d.eml", now().UnixNano())
+
+	return os.WriteFile(filepath.Join(f.Dir, name), msg, 0644)
+}
+
+// Memory keeps messages, so tests can look at what was sent
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send keeps the message
+func (mem *Memory) Send(ctx context.Context, m Message) error {
+	if _, err := m.Bytes("memory@localhost"); err != nil {
+		return err
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.messages = append(mem.messages, m)
+
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (mem *Memory) Messages() []Message {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	return append([]Message{}, mem.messages...)
+}
+
+// Reset forgets the messages sent so far
+func (mem *Memory) Reset() {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.messages = nil
+}
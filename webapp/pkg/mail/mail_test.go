@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage_Bytes(t *testing.T) {
+	now = func() time.Time { return time.Date(2022, 8, 19, 12, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	m := Message{To: "jack@example.com", Subject: "Grüße", Text: "line one\nline two"}
+
+	b, err := m.Bytes("app@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From: app@example.com\r\n" +
+		"To: jack@example.com\r\n" +
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"Date: Fri, 19 Aug 2022 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"line one\r\nline two"
+
+	if string(b) != expected {
+		t.Errorf("expected\n%q\nbut got\n%q", expected, b)
+	}
+}
+
+func TestMessage_BytesInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		to   string
+		from string
+	}{
+		{"no recipient", "", "app@example.com"},
+		{"header in the recipient", "jack@example.com\r\nBcc: all@example.com", "app@example.com"},
+		{"not an address", "jack", "app@example.com"},
+		{"no sender", "jack@example.com", ""},
+	}
+
+	for _, e := range tests {
+		_, err := Message{To: e.to, Subject: "Hi"}.Bytes(e.from)
+
+		if !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("%s: expected an invalid address, but got %v", e.name, err)
+		}
+	}
+
+	// line breaks in the subject are encoded, so they can't add headers
+	b, _ := Message{To: "jack@example.com", Subject: "Hi\r\nBcc: all@example.com"}.Bytes("app@example.com")
+
+	if strings.Contains(string(b), "\r\nBcc:") {
+		t.Error("subject added a header")
+	}
+}
+
+func TestFile_Send(t *testing.T) {
+	f := &File{Dir: filepath.Join(t.TempDir(), "mail"), From: "app@example.com"}
+
+	for i := 0; i < 2; i++ {
+		if err := f.Send(context.Background(), Message{To: "jack@example.com", Subject: "Hi", Text: "Hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := os.ReadDir(f.Dir)
+
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, but got %d", len(files))
+	}
+
+	content, _ := os.ReadFile(filepath.Join(f.Dir, files[0].Name()))
+
+	if !strings.HasSuffix(files[0].Name(), ".eml") || !strings.Contains(string(content), "To: jack@example.com") {
+		t.Errorf("unexpected file %s: %s", files[0].Name(), content)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	mem := &Memory{}
+
+	_ = mem.Send(context.Background(), Message{To: "jack@example.com", Subject: "One"})
+	_ = mem.Send(context.Background(), Message{To: "jill@example.com", Subject: "Two"})
+
+	if err := mem.Send(context.Background(), Message{To: "nobody"}); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("expected an invalid address, but got %v", err)
+	}
+
+	messages := mem.Messages()
+
+	if len(messages) != 2 || messages[1].Subject != "Two" {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	mem.Reset()
+
+	if len(mem.Messages()) != 0 {
+		t.Error("messages are left after a reset")
+	}
+}
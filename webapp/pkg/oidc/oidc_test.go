@@ -0,0 +1,185 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/oidc/oidctest"
+	"webapp/pkg/random"
+)
+
+// authorize follows the provider redirect and returns the code and state it sends back
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) (string, string) {
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	loc, err := res.Location()
+	if err != nil {
+		t.Fatalf("provider did not redirect back: %s", err)
+	}
+
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestProvider_Flow(t *testing.T) {
+	srv := oidctest.NewServer("webapp")
+	defer srv.Close()
+
+	p := NewProvider(Config{Name: "test", Issuer: srv.URL, ClientID: "webapp", RedirectURL: "http://localhost/callback"})
+
+	verifier, _ := random.String()
+
+	code, state := authorize(t, p, "the-state", "the-nonce", verifier)
+
+	if state != "the-state" {
+		t.Errorf("expected state the-state, but got %s", state)
+	}
+
+	claims, err := p.Exchange(context.Background(), code, verifier, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "subject-1" || claims.Email != "admin@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestProvider_ExchangeErrors(t *testing.T) {
+	srv := oidctest.NewServer("webapp")
+	defer srv.Close()
+
+	p := NewProvider(Config{Name: "test", Issuer: srv.URL, ClientID: "webapp", RedirectURL: "http://localhost/callback"})
+
+	verifier, _ := random.String()
+
+	// wrong PKCE verifier
+	code, _ := authorize(t, p, "s", "n", verifier)
+
+	if _, err := p.Exchange(context.Background(), code, "not-the-verifier", "n"); err == nil {
+		t.Error("expected error with wrong verifier, but got none")
+	}
+
+	// wrong nonce
+	code, _ = authorize(t, p, "s", "n", verifier)
+
+	if _, err := p.Exchange(context.Background(), code, verifier, "other-nonce"); err == nil {
+		t.Error("expected error with wrong nonce, but got none")
+	}
+
+	// codes can only be used once
+	code, _ = authorize(t, p, "s", "n", verifier)
+	_, _ = p.Exchange(context.Background(), code, verifier, "n")
+
+	if _, err := p.Exchange(context.Background(), code, verifier, "n"); err == nil {
+		t.Error("expected error reusing a code, but got none")
+	}
+}
+
+func TestProvider_verify(t *testing.T) {
+	srv := oidctest.NewServer("webapp")
+	defer srv.Close()
+
+	p := NewProvider(Config{Name: "test", Issuer: srv.URL, ClientID: "webapp", RedirectURL: "http://localhost/callback"})
+
+	valid := map[string]any{
+		"iss":   srv.URL,
+		"sub":   "subject-1",
+		"aud":   []string{"other", "webapp"},
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": "n",
+	}
+
+	claims := func(key string, value any) map[string]any {
+		c := map[string]any{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		c[key] = value
+		return c
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		strings.Split(srv.Sign(valid), ".")[1] + "."
+
+	tampered := strings.Split(srv.Sign(valid), ".")
+	tampered[1] = strings.Split(srv.Sign(claims("sub", "someone-else")), ".")[1]
+
+	var tests = []struct {
+		name    string
+		token   string
+		isValid bool
+	}{
+		{"valid", srv.Sign(valid), true},
+		{"wrong issuer", srv.Sign(claims("iss", "https://evil.example.com")), false},
+		{"wrong audience", srv.Sign(claims("aud", "other")), false},
+		{"expired", srv.Sign(claims("exp", time.Now().Add(-time.Minute).Unix())), false},
+		{"wrong nonce", srv.Sign(claims("nonce", "x")), false},
+		{"alg none", unsigned, false},
+		{"tampered payload", strings.Join(tampered, "."), false},
+		{"garbage", "not.a.jwt", false},
+	}
+
+	for _, e := range tests {
+		_, err := p.verify(context.Background(), e.token, "n")
+
+		if e.isValid && err != nil {
+			t.Errorf("%s: expected token to be valid, but got %s", e.name, err)
+		}
+
+		if !e.isValid && err == nil {
+			t.Errorf("%s: expected token to be rejected", e.name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.json")
+	_ = os.WriteFile(good, []byte(`[{"name":"company","issuer":"https://idp.example.com","client_id":"webapp","redirect_url":"https://app.example.com/login/oidc/company/callback","allow_signup":true}]`), 0644)
+
+	configs, err := LoadConfig(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(configs) != 1 || configs[0].Name != "company" || !configs[0].AllowSignup {
+		t.Errorf("unexpected config %+v", configs)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	_ = os.WriteFile(bad, []byte(`[{"name":"company"}]`), 0644)
+
+	if _, err := LoadConfig(bad); err == nil {
+		t.Error("expected error for incomplete config, but got none")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	// example from RFC 7636 appendix B
+	got := Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+
+	if got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("unexpected challenge %s", got)
+	}
+}
@@ -0,0 +1,271 @@
+// Package openapi describes a JSON API as an OpenAPI 3 document, and checks requests and
+// responses against it. Schemas of Go types are made from their fields, the way encoding/json
+// marshals them, so the document follows the types; only what the types can't tell, like
+// which values are allowed, is written by hand.
+package openapi
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Version is the OpenAPI version of documents
+const Version = "3.0.3"
+
+// ErrNoOperation is returned for requests the document has no operation for
+var ErrNoOperation = errors.New("openapi: no operation for this method and path")
+
+// Document is an OpenAPI document, with the parts we use
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+
+	// names are the components of Go types, see Define
+	names map[reflect.Type]string
+}
+
+// Info is about the API
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem is the operations of a path, by method
+type PathItem struct {
+	Get    *Operation `json:"get,omitempty"`
+	Post   *Operation `json:"post,omitempty"`
+	Put    *Operation `json:"put,omitempty"`
+	Patch  *Operation `json:"patch,omitempty"`
+	Delete *Operation `json:"delete,omitempty"`
+}
+
+// operation returns a pointer to the operation of method, or nil for methods a path item can't have
+func (p *PathItem) operation(method string) **Operation {
+	switch method {
+	case http.MethodGet:
+		return &p.Get
+	case http.MethodPost:
+		return &p.Post
+	case http.MethodPut:
+		return &p.Put
+	case http.MethodPatch:
+		return &p.Patch
+	case http.MethodDelete:
+		return &p.Delete
+	default:
+		return nil
+	}
+}
+
+// Operation is what one method of a path does
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Summary     string       `json:"summary,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	Parameters  []*Parameter `json:"parameters,omitempty"`
+	RequestBody *RequestBody `json:"requestBody,omitempty"`
+	// Responses are by status code, like "200", or "default" for the others
+	Responses map[string]*Response `json:"responses"`
+	// Security are the schemes of Components.SecuritySchemes, any of which lets a client in
+	Security []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a value in the path or query string
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// PathParam is a parameter in the path, which is always required
+func PathParam(name string, schema *Schema) *Parameter {
+	return &Parameter{Name: name, In: "path", Required: true, Schema: schema}
+}
+
+// QueryParam is an optional parameter in the query string
+func QueryParam(name, description string, schema *Schema) *Parameter {
+	return &Parameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+// RequestBody is what an operation takes, by content type
+type RequestBody struct {
+	Description string                `json:"description,omitempty"`
+	Required    bool                  `json:"required,omitempty"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+// Response is what an operation answers with one status, by content type; responses
+// without content have no body
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body of one content type
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// JSON is content of type application/json, with schema
+func JSON(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
+
+// Components are the parts operations refer to
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas,omitempty"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme is how clients show who they are, like with a cookie
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// New returns a document without any operations
+func New(title, version, description string) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    Info{Title: title, Version: version, Description: description},
+		Paths:   make(map[string]*PathItem),
+		Components: Components{
+			Schemas:         make(map[string]*Schema),
+			SecuritySchemes: make(map[string]*SecurityScheme),
+		},
+		names: make(map[reflect.Type]string),
+	}
+}
+
+// Add adds the operation of method on path; paths have their parameters in braces, like
+// /users/{id}. It panics if the path already has an operation for method.
+func (d *Document) Add(method, path string, op *Operation) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+
+	slot := item.operation(method)
+
+	if slot == nil || *slot != nil {
+		panic("openapi: can't add " + method + " " + path)
+	}
+
+	*slot = op
+}
+
+// Define adds the schema of the type of v to the components, under name, and returns a
+// reference to it. Schemas made afterwards refer to it wherever they have the type, so types
+// have to be defined before the types that have them.
+func (d *Document) Define(name string, v any) *Schema {
+	d.Components.Schemas[name] = d.SchemaOf(v)
+	d.names[reflect.TypeOf(v)] = name
+
+	return Ref(name)
+}
+
+// Ref refers to the schema called name in the components
+func Ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// resolve follows the reference of s, if it has one
+func (d *Document) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+
+	return s
+}
+
+// Endpoint is an operation, with its method and path
+type Endpoint struct {
+	Method string
+	Path   string
+	*Operation
+}
+
+// Endpoints are all operations, sorted by path, and by method on each path
+func (d *Document) Endpoints() []Endpoint {
+	paths := make([]string, 0, len(d.Paths))
+
+	for p := range d.Paths {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	var endpoints []Endpoint
+
+	for _, p := range paths {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if op := *d.Paths[p].operation(method); op != nil {
+				endpoints = append(endpoints, Endpoint{Method: method, Path: p, Operation: op})
+			}
+		}
+	}
+
+	return endpoints
+}
+
+// Find returns the operation for a request with method and path, and the values of the path
+// parameters. Paths without parameters win over paths with them, so /users/search isn't taken
+// for /users/{id}.
+func (d *Document) Find(method, path string) (*Operation, map[string]string) {
+	var found *Operation
+	var params map[string]string
+
+	segments := strings.Split(path, "/")
+
+	for template, item := range d.Paths {
+		slot := item.operation(method)
+		if slot == nil || *slot == nil {
+			continue
+		}
+
+		values, ok := matchPath(strings.Split(template, "/"), segments)
+
+		if ok && (found == nil || len(values) < len(params)) {
+			found, params = *slot, values
+		}
+	}
+
+	return found, params
+}
+
+func matchPath(template, segments []string) (map[string]string, bool) {
+	if len(template) != len(segments) {
+		return nil, false
+	}
+
+	values := make(map[string]string)
+
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+
+			values[t[1:len(t)-1]] = segments[i]
+			continue
+		}
+
+		if t != segments[i] {
+			return nil, false
+		}
+	}
+
+	return values, true
+}
@@ -0,0 +1,159 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testImage struct {
+	ID  int    `json:"id"`
+	URL string `json:"url,omitempty"`
+}
+
+type testUser struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	Password  string            `json:"-"`
+	Admin     bool              `json:"admin"`
+	Avatar    *testImage        `json:"avatar"`
+	Images    []*testImage      `json:"images,omitempty"`
+	Verified  *time.Time        `json:"verified_at,omitempty"`
+	Created   time.Time         `json:"created_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Extra     json.RawMessage   `json:"extra,omitempty"`
+	Size      int64             `json:"size"`
+	NoTag     float64
+	unexposed string
+}
+
+type testHit struct {
+	*testUser
+	Rank float64 `json:"rank"`
+}
+
+func TestDocument_SchemaOf(t *testing.T) {
+	doc := New("Test", "1", "")
+	doc.Define("Image", testImage{})
+	doc.Define("User", testUser{})
+
+	user := doc.Components.Schemas["User"]
+
+	var tests = []struct {
+		property string
+		expected string
+	}{
+		{"id", `{"type":"integer"}`},
+		{"name", `{"type":"string"}`},
+		{"admin", `{"type":"boolean"}`},
+		{"avatar", `{"nullable":true,"allOf":[{"$ref":"#/components/schemas/Image"}]}`},
+		{"images", `{"type":"array","items":{"$ref":"#/components/schemas/Image"}}`},
+		{"verified_at", `{"type":"string","format":"date-time"}`},
+		{"created_at", `{"type":"string","format":"date-time"}`},
+		{"labels", `{"type":"object","additionalProperties":{"type":"string"}}`},
+		{"extra", `{}`},
+		{"size", `{"type":"integer","format":"int64"}`},
+		{"NoTag", `{"type":"number"}`},
+	}
+
+	for _, e := range tests {
+		out, _ := json.Marshal(user.Properties[e.property])
+
+		if string(out) != e.expected {
+			t.Errorf("%s: expected %s, but got %s", e.property, e.expected, out)
+		}
+	}
+
+	if len(user.Properties) != len(tests) {
+		t.Errorf("expected %d properties, but got %d", len(tests), len(user.Properties))
+	}
+
+	expectedRequired := []string{"id", "name", "admin", "avatar", "created_at", "size", "NoTag"}
+
+	if !reflect.DeepEqual(user.Required, expectedRequired) {
+		t.Errorf("expected required %v, but got %v", expectedRequired, user.Required)
+	}
+
+	// embedded structs are flattened, like encoding/json does
+	hit := doc.SchemaOf(testHit{})
+
+	if hit.Properties["name"] == nil || hit.Properties["rank"] == nil {
+		t.Errorf("expected the fields of the embedded user, but got %v", hit.Properties)
+	}
+}
+
+func TestDocument_Find(t *testing.T) {
+	doc := New("Test", "1", "")
+	doc.Add(http.MethodGet, "/users/{id}", &Operation{OperationID: "getUser"})
+	doc.Add(http.MethodGet, "/users/search", &Operation{OperationID: "searchUsers"})
+	doc.Add(http.MethodPost, "/users/{id}/images/{image}", &Operation{OperationID: "addImage"})
+
+	var tests = []struct {
+		method         string
+		path           string
+		expectedID     string
+		expectedParams map[string]string
+	}{
+		{"GET", "/users/7", "getUser", map[string]string{"id": "7"}},
+		{"GET", "/users/search", "searchUsers", map[string]string{}},
+		{"POST", "/users/7/images/3", "addImage", map[string]string{"id": "7", "image": "3"}},
+		{"POST", "/users/7", "", nil},
+		{"GET", "/users/", "", nil},
+		{"GET", "/users/7/images", "", nil},
+	}
+
+	for _, e := range tests {
+		op, params := doc.Find(e.method, e.path)
+
+		id := ""
+		if op != nil {
+			id = op.OperationID
+		}
+
+		if id != e.expectedID || !reflect.DeepEqual(params, e.expectedParams) {
+			t.Errorf("%s %s: expected %q %v, but got %q %v", e.method, e.path, e.expectedID, e.expectedParams, id, params)
+		}
+	}
+
+	endpoints := doc.Endpoints()
+
+	if len(endpoints) != 3 || endpoints[0].Path != "/users/search" || endpoints[2].OperationID != "addImage" {
+		t.Errorf("expected the endpoints sorted by path, but got %v", endpoints)
+	}
+}
+
+func TestDocument_Add(t *testing.T) {
+	doc := New("Test", "1", "")
+	doc.Add(http.MethodGet, "/users", &Operation{OperationID: "listUsers"})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a second operation of the same method")
+		}
+	}()
+
+	doc.Add(http.MethodGet, "/users", &Operation{OperationID: "listUsersAgain"})
+}
+
+func TestSchema_TypeName(t *testing.T) {
+	var tests = []struct {
+		schema   *Schema
+		expected string
+	}{
+		{Ref("User"), "User"},
+		{ArrayOf(Ref("User")), "array of User"},
+		{&Schema{AllOf: []*Schema{Ref("User")}, Nullable: true}, "User"},
+		{&Schema{Type: "object", AdditionalProperties: &Schema{Type: "string"}}, "map of string"},
+		{String("date"), "string (date)"},
+		{Integer(0), "integer"},
+		{&Schema{}, "any"},
+	}
+
+	for _, e := range tests {
+		if e.schema.TypeName() != e.expected {
+			t.Errorf("expected %q, but got %q", e.expected, e.schema.TypeName())
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema is the shape of a value, with the keywords of OpenAPI 3.0 we use. The empty schema
+// allows any value.
+type Schema struct {
+	Ref         string   `json:"$ref,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Format      string   `json:"format,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Nullable    bool     `json:"nullable,omitempty"`
+	Enum        []any    `json:"enum,omitempty"`
+	Minimum     *float64 `json:"minimum,omitempty"`
+	Maximum     *float64 `json:"maximum,omitempty"`
+	MinLength   *int     `json:"minLength,omitempty"`
+	MaxLength   *int     `json:"maxLength,omitempty"`
+	Items       *Schema  `json:"items,omitempty"`
+	// AllOf are schemas the value has to match as well; we use it for references that can be null
+	AllOf      []*Schema          `json:"allOf,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	// AdditionalProperties is the schema of the values of a map, or false for objects that
+	// can't have other properties; nil allows anything
+	AdditionalProperties any `json:"additionalProperties,omitempty"`
+}
+
+// Integer is the schema of whole numbers of at least min
+func Integer(min float64) *Schema {
+	return &Schema{Type: "integer", Minimum: &min}
+}
+
+// String is the schema of strings, with format, like date; the value has to be one of enum,
+// when there are any
+func String(format string, enum ...string) *Schema {
+	s := &Schema{Type: "string", Format: format}
+
+	for _, e := range enum {
+		s.Enum = append(s.Enum, e)
+	}
+
+	return s
+}
+
+// ArrayOf is the schema of arrays of items
+func ArrayOf(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+// TypeName says what s is in a few words, like "array of User", for people reading the docs
+func (s *Schema) TypeName() string {
+	switch {
+	case s == nil:
+		return ""
+	case s.Ref != "":
+		return s.Ref[strings.LastIndex(s.Ref, "/")+1:]
+	case len(s.AllOf) == 1:
+		return s.AllOf[0].TypeName()
+	case s.Type == "array":
+		return "array of " + s.Items.TypeName()
+	case s.Type == "object" && s.Properties == nil && s.AdditionalProperties != nil:
+		if values, ok := s.AdditionalProperties.(*Schema); ok {
+			return "map of " + values.TypeName()
+		}
+	case s.Type == "":
+		return "any"
+	case s.Format != "":
+		return s.Type + " (" + s.Format + ")"
+	}
+
+	return s.Type
+}
+
+// IsRequired reports whether objects of s have to have the property name
+func (s *Schema) IsRequired(name string) bool {
+	for _, r := range s.Required {
+		if r == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// SchemaOf returns the schema of the JSON encoding/json makes of v. Fields without omitempty
+// are required, and pointer fields without it can be null; types given to Define are
+// references to their component.
+func (d *Document) SchemaOf(v any) *Schema {
+	return d.schemaOf(reflect.TypeOf(v), true)
+}
+
+// schemaOf returns the schema of t; top is true for the type SchemaOf was given, which is
+// not a reference to itself
+func (d *Document) schemaOf(t reflect.Type, top bool) *Schema {
+	if name, ok := d.names[t]; ok && !top {
+		return Ref(name)
+	}
+
+	switch t {
+	case timeType:
+		return String("date-time")
+	case rawMessageType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return d.schemaOf(t.Elem(), false)
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return String("byte")
+		}
+
+		return ArrayOf(d.schemaOf(t.Elem(), false))
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schemaOf(t.Elem(), false)}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		d.addFields(s, t)
+
+		return s
+	case reflect.Interface:
+		return &Schema{}
+	default:
+		panic(fmt.Sprintf("openapi: no schema for %s", t))
+	}
+}
+
+// addFields adds the fields of the struct t to s, and those of structs it embeds
+func (d *Document) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+
+		// encoding/json puts the fields of embedded structs in with ours
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+
+			if embedded.Kind() == reflect.Struct {
+				d.addFields(s, embedded)
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		field := d.schemaOf(f.Type, false)
+		omitEmpty := strings.Contains(","+opts+",", ",omitempty,")
+
+		if f.Type.Kind() == reflect.Pointer && !omitEmpty {
+			// a reference can't have other keywords next to it
+			if field.Ref != "" {
+				field = &Schema{AllOf: []*Schema{field}}
+			}
+
+			field.Nullable = true
+		}
+
+		s.Properties[name] = field
+
+		if !omitEmpty {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
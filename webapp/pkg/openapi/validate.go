@@ -0,0 +1,416 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError is what is wrong with a request or response, by field, like the
+// errors of a form. Fields in a body are paths like users[0].email; parameters are their
+// name, and the body as a whole is "body".
+type ValidationError struct {
+	Errors map[string][]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Errors))
+
+	for f := range e.Errors {
+		fields = append(fields, f)
+	}
+
+	sort.Strings(fields)
+
+	parts := make([]string, len(fields))
+
+	for i, f := range fields {
+		parts[i] = f + ": " + strings.Join(e.Errors[f], ", ")
+	}
+
+	return "openapi: " + strings.Join(parts, "; ")
+}
+
+// validation collects the errors of one value; root is the name of the value itself
+type validation struct {
+	doc    *Document
+	root   string
+	errors map[string][]string
+}
+
+func (d *Document) newValidation(root string) *validation {
+	return &validation{doc: d, root: root, errors: make(map[string][]string)}
+}
+
+func (v *validation) add(path, message string) {
+	if path == "" {
+		path = v.root
+	}
+
+	v.errors[path] = append(v.errors[path], message)
+}
+
+func (v *validation) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Errors: v.errors}
+}
+
+// Validate checks value, as encoding/json decodes JSON into an any, against s
+func (d *Document) Validate(s *Schema, value any) error {
+	v := d.newValidation("body")
+	v.check(s, value, "")
+
+	return v.err()
+}
+
+func (v *validation) check(s *Schema, value any, path string) {
+	s = v.doc.resolve(s)
+
+	if s == nil {
+		return
+	}
+
+	if value == nil {
+		if !s.Nullable && (s.Type != "" || s.AllOf != nil) {
+			v.add(path, "Must not be null")
+		}
+
+		return
+	}
+
+	for _, all := range s.AllOf {
+		v.check(all, value, path)
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		v.add(path, "Must be one of "+enumList(s.Enum))
+		return
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			v.add(path, "Must be a string")
+			return
+		}
+
+		v.checkString(s, str, path)
+
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			v.add(path, "Must be a number")
+			return
+		}
+
+		if s.Type == "integer" && n != math.Trunc(n) {
+			v.add(path, "Must be a whole number")
+			return
+		}
+
+		if s.Minimum != nil && n < *s.Minimum {
+			v.add(path, fmt.Sprintf("Must be at least %g", *s.Minimum))
+		}
+
+		if s.Maximum != nil && n > *s.Maximum {
+			v.add(path, fmt.Sprintf("Must be at most %g", *s.Maximum))
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.add(path, "Must be true or false")
+		}
+
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			v.add(path, "Must be an array")
+			return
+		}
+
+		for i, item := range items {
+			v.check(s.Items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			v.add(path, "Must be an object")
+			return
+		}
+
+		v.checkObject(s, object, path)
+	}
+}
+
+func (v *validation) checkString(s *Schema, str, path string) {
+	length := utf8.RuneCountInString(str)
+
+	if s.MinLength != nil && length < *s.MinLength {
+		if *s.MinLength == 1 {
+			v.add(path, "This field cannot be blank")
+		} else {
+			v.add(path, fmt.Sprintf("Must be at least %d characters long", *s.MinLength))
+		}
+	}
+
+	if s.MaxLength != nil && length > *s.MaxLength {
+		v.add(path, fmt.Sprintf("Must be at most %d characters long", *s.MaxLength))
+	}
+
+	switch s.Format {
+	case "date":
+		if _, err := time.Parse("2006-01-02", str); err != nil {
+			v.add(path, "Must be a date like 2022-08-19")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, str); err != nil {
+			v.add(path, "Must be a date and time like 2022-08-19T14:30:00Z")
+		}
+	case "email":
+		if !strings.Contains(str, "@") {
+			v.add(path, "Must be an email address")
+		}
+	}
+}
+
+func (v *validation) checkObject(s *Schema, object map[string]any, path string) {
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+
+	for _, name := range s.Required {
+		if _, ok := object[name]; !ok {
+			v.add(prefix+name, "This field is required")
+		}
+	}
+
+	for name, value := range object {
+		if property, ok := s.Properties[name]; ok {
+			v.check(property, value, prefix+name)
+			continue
+		}
+
+		switch additional := s.AdditionalProperties.(type) {
+		case bool:
+			if !additional {
+				v.add(prefix+name, "Unknown field")
+			}
+		case *Schema:
+			v.check(additional, value, prefix+name)
+		}
+	}
+}
+
+// inEnum compares values as JSON, so numbers match whatever their Go type
+func inEnum(enum []any, value any) bool {
+	have, _ := json.Marshal(value)
+
+	for _, e := range enum {
+		if want, _ := json.Marshal(e); bytes.Equal(have, want) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func enumList(enum []any) string {
+	parts := make([]string, len(enum))
+
+	for i, e := range enum {
+		parts[i] = fmt.Sprint(e)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// ValidateRequest checks the path parameters, query string and body of r against the
+// operation for its method and path; it returns ErrNoOperation when there is none. The body
+// is read, and put back for the handler; limit its size before.
+func (d *Document) ValidateRequest(r *http.Request) error {
+	op, pathValues := d.Find(r.Method, r.URL.Path)
+	if op == nil {
+		return ErrNoOperation
+	}
+
+	v := d.newValidation("body")
+	query := r.URL.Query()
+
+	for _, p := range op.Parameters {
+		var raw string
+		var found bool
+
+		switch p.In {
+		case "path":
+			raw, found = pathValues[p.Name]
+		case "query":
+			raw, found = query.Get(p.Name), query.Has(p.Name)
+		default:
+			continue
+		}
+
+		if !found {
+			if p.Required {
+				v.add(p.Name, "This field is required")
+			}
+
+			continue
+		}
+
+		value, ok := parseParam(d.resolve(p.Schema), raw)
+		if !ok {
+			v.add(p.Name, "Must be a "+paramKind(d.resolve(p.Schema)))
+			continue
+		}
+
+		v.check(p.Schema, value, p.Name)
+	}
+
+	if op.RequestBody != nil {
+		if err := d.validateRequestBody(op.RequestBody, r, v); err != nil {
+			return err
+		}
+	}
+
+	return v.err()
+}
+
+func (d *Document) validateRequestBody(body *RequestBody, r *http.Request, v *validation) error {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(content))
+
+	if len(bytes.TrimSpace(content)) == 0 {
+		if body.Required {
+			v.add("", "This field is required")
+		}
+
+		return nil
+	}
+
+	media, ok := findContent(body.Content, r.Header.Get("Content-Type"))
+	if !ok {
+		v.add("", "Must be "+strings.Join(contentTypes(body.Content), " or "))
+		return nil
+	}
+
+	var value any
+
+	if err := json.Unmarshal(content, &value); err != nil {
+		v.add("", "Must be JSON")
+		return nil
+	}
+
+	v.check(media.Schema, value, "")
+
+	return nil
+}
+
+// parseParam turns the text of a parameter into the value JSON would have for it
+func parseParam(s *Schema, raw string) (any, bool) {
+	if s == nil {
+		return raw, true
+	}
+
+	switch s.Type {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(raw, 64)
+		return n, err == nil
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		return b, err == nil
+	default:
+		return raw, true
+	}
+}
+
+func paramKind(s *Schema) string {
+	if s.Type == "integer" {
+		return "whole number"
+	}
+
+	return s.Type
+}
+
+// ValidateResponse checks a response to method and path against the operation: its status
+// has to be one of the responses, and the body has to match the schema of its content type
+func (d *Document) ValidateResponse(method, path string, status int, header http.Header, body []byte) error {
+	op, _ := d.Find(method, path)
+	if op == nil {
+		return ErrNoOperation
+	}
+
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = op.Responses["default"]
+	}
+
+	if !ok {
+		return fmt.Errorf("openapi: %s %s can't answer with status %d", method, path, status)
+	}
+
+	if len(response.Content) == 0 {
+		// net/http gives redirects a link, for clients that don't follow them
+		if len(body) > 0 && (status < 300 || status > 399) {
+			return fmt.Errorf("openapi: %s %s answers %d without a body", method, path, status)
+		}
+
+		return nil
+	}
+
+	media, ok := findContent(response.Content, header.Get("Content-Type"))
+	if !ok {
+		return fmt.Errorf("openapi: %s %s answers %d with %s, not %q", method, path, status,
+			strings.Join(contentTypes(response.Content), " or "), header.Get("Content-Type"))
+	}
+
+	var value any
+
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("openapi: %s %s answered %d with invalid JSON: %w", method, path, status, err)
+	}
+
+	return d.Validate(media.Schema, value)
+}
+
+// findContent returns the media type of content for a Content-Type header
+func findContent(content map[string]*MediaType, contentType string) (*MediaType, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	media, ok := content[mediaType]
+
+	return media, ok
+}
+
+func contentTypes(content map[string]*MediaType) []string {
+	types := make([]string, 0, len(content))
+
+	for t := range content {
+		types = append(types, t)
+	}
+
+	sort.Strings(types)
+
+	return types
+}
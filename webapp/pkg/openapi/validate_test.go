@@ -0,0 +1,176 @@
+package openapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testDocument() *Document {
+	doc := New("Test", "1", "")
+	image := doc.Define("Image", testImage{})
+	user := doc.Define("User", testUser{})
+
+	one := 1
+	patch := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"name":  {Type: "string", MinLength: &one},
+			"email": String("email"),
+			"role":  String("", "admin", "user"),
+		},
+		Required:             []string{"name"},
+		AdditionalProperties: false,
+	}
+
+	doc.Add(http.MethodGet, "/users", &Operation{
+		OperationID: "listUsers",
+		Parameters: []*Parameter{
+			QueryParam("page", "", Integer(1)),
+			QueryParam("from", "", String("date")),
+			QueryParam("order", "", String("", "asc", "desc")),
+		},
+		Responses: map[string]*Response{
+			"200": {Description: "Users", Content: JSON(ArrayOf(user))},
+			"400": {Description: "Invalid filter", Content: JSON(&Schema{Type: "object"})},
+		},
+	})
+
+	doc.Add(http.MethodPatch, "/users/{id}", &Operation{
+		OperationID: "patchUser",
+		Parameters:  []*Parameter{PathParam("id", Integer(1))},
+		RequestBody: &RequestBody{Required: true, Content: JSON(patch)},
+		Responses: map[string]*Response{
+			"200": {Description: "The user", Content: JSON(user)},
+		},
+	})
+
+	doc.Add(http.MethodPost, "/images/{id}/retry", &Operation{
+		OperationID: "retryImage",
+		Parameters:  []*Parameter{PathParam("id", Integer(1))},
+		Responses: map[string]*Response{
+			"204":     {Description: "Queued"},
+			"303":     {Description: "Not logged in"},
+			"default": {Description: "Error", Content: JSON(image)},
+		},
+	})
+
+	return doc
+}
+
+func TestDocument_ValidateRequest(t *testing.T) {
+	doc := testDocument()
+
+	var tests = []struct {
+		name           string
+		method         string
+		url            string
+		contentType    string
+		body           string
+		expectedErrors map[string][]string
+	}{
+		{"valid query", "GET", "/users?page=2&from=2022-08-19&order=desc", "", "", nil},
+		{"no query", "GET", "/users", "", "", nil},
+		{"invalid query", "GET", "/users?page=0&from=yesterday&order=up", "", "", map[string][]string{
+			"page":  {"Must be at least 1"},
+			"from":  {"Must be a date like 2022-08-19"},
+			"order": {"Must be one of asc, desc"},
+		}},
+		{"not a number", "GET", "/users?page=two", "", "", map[string][]string{"page": {"Must be a whole number"}}},
+		{"fraction", "GET", "/users?page=1.5", "", "", map[string][]string{"page": {"Must be a whole number"}}},
+		{"valid body", "PATCH", "/users/1", "application/json; charset=utf-8", `{"name":"Jack","role":"admin"}`, nil},
+		{"invalid path", "PATCH", "/users/x", "application/json", `{"name":"Jack"}`, map[string][]string{"id": {"Must be a whole number"}}},
+		{"invalid body", "PATCH", "/users/1", "application/json", `{"name":"","email":"jack","role":"root","admin":true}`, map[string][]string{
+			"name":  {"This field cannot be blank"},
+			"email": {"Must be an email address"},
+			"role":  {"Must be one of admin, user"},
+			"admin": {"Unknown field"},
+		}},
+		{"missing field", "PATCH", "/users/1", "application/json", `{"email":"jack@example.com"}`, map[string][]string{"name": {"This field is required"}}},
+		{"wrong type", "PATCH", "/users/1", "application/json", `{"name":7}`, map[string][]string{"name": {"Must be a string"}}},
+		{"not an object", "PATCH", "/users/1", "application/json", `[]`, map[string][]string{"body": {"Must be an object"}}},
+		{"no body", "PATCH", "/users/1", "application/json", "", map[string][]string{"body": {"This field is required"}}},
+		{"not JSON", "PATCH", "/users/1", "application/json", `{"name":`, map[string][]string{"body": {"Must be JSON"}}},
+		{"form", "PATCH", "/users/1", "application/x-www-form-urlencoded", "name=Jack", map[string][]string{"body": {"Must be application/json"}}},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+
+		if e.contentType != "" {
+			req.Header.Set("Content-Type", e.contentType)
+		}
+
+		err := doc.ValidateRequest(req)
+
+		var verr *ValidationError
+
+		switch {
+		case e.expectedErrors == nil && err != nil:
+			t.Errorf("%s: expected no error, but got %s", e.name, err)
+		case e.expectedErrors != nil && !errors.As(err, &verr):
+			t.Errorf("%s: expected a validation error, but got %v", e.name, err)
+		case e.expectedErrors != nil && !reflect.DeepEqual(verr.Errors, e.expectedErrors):
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expectedErrors, verr.Errors)
+		}
+
+		// the handler still gets the body
+		if body, _ := io.ReadAll(req.Body); string(body) != e.body {
+			t.Errorf("%s: expected the body to be put back, but got %q", e.name, body)
+		}
+	}
+
+	req, _ := http.NewRequest("DELETE", "/users/1", nil)
+
+	if err := doc.ValidateRequest(req); !errors.Is(err, ErrNoOperation) {
+		t.Errorf("expected ErrNoOperation for an unknown operation, but got %v", err)
+	}
+}
+
+func TestDocument_ValidateResponse(t *testing.T) {
+	doc := testDocument()
+
+	user := `{"id":1,"name":"Jack","admin":false,"avatar":null,"created_at":"2022-08-19T00:00:00Z","size":0,"NoTag":1.5}`
+
+	var tests = []struct {
+		name          string
+		method        string
+		path          string
+		status        int
+		contentType   string
+		body          string
+		expectedError string
+	}{
+		{"valid", "GET", "/users", 200, "application/json", "[" + user + "]", ""},
+		{"null array", "GET", "/users", 200, "application/json", "null", "body: Must not be null"},
+		{"invalid item", "GET", "/users", 200, "application/json", `[{"id":"1"}]`, "[0].id: Must be a number"},
+		{"missing fields", "GET", "/users", 200, "application/json", `[{"id":1,"name":"Jack","admin":false,"avatar":null,"size":0,"NoTag":1}]`, "[0].created_at: This field is required"},
+		{"nested", "PATCH", "/users/1", 200, "application/json", strings.Replace(user, `"avatar":null`, `"avatar":{"id":"x"}`, 1), "avatar.id: Must be a number"},
+		{"bad time", "PATCH", "/users/1", 200, "application/json", strings.Replace(user, "2022-08-19T00:00:00Z", "today", 1), "created_at: Must be a date and time"},
+		{"undocumented status", "GET", "/users", 500, "application/json", "{}", "can't answer with status 500"},
+		{"wrong content type", "GET", "/users", 200, "text/html", "[]", `not "text/html"`},
+		{"invalid JSON", "GET", "/users", 400, "application/json", "{", "invalid JSON"},
+		{"no content", "POST", "/images/1/retry", 204, "", "", ""},
+		{"unexpected content", "POST", "/images/1/retry", 204, "", "{}", "without a body"},
+		{"redirect", "POST", "/images/1/retry", 303, "text/html", `<a href="/">See Other</a>.`, ""},
+		{"default", "POST", "/images/1/retry", 404, "application/json", `{"id":1}`, ""},
+		{"no operation", "GET", "/images", 200, "application/json", "[]", ErrNoOperation.Error()},
+	}
+
+	for _, e := range tests {
+		header := http.Header{}
+		header.Set("Content-Type", e.contentType)
+
+		err := doc.ValidateResponse(e.method, e.path, e.status, header, []byte(e.body))
+
+		switch {
+		case e.expectedError == "" && err != nil:
+			t.Errorf("%s: expected no error, but got %s", e.name, err)
+		case e.expectedError != "" && (err == nil || !strings.Contains(err.Error(), e.expectedError)):
+			t.Errorf("%s: expected an error with %q, but got %v", e.name, e.expectedError, err)
+		}
+	}
+}
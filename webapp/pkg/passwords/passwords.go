@@ -0,0 +1,243 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// algorithms we know how to hash with
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// ErrUnknownHash is returned when a stored hash is in a format we don't recognize
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Argon2Params are the tuning parameters for argon2id
+type Argon2Params struct {
+	// Memory in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// the largest argon2id parameters we hash or verify with; verifying a hash with larger ones
+// could take all the memory or time of the server
+const (
+	// MaxArgon2Memory is 1 GiB, in KiB
+	MaxArgon2Memory      = 1024 * 1024
+	MaxArgon2Iterations  = 100
+	MaxArgon2Parallelism = 255
+)
+
+// DefaultArgon2Params follow the recommendations of RFC 9106 for memory constrained environments
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Hasher hashes new passwords with one algorithm, and verifies passwords hashed with any
+// algorithm we support, so we can move users to new parameters as they log in
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// Default is what we used before hashing was configurable: bcrypt with a cost of 12
+var Default = &Hasher{
+	Algorithm:  Bcrypt,
+	BcryptCost: 12,
+	Argon2:     DefaultArgon2Params,
+}
+
+// New returns a hasher for the given algorithm, validating its parameters
+func New(algorithm string, bcryptCost int, params Argon2Params) (*Hasher, error) {
+	switch algorithm {
+	case Bcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		if !params.inRange() {
+			return nil, fmt.Errorf("argon2id memory must be between 1 and %d KiB, iterations between 1 and %d, and parallelism between 1 and %d",
+				MaxArgon2Memory, MaxArgon2Iterations, MaxArgon2Parallelism)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported password hashing algorithm %q", algorithm)
+	}
+
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2Params.SaltLength
+	}
+
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2Params.KeyLength
+	}
+
+	return &Hasher{Algorithm: algorithm, BcryptCost: bcryptCost, Argon2: params}, nil
+}
+
+// Hash returns the encoded hash of a password, using the hasher's algorithm
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Argon2id {
+		return hashArgon2id(password, h.Argon2)
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// NeedsRehash reports whether a stored hash was made with another algorithm, or with
+// weaker parameters than the hasher's. We never rehash to weaker parameters.
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	switch {
+	case isBcrypt(encoded):
+		if h.Algorithm != Bcrypt {
+			return true
+		}
+
+		cost, err := bcrypt.Cost([]byte(encoded))
+
+		return err != nil || cost < h.BcryptCost
+
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		if h.Algorithm != Argon2id {
+			return true
+		}
+
+		p, _, _, err := decodeArgon2id(encoded)
+
+		return err != nil ||
+			p.Memory < h.Argon2.Memory ||
+			p.Iterations < h.Argon2.Iterations ||
+			p.Parallelism < h.Argon2.Parallelism ||
+			p.KeyLength < h.Argon2.KeyLength
+	}
+
+	return true
+}
+
+// Verify compares a plain text password with an encoded hash in any supported format
+func Verify(password, encoded string) (bool, error) {
+	switch {
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+
+		if err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		return true, nil
+
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		p, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	return false, ErrUnknownHash
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// hashArgon2id encodes in the PHC string format: $argon2id$v=19$m=65536,t=3,p=2$salt$hash
+func hashArgon2id(password string, p Argon2Params) (string, error) {
+	salt := make([]byte, p.SaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.Memory,
+		p.Iterations,
+		p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// inRange reports whether memory, iterations and parallelism are between 1 and their maximum
+func (p Argon2Params) inRange() bool {
+	return p.Memory >= 1 && p.Memory <= MaxArgon2Memory &&
+		p.Iterations >= 1 && p.Iterations <= MaxArgon2Iterations &&
+		p.Parallelism >= 1 && p.Parallelism <= MaxArgon2Parallelism
+}
+
+// decodeArgon2id reads a hash of hashArgon2id. Hashes with parameters out of range, or without a
+// salt or key, are ErrUnknownHash, as argon2 would panic or run out of memory on them.
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+
+	parts := strings.Split(encoded, "$")
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+
+	if len(salt) == 0 || len(key) == 0 || !p.inRange() {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,133 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+)
+
+// small parameters, so tests stay fast
+var testArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHasher_HashAndVerify(t *testing.T) {
+	bcryptHasher, _ := New(Bcrypt, 4, testArgon2Params)
+	argonHasher, _ := New(Argon2id, 0, testArgon2Params)
+
+	var tests = []struct {
+		name   string
+		hasher *Hasher
+		prefix string
+	}{
+		{"bcrypt", bcryptHasher, "$2a$04$"},
+		{"argon2id", argonHasher, "$argon2id$v=19$m=1024,t=1,p=1$"},
+	}
+
+	for _, e := range tests {
+		encoded, err := e.hasher.Hash("secret")
+
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if !strings.HasPrefix(encoded, e.prefix) {
+			t.Errorf("%s: expected hash to start with %s, but got %s", e.name, e.prefix, encoded)
+		}
+
+		ok, err := Verify("secret", encoded)
+
+		if err != nil || !ok {
+			t.Errorf("%s: correct password did not verify (%v)", e.name, err)
+		}
+
+		ok, err = Verify("wrong", encoded)
+
+		if err != nil || ok {
+			t.Errorf("%s: wrong password verified (%v)", e.name, err)
+		}
+	}
+}
+
+func TestVerify_ExistingBcryptHash(t *testing.T) {
+	// the admin user from sql/users.sql; password is "secret"
+	ok, err := Verify("secret", "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK")
+
+	if err != nil || !ok {
+		t.Errorf("existing bcrypt hash did not verify (%v)", err)
+	}
+}
+
+func TestVerify_Unknown(t *testing.T) {
+	var tests = []string{
+		"",
+		"plain text",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1$c2FsdA$aGFzaA",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		// argon2 would panic, or take all the memory, on these
+		"$argon2id$v=19$m=8,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2id$v=19$m=8,t=1,p=1$$aGFzaA",
+		"$argon2id$v=19$m=8,t=0,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=8,t=1,p=0$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=8,t=1,p=256$c2FsdA$aGFzaA",
+	}
+
+	for _, e := range tests {
+		if ok, err := Verify("secret", e); ok || err == nil {
+			t.Errorf("expected %q to be rejected with an error", e)
+		}
+	}
+}
+
+func TestHasher_NeedsRehash(t *testing.T) {
+	bcrypt4, _ := New(Bcrypt, 4, testArgon2Params)
+	bcrypt5, _ := New(Bcrypt, 5, testArgon2Params)
+	argon, _ := New(Argon2id, 0, testArgon2Params)
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	argonStronger, _ := New(Argon2id, 0, stronger)
+
+	bcrypt4Hash, _ := bcrypt4.Hash("secret")
+	bcrypt5Hash, _ := bcrypt5.Hash("secret")
+	argonHash, _ := argon.Hash("secret")
+
+	var tests = []struct {
+		name     string
+		hasher   *Hasher
+		encoded  string
+		expected bool
+	}{
+		{"same bcrypt cost", bcrypt4, bcrypt4Hash, false},
+		{"higher bcrypt cost wanted", bcrypt5, bcrypt4Hash, true},
+		{"lower bcrypt cost wanted", bcrypt4, bcrypt5Hash, false},
+		{"bcrypt to argon2id", argon, bcrypt4Hash, true},
+		{"argon2id to bcrypt", bcrypt4, argonHash, true},
+		{"same argon2id params", argon, argonHash, false},
+		{"stronger argon2id params wanted", argonStronger, argonHash, true},
+		{"unknown format", argon, "nonsense", true},
+	}
+
+	for _, e := range tests {
+		if got := e.hasher.NeedsRehash(e.encoded); got != e.expected {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("md5", 10, DefaultArgon2Params); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+
+	if _, err := New(Bcrypt, 99, DefaultArgon2Params); err == nil {
+		t.Error("expected error for invalid bcrypt cost")
+	}
+
+	if _, err := New(Argon2id, 0, Argon2Params{}); err == nil {
+		t.Error("expected error for empty argon2id params")
+	}
+
+	if _, err := New(Argon2id, 0, Argon2Params{Memory: MaxArgon2Memory + 1, Iterations: 1, Parallelism: 1}); err == nil {
+		t.Error("expected error for too much argon2id memory")
+	}
+}
@@ -0,0 +1,19 @@
+// Package random makes unguessable strings, for things like OpenID Connect state, storage keys
+// and passwords nobody is meant to know.
+package random
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// String returns a url safe string of 32 random bytes
+func String() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,23 @@
+package random
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	first, err := String()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := String()
+
+	if len(first) != 43 || first == second {
+		t.Errorf("expected two different strings of 43 characters, but got %q and %q", first, second)
+	}
+
+	if url.QueryEscape(first) != first {
+		t.Errorf("expected a url safe string, but got %q", first)
+	}
+}
@@ -0,0 +1,124 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"webapp/pkg/data"
+)
+
+// the most audit events we return in one go
+const maxAuditEvents = 500
+
+// InsertAuditEvent adds an event to the audit log, and returns its id
+func (m *PostgresDBRepo) InsertAuditEvent(e data.AuditEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+
+	var newID int
+	stmt := `insert into audit_events (actor_id, target_user_id, action, ip, details, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := m.db().QueryRowContext(ctx, stmt,
+		nullInt(e.ActorID),
+		nullInt(e.TargetUserID),
+		e.Action,
+		e.IP,
+		e.Details,
+		e.CreatedAt,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	return newID, nil
+}
+
+// AuditEvents returns audit events matching the filter, newest first
+func (m *PostgresDBRepo) AuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+
+	if f.UserID != 0 {
+		args = append(args, f.UserID)
+		where = append(where, fmt.Sprintf("(actor_id = $%d or target_user_id = $%d)", len(args), len(args)))
+	}
+
+	if f.Action != "" {
+		args = append(args, f.Action)
+		where = append(where, fmt.Sprintf("action = $%d", len(args)))
+	}
+
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		where = append(where, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		where = append(where, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	query := `select id, actor_id, target_user_id, action, coalesce(ip, ''), coalesce(details, ''), created_at
+	from audit_events`
+
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+
+	limit := f.Limit
+	if limit <= 0 || limit > maxAuditEvents {
+		limit = maxAuditEvents
+	}
+
+	args = append(args, limit, f.Offset)
+	query += fmt.Sprintf(" order by created_at desc, id desc limit $%d offset $%d", len(args)-1, len(args))
+
+	rows, err := m.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	var events []*data.AuditEvent
+
+	for rows.Next() {
+		var e data.AuditEvent
+		var actorID, targetID sql.NullInt64
+
+		err := rows.Scan(
+			&e.ID,
+			&actorID,
+			&targetID,
+			&e.Action,
+			&e.IP,
+			&e.Details,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		e.ActorID = int(actorID.Int64)
+		e.TargetUserID = int(targetID.Int64)
+
+		events = append(events, &e)
+	}
+
+	return events, mapError(rows.Err())
+}
+
+// nullInt stores 0 ids as null
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
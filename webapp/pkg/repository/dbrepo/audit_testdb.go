@@ -0,0 +1,28 @@
+package dbrepo
+
+import (
+	"time"
+	"webapp/pkg/data"
+)
+
+// InsertAuditEvent adds an event to the audit log, and returns its id
+func (m *TestDBRepo) InsertAuditEvent(e data.AuditEvent) (int, error) {
+
+	return 1, nil
+}
+
+// AuditEvents returns audit events matching the filter, newest first
+func (m *TestDBRepo) AuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error) {
+	var events = []*data.AuditEvent{
+		{
+			ID:           1,
+			ActorID:      1,
+			TargetUserID: 1,
+			Action:       data.AuditLogin,
+			IP:           "127.0.0.1",
+			CreatedAt:    time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	return events, nil
+}
@@ -0,0 +1,88 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+	"webapp/pkg/repository"
+
+	"github.com/jackc/pgconn"
+)
+
+// usersEmailIndex keeps email addresses of users that are not deleted unique
+const usersEmailIndex = "users_email_key"
+
+// mapError turns database errors into the errors of the repository package. Errors it doesn't
+// know, and errors it already mapped, are returned as they are.
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var repoErr *repository.Error
+	if errors.As(err, &repoErr) {
+		return err
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &repository.Error{Kind: repository.ErrNotFound, Err: err}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23505" && pgErr.ConstraintName == usersEmailIndex:
+			return &repository.Error{Kind: repository.ErrDuplicateEmail, Err: err}
+
+		// unique_violation, serialization_failure, deadlock_detected
+		case pgErr.Code == "23505" || pgErr.Code == "40001" || pgErr.Code == "40P01":
+			return &repository.Error{Kind: repository.ErrConflict, Err: err}
+
+		// foreign_key_violation: whatever we point to is gone
+		case pgErr.Code == "23503":
+			return &repository.Error{Kind: repository.ErrNotFound, Err: err}
+
+		// connection_exception, insufficient_resources, and the server shutting down or starting up
+		case strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "53") ||
+			pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03":
+			return &repository.Error{Kind: repository.ErrUnavailable, Err: err}
+		}
+
+		return err
+	}
+
+	// failing to connect ends up here too, as a wrapped dial error
+	var netErr net.Error
+
+	if errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		pgconn.Timeout(err) {
+		return &repository.Error{Kind: repository.ErrUnavailable, Err: err}
+	}
+
+	return err
+}
+
+// execOne runs a statement that should change a row, and returns repository.ErrNotFound if it didn't
+func (m *PostgresDBRepo) execOne(ctx context.Context, stmt string, args ...any) error {
+	result, err := m.db().ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return mapError(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return mapError(err)
+	}
+
+	if affected == 0 {
+		return &repository.Error{Kind: repository.ErrNotFound, Err: sql.ErrNoRows}
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// MemoryJobRepo is a job queue in memory, for tests and for running without a database.
+// It behaves like the postgres queue, but its jobs are gone when the process stops.
+type MemoryJobRepo struct {
+	// Now is the clock; tests set it to move time along
+	Now func() time.Time
+
+	mu     sync.Mutex
+	nextID int64
+	jobs   map[int64]*data.Job
+}
+
+// NewMemoryJobRepo returns an empty queue
+func NewMemoryJobRepo() *MemoryJobRepo {
+	return &MemoryJobRepo{Now: time.Now, jobs: map[int64]*data.Job{}}
+}
+
+// EnqueueJob queues a job and returns its id. A job with the unique key of another job is
+// not added, and its id is 0.
+func (m *MemoryJobRepo) EnqueueJob(ctx context.Context, job data.Job) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job.UniqueKey != "" {
+		for _, j := range m.jobs {
+			if j.UniqueKey == job.UniqueKey {
+				return 0, nil
+			}
+		}
+	}
+
+	job = newJob(job, m.Now())
+	job.Payload = append([]byte{}, job.Payload...)
+
+	m.nextID++
+	job.ID = m.nextID
+	m.jobs[job.ID] = &job
+
+	return job.ID, nil
+}
+
+// ClaimJob locks the next due job of one of the kinds, or returns ErrNotFound
+func (m *MemoryJobRepo) ClaimJob(ctx context.Context, kinds []string, staleAfter time.Duration) (*data.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.Now()
+	stale := now.Add(-staleAfter)
+
+	var next *data.Job
+
+	for _, j := range m.sorted() {
+		if !contains(kinds, j.Kind) {
+			continue
+		}
+
+		due := j.Status == data.JobPending && !j.RunAt.After(now)
+		abandoned := j.Status == data.JobRunning && j.LockedAt != nil && j.LockedAt.Before(stale)
+
+		if due || abandoned {
+			next = j
+			break
+		}
+	}
+
+	if next == nil {
+		return nil, &repository.Error{Kind: repository.ErrNotFound, Err: sql.ErrNoRows}
+	}
+
+	next.Status = data.JobRunning
+	next.Attempts++
+	next.LockedAt = &now
+	next.UpdatedAt = now
+
+	return copyJob(next), nil
+}
+
+// CompleteJob marks a claimed job as done
+func (m *MemoryJobRepo) CompleteJob(ctx context.Context, job *data.Job) error {
+	return m.finish(job, func(j *data.Job, now time.Time) {
+		j.Status = data.JobDone
+		j.FinishedAt = &now
+	})
+}
+
+// RetryJob puts a failed job back into the queue, due at runAt
+func (m *MemoryJobRepo) RetryJob(ctx context.Context, job *data.Job, runAt time.Time, lastError string) error {
+	return m.finish(job, func(j *data.Job, now time.Time) {
+		j.Status = data.JobPending
+		j.RunAt = runAt
+		j.LastError = lastError
+	})
+}
+
+// BuryJob moves a failed job to the dead letters
+func (m *MemoryJobRepo) BuryJob(ctx context.Context, job *data.Job, lastError string) error {
+	return m.finish(job, func(j *data.Job, now time.Time) {
+		j.Status = data.JobDead
+		j.LastError = lastError
+		j.FinishedAt = &now
+	})
+}
+
+// RequeueJob gives a dead job a new set of attempts, due now
+func (m *MemoryJobRepo) RequeueJob(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok || j.Status != data.JobDead {
+		return &repository.Error{Kind: repository.ErrNotFound, Err: sql.ErrNoRows}
+	}
+
+	now := m.Now()
+
+	j.Status = data.JobPending
+	j.Attempts = 0
+	j.RunAt = now
+	j.FinishedAt = nil
+	j.UpdatedAt = now
+
+	return nil
+}
+
+// Jobs returns jobs matching the filter, newest first
+func (m *MemoryJobRepo) Jobs(ctx context.Context, f data.JobFilter) ([]*data.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := []*data.Job{}
+
+	for id := m.nextID; id > 0 && len(jobs) < jobLimit(f.Limit); id-- {
+		j, ok := m.jobs[id]
+		if !ok || (f.Kind != "" && j.Kind != f.Kind) || (f.Status != "" && j.Status != f.Status) {
+			continue
+		}
+
+		jobs = append(jobs, copyJob(j))
+	}
+
+	return jobs, nil
+}
+
+// PruneJobs removes jobs that were done before the given time; dead jobs stay
+func (m *MemoryJobRepo) PruneJobs(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+
+	for id, j := range m.jobs {
+		if j.Status == data.JobDone && j.FinishedAt.Before(before) {
+			delete(m.jobs, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// finish changes a claimed job, if it is still the claim of the caller
+func (m *MemoryJobRepo) finish(job *data.Job, change func(j *data.Job, now time.Time)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[job.ID]
+	if !ok || j.Status != data.JobRunning || j.Attempts != job.Attempts {
+		return &repository.Error{Kind: repository.ErrNotFound, Err: sql.ErrNoRows}
+	}
+
+	now := m.Now()
+
+	change(j, now)
+	j.LockedAt = nil
+	j.UpdatedAt = now
+
+	return nil
+}
+
+// sorted returns the jobs in the order they are claimed in
+func (m *MemoryJobRepo) sorted() []*data.Job {
+	jobs := make([]*data.Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+
+	sort.Slice(jobs, func(a, b int) bool {
+		if !jobs[a].RunAt.Equal(jobs[b].RunAt) {
+			return jobs[a].RunAt.Before(jobs[b].RunAt)
+		}
+
+		return jobs[a].ID < jobs[b].ID
+	})
+
+	return jobs
+}
+
+func copyJob(j *data.Job) *data.Job {
+	c := *j
+	c.Payload = append([]byte{}, j.Payload...)
+
+	return &c
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,258 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"webapp/pkg/data"
+)
+
+// the most jobs we return in one go
+const maxJobs = 500
+
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, locked_at,
+	coalesce(last_error, ''), coalesce(unique_key, ''), created_at, updated_at, finished_at`
+
+// EnqueueJob queues a job and returns its id. A job with the unique key of another job is
+// not added, and its id is 0.
+func (m *PostgresDBRepo) EnqueueJob(ctx context.Context, job data.Job) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	job = newJob(job, time.Now())
+
+	var newID int64
+	stmt := `insert into jobs (kind, payload, status, max_attempts, run_at, unique_key, created_at, updated_at)
+		values ($1, $2::jsonb, $3, $4, $5, $6, $7, $7)
+		on conflict (unique_key) where unique_key is not null do nothing
+		returning id`
+
+	err := m.db().QueryRowContext(ctx, stmt,
+		job.Kind,
+		string(job.Payload),
+		data.JobPending,
+		job.MaxAttempts,
+		job.RunAt,
+		sql.NullString{String: job.UniqueKey, Valid: job.UniqueKey != ""},
+		job.CreatedAt,
+	).Scan(&newID)
+
+	// the unique key is taken
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	return newID, nil
+}
+
+// ClaimJob locks the next due job of one of the kinds, or returns ErrNotFound. Jobs that
+// were locked longer than staleAfter ago belong to a worker that stopped, and are due again.
+// Workers skip the rows others have locked, so they never wait for each other.
+func (m *PostgresDBRepo) ClaimJob(ctx context.Context, kinds []string, staleAfter time.Duration) (*data.Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `update jobs set status = $1, attempts = attempts + 1, locked_at = $2, updated_at = $2
+	where id = (
+		select id from jobs
+		where kind = any($3)
+		and ((status = $4 and run_at <= $2) or (status = $1 and locked_at < $5))
+		order by run_at, id
+		limit 1
+		for update skip locked
+	)
+	returning ` + jobColumns
+
+	row := m.db().QueryRowContext(ctx, query, data.JobRunning, now, kinds, data.JobPending, now.Add(-staleAfter))
+
+	job, err := scanJob(row)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return job, nil
+}
+
+// CompleteJob marks a claimed job as done
+func (m *PostgresDBRepo) CompleteJob(ctx context.Context, job *data.Job) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, locked_at = null, finished_at = $2, updated_at = $2
+		where id = $3 and status = $4 and attempts = $5`
+
+	return m.execOne(ctx, stmt, data.JobDone, time.Now(), job.ID, data.JobRunning, job.Attempts)
+}
+
+// RetryJob puts a failed job back into the queue, due at runAt
+func (m *PostgresDBRepo) RetryJob(ctx context.Context, job *data.Job, runAt time.Time, lastError string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, locked_at = null, run_at = $2, last_error = $3, updated_at = $4
+		where id = $5 and status = $6 and attempts = $7`
+
+	return m.execOne(ctx, stmt, data.JobPending, runAt, lastError, time.Now(), job.ID, data.JobRunning, job.Attempts)
+}
+
+// BuryJob moves a failed job to the dead letters
+func (m *PostgresDBRepo) BuryJob(ctx context.Context, job *data.Job, lastError string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, locked_at = null, last_error = $2, finished_at = $3, updated_at = $3
+		where id = $4 and status = $5 and attempts = $6`
+
+	return m.execOne(ctx, stmt, data.JobDead, lastError, time.Now(), job.ID, data.JobRunning, job.Attempts)
+}
+
+// RequeueJob gives a dead job a new set of attempts, due now
+func (m *PostgresDBRepo) RequeueJob(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, attempts = 0, run_at = $2, finished_at = null, updated_at = $2
+		where id = $3 and status = $4`
+
+	return m.execOne(ctx, stmt, data.JobPending, time.Now(), id, data.JobDead)
+}
+
+// Jobs returns jobs matching the filter, newest first
+func (m *PostgresDBRepo) Jobs(ctx context.Context, f data.JobFilter) ([]*data.Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+
+	if f.Kind != "" {
+		args = append(args, f.Kind)
+		where = append(where, fmt.Sprintf("kind = $%d", len(args)))
+	}
+
+	if f.Status != "" {
+		args = append(args, f.Status)
+		where = append(where, fmt.Sprintf("status = $%d", len(args)))
+	}
+
+	query := "select " + jobColumns + " from jobs"
+
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+
+	args = append(args, jobLimit(f.Limit))
+	query += fmt.Sprintf(" order by id desc limit $%d", len(args))
+
+	rows, err := m.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	jobs := []*data.Job{}
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, mapError(err)
+	}
+
+	return jobs, nil
+}
+
+// PruneJobs removes jobs that were done before the given time; dead jobs stay
+func (m *PostgresDBRepo) PruneJobs(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, "delete from jobs where status = $1 and finished_at < $2", data.JobDone, before)
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	return int(n), nil
+}
+
+// scanner is what sql.Row and sql.Rows have in common
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (*data.Job, error) {
+	var job data.Job
+	var payload []byte
+
+	err := row.Scan(
+		&job.ID,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LockedAt,
+		&job.LastError,
+		&job.UniqueKey,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.FinishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = payload
+
+	return &job, nil
+}
+
+// newJob fills in the defaults of a job about to be queued
+func newJob(job data.Job, now time.Time) data.Job {
+	if len(job.Payload) == 0 {
+		job.Payload = []byte("{}")
+	}
+
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = data.DefaultMaxAttempts
+	}
+
+	if job.RunAt.IsZero() {
+		job.RunAt = now
+	}
+
+	job.Status = data.JobPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	return job
+}
+
+func jobLimit(limit int) int {
+	if limit <= 0 || limit > maxJobs {
+		return maxJobs
+	}
+
+	return limit
+}
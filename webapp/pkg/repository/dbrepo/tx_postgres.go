@@ -0,0 +1,94 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+	"webapp/pkg/repository"
+
+	"github.com/jackc/pgconn"
+)
+
+// how often WithTx runs a transaction that postgres could not serialize
+const maxTxAttempts = 3
+
+// dbtx is what *sql.DB and *sql.Tx have in common, so methods run the same in and out of a transaction
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// db is the open transaction, if there is one, or the connection pool
+func (m *PostgresDBRepo) db() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+
+	return m.DB
+}
+
+// WithTx runs fn in a serializable transaction. Everything fn does with repo is committed
+// when fn returns nil, and rolled back when it returns an error. When postgres aborts the
+// transaction because of a serialization failure or deadlock, fn runs again, so it must not
+// have side effects outside of repo. Calls of WithTx within fn join the outer transaction.
+func (m *PostgresDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		return fn(tx)
+	})
+
+	return mapError(err)
+}
+
+// inTx is WithTx for our own methods that need more than one statement
+func (m *PostgresDBRepo) inTx(ctx context.Context, fn func(tx *PostgresDBRepo) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	var err error
+
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = m.runTx(ctx, fn)
+
+		if !isRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 20 * time.Millisecond):
+		}
+	}
+
+	return err
+}
+
+func (m *PostgresDBRepo) runTx(ctx context.Context, fn func(tx *PostgresDBRepo) error) error {
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(&PostgresDBRepo{DB: m.DB, Hasher: m.Hasher, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isRetryable reports whether err is postgres giving up on a transaction that is safe to run again
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	// serialization_failure and deadlock_detected
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
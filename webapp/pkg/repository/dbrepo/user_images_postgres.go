@@ -0,0 +1,198 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"webapp/pkg/data"
+)
+
+// AllUserImages returns the images of a user, newest first
+func (m *PostgresDBRepo) AllUserImages(userID int) ([]*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, coalesce(file_name, ''), is_primary, created_at, updated_at
+	from user_images where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.db().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	images := []*data.UserImage{}
+
+	for rows.Next() {
+		var i data.UserImage
+		err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.FileName,
+			&i.IsPrimary,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		images = append(images, &i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, mapError(err)
+	}
+
+	err = m.attachVariants(ctx, images, `select v.id, v.user_image_id, v.name, v.file_name, v.content_type,
+		v.width, v.height, v.created_at, v.updated_at
+		from user_image_variants v join user_images i on i.id = v.user_image_id
+		where i.user_id = $1 order by v.width desc, v.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// GetUserImage returns one image by id
+func (m *PostgresDBRepo) GetUserImage(id int) (*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, coalesce(file_name, ''), is_primary, created_at, updated_at
+	from user_images where id = $1`
+
+	var i data.UserImage
+
+	err := m.db().QueryRowContext(ctx, query, id).Scan(
+		&i.ID,
+		&i.UserID,
+		&i.FileName,
+		&i.IsPrimary,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	err = m.attachVariants(ctx, []*data.UserImage{&i}, `select id, user_image_id, name, file_name, content_type,
+		width, height, created_at, updated_at
+		from user_image_variants where user_image_id = $1 order by width desc, id`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// attachVariants runs a query for variants, and adds each one to its image
+func (m *PostgresDBRepo) attachVariants(ctx context.Context, images []*data.UserImage, query string, args ...any) error {
+	byID := make(map[int]*data.UserImage, len(images))
+
+	for _, i := range images {
+		byID[i.ID] = i
+	}
+
+	rows, err := m.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return mapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v data.UserImageVariant
+		err := rows.Scan(
+			&v.ID,
+			&v.UserImageID,
+			&v.Name,
+			&v.FileName,
+			&v.ContentType,
+			&v.Width,
+			&v.Height,
+			&v.CreatedAt,
+			&v.UpdatedAt,
+		)
+		if err != nil {
+			return mapError(err)
+		}
+
+		if i, ok := byID[v.UserImageID]; ok {
+			i.Variants = append(i.Variants, &v)
+		}
+	}
+
+	return mapError(rows.Err())
+}
+
+// DeleteUserImage removes an image and its variants. When it was the primary image, the newest
+// remaining image becomes primary. The caller has to remove the files.
+func (m *PostgresDBRepo) DeleteUserImage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		var userID int
+		var wasPrimary bool
+
+		err := tx.db().QueryRowContext(ctx, `delete from user_images where id = $1 returning user_id, is_primary`, id).
+			Scan(&userID, &wasPrimary)
+		if err != nil {
+			return mapError(err)
+		}
+
+		if !wasPrimary {
+			return nil
+		}
+
+		_, err = tx.db().ExecContext(ctx, `update user_images set is_primary = true, updated_at = $1
+			where id = (select id from user_images where user_id = $2 order by created_at desc, id desc limit 1)`,
+			time.Now(), userID)
+
+		return mapError(err)
+	})
+}
+
+// SetPrimaryUserImage makes one of a user's images their avatar. It returns repository.ErrNotFound
+// if the image does not belong to the user.
+func (m *PostgresDBRepo) SetPrimaryUserImage(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		var exists bool
+
+		err := tx.db().QueryRowContext(ctx, `select true from user_images where id = $1 and user_id = $2`, id, userID).
+			Scan(&exists)
+		if err != nil {
+			return mapError(err)
+		}
+
+		// one after the other, or the unique index sees two primary images
+		_, err = tx.db().ExecContext(ctx, `update user_images set is_primary = false, updated_at = $1
+			where user_id = $2 and is_primary and id <> $3`, time.Now(), userID, id)
+		if err != nil {
+			return mapError(err)
+		}
+
+		_, err = tx.db().ExecContext(ctx, `update user_images set is_primary = true, updated_at = $1
+			where id = $2 and not is_primary`, time.Now(), id)
+
+		return mapError(err)
+	})
+}
+
+// UserImageFileInUse reports whether any image or variant, of any user, still uses the file. Files are
+// named after their content, so the same upload can be shared by several images.
+func (m *PostgresDBRepo) UserImageFileInUse(fileName string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var inUse bool
+
+	err := m.db().QueryRowContext(ctx, `select exists(select 1 from user_images where file_name = $1)
+		or exists(select 1 from user_image_variants where file_name = $1)`, fileName).Scan(&inUse)
+
+	return inUse, mapError(err)
+}
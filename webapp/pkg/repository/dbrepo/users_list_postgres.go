@@ -0,0 +1,255 @@
+package dbrepo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// page sizes for ListUsers
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// cursorTimeLayout keeps the microseconds postgres stores
+const cursorTimeLayout = "2006-01-02T15:04:05.999999"
+
+// sortColumn is how we order by a column, and how we cast a cursor value back to its type
+type sortColumn struct {
+	expr string
+	cast string
+}
+
+// sortColumns whitelists what users can be sorted by; nullable text columns sort as empty strings
+var sortColumns = map[string]sortColumn{
+	data.SortByID:        {"id", "int"},
+	data.SortByEmail:     {"coalesce(email, '')", "text"},
+	data.SortByFirstName: {"coalesce(first_name, '')", "text"},
+	data.SortByLastName:  {"coalesce(last_name, '')", "text"},
+	data.SortByIsAdmin:   {"coalesce(is_admin, 0)", "int"},
+	data.SortByCreatedAt: {"created_at", "timestamp"},
+	data.SortByUpdatedAt: {"updated_at", "timestamp"},
+}
+
+// cursor is the last row of a page: its sort value and id, which breaks ties
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// ListUsers returns one page of users matching the options, and how many match in total
+func (m *PostgresDBRepo) ListUsers(ctx context.Context, opts data.ListOptions) (*data.UserList, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	opts, col, err := normalizeListOptions(opts)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	where, args := listUsersWhere(opts)
+
+	var total int
+	err = m.db().QueryRowContext(ctx, "select count(*) from users where "+strings.Join(where, " and "), args...).Scan(&total)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	dir, cmp := "asc", ">"
+	if opts.Desc {
+		dir, cmp = "desc", "<"
+	}
+
+	if opts.After != "" {
+		c, err := decodeCursor(opts.After)
+		if err != nil || c.Sort != opts.Sort || c.Desc != opts.Desc {
+			return nil, repository.ErrInvalidCursor
+		}
+
+		args = append(args, c.Value, c.ID)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)", col.expr, cmp, len(args)-1, col.cast, len(args)))
+	}
+
+	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+	totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale
+	from users where ` + strings.Join(where, " and ")
+
+	args = append(args, opts.PerPage)
+	query += fmt.Sprintf(" order by %s %s, id %s limit $%d", col.expr, dir, dir, len(args))
+
+	if opts.After == "" {
+		args = append(args, (opts.Page-1)*opts.PerPage)
+		query += fmt.Sprintf(" offset $%d", len(args))
+	}
+
+	rows, err := m.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	list := data.UserList{
+		Users:   []*data.User{},
+		Total:   total,
+		PerPage: opts.PerPage,
+	}
+
+	if opts.After == "" {
+		list.Page = opts.Page
+	}
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.IsAdmin,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.TOTPSecret,
+			&user.TOTPEnabled,
+			&user.Version,
+			&user.EmailVerifiedAt,
+			&user.PendingEmail,
+			&user.Locale,
+		)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		list.Users = append(list.Users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, mapError(err)
+	}
+
+	// a full page means there might be more
+	if len(list.Users) == opts.PerPage {
+		last := list.Users[len(list.Users)-1]
+		list.NextCursor = encodeCursor(cursor{Sort: opts.Sort, Desc: opts.Desc, Value: sortValue(last, opts.Sort), ID: last.ID})
+	}
+
+	return &list, nil
+}
+
+// normalizeListOptions fills in defaults and checks the sort column
+func normalizeListOptions(opts data.ListOptions) (data.ListOptions, sortColumn, error) {
+	if opts.Sort == "" {
+		opts.Sort = data.SortByLastName
+	}
+
+	col, ok := sortColumns[opts.Sort]
+	if !ok {
+		return opts, col, fmt.Errorf("can not sort users by %q", opts.Sort)
+	}
+
+	if opts.PerPage <= 0 {
+		opts.PerPage = defaultPerPage
+	}
+
+	if opts.PerPage > maxPerPage {
+		opts.PerPage = maxPerPage
+	}
+
+	if opts.Page <= 0 {
+		opts.Page = 1
+	}
+
+	return opts, col, nil
+}
+
+// listUsersWhere builds the filters shared by the count and the page query
+func listUsersWhere(opts data.ListOptions) ([]string, []any) {
+	where := []string{"deleted_at is null"}
+	var args []any
+
+	if opts.IsAdmin != nil {
+		args = append(args, *opts.IsAdmin)
+		where = append(where, fmt.Sprintf("coalesce(is_admin, 0) = $%d", len(args)))
+	}
+
+	if !opts.CreatedFrom.IsZero() {
+		args = append(args, opts.CreatedFrom)
+		where = append(where, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+
+	if !opts.CreatedTo.IsZero() {
+		args = append(args, opts.CreatedTo)
+		where = append(where, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	if s := strings.TrimSpace(opts.Search); s != "" {
+		args = append(args, "%"+escapeLike(s)+"%")
+		n := len(args)
+		where = append(where, fmt.Sprintf("(first_name ilike $%d or last_name ilike $%d or email ilike $%d)", n, n, n))
+	}
+
+	return where, args
+}
+
+// escapeLike makes the LIKE wildcards in s match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sortValue is the value of the sort column for a user, as it goes into a cursor
+func sortValue(u *data.User, sort string) string {
+	switch sort {
+	case data.SortByEmail:
+		return u.Email
+	case data.SortByFirstName:
+		return u.FirstName
+	case data.SortByLastName:
+		return u.LastName
+	case data.SortByIsAdmin:
+		return strconv.Itoa(u.IsAdmin)
+	case data.SortByCreatedAt:
+		return u.CreatedAt.Format(cursorTimeLayout)
+	case data.SortByUpdatedAt:
+		return u.UpdatedAt.Format(cursorTimeLayout)
+	}
+
+	return strconv.Itoa(u.ID)
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+
+	// the value is cast in sql, so make sure it is what the column holds
+	switch sortColumns[c.Sort].cast {
+	case "int":
+		_, err = strconv.Atoi(c.Value)
+	case "timestamp":
+		_, err = time.Parse(cursorTimeLayout, c.Value)
+	}
+
+	return c, err
+}
@@ -3,17 +3,28 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 	"webapp/pkg/data"
-
-	"golang.org/x/crypto/bcrypt"
+	"webapp/pkg/passwords"
+	"webapp/pkg/repository"
 )
 
 const dbTimeout = time.Second * 3
 
+// errPatchEmail is returned for patches that change the address, which only SetPendingEmail and
+// VerifyEmail do
+var errPatchEmail = errors.New("PatchUser does not change the email address; use SetPendingEmail")
+
 type PostgresDBRepo struct {
 	DB *sql.DB
+	// Hasher hashes new passwords; passwords.Default is used when it is nil
+	Hasher *passwords.Hasher
+	// tx is set on the copies WithTx hands out
+	tx *sql.Tx
 }
 
 // m model
@@ -22,17 +33,26 @@ func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
+func (m *PostgresDBRepo) hasher() *passwords.Hasher {
+	if m.Hasher == nil {
+		return passwords.Default
+	}
+
+	return m.Hasher
+}
+
 // AllUsers returns all users as a slice of *data.User
 func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at
-	from users order by last_name`
+	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+	totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale
+	from users where deleted_at is null order by last_name`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.db().QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, mapError(err)
 	}
 	defer rows.Close()
 
@@ -49,10 +69,16 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 			&user.IsAdmin,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.TOTPSecret,
+			&user.TOTPEnabled,
+			&user.Version,
+			&user.EmailVerifiedAt,
+			&user.PendingEmail,
+			&user.Locale,
 		)
 		if err != nil {
 			log.Println("Error scanning", err)
-			return nil, err
+			return nil, mapError(err)
 		}
 
 		users = append(users, &user)
@@ -68,14 +94,15 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 
 	query := `
 		select 
-			id, email, first_name, last_name, password, is_admin, created_at, updated_at 
+			id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+			totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale
 		from 
 			users 
 		where 
-		    id = $1`
+		    id = $1 and deleted_at is null`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.db().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&user.ID,
@@ -86,10 +113,16 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+		&user.EmailVerifiedAt,
+		&user.PendingEmail,
+		&user.Locale,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, mapError(err)
 	}
 
 	return &user, nil
@@ -102,14 +135,15 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 
 	query := `
 		select 
-			id, email, first_name, last_name, password, is_admin, created_at, updated_at 
+			id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+			totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale
 		from 
 			users 
 		where 
-		    email = $1`
+		    email = $1 and deleted_at is null`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, email)
+	row := m.db().QueryRowContext(ctx, query, email)
 
 	err := row.Scan(
 		&user.ID,
@@ -120,58 +154,331 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+		&user.EmailVerifiedAt,
+		&user.PendingEmail,
+		&user.Locale,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, mapError(err)
 	}
 
 	return &user, nil
 }
 
-// UpdateUser updates one user in the database
+// UpdateUser updates one user in the database. It returns repository.ErrConflict when the user
+// changed since u.Version was read. u.Email is not written: an address only changes through
+// SetPendingEmail and VerifyEmail, once the user proved they get mail there.
 func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	stmt := `update users set
-		email = $1,
-		first_name = $2,
-		last_name = $3,
-		is_admin = $4,
-		updated_at = $5
-		where id = $6
+		first_name = $1,
+		last_name = $2,
+		is_admin = $3,
+		updated_at = $4,
+		version = version + 1
+		where id = $5 and version = $6 and deleted_at is null
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.Email,
+	err := m.execOne(ctx, stmt,
 		u.FirstName,
 		u.LastName,
 		u.IsAdmin,
 		time.Now(),
 		u.ID,
+		u.Version,
+	)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return m.whyNotUpdated(ctx, u.ID)
+	}
+
+	return err
+}
+
+// PatchUser changes only the fields set in the patch, and returns the updated user. Like UpdateUser,
+// it returns repository.ErrConflict when the user changed since version was read, and it does not
+// change the address: a patch with Email set is an error.
+func (m *PostgresDBRepo) PatchUser(id, version int, p data.UserPatch) (*data.User, error) {
+	if p.Email != nil {
+		return nil, errPatchEmail
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var set []string
+	var args []any
+
+	add := func(column string, value any) {
+		args = append(args, value)
+		set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if p.FirstName != nil {
+		add("first_name", *p.FirstName)
+	}
+
+	if p.LastName != nil {
+		add("last_name", *p.LastName)
+	}
+
+	if p.IsAdmin != nil {
+		add("is_admin", *p.IsAdmin)
+	}
+
+	// nothing to change, but the caller should still learn they are out of date
+	if p.Empty() {
+		user, err := m.GetUser(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if user.Version != version {
+			return nil, &repository.Error{Kind: repository.ErrConflict, Err: fmt.Errorf("user %d is at version %d, not %d", id, user.Version, version)}
+		}
+
+		return user, nil
+	}
+
+	add("updated_at", time.Now())
+	set = append(set, "version = version + 1")
+
+	args = append(args, id, version)
+
+	stmt := fmt.Sprintf(`update users set %s
+		where id = $%d and version = $%d and deleted_at is null
+		returning id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+		totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale`, strings.Join(set, ", "), len(args)-1, len(args))
+
+	var user data.User
+
+	err := m.db().QueryRowContext(ctx, stmt, args...).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.IsAdmin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+		&user.EmailVerifiedAt,
+		&user.PendingEmail,
+		&user.Locale,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, m.whyNotUpdated(ctx, id)
+	}
+
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return &user, nil
+}
+
+// SetPendingEmail stores the address a user is changing to, until VerifyEmail confirms it; an
+// empty email cancels the change. It returns repository.ErrDuplicateEmail when another user has
+// the address already.
+func (m *PostgresDBRepo) SetPendingEmail(id int, email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		if email != "" {
+			var taken bool
+
+			err := tx.db().QueryRowContext(ctx,
+				`select exists (select 1 from users where email = $1 and id <> $2 and deleted_at is null)`,
+				email, id,
+			).Scan(&taken)
+			if err != nil {
+				return mapError(err)
+			}
+
+			if taken {
+				return &repository.Error{Kind: repository.ErrDuplicateEmail, Err: fmt.Errorf("%s belongs to another user", email)}
+			}
+		}
+
+		return tx.execOne(ctx, `update users set pending_email = $1, updated_at = $2 where id = $3 and deleted_at is null`,
+			sql.NullString{String: email, Valid: email != ""}, time.Now(), id)
+	})
+}
+
+// VerifyEmail records that the user gets mail at email. That is either their address, or the
+// pending one, which then replaces it. It returns repository.ErrNotFound when the user has
+// neither address (anymore), and repository.ErrDuplicateEmail when another user took the
+// pending address in the meantime.
+func (m *PostgresDBRepo) VerifyEmail(id int, email string) (*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// columns on the right are the values before the update; taking the pending address is a
+	// change of the user like PatchUser makes, so the version goes up
+	stmt := `update users set
+		email = $1,
+		pending_email = case when pending_email = $1 then null else pending_email end,
+		email_verified_at = coalesce(case when email = $1 then email_verified_at end, $2),
+		version = case when email = $1 then version else version + 1 end,
+		updated_at = $2
+		where id = $3 and deleted_at is null and (email = $1 or pending_email = $1)
+		returning id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+		totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale`
+
+	var user data.User
+
+	err := m.db().QueryRowContext(ctx, stmt, email, time.Now(), id).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.IsAdmin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+		&user.EmailVerifiedAt,
+		&user.PendingEmail,
+		&user.Locale,
 	)
 
 	if err != nil {
-		return err
+		return nil, mapError(err)
 	}
 
-	return nil
+	return &user, nil
 }
 
-// DeleteUser deletes one user from the database, by id
+// SetUserLocale stores the language the user chose; an empty locale goes back to the one their
+// browser asks for. It is a preference, not a change of the user, so the version stays.
+func (m *PostgresDBRepo) SetUserLocale(id int, locale string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.execOne(ctx, `update users set locale = $1, updated_at = $2 where id = $3 and deleted_at is null`,
+		locale, time.Now(), id)
+}
+
+// whyNotUpdated tells apart a user that is gone from one that was changed by someone else
+func (m *PostgresDBRepo) whyNotUpdated(ctx context.Context, id int) error {
+	var version int
+
+	err := m.db().QueryRowContext(ctx, `select version from users where id = $1 and deleted_at is null`, id).Scan(&version)
+	if err != nil {
+		return mapError(err)
+	}
+
+	return &repository.Error{Kind: repository.ErrConflict, Err: fmt.Errorf("user %d was changed, it is at version %d now", id, version)}
+}
+
+// DeleteUser soft deletes one user, by id. The user can be restored with RestoreUser
+// until PurgeDeletedUsers removes them for good.
 func (m *PostgresDBRepo) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	stmt := `update users set deleted_at = $1 where id = $2 and deleted_at is null`
+
+	return m.execOne(ctx, stmt, time.Now(), id)
+}
+
+// RestoreUser undoes DeleteUser. It returns repository.ErrNotFound if there is no deleted user with that id,
+// and repository.ErrDuplicateEmail when another user has taken their email address since.
+func (m *PostgresDBRepo) RestoreUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set deleted_at = null, updated_at = $1 where id = $2 and deleted_at is not null`
+
+	return m.execOne(ctx, stmt, time.Now(), id)
+}
+
+// PurgeDeletedUsers permanently removes users that were deleted before the given time, together with
+// their images. It returns how many users were removed, and the file names of their images.
+func (m *PostgresDBRepo) PurgeDeletedUsers(before time.Time) (int, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var count int
+	var files []string
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		files = nil
+
+		// variants would go with their images anyway, but we need their files
+		variantFiles, err := tx.deletedFileNames(ctx, `delete from user_image_variants
+			where user_image_id in (select i.id from user_images i join users u on u.id = i.user_id where u.deleted_at < $1)
+			returning file_name`, before)
+		if err != nil {
+			return err
+		}
+
+		imageFiles, err := tx.deletedFileNames(ctx, `delete from user_images
+			where user_id in (select id from users where deleted_at < $1)
+			returning coalesce(file_name, '')`, before)
+		if err != nil {
+			return err
+		}
+
+		files = append(imageFiles, variantFiles...)
+
+		result, err := tx.db().ExecContext(ctx, `delete from users where deleted_at < $1`, before)
+		if err != nil {
+			return mapError(err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return mapError(err)
+		}
+
+		count = int(affected)
+
+		return nil
+	})
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
 	if err != nil {
-		return err
+		return 0, nil, mapError(err)
+	}
+
+	return count, files, nil
+}
+
+// deletedFileNames runs a delete that returns file names, and collects the ones that are set
+func (m *PostgresDBRepo) deletedFileNames(ctx context.Context, stmt string, args ...any) ([]string, error) {
+	rows, err := m.db().QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	var files []string
+
+	for rows.Next() {
+		var f string
+
+		if err := rows.Scan(&f); err != nil {
+			return nil, mapError(err)
+		}
+
+		if f != "" {
+			files = append(files, f)
+		}
 	}
 
-	return nil
+	return files, mapError(rows.Err())
 }
 
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
@@ -179,16 +486,16 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := m.hasher().Hash(user.Password)
 	if err != nil {
-		return 0, err
+		return 0, mapError(err)
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at, email_verified_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
-	err = m.DB.QueryRowContext(ctx, stmt,
+	err = m.db().QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
@@ -196,10 +503,11 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 		user.IsAdmin,
 		time.Now(),
 		time.Now(),
+		user.EmailVerifiedAt,
 	).Scan(&newID)
 
 	if err != nil {
-		return 0, err
+		return 0, mapError(err)
 	}
 
 	return newID, nil
@@ -210,38 +518,224 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := m.hasher().Hash(password)
 	if err != nil {
-		return err
+		return mapError(err)
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
+	stmt := `update users set password = $1 where id = $2 and deleted_at is null`
+
+	return m.execOne(ctx, stmt, hashedPassword, id)
+}
+
+// InsertUserImage inserts a user profile image, and its variants, into the database. When the image is primary,
+// the user's other images stop being primary.
+func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		if i.IsPrimary {
+			_, err := tx.db().ExecContext(ctx, `update user_images set is_primary = false, updated_at = $1
+				where user_id = $2 and is_primary`, time.Now(), i.UserID)
+			if err != nil {
+				return err
+			}
+		}
+
+		stmt := `insert into user_images (user_id, file_name, is_primary, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+		err := tx.db().QueryRowContext(ctx, stmt,
+			i.UserID,
+			i.FileName,
+			i.IsPrimary,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range i.Variants {
+			_, err := tx.db().ExecContext(ctx, `insert into user_image_variants
+				(user_image_id, name, file_name, content_type, width, height, created_at, updated_at)
+				values ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				newID, v.Name, v.FileName, v.ContentType, v.Width, v.Height, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
 	if err != nil {
-		return err
+		return 0, mapError(err)
 	}
 
-	return nil
+	return newID, nil
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+// EnableTOTP stores the (already encrypted) two-factor secret for a user and turns 2FA on.
+func (m *PostgresDBRepo) EnableTOTP(id int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, totp_enabled = true, updated_at = $2 where id = $3`
+
+	return m.execOne(ctx, stmt, secret, time.Now(), id)
+}
+
+// DisableTOTP turns 2FA off for a user, and removes their secret and recovery codes.
+func (m *PostgresDBRepo) DisableTOTP(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		stmt := `update users set totp_secret = '', totp_enabled = false, updated_at = $1 where id = $2`
+
+		err := tx.execOne(ctx, stmt, time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.db().ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, id)
+
+		return mapError(err)
+	})
+}
+
+// ReplaceRecoveryCodes removes a user's existing recovery codes and stores the given hashes instead.
+func (m *PostgresDBRepo) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		_, err := tx.db().ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID)
+		if err != nil {
+			return mapError(err)
+		}
+
+		stmt := `insert into user_recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+
+		for _, hash := range hashes {
+			_, err = tx.db().ExecContext(ctx, stmt, userID, hash, time.Now())
+			if err != nil {
+				return mapError(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// UseRecoveryCode marks an unused recovery code as used. It returns false if
+// there is no unused code with that hash for the user.
+func (m *PostgresDBRepo) UseRecoveryCode(userID int, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := m.db().ExecContext(ctx, stmt, time.Now(), userID, hash)
+	if err != nil {
+		return false, mapError(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, mapError(err)
+	}
+
+	return affected == 1, nil
+}
+
+// UseTOTPCounter records counter as the last time step a TOTP code of the user was accepted
+// for. It returns false if a code of this or a later step was accepted already.
+func (m *PostgresDBRepo) UseTOTPCounter(userID int, counter int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set totp_last_counter = $1 where id = $2 and totp_last_counter < $1`
+
+	result, err := m.db().ExecContext(ctx, stmt, counter, userID)
+	if err != nil {
+		return false, mapError(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, mapError(err)
+	}
+
+	return affected == 1, nil
+}
+
+// GetUserByIdentity returns the user linked to an account at an external identity provider
+func (m *PostgresDBRepo) GetUserByIdentity(provider, subject string) (*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select 
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			u.totp_secret, u.totp_enabled, u.version, u.email_verified_at, coalesce(u.pending_email, ''), u.locale
+		from 
+			users u
+			inner join user_identities i on (i.user_id = u.id)
+		where 
+		    i.provider = $1 and i.subject = $2 and u.deleted_at is null`
+
+	var user data.User
+	row := m.db().QueryRowContext(ctx, query, provider, subject)
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.IsAdmin,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+		&user.EmailVerifiedAt,
+		&user.PendingEmail,
+		&user.Locale,
+	)
+
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return &user, nil
+}
+
+// InsertUserIdentity links a user to an account at an external identity provider.
+func (m *PostgresDBRepo) InsertUserIdentity(i data.UserIdentity) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	var newID int
-	stmt := `insert into user_images (user_id, fileName, created_at, updated_at)
-		values ($1, $2, $3, $4) returning id`
+	stmt := `insert into user_identities (user_id, provider, subject, email, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
 
-	err := m.DB.QueryRowContext(ctx, stmt,
+	err := m.db().QueryRowContext(ctx, stmt,
 		i.UserID,
-		i.FileName,
-		time.Now(),
+		i.Provider,
+		i.Subject,
+		i.Email,
 		time.Now(),
 	).Scan(&newID)
 
 	if err != nil {
-		return 0, err
+		return 0, mapError(err)
 	}
 
 	return newID, nil
@@ -1,17 +1,22 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"testing"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/passwords"
 	"webapp/pkg/repository"
 
-	_ "github.com/jackc/pgconn"
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/ory/dockertest/v3"
@@ -213,6 +218,7 @@ func TestPostgresDBRepoUpdateUser(t *testing.T) {
 		newName  = "KINGKONG"
 	)
 
+	oldEmail := user.Email
 	user.Email = newEmail
 	user.FirstName = newName
 
@@ -224,8 +230,867 @@ func TestPostgresDBRepoUpdateUser(t *testing.T) {
 
 	user, _ = testRepo.GetUser(2)
 
-	if user.Email != newEmail || user.FirstName != newName {
-		t.Errorf("expected user email to be %s but got %s, and expected user name to be %s, but got %s", newEmail, user.Email, newName, user.FirstName)
+	// the address only changes once the new one is verified
+	if user.Email != oldEmail || user.FirstName != newName {
+		t.Errorf("expected user email to stay %s but got %s, and expected user name to be %s, but got %s", oldEmail, user.Email, newName, user.FirstName)
 	}
 
 }
+
+func TestPostgresDBRepoUserIdentity(t *testing.T) {
+	identity := data.UserIdentity{
+		UserID:   1,
+		Provider: "company",
+		Subject:  "abc",
+		Email:    "admin@example.com",
+	}
+
+	_, err := testRepo.InsertUserIdentity(identity)
+
+	if err != nil {
+		t.Errorf("insert user identity returned an error: %s", err)
+	}
+
+	user, err := testRepo.GetUserByIdentity("company", "abc")
+
+	if err != nil {
+		t.Errorf("get user by identity returned an error: %s", err)
+	}
+
+	if user != nil && user.ID != 1 {
+		t.Errorf("expected identity to belong to user 1, but got %d", user.ID)
+	}
+
+	// the same external account can't be linked twice
+	_, err = testRepo.InsertUserIdentity(identity)
+
+	if err == nil {
+		t.Error("no error reported when linking an identity twice")
+	}
+
+	_, err = testRepo.GetUserByIdentity("company", "unknown")
+
+	if err == nil {
+		t.Error("no error reported when getting a user by an unknown identity")
+	}
+}
+
+func TestPostgresDBRepoResetPasswordArgon2id(t *testing.T) {
+	hasher, _ := passwords.New(passwords.Argon2id, 0, passwords.DefaultArgon2Params)
+
+	repo := &PostgresDBRepo{DB: testDB, Hasher: hasher}
+
+	err := repo.ResetPassword(2, "new password")
+
+	if err != nil {
+		t.Errorf("error resetting password: %s", err)
+	}
+
+	// argon2id hashes don't fit the old varchar(60) column
+	user, _ := repo.GetUser(2)
+
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("expected an argon2id hash, but got %s", user.Password)
+	}
+
+	matches, err := user.PasswordMatches("new password")
+
+	if err != nil || !matches {
+		t.Errorf("new password does not match the stored hash (%v)", err)
+	}
+}
+
+func TestPostgresDBRepoAuditEvents(t *testing.T) {
+	repo := testRepo.(repository.AuditRepo)
+
+	events := []data.AuditEvent{
+		{ActorID: 1, TargetUserID: 1, Action: data.AuditLogin, IP: "127.0.0.1"},
+		{TargetUserID: 2, Action: data.AuditLoginFailed, IP: "127.0.0.2", Details: "bad password"},
+		{Action: data.AuditLoginFailed, IP: "127.0.0.3", Details: "unknown email"},
+	}
+
+	for _, e := range events {
+		_, err := repo.InsertAuditEvent(e)
+
+		if err != nil {
+			t.Errorf("insert audit event returned an error: %s", err)
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		filter   data.AuditFilter
+		expected int
+	}{
+		{"everything", data.AuditFilter{}, 3},
+		{"by action", data.AuditFilter{Action: data.AuditLoginFailed}, 2},
+		{"by user", data.AuditFilter{UserID: 2}, 1},
+		{"limited", data.AuditFilter{Limit: 1}, 1},
+		{"in the future", data.AuditFilter{From: time.Now().Add(time.Hour)}, 0},
+	}
+
+	for _, e := range tests {
+		found, err := repo.AuditEvents(e.filter)
+
+		if err != nil {
+			t.Errorf("%s: audit events returned an error: %s", e.name, err)
+		}
+
+		if len(found) != e.expected {
+			t.Errorf("%s: expected %d events, but got %d", e.name, e.expected, len(found))
+		}
+	}
+
+	// newest first, and no id comes back as a null
+	found, _ := repo.AuditEvents(data.AuditFilter{})
+
+	if len(found) == 3 && (found[0].IP != "127.0.0.3" || found[0].ActorID != 0) {
+		t.Errorf("unexpected first event %+v", found[0])
+	}
+}
+
+func TestPostgresDBRepoSoftDeleteAndRestore(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{
+		FirstName: "Soft",
+		LastName:  "Delete",
+		Email:     "soft@example.com",
+		Password:  "secret",
+	})
+
+	_, _ = testDB.Exec(`insert into user_images (user_id, file_name, created_at, updated_at) values ($1, 'soft.jpg', now(), now())`, id)
+
+	before, _ := testRepo.AllUsers()
+
+	err := testRepo.DeleteUser(id)
+
+	if err != nil {
+		t.Errorf("delete user returned an error: %s", err)
+	}
+
+	// deleted users are hidden from all the read methods
+	if _, err := testRepo.GetUser(id); err == nil {
+		t.Error("deleted user is still returned by GetUser")
+	}
+
+	if _, err := testRepo.GetUserByEmail("soft@example.com"); err == nil {
+		t.Error("deleted user is still returned by GetUserByEmail")
+	}
+
+	after, _ := testRepo.AllUsers()
+
+	if len(after) != len(before)-1 {
+		t.Errorf("expected %d users after delete, but got %d", len(before)-1, len(after))
+	}
+
+	// restore brings them back
+	err = testRepo.RestoreUser(id)
+
+	if err != nil {
+		t.Errorf("restore user returned an error: %s", err)
+	}
+
+	if _, err := testRepo.GetUser(id); err != nil {
+		t.Errorf("restored user not found: %s", err)
+	}
+
+	if err := testRepo.RestoreUser(id); err == nil {
+		t.Error("no error restoring a user that is not deleted")
+	}
+
+	// recently deleted users are not purged
+	_ = testRepo.DeleteUser(id)
+
+	count, _, err := testRepo.PurgeDeletedUsers(time.Now().Add(-time.Hour))
+
+	if err != nil || count != 0 {
+		t.Errorf("expected nothing to be purged, but got %d (%v)", count, err)
+	}
+
+	count, files, err := testRepo.PurgeDeletedUsers(time.Now().Add(time.Minute))
+
+	if err != nil {
+		t.Errorf("purge returned an error: %s", err)
+	}
+
+	if count != 1 || len(files) != 1 || files[0] != "soft.jpg" {
+		t.Errorf("expected to purge 1 user with soft.jpg, but got %d and %v", count, files)
+	}
+
+	if err := testRepo.RestoreUser(id); err == nil {
+		t.Error("purged user could be restored")
+	}
+}
+
+func TestPostgresDBRepoRestoreUserTakenEmail(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{
+		FirstName: "Gone",
+		LastName:  "User",
+		Email:     "gone@example.com",
+		Password:  "secret",
+	})
+
+	_ = testRepo.DeleteUser(id)
+
+	// the address is free while the user is deleted
+	if _, err := testRepo.InsertUser(data.User{FirstName: "New", LastName: "User", Email: "gone@example.com", Password: "secret"}); err != nil {
+		t.Fatalf("could not take the address of a deleted user: %s", err)
+	}
+
+	if err := testRepo.RestoreUser(id); !errors.Is(err, repository.ErrDuplicateEmail) {
+		t.Errorf("expected ErrDuplicateEmail restoring a user whose address was taken, but got %v", err)
+	}
+}
+
+func TestPostgresDBRepoListUsers(t *testing.T) {
+	for _, name := range []string{"Carol", "Alice", "Bob", "Dave", "Eve"} {
+		_, _ = testRepo.InsertUser(data.User{
+			FirstName: name,
+			LastName:  "Lister",
+			Email:     strings.ToLower(name) + "@list.example.com",
+			Password:  "secret",
+			IsAdmin:   0,
+		})
+	}
+
+	opts := data.ListOptions{Search: "list.example", Sort: data.SortByFirstName, PerPage: 2}
+
+	// offset pagination
+	list, err := testRepo.ListUsers(context.Background(), opts)
+
+	if err != nil {
+		t.Fatalf("list users returned an error: %s", err)
+	}
+
+	if list.Total != 5 || len(list.Users) != 2 || list.Users[0].FirstName != "Alice" || list.NextCursor == "" {
+		t.Errorf("unexpected first page: total %d, %d users, cursor %q", list.Total, len(list.Users), list.NextCursor)
+	}
+
+	opts.Page = 3
+	list, _ = testRepo.ListUsers(context.Background(), opts)
+
+	if len(list.Users) != 1 || list.Users[0].FirstName != "Eve" || list.NextCursor != "" {
+		t.Errorf("unexpected last page: %d users, cursor %q", len(list.Users), list.NextCursor)
+	}
+
+	// keyset pagination, descending, walks through everyone exactly once
+	opts = data.ListOptions{Search: "list.example", Sort: data.SortByFirstName, Desc: true, PerPage: 2}
+
+	var names []string
+
+	for {
+		list, err := testRepo.ListUsers(context.Background(), opts)
+
+		if err != nil {
+			t.Fatalf("list users returned an error: %s", err)
+		}
+
+		for _, u := range list.Users {
+			names = append(names, u.FirstName)
+		}
+
+		if list.NextCursor == "" {
+			break
+		}
+
+		opts.After = list.NextCursor
+	}
+
+	if strings.Join(names, ",") != "Eve,Dave,Carol,Bob,Alice" {
+		t.Errorf("unexpected keyset order: %v", names)
+	}
+
+	// a cursor only works for the sort it was made for
+	opts.Sort = data.SortByEmail
+
+	if _, err := testRepo.ListUsers(context.Background(), opts); err != repository.ErrInvalidCursor {
+		t.Errorf("expected invalid cursor error, but got %v", err)
+	}
+
+	// filters
+	admin := 1
+	list, _ = testRepo.ListUsers(context.Background(), data.ListOptions{IsAdmin: &admin})
+
+	for _, u := range list.Users {
+		if u.IsAdmin != 1 {
+			t.Errorf("admin filter returned %s, who is not an admin", u.Email)
+		}
+	}
+
+	list, _ = testRepo.ListUsers(context.Background(), data.ListOptions{Search: "list.example", CreatedFrom: time.Now().Add(time.Hour)})
+
+	if list.Total != 0 {
+		t.Errorf("expected no users created in the future, but got %d", list.Total)
+	}
+
+	list, _ = testRepo.ListUsers(context.Background(), data.ListOptions{Search: "100%"})
+
+	if list.Total != 0 {
+		t.Errorf("expected %% to match literally, but got %d users", list.Total)
+	}
+}
+
+func TestPostgresDBRepoSearchUsers(t *testing.T) {
+	for _, u := range [][]string{{"Miss", "Moneypenny"}, {"Money", "Maker"}, {"Q", "Boothroyd"}} {
+		_, _ = testRepo.InsertUser(data.User{
+			FirstName: u[0],
+			LastName:  u[1],
+			Email:     strings.ToLower(u[1]) + "@mi6.example.com",
+			Password:  "secret",
+		})
+	}
+
+	var tests = []struct {
+		name          string
+		query         string
+		expectedFirst string
+		// similar users can be found as well, so this is the least we expect
+		expectedCount int
+	}{
+		{"whole word", "moneypenny", "Moneypenny", 1},
+		{"prefix ranks whole words first", "money", "Maker", 2},
+		{"several prefixes", "miss money", "Moneypenny", 1},
+		{"substring", "throy", "Boothroyd", 1},
+		{"email", "boothroyd@mi6", "Boothroyd", 1},
+		{"no match", "blofeld", "", 0},
+		{"nothing to search for", "  ", "", 0},
+	}
+
+	for _, e := range tests {
+		results, err := testRepo.SearchUsers(context.Background(), e.query, 10)
+
+		if err != nil {
+			t.Errorf("%s: search returned an error: %s", e.name, err)
+			continue
+		}
+
+		if len(results) < e.expectedCount || (e.expectedCount == 0 && len(results) > 0) {
+			t.Errorf("%s: expected %d results, but got %d", e.name, e.expectedCount, len(results))
+			continue
+		}
+
+		if e.expectedCount > 0 && results[0].User.LastName != e.expectedFirst {
+			t.Errorf("%s: expected %s first, but got %s", e.name, e.expectedFirst, results[0].User.LastName)
+		}
+	}
+}
+
+func TestPostgresDBRepoWithTx(t *testing.T) {
+	ctx := context.Background()
+
+	// an error rolls back everything
+	var id int
+
+	err := testRepo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+
+		id, err = repo.InsertUser(data.User{FirstName: "Roll", LastName: "Back", Email: "rollback@example.com", Password: "secret"})
+		if err != nil {
+			return err
+		}
+
+		if _, err := repo.GetUser(id); err != nil {
+			t.Errorf("user inserted in the transaction is not visible in it: %s", err)
+		}
+
+		return errors.New("something went wrong")
+	})
+
+	if err == nil || err.Error() != "something went wrong" {
+		t.Errorf("expected the error of fn, but got %v", err)
+	}
+
+	if _, err := testRepo.GetUser(id); err == nil {
+		t.Error("user inserted in a rolled back transaction exists")
+	}
+
+	// nested calls join the outer transaction, and success commits
+	err = testRepo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+
+		id, err = repo.InsertUser(data.User{FirstName: "Com", LastName: "Mit", Email: "commit@example.com", Password: "secret"})
+		if err != nil {
+			return err
+		}
+
+		return repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+			_, err := repo.InsertUserIdentity(data.UserIdentity{UserID: id, Provider: "tx", Subject: "commit"})
+
+			return err
+		})
+	})
+
+	if err != nil {
+		t.Errorf("transaction returned an error: %s", err)
+	}
+
+	user, err := testRepo.GetUserByIdentity("tx", "commit")
+
+	if err != nil || user.ID != id {
+		t.Errorf("expected committed user %d with identity, but got %v (%v)", id, user, err)
+	}
+
+	// serialization failures are retried
+	attempts := 0
+
+	err = testRepo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		attempts++
+
+		if attempts == 1 {
+			return &pgconn.PgError{Code: "40001", Message: "could not serialize access"}
+		}
+
+		return nil
+	})
+
+	if err != nil || attempts != 2 {
+		t.Errorf("expected success on the second attempt, but got %d attempts and %v", attempts, err)
+	}
+
+	// but not forever
+	attempts = 0
+
+	err = testRepo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		attempts++
+
+		return &pgconn.PgError{Code: "40P01", Message: "deadlock detected"}
+	})
+
+	if err == nil || attempts != maxTxAttempts {
+		t.Errorf("expected to give up after %d attempts, but got %d and %v", maxTxAttempts, attempts, err)
+	}
+}
+
+func TestPostgresDBRepoErrors(t *testing.T) {
+	_, err := testRepo.InsertUser(data.User{FirstName: "Admin", LastName: "Again", Email: "admin@example.com", Password: "secret"})
+
+	if !errors.Is(err, repository.ErrDuplicateEmail) {
+		t.Errorf("expected duplicate email error, but got %v", err)
+	}
+
+	if _, err := testRepo.GetUser(9999); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUser: expected not found, but got %v", err)
+	}
+
+	if _, err := testRepo.GetUserByEmail("nobody@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUserByEmail: expected not found, but got %v", err)
+	}
+
+	if err := testRepo.UpdateUser(data.User{ID: 9999, Email: "nobody@example.com"}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateUser: expected not found, but got %v", err)
+	}
+
+	if err := testRepo.DeleteUser(9999); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteUser: expected not found, but got %v", err)
+	}
+
+	if err := testRepo.ResetPassword(9999, "secret"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("ResetPassword: expected not found, but got %v", err)
+	}
+
+	if _, err := testRepo.InsertUserIdentity(data.UserIdentity{UserID: 9999, Provider: "test", Subject: "nobody"}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("InsertUserIdentity: expected not found, but got %v", err)
+	}
+}
+
+func Test_mapError(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"no rows", sql.ErrNoRows, repository.ErrNotFound},
+		{"duplicate email", &pgconn.PgError{Code: "23505", ConstraintName: usersEmailIndex}, repository.ErrDuplicateEmail},
+		{"other unique violation", &pgconn.PgError{Code: "23505", ConstraintName: "user_identities_provider_subject_key"}, repository.ErrConflict},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, repository.ErrConflict},
+		{"foreign key", &pgconn.PgError{Code: "23503"}, repository.ErrNotFound},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, repository.ErrUnavailable},
+		{"shutting down", &pgconn.PgError{Code: "57P01"}, repository.ErrUnavailable},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, repository.ErrUnavailable},
+		{"timeout", context.DeadlineExceeded, repository.ErrUnavailable},
+		{"bad connection", driver.ErrBadConn, repository.ErrUnavailable},
+	}
+
+	for _, e := range tests {
+		got := mapError(e.err)
+
+		if !errors.Is(got, e.expected) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expected, got)
+		}
+
+		// the original error is still there, for logging and retries
+		if !errors.Is(got, e.err) {
+			t.Errorf("%s: mapped error does not wrap %v", e.name, e.err)
+		}
+	}
+
+	other := errors.New("something else")
+
+	if got := mapError(other); got != other {
+		t.Errorf("expected unknown errors to be returned as they are, but got %v", got)
+	}
+}
+
+func TestPostgresDBRepoOptimisticConcurrency(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{FirstName: "Opti", LastName: "Mistic", Email: "optimistic@example.com", Password: "secret"})
+
+	first, _ := testRepo.GetUser(id)
+	second, _ := testRepo.GetUser(id)
+
+	if first.Version != 1 {
+		t.Errorf("expected a new user to be at version 1, but got %d", first.Version)
+	}
+
+	// the first save wins, the second one is out of date
+	first.FirstName = "First"
+
+	if err := testRepo.UpdateUser(*first); err != nil {
+		t.Errorf("first update returned an error: %s", err)
+	}
+
+	second.LastName = "Second"
+
+	if err := testRepo.UpdateUser(*second); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected a conflict, but got %v", err)
+	}
+
+	// a patch only writes its own fields
+	lastName := "Patched"
+
+	user, err := testRepo.PatchUser(id, 2, data.UserPatch{LastName: &lastName})
+
+	if err != nil {
+		t.Fatalf("patch returned an error: %s", err)
+	}
+
+	if user.FirstName != "First" || user.LastName != "Patched" || user.Version != 3 {
+		t.Errorf("unexpected user after patch: %+v", user)
+	}
+
+	if _, err := testRepo.PatchUser(id, 2, data.UserPatch{LastName: &lastName}); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected a conflict for a stale patch, but got %v", err)
+	}
+
+	if _, err := testRepo.PatchUser(id, 2, data.UserPatch{}); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected a conflict for a stale empty patch, but got %v", err)
+	}
+
+	if _, err := testRepo.PatchUser(9999, 1, data.UserPatch{LastName: &lastName}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found, but got %v", err)
+	}
+}
+
+func TestPostgresDBRepoUserImages(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{
+		FirstName: "Image",
+		LastName:  "Gallery",
+		Email:     "gallery@example.com",
+		Password:  "secret",
+	})
+
+	other, _ := testRepo.InsertUser(data.User{
+		FirstName: "Other",
+		LastName:  "Gallery",
+		Email:     "other-gallery@example.com",
+		Password:  "secret",
+	})
+
+	var ids []int
+
+	for _, f := range []string{"first.jpg", "second.jpg", "third.jpg"} {
+		imageID, err := testRepo.InsertUserImage(data.UserImage{UserID: id, FileName: f, IsPrimary: true})
+
+		if err != nil {
+			t.Fatalf("insert image returned an error: %s", err)
+		}
+
+		ids = append(ids, imageID)
+	}
+
+	otherImage, _ := testRepo.InsertUserImage(data.UserImage{UserID: other, FileName: "other.jpg", IsPrimary: true, Variants: []*data.UserImageVariant{
+		{Name: "large", FileName: "other.jpg", ContentType: "image/jpeg", Width: 1600, Height: 900},
+		{Name: "thumbnail", FileName: "other-thumbnail.jpg", ContentType: "image/jpeg", Width: 160, Height: 160},
+	}})
+
+	image, err := testRepo.GetUserImage(otherImage)
+
+	if err != nil || len(image.Variants) != 2 || image.Variants[0].Name != "large" || image.Variants[1].FileName != "other-thumbnail.jpg" {
+		t.Errorf("unexpected variants %+v (%v)", image, err)
+	}
+
+	otherImages, _ := testRepo.AllUserImages(other)
+
+	if len(otherImages) != 1 || len(otherImages[0].Variants) != 2 {
+		t.Errorf("expected one image with two variants, but got %+v", otherImages)
+	}
+
+	images, err := testRepo.AllUserImages(id)
+
+	if err != nil {
+		t.Fatalf("all user images returned an error: %s", err)
+	}
+
+	if len(images) != 3 || images[0].FileName != "third.jpg" {
+		t.Fatalf("expected 3 images, newest first, but got %d", len(images))
+	}
+
+	// only the last upload is primary
+	for _, i := range images {
+		if i.IsPrimary != (i.ID == ids[2]) {
+			t.Errorf("image %d: unexpected primary %t", i.ID, i.IsPrimary)
+		}
+	}
+
+	err = testRepo.SetPrimaryUserImage(id, ids[0])
+
+	if err != nil {
+		t.Errorf("set primary returned an error: %s", err)
+	}
+
+	image, _ = testRepo.GetUserImage(ids[0])
+
+	if !image.IsPrimary {
+		t.Error("image was not made primary")
+	}
+
+	image, _ = testRepo.GetUserImage(ids[2])
+
+	if image.IsPrimary {
+		t.Error("previous primary image is still primary")
+	}
+
+	// users can only pick their own images
+	if err := testRepo.SetPrimaryUserImage(id, otherImage); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found for another user's image, but got %v", err)
+	}
+
+	// deleting the primary image promotes the newest one that is left
+	if err := testRepo.DeleteUserImage(ids[0]); err != nil {
+		t.Errorf("delete image returned an error: %s", err)
+	}
+
+	image, _ = testRepo.GetUserImage(ids[2])
+
+	if !image.IsPrimary {
+		t.Error("newest image was not promoted after deleting the primary image")
+	}
+
+	if _, err := testRepo.GetUserImage(ids[0]); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected deleted image to be gone, but got %v", err)
+	}
+
+	if err := testRepo.DeleteUserImage(ids[0]); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found deleting twice, but got %v", err)
+	}
+
+	image, _ = testRepo.GetUserImage(otherImage)
+
+	if !image.IsPrimary {
+		t.Error("another user's primary image changed")
+	}
+
+	// files are only in use while an image has them
+	if inUse, err := testRepo.UserImageFileInUse("first.jpg"); err != nil || inUse {
+		t.Errorf("expected first.jpg to be unused, but got %t (%v)", inUse, err)
+	}
+
+	if inUse, err := testRepo.UserImageFileInUse("other.jpg"); err != nil || !inUse {
+		t.Errorf("expected other.jpg to be in use, but got %t (%v)", inUse, err)
+	}
+
+	if inUse, err := testRepo.UserImageFileInUse("other-thumbnail.jpg"); err != nil || !inUse {
+		t.Errorf("expected the thumbnail to be in use, but got %t (%v)", inUse, err)
+	}
+
+	// deleting an image takes its variants along
+	_ = testRepo.DeleteUserImage(otherImage)
+
+	if inUse, _ := testRepo.UserImageFileInUse("other-thumbnail.jpg"); inUse {
+		t.Error("thumbnail of a deleted image is still in use")
+	}
+}
+
+func TestPostgresDBRepoJobs(t *testing.T) {
+	repo := testRepo.(repository.JobRepo)
+	ctx := context.Background()
+
+	first, err := repo.EnqueueJob(ctx, data.Job{Kind: "test", Payload: []byte(`{"n": 1}`), UniqueKey: "once"})
+	if err != nil {
+		t.Fatalf("enqueue job returned an error: %s", err)
+	}
+
+	// the same unique key is not queued twice
+	if id, err := repo.EnqueueJob(ctx, data.Job{Kind: "test", UniqueKey: "once"}); id != 0 || err != nil {
+		t.Errorf("expected no second job, but got %d (%v)", id, err)
+	}
+
+	later, _ := repo.EnqueueJob(ctx, data.Job{Kind: "test", RunAt: time.Now().Add(time.Hour)})
+	_, _ = repo.EnqueueJob(ctx, data.Job{Kind: "other"})
+
+	job, err := repo.ClaimJob(ctx, []string{"test"}, time.Minute)
+	if err != nil {
+		t.Fatalf("claim job returned an error: %s", err)
+	}
+
+	if job.ID != first || job.Status != data.JobRunning || job.Attempts != 1 || string(job.Payload) != `{"n": 1}` {
+		t.Errorf("unexpected claimed job %+v", job)
+	}
+
+	// the other test job is not due, and the other kind is not asked for
+	if _, err := repo.ClaimJob(ctx, []string{"test"}, time.Minute); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected no due job, but got %v", err)
+	}
+
+	// a lock older than the stale time is taken over, and the first worker can't finish anymore
+	taken, err := repo.ClaimJob(ctx, []string{"test"}, -time.Second)
+	if err != nil || taken.ID != first || taken.Attempts != 2 {
+		t.Fatalf("expected to take over the stale job, but got %+v (%v)", taken, err)
+	}
+
+	if err := repo.CompleteJob(ctx, job); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found completing a lost job, but got %v", err)
+	}
+
+	if err := repo.RetryJob(ctx, taken, time.Now(), "failed"); err != nil {
+		t.Errorf("retry job returned an error: %s", err)
+	}
+
+	job, _ = repo.ClaimJob(ctx, []string{"test"}, time.Minute)
+
+	if err := repo.BuryJob(ctx, job, "failed again"); err != nil {
+		t.Errorf("bury job returned an error: %s", err)
+	}
+
+	dead, _ := repo.Jobs(ctx, data.JobFilter{Status: data.JobDead})
+
+	if len(dead) != 1 || dead[0].LastError != "failed again" || dead[0].FinishedAt == nil {
+		t.Errorf("expected one dead job, but got %+v", dead)
+	}
+
+	if err := repo.RequeueJob(ctx, first); err != nil {
+		t.Errorf("requeue job returned an error: %s", err)
+	}
+
+	if err := repo.RequeueJob(ctx, later); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found requeueing a pending job, but got %v", err)
+	}
+
+	job, _ = repo.ClaimJob(ctx, []string{"test"}, time.Minute)
+	_ = repo.CompleteJob(ctx, job)
+
+	if n, err := repo.PruneJobs(ctx, time.Now().Add(time.Minute)); n != 1 || err != nil {
+		t.Errorf("expected to prune 1 job, but pruned %d (%v)", n, err)
+	}
+
+	all, _ := repo.Jobs(ctx, data.JobFilter{})
+
+	if len(all) != 2 {
+		t.Errorf("expected 2 jobs left, but got %d", len(all))
+	}
+}
+
+func TestPostgresDBRepoEmailVerification(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{FirstName: "Veri", LastName: "Fied", Email: "verify@example.com", Password: "secret"})
+	otherID, _ := testRepo.InsertUser(data.User{FirstName: "Oth", LastName: "Er", Email: "verify-other@example.com", Password: "secret"})
+
+	user, _ := testRepo.GetUser(id)
+
+	if user.EmailVerified() || user.PendingEmail != "" {
+		t.Errorf("expected a new user to be unverified, but got %+v", user)
+	}
+
+	// the current address
+	user, err := testRepo.VerifyEmail(id, "verify@example.com")
+
+	if err != nil || !user.EmailVerified() || user.Version != 1 {
+		t.Errorf("expected a verified user at version 1, but got %+v (%v)", user, err)
+	}
+
+	if err := testRepo.SetPendingEmail(id, "verify-other@example.com"); !errors.Is(err, repository.ErrDuplicateEmail) {
+		t.Errorf("expected a duplicate email, but got %v", err)
+	}
+
+	if err := testRepo.SetPendingEmail(id, "verify-new@example.com"); err != nil {
+		t.Fatalf("set pending email returned an error: %s", err)
+	}
+
+	// the old address is still in use until the new one is verified
+	user, _ = testRepo.GetUser(id)
+
+	if user.Email != "verify@example.com" || user.PendingEmail != "verify-new@example.com" || !user.EmailVerified() {
+		t.Errorf("unexpected user with a pending email: %+v", user)
+	}
+
+	if _, err := testRepo.VerifyEmail(otherID, "verify-new@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found verifying another user's address, but got %v", err)
+	}
+
+	user, err = testRepo.VerifyEmail(id, "verify-new@example.com")
+
+	if err != nil || user.Email != "verify-new@example.com" || user.PendingEmail != "" || user.Version != 2 {
+		t.Errorf("expected the new address to be in use, but got %+v (%v)", user, err)
+	}
+
+	// a link for the old address is no good anymore
+	if _, err := testRepo.VerifyEmail(id, "verify@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found for the old address, but got %v", err)
+	}
+
+	// the address can't be changed around the verification
+	email := "verify-patched@example.com"
+
+	if _, err := testRepo.PatchUser(id, 2, data.UserPatch{Email: &email}); err == nil {
+		t.Error("expected an error patching the address")
+	}
+
+	user, _ = testRepo.GetUser(id)
+
+	if user.Email != "verify-new@example.com" || !user.EmailVerified() {
+		t.Errorf("expected the verified address to be unchanged, but got %+v", user)
+	}
+}
+
+func TestPostgresDBRepoSetUserLocale(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{FirstName: "Lo", LastName: "Cale", Email: "locale@example.com", Password: "secret"})
+
+	if err := testRepo.SetUserLocale(id, "sr"); err != nil {
+		t.Fatalf("set user locale returned an error: %s", err)
+	}
+
+	user, _ := testRepo.GetUser(id)
+
+	// a preference does not conflict with edits in progress
+	if user.Locale != "sr" || user.Version != 0 {
+		t.Errorf("expected locale sr at version 0, but got %+v", user)
+	}
+
+	if err := testRepo.SetUserLocale(9999, "sr"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected not found for a missing user, but got %v", err)
+	}
+}
+
+func TestPostgresDBRepoUseTOTPCounter(t *testing.T) {
+	id, _ := testRepo.InsertUser(data.User{FirstName: "To", LastName: "Tp", Email: "totp-counter@example.com", Password: "secret"})
+
+	var tests = []struct {
+		name     string
+		counter  int64
+		expected bool
+	}{
+		{"first code", 100, true},
+		{"same code again", 100, false},
+		{"older code", 99, false},
+		{"next code", 101, true},
+	}
+
+	for _, e := range tests {
+		fresh, err := testRepo.UseTOTPCounter(id, e.counter)
+
+		if err != nil {
+			t.Fatalf("%s: use totp counter returned an error: %s", e.name, err)
+		}
+
+		if fresh != e.expected {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.expected, fresh)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package dbrepo
+
+import (
+	"context"
+	"strings"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// searchDocument is what we search users by. It has to match the expressions of the
+// users_search_idx and users_search_trgm_idx indexes exactly, or they are not used.
+const searchDocument = `(coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(email, ''))`
+
+// SearchUsers finds users by (parts of) their names and email, best matches first. Whole words
+// and word prefixes are found with the full-text index, typos with trigram similarity, and any
+// other substring with ILIKE.
+func (m *PostgresDBRepo) SearchUsers(ctx context.Context, query string, limit int) ([]*data.UserSearchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	results := []*data.UserSearchResult{}
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return results, nil
+	}
+
+	if limit <= 0 {
+		limit = defaultPerPage
+	}
+
+	if limit > maxPerPage {
+		limit = maxPerPage
+	}
+
+	// every term as a prefix: "jam bo" becomes jam:* & bo:*
+	terms := repository.SearchTerms(query)
+	for i, t := range terms {
+		terms[i] = t + ":*"
+	}
+
+	stmt := `
+		select
+			id, email, first_name, last_name, password, is_admin, created_at, updated_at,
+			totp_secret, totp_enabled, version, email_verified_at, coalesce(pending_email, ''), locale,
+			ts_rank(to_tsvector('simple', ` + searchDocument + `), to_tsquery('simple', $1))
+				+ word_similarity($2, ` + searchDocument + `) as rank
+		from
+			users
+		where
+			deleted_at is null and (
+				to_tsvector('simple', ` + searchDocument + `) @@ to_tsquery('simple', $1)
+				or $2 <% ` + searchDocument + `
+				or ` + searchDocument + ` ilike $3
+			)
+		order by rank desc, last_name, id
+		limit $4`
+
+	rows, err := m.db().QueryContext(ctx, stmt, strings.Join(terms, " & "), query, "%"+escapeLike(query)+"%", limit)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user data.User
+		var rank float64
+
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.IsAdmin,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.TOTPSecret,
+			&user.TOTPEnabled,
+			&user.Version,
+			&user.EmailVerifiedAt,
+			&user.PendingEmail,
+			&user.Locale,
+			&rank,
+		)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		results = append(results, &data.UserSearchResult{User: &user, Rank: rank})
+	}
+
+	return results, mapError(rows.Err())
+}
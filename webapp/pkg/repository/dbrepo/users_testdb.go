@@ -1,11 +1,60 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"sync"
+	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/totp"
 )
 
+// TestTOTPSecret is the plain two-factor secret of the 2fa@example.com test user; the
+// stored value is encrypted with the key "test-encryption-key"
+const TestTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// TestRecoveryCode is the one recovery code the test repository accepts
+const TestRecoveryCode = "abcde-fghjk"
+
+// TestPendingEmail is the address the 2fa@example.com test user is changing to
+const TestPendingEmail = "2fa-new@example.com"
+
+// TestUnavailableEmail makes GetUserByEmail fail as if the database was down
+const TestUnavailableEmail = "down@example.com"
+
+// TestTakenEmailUserID is a deleted user whose email address another user has taken since;
+// RestoreUser fails for them
+const TestTakenEmailUserID = 3
+
+// hash of "secret"
+const testPasswordHash = "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK"
+
+// TestDBRepo is a repository of fixed test users and images. Its writes change nothing, but
+// are logged, for tests to check what was written; see Writes.
 type TestDBRepo struct {
+	mu sync.Mutex
+	// writes are the successful writes, like "PatchUser 2"
+	writes []string
+	// totpCounters are the time steps of the last TOTP codes accepted, by user
+	totpCounters map[int]int64
+}
+
+// Writes returns the writes that were made and committed, as method and id, like "PatchUser 2"
+func (m *TestDBRepo) Writes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.writes...)
+}
+
+// wrote logs a successful write
+func (m *TestDBRepo) wrote(method string, id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writes = append(m.writes, fmt.Sprintf("%s %d", method, id))
 }
 
 // m model
@@ -14,6 +63,24 @@ func (m *TestDBRepo) Connection() *sql.DB {
 	return nil
 }
 
+// WithTx runs fn with a transaction: a repository of its own, whose writes are added to the
+// ones of m when fn returns nil, and discarded when it returns an error. The TOTP counters of
+// the transaction start empty; nothing uses them in a transaction.
+func (m *TestDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	tx := &TestDBRepo{}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writes = append(m.writes, tx.writes...)
+
+	return nil
+}
+
 // AllUsers returns all users as a slice of *data.User
 func (m *TestDBRepo) AllUsers() ([]*data.User, error) {
 	var users []*data.User
@@ -21,66 +88,371 @@ func (m *TestDBRepo) AllUsers() ([]*data.User, error) {
 	return users, nil
 }
 
+// ListUsers returns one page of users matching the options
+func (m *TestDBRepo) ListUsers(ctx context.Context, opts data.ListOptions) (*data.UserList, error) {
+	users := []*data.User{
+		testAdminUser(),
+		testTwoFactorUser(),
+	}
+
+	return &data.UserList{Users: users, Total: len(users), Page: 1, PerPage: 20}, nil
+}
+
+// SearchUsers finds users by (parts of) their names and email, best matches first
+func (m *TestDBRepo) SearchUsers(ctx context.Context, query string, limit int) ([]*data.UserSearchResult, error) {
+	list, _ := m.ListUsers(ctx, data.ListOptions{})
+
+	return repository.SearchUsersLike(list.Users, query, limit), nil
+}
+
 // GetUser returns one user by id
 func (m *TestDBRepo) GetUser(id int) (*data.User, error) {
-	var user = data.User{
-		ID: 1,
+	if id == 2 {
+		return testTwoFactorUser(), nil
+	}
+
+	if id == 1 {
+		return testAdminUser(), nil
 	}
 
-	return &user, nil
+	return nil, repository.ErrNotFound
 }
 
 // GetUserByEmail returns one user by email address
 func (m *TestDBRepo) GetUserByEmail(email string) (*data.User, error) {
-	// if email == "admin@example.com" {
-	// 	var user = data.User{
-	// 		ID:        1,
-	// 		FirstName: "Admin",
-	// 		LastName:  "User",
-	// 		Email:     "admin@example.com",
-	// 		Password:  "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
-	// 		IsAdmin:   1,
-	// 		CreatedAt: time.Now(),
-	// 		UpdatedAt: time.Now(),
-	// 	}
+	if email == "admin@example.com" {
+		return testAdminUser(), nil
+	}
 
-	// 	return &user, nil
-	// }
+	if email == "2fa@example.com" {
+		return testTwoFactorUser(), nil
+	}
 
-	// return nil, errors.New("not found")
-	var user = data.User{
-		ID: 1,
+	// pretends the database is down
+	if email == TestUnavailableEmail {
+		return nil, repository.ErrUnavailable
 	}
 
-	return &user, nil
+	return nil, repository.ErrNotFound
 }
 
-// UpdateUser updates one user in the database
+// testAdminUser is the admin with the password "secret", and a verified address
+func testAdminUser() *data.User {
+	verified := time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC)
+
+	return &data.User{
+		ID:              1,
+		FirstName:       "Admin",
+		LastName:        "User",
+		Email:           "admin@example.com",
+		Password:        testPasswordHash,
+		IsAdmin:         1,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		Version:         1,
+		EmailVerifiedAt: &verified,
+	}
+}
+
+// testTwoFactorUser is a regular user with two-factor authentication turned on, who has not
+// verified their address, and is changing it to TestPendingEmail
+func testTwoFactorUser() *data.User {
+	return &data.User{
+		ID:           2,
+		FirstName:    "Two",
+		LastName:     "Factor",
+		Email:        "2fa@example.com",
+		Password:     testPasswordHash,
+		IsAdmin:      0,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		TOTPSecret:   "KvYvQI0Bbu6JoGlN7m6XoeZ0jKOMJGIKvEumyUi2YDMb6F5QN/53Nr8xAOE=",
+		TOTPEnabled:  true,
+		Version:      1,
+		PendingEmail: TestPendingEmail,
+	}
+}
+
+// UpdateUser updates one user in the database; the test users are all at version 1
 func (m *TestDBRepo) UpdateUser(u data.User) error {
+	_, err := m.PatchUser(u.ID, u.Version, data.UserPatch{})
+
+	return err
+}
+
+// PatchUser changes only the fields set in the patch, and returns the updated user
+func (m *TestDBRepo) PatchUser(id, version int, p data.UserPatch) (*data.User, error) {
+	if p.Email != nil {
+		return nil, errPatchEmail
+	}
+
+	user, err := m.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Version != version {
+		return nil, repository.ErrConflict
+	}
+
+	p.Apply(user)
+
+	if !p.Empty() {
+		user.Version++
+	}
+
+	m.wrote("PatchUser", id)
+
+	return user, nil
+}
+
+// SetPendingEmail stores the address a user is changing to
+func (m *TestDBRepo) SetPendingEmail(id int, email string) error {
+	user, err := m.GetUser(id)
+	if err != nil {
+		return err
+	}
+
+	if other, err := m.GetUserByEmail(email); err == nil && other.ID != user.ID {
+		return repository.ErrDuplicateEmail
+	}
+
+	m.wrote("SetPendingEmail", id)
+
+	return nil
+}
+
+// VerifyEmail records that the user gets mail at their address, or at the pending one
+func (m *TestDBRepo) VerifyEmail(id int, email string) (*data.User, error) {
+	user, err := m.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch email {
+	case user.Email:
+	case user.PendingEmail:
+		user.Email = email
+		user.PendingEmail = ""
+		user.Version++
+	default:
+		return nil, repository.ErrNotFound
+	}
+
+	if user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	m.wrote("VerifyEmail", id)
+
+	return user, nil
+}
+
+// SetUserLocale stores the language the user chose
+func (m *TestDBRepo) SetUserLocale(id int, locale string) error {
+	if _, err := m.GetUser(id); err != nil {
+		return err
+	}
+
+	m.wrote("SetUserLocale", id)
 
 	return nil
 }
 
-// DeleteUser deletes one user from the database, by id
+// DeleteUser soft deletes one user, by id
 func (m *TestDBRepo) DeleteUser(id int) error {
+	if _, err := m.GetUser(id); err != nil {
+		return err
+	}
+
+	m.wrote("DeleteUser", id)
 
 	return nil
 }
 
+// RestoreUser undoes DeleteUser
+func (m *TestDBRepo) RestoreUser(id int) error {
+	if id == TestTakenEmailUserID {
+		return repository.ErrDuplicateEmail
+	}
+
+	if id == 1 {
+		m.wrote("RestoreUser", id)
+		return nil
+	}
+
+	return repository.ErrNotFound
+}
+
+// PurgeDeletedUsers permanently removes users that were deleted before the given time
+func (m *TestDBRepo) PurgeDeletedUsers(before time.Time) (int, []string, error) {
+	m.wrote("PurgeDeletedUsers", 0)
+
+	return 1, []string{"purged.jpg"}, nil
+}
+
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
 func (m *TestDBRepo) InsertUser(user data.User) (int, error) {
+	m.wrote("InsertUser", 2)
 
 	return 2, nil
 }
 
 // ResetPassword is the method we will use to change a user's password.
 func (m *TestDBRepo) ResetPassword(id int, password string) error {
+	m.wrote("ResetPassword", id)
 
 	return nil
 }
 
 // InsertUserImage inserts a user profile image into the database.
 func (m *TestDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	m.wrote("InsertUserImage", 1)
+
+	return 1, nil
+}
+
+// testUserImages are the images of the test users; the admin has two, 2fa@example.com two,
+// one of them the same file as the admin's newest image. Only the admin's newest image has variants.
+func testUserImages() []*data.UserImage {
+	return []*data.UserImage{
+		{ID: 2, UserID: 1, FileName: "admin-new.jpg", IsPrimary: true, Variants: []*data.UserImageVariant{
+			{ID: 1, UserImageID: 2, Name: "large", FileName: "admin-new.jpg", ContentType: "image/jpeg", Width: 1600, Height: 1200},
+			{ID: 2, UserImageID: 2, Name: "medium", FileName: "admin-new-medium.jpg", ContentType: "image/jpeg", Width: 640, Height: 480},
+			{ID: 3, UserImageID: 2, Name: "thumbnail", FileName: "admin-new-thumbnail.jpg", ContentType: "image/jpeg", Width: 160, Height: 160},
+		}},
+		{ID: 1, UserID: 1, FileName: "admin-old.jpg"},
+		{ID: 4, UserID: 2, FileName: "admin-new.jpg"},
+		{ID: 3, UserID: 2, FileName: "2fa.jpg", IsPrimary: true},
+	}
+}
+
+// AllUserImages returns the images of a user, newest first
+func (m *TestDBRepo) AllUserImages(userID int) ([]*data.UserImage, error) {
+	images := []*data.UserImage{}
+
+	for _, i := range testUserImages() {
+		if i.UserID == userID {
+			images = append(images, i)
+		}
+	}
+
+	return images, nil
+}
+
+// GetUserImage returns one image by id
+func (m *TestDBRepo) GetUserImage(id int) (*data.UserImage, error) {
+	for _, i := range testUserImages() {
+		if i.ID == id {
+			return i, nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// DeleteUserImage removes an image
+func (m *TestDBRepo) DeleteUserImage(id int) error {
+	if _, err := m.GetUserImage(id); err != nil {
+		return err
+	}
+
+	m.wrote("DeleteUserImage", id)
+
+	return nil
+}
+
+// SetPrimaryUserImage makes one of a user's images their avatar
+func (m *TestDBRepo) SetPrimaryUserImage(userID, id int) error {
+	i, err := m.GetUserImage(id)
+	if err != nil {
+		return err
+	}
+
+	if i.UserID != userID {
+		return repository.ErrNotFound
+	}
+
+	m.wrote("SetPrimaryUserImage", id)
+
+	return nil
+}
+
+// UserImageFileInUse reports whether any image or variant still uses the file. Nothing is ever
+// deleted here, so a file is in use when more than one image has it.
+func (m *TestDBRepo) UserImageFileInUse(fileName string) (bool, error) {
+	count := 0
+
+	for _, i := range testUserImages() {
+		for _, f := range i.FileNames() {
+			if f == fileName {
+				count++
+			}
+		}
+	}
+
+	return count > 1, nil
+}
+
+// EnableTOTP stores the (already encrypted) two-factor secret for a user and turns 2FA on.
+func (m *TestDBRepo) EnableTOTP(id int, secret string) error {
+	m.wrote("EnableTOTP", id)
+
+	return nil
+}
+
+// DisableTOTP turns 2FA off for a user, and removes their secret and recovery codes.
+func (m *TestDBRepo) DisableTOTP(id int) error {
+	m.wrote("DisableTOTP", id)
+
+	return nil
+}
+
+// ReplaceRecoveryCodes removes a user's existing recovery codes and stores the given hashes instead.
+func (m *TestDBRepo) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	m.wrote("ReplaceRecoveryCodes", userID)
+
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used.
+func (m *TestDBRepo) UseRecoveryCode(userID int, hash string) (bool, error) {
+
+	return hash == totp.HashRecoveryCode(TestRecoveryCode), nil
+}
+
+// UseTOTPCounter records counter as the last time step a TOTP code of the user was accepted
+// for. It returns false if a code of this or a later step was accepted already.
+func (m *TestDBRepo) UseTOTPCounter(userID int, counter int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.totpCounters == nil {
+		m.totpCounters = make(map[int]int64)
+	}
+
+	if counter <= m.totpCounters[userID] {
+		return false, nil
+	}
+
+	m.totpCounters[userID] = counter
+
+	return true, nil
+}
+
+// GetUserByIdentity returns the user linked to an account at an external identity provider
+func (m *TestDBRepo) GetUserByIdentity(provider, subject string) (*data.User, error) {
+	if provider == "test" && subject == "linked-subject" {
+		return testTwoFactorUser(), nil
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+// InsertUserIdentity links a user to an account at an external identity provider.
+func (m *TestDBRepo) InsertUserIdentity(i data.UserIdentity) (int, error) {
+	m.wrote("InsertUserIdentity", i.UserID)
 
 	return 1, nil
 }
@@ -0,0 +1,37 @@
+package repository
+
+import "errors"
+
+// errors returned by repositories, whatever database is behind them; check them with errors.Is
+var (
+	// ErrNotFound means there is no such row, or it was (soft) deleted
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicateEmail means another user already has the email address
+	ErrDuplicateEmail = errors.New("email address is already taken")
+	// ErrConflict means the change clashes with the current data, or with a concurrent change
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable means the database could not be reached or is overloaded; trying again later may work
+	ErrUnavailable = errors.New("database unavailable")
+	// ErrInvalidCursor is returned by ListUsers when ListOptions.After was not a NextCursor for the same sort order
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Error is one of the errors above, with the error of the database behind it
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap gives access to the database error, for logging and retries
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrNotFound) and the like work
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
@@ -1,18 +1,69 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"time"
 	"webapp/pkg/data"
 )
 
 type DatabaseRepo interface {
 	Connection() *sql.DB
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
 	AllUsers() ([]*data.User, error)
+	ListUsers(ctx context.Context, opts data.ListOptions) (*data.UserList, error)
+	SearchUsers(ctx context.Context, query string, limit int) ([]*data.UserSearchResult, error)
 	GetUser(id int) (*data.User, error)
 	GetUserByEmail(email string) (*data.User, error)
 	UpdateUser(u data.User) error
+	PatchUser(id, version int, p data.UserPatch) (*data.User, error)
+	SetPendingEmail(id int, email string) error
+	VerifyEmail(id int, email string) (*data.User, error)
+	SetUserLocale(id int, locale string) error
 	DeleteUser(id int) error
+	RestoreUser(id int) error
+	PurgeDeletedUsers(before time.Time) (int, []string, error)
 	InsertUser(user data.User) (int, error)
 	ResetPassword(id int, password string) error
 	InsertUserImage(i data.UserImage) (int, error)
+	AllUserImages(userID int) ([]*data.UserImage, error)
+	GetUserImage(id int) (*data.UserImage, error)
+	DeleteUserImage(id int) error
+	SetPrimaryUserImage(userID, id int) error
+	UserImageFileInUse(fileName string) (bool, error)
+	EnableTOTP(id int, secret string) error
+	DisableTOTP(id int) error
+	ReplaceRecoveryCodes(userID int, hashes []string) error
+	UseRecoveryCode(userID int, hash string) (bool, error)
+	// UseTOTPCounter records the time step of an accepted TOTP code. It returns false when a
+	// code of the same or a later step was accepted before, so codes can't be replayed.
+	UseTOTPCounter(userID int, counter int64) (bool, error)
+	GetUserByIdentity(provider, subject string) (*data.User, error)
+	InsertUserIdentity(i data.UserIdentity) (int, error)
+}
+
+// AuditRepo stores the audit log of security relevant events
+type AuditRepo interface {
+	InsertAuditEvent(e data.AuditEvent) (int, error)
+	AuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error)
+}
+
+// JobRepo is the queue of background jobs. Claimed jobs are locked to one worker; a worker that
+// stops without finishing a job loses it to another one once the lock is stale.
+type JobRepo interface {
+	// EnqueueJob queues a job and returns its id. A job with the unique key of another job
+	// is not added, and its id is 0; keys are free again once the other job is pruned.
+	EnqueueJob(ctx context.Context, job data.Job) (int64, error)
+	// ClaimJob locks the next due job of one of the kinds, or returns ErrNotFound
+	ClaimJob(ctx context.Context, kinds []string, staleAfter time.Duration) (*data.Job, error)
+	CompleteJob(ctx context.Context, job *data.Job) error
+	// RetryJob puts a failed job back into the queue, due at runAt
+	RetryJob(ctx context.Context, job *data.Job, runAt time.Time, lastError string) error
+	// BuryJob moves a failed job to the dead letters
+	BuryJob(ctx context.Context, job *data.Job, lastError string) error
+	// RequeueJob gives a dead job a new set of attempts
+	RequeueJob(ctx context.Context, id int64) error
+	Jobs(ctx context.Context, f data.JobFilter) ([]*data.Job, error)
+	// PruneJobs removes jobs that were done before the given time
+	PruneJobs(ctx context.Context, before time.Time) (int, error)
 }
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"webapp/pkg/data"
+)
+
+// SearchTerms splits a search query into lower case words, dropping punctuation
+func SearchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchUsersLike searches users for backends without full-text indexes. Like an ILIKE '%term%'
+// on each field, a user matches when every term is part of their name or email. Terms matching
+// a whole field rank highest, then terms matching the start of a word. At most limit results are
+// returned, unless limit is 0.
+func SearchUsersLike(users []*data.User, query string, limit int) []*data.UserSearchResult {
+	terms := SearchTerms(query)
+
+	results := []*data.UserSearchResult{}
+
+	if len(terms) == 0 {
+		return results
+	}
+
+	for _, u := range users {
+		fields := []string{
+			strings.ToLower(u.FirstName),
+			strings.ToLower(u.LastName),
+			strings.ToLower(u.Email),
+		}
+
+		var rank float64
+
+		for _, term := range terms {
+			best := 0.0
+
+			for _, f := range fields {
+				best = maxFloat(best, termScore(f, term))
+			}
+
+			// every term has to match somewhere
+			if best == 0 {
+				rank = 0
+				break
+			}
+
+			rank += best
+		}
+
+		if rank > 0 {
+			results = append(results, &data.UserSearchResult{User: u, Rank: rank / float64(len(terms))})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+
+		if a.User.LastName != b.User.LastName {
+			return a.User.LastName < b.User.LastName
+		}
+
+		return a.User.ID < b.User.ID
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+// termScore is 1 when the field is the term, 0.75 when a word in the field starts with it,
+// 0.5 when it is anywhere in the field, and 0 otherwise
+func termScore(field, term string) float64 {
+	switch {
+	case field == term:
+		return 1
+	case !strings.Contains(field, term):
+		return 0
+	}
+
+	for _, word := range SearchTerms(field) {
+		if strings.HasPrefix(word, term) {
+			return 0.75
+		}
+	}
+
+	return 0.5
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+	"webapp/pkg/data"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := SearchTerms("  James BOND@example.com, 007 ")
+	expected := []string{"james", "bond", "example", "com", "007"}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, but got %v", expected, got)
+	}
+}
+
+func TestSearchUsersLike(t *testing.T) {
+	users := []*data.User{
+		{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com"},
+		{ID: 2, FirstName: "James", LastName: "Bond", Email: "bond@example.com"},
+		{ID: 3, FirstName: "Jim", LastName: "Jameson", Email: "jim@example.com"},
+		{ID: 4, FirstName: "Benjamin", LastName: "Button", Email: "ben@example.com"},
+	}
+
+	var tests = []struct {
+		name     string
+		query    string
+		limit    int
+		expected []int
+	}{
+		{"empty", "", 0, []int{}},
+		{"whole word first, then prefix, then substring", "james", 0, []int{2, 3}},
+		{"partial", "jam", 0, []int{2, 3, 4}},
+		{"all terms must match", "jam bond", 0, []int{2}},
+		{"email", "bond@example", 0, []int{2}},
+		{"case insensitive", "ADMIN", 0, []int{1}},
+		{"limit", "example", 2, []int{2, 4}},
+		{"no match", "moneypenny", 0, []int{}},
+	}
+
+	for _, e := range tests {
+		results := SearchUsersLike(users, e.query, e.limit)
+
+		ids := []int{}
+		for _, r := range results {
+			ids = append(ids, r.User.ID)
+		}
+
+		if !reflect.DeepEqual(ids, e.expected) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expected, ids)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package signing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	s := New("test-key")
+	now := time.Date(2022, 8, 19, 12, 0, 0, 0, time.UTC)
+
+	token := s.Sign("verify-email", "2:jack@example.com", now.Add(time.Hour))
+
+	// take the value apart, and put it back together with another one
+	parts := strings.Split(token, ".")
+	forged := "MzpqaWxsQGV4YW1wbGUuY29t." + parts[1] + "." + parts[2]
+
+	var tests = []struct {
+		name          string
+		signer        *Signer
+		purpose       string
+		token         string
+		now           time.Time
+		expected      string
+		expectedError error
+	}{
+		{"valid", s, "verify-email", token, now, "2:jack@example.com", nil},
+		{"just before it expires", s, "verify-email", token, now.Add(time.Hour), "2:jack@example.com", nil},
+		{"expired", s, "verify-email", token, now.Add(time.Hour + time.Second), "", ErrExpired},
+		{"other purpose", s, "reset-password", token, now, "", ErrInvalid},
+		{"other key", New("other-key"), "verify-email", token, now, "", ErrInvalid},
+		{"other value", s, "verify-email", forged, now, "", ErrInvalid},
+		{"garbage", s, "verify-email", "not a token", now, "", ErrInvalid},
+		{"empty", s, "verify-email", "", now, "", ErrInvalid},
+	}
+
+	for _, e := range tests {
+		value, err := e.signer.Verify(e.purpose, e.token, e.now)
+
+		if !errors.Is(err, e.expectedError) {
+			t.Errorf("%s: expected error %v, but got %v", e.name, e.expectedError, err)
+		}
+
+		if value != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, value)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package s3test is a tiny S3 compatible server for tests, in the spirit of a local MinIO.
+// It keeps objects of one bucket in memory, and checks signature version 4 on every
+// request, in headers or in presigned links. Buckets are addressed in path style.
+package s3test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far the clock of a signed request may be off
+const maxSkew = 15 * time.Minute
+
+// Server is a running stub bucket; use URL as the endpoint
+type Server struct {
+	*httptest.Server
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+// Object is what the server stores for a key
+type Object struct {
+	Data        []byte
+	ContentType string
+}
+
+// NewServer starts a stub bucket that accepts requests signed with the given keys
+func NewServer(bucket, accessKey, secretKey string) *Server {
+	s := &Server{
+		Bucket:    bucket,
+		Region:    "us-east-1",
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		objects:   make(map[string]Object),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Object returns what is stored under key
+func (s *Server) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[key]
+
+	return o, ok
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	if bucket != s.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	if code := s.authenticate(r); code != "" {
+		writeError(w, http.StatusForbidden, code)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+
+		sum := sha256.Sum256(body)
+
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+			return
+		}
+
+		s.objects[key] = Object{Data: body, ContentType: r.Header.Get("Content-Type")}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		o, ok := s.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("Content-Type", o.ContentType)
+		_, _ = w.Write(o.Data)
+
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// authenticate returns the S3 error code for a request that is not properly signed, or ""
+func (s *Server) authenticate(r *http.Request) string {
+	q := r.URL.Query()
+
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+
+	if q.Get("X-Amz-Signature") != "" {
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+
+		t, err := time.Parse("20060102T150405Z", amzDate)
+		expires, _ := strconv.Atoi(q.Get("X-Amz-Expires"))
+
+		if err != nil || expires <= 0 || time.Now().After(t.Add(time.Duration(expires)*time.Second)) {
+			return "AccessDenied"
+		}
+
+		q.Del("X-Amz-Signature")
+	} else {
+		fields := map[string]string{}
+
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+
+		for _, f := range strings.Split(auth, ", ") {
+			k, v, _ := strings.Cut(f, "=")
+			fields[k] = v
+		}
+
+		credential = fields["Credential"]
+		signedHeaders = fields["SignedHeaders"]
+		signature = fields["Signature"]
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+
+		t, err := time.Parse("20060102T150405Z", amzDate)
+
+		if err != nil || time.Since(t) > maxSkew || time.Until(t) > maxSkew {
+			return "RequestTimeTooSkewed"
+		}
+	}
+
+	accessKey, scope, _ := strings.Cut(credential, "/")
+
+	if accessKey != s.AccessKey {
+		return "InvalidAccessKeyId"
+	}
+
+	if len(amzDate) < 8 || scope != amzDate[:8]+"/"+s.Region+"/s3/aws4_request" {
+		return "AuthorizationHeaderMalformed"
+	}
+
+	var headers strings.Builder
+
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		encode(r.URL.Path, false),
+		canonicalQuery(q),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+
+	for _, part := range []string{amzDate[:8], s.Region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(key))) {
+		return "SignatureDoesNotMatch"
+	}
+
+	return ""
+}
+
+func canonicalQuery(q url.Values) string {
+	var parts []string
+
+	for k, values := range q {
+		for _, v := range values {
+			parts = append(parts, encode(k, true)+"="+encode(v, true))
+		}
+	}
+
+	sort.Strings(parts)
+
+	return strings.Join(parts, "&")
+}
+
+func encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>%s</Code></Error>", code)
+}
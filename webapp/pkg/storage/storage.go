@@ -0,0 +1,59 @@
+// Package storage keeps uploaded files, on the local disk or in an S3 compatible bucket.
+// Keys are flat names; ContentKey derives them from the content, so the same file is
+// only stored once.
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get for keys that are not stored
+var ErrNotFound = errors.New("storage: not found")
+
+// ErrInvalidKey is returned for keys that are not a plain file name
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Storage is where uploaded files live
+type Storage interface {
+	// Put stores content under key, replacing what was there
+	Put(ctx context.Context, key string, content io.Reader, contentType string) error
+	// Get opens the content stored under key; the caller closes it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes key; deleting a key that is not stored is not an error
+	Delete(ctx context.Context, key string) error
+	// URL is a signed link to key that browsers can use until it expires
+	URL(key string, expires time.Duration) (string, error)
+}
+
+// now is swapped in tests, to sign links in the past
+var now = time.Now
+
+// ContentKey is the key for content: the hex sha256 of it, with ext appended
+func ContentKey(content []byte, ext string) string {
+	sum := sha256.Sum256(content)
+
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// validKey accepts plain file names only, so keys can never escape a directory or bucket prefix
+func validKey(key string) bool {
+	if key == "" || len(key) > 255 || strings.HasPrefix(key, ".") {
+		return false
+	}
+
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
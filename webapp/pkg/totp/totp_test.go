@@ -0,0 +1,140 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// secret from RFC 6238 appendix B ("12345678901234567890"), base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// last six digits of the SHA1 test vectors from RFC 6238
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range tests {
+		c, err := Code(rfcSecret, time.Unix(e.unix, 0))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c != e.expected {
+			t.Errorf("at %d expected code %s, but got %s", e.unix, e.expected, c)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		code     string
+		expected bool
+	}{
+		{"current period", now, "005924", true},
+		{"with spaces", now, " 005 924 ", true},
+		{"previous period", now.Add(Period * time.Second), "005924", true},
+		{"too old", now.Add(3 * Period * time.Second), "005924", false},
+		{"wrong code", now, "123456", false},
+		{"wrong length", now, "5924", false},
+	}
+
+	for _, e := range tests {
+		if Validate(rfcSecret, e.code, e.at) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / Period
+
+	tests := []struct {
+		name         string
+		at           time.Time
+		expectedStep int64
+		expectedOK   bool
+	}{
+		{"current period", now, step, true},
+		{"next period", now.Add(Period * time.Second), step, true},
+		{"previous period", now.Add(-Period * time.Second), step, true},
+		{"too old", now.Add(3 * Period * time.Second), 0, false},
+	}
+
+	for _, e := range tests {
+		// the step is the one of the code, not the one of the time it is checked at
+		s, ok := Match(rfcSecret, "005924", e.at)
+
+		if s != e.expectedStep || ok != e.expectedOK {
+			t.Errorf("%s: expected step %d and %t, but got %d and %t", e.name, e.expectedStep, e.expectedOK, s, ok)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	s, err := GenerateSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Code(s, time.Now()); err != nil {
+		t.Errorf("generated secret is not valid base32: %s", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Webapp", "admin@example.com", rfcSecret)
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Webapp:admin@example.com?") {
+		t.Errorf("unexpected uri prefix: %s", uri)
+	}
+
+	if !strings.Contains(uri, "secret="+rfcSecret) {
+		t.Errorf("uri does not contain secret: %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 codes, but got %d", len(codes))
+	}
+
+	seen := map[string]bool{}
+
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Errorf("badly formatted code %s", c)
+		}
+
+		if seen[c] {
+			t.Errorf("duplicate code %s", c)
+		}
+
+		seen[c] = true
+	}
+
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+strings.ToUpper(codes[0])+" ") {
+		t.Error("hash should ignore case and surrounding spaces")
+	}
+}